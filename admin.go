@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var adminKeysFile = serveFlags.String("admin-keys", "", "File of admin keys (one per line), which clients can send as X-Admin-Key to upload and list datasets, change the log level, and profile the server (without any, those are disabled)")
+
+// adminKeys are the keys which authorize administrative requests, which are separate from
+// the API keys (which only identify clients for the render limits, and are given out more freely).
+type adminKeys []string
+
+// loadAdminKeys returns the keys in --admin-keys.
+func loadAdminKeys() (adminKeys, error) {
+	if *adminKeysFile == "" {
+		return nil, nil
+	}
+	keys, err := readKeys(*adminKeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("--admin-keys: %w", err)
+	}
+	var admin adminKeys
+	for key := range keys {
+		admin = append(admin, key)
+	}
+	return admin, nil
+}
+
+// authorized reports whether the request has a valid X-Admin-Key.
+func (keys adminKeys) authorized(r *http.Request) bool {
+	got := r.Header.Get("X-Admin-Key")
+	if got == "" {
+		return false
+	}
+	var ok bool
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(key)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// profileHandler serves the runtime profiles under /debug/pprof/ (like net/http/pprof, whose handlers
+// anyone could reach on the default mux) to authorized requests only, since they reveal the server's internals
+// and profiling slows it down:
+//
+//	/debug/pprof/                 the list of profiles
+//	/debug/pprof/<name>?debug=N   a profile, e.g. heap or goroutine (in text form if debug is nonzero)
+//	/debug/pprof/profile?seconds=N  a CPU profile (default 30s)
+//	/debug/pprof/trace?seconds=N    an execution trace (default 1s)
+func profileHandler(authorized func(*http.Request) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "profiling requires a valid X-Admin-Key", http.StatusUnauthorized)
+			return
+		}
+		debug, _ := strconv.Atoi(r.FormValue("debug"))
+		switch name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/"); name {
+		case "":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for _, p := range pprof.Profiles() {
+				fmt.Fprintf(w, "%s\t%d\n", p.Name(), p.Count())
+			}
+			fmt.Fprintf(w, "profile\ntrace\n")
+		case "profile", "trace":
+			seconds, err := strconv.Atoi(r.FormValue("seconds"))
+			if err != nil || seconds <= 0 {
+				seconds = map[string]int{"profile": 30, "trace": 1}[name]
+			}
+			start, stop := pprof.StartCPUProfile, pprof.StopCPUProfile
+			if name == "trace" {
+				start, stop = trace.Start, trace.Stop
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			if err := start(w); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict) // e.g. already profiling
+				return
+			}
+			select {
+			case <-time.After(time.Duration(seconds) * time.Second):
+			case <-r.Context().Done():
+			}
+			stop()
+		default:
+			p := pprof.Lookup(name)
+			if p == nil {
+				http.Error(w, fmt.Sprintf("unknown profile %q", name), http.StatusNotFound)
+				return
+			}
+			if debug != 0 {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			} else {
+				w.Header().Set("Content-Type", "application/octet-stream")
+			}
+			p.WriteTo(w, debug)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProfileHandler(t *testing.T) {
+	handler := profileHandler(adminKeys{"letmein"}.authorized)
+	tests := []struct {
+		path, key string
+		want      int
+	}{
+		{"/debug/pprof/", "", http.StatusUnauthorized},
+		{"/debug/pprof/heap", "wrong", http.StatusUnauthorized},
+		{"/debug/pprof/", "letmein", http.StatusOK},
+		{"/debug/pprof/heap", "letmein", http.StatusOK},
+		{"/debug/pprof/goroutine?debug=1", "letmein", http.StatusOK},
+		{"/debug/pprof/profile?seconds=1", "letmein", http.StatusOK},
+		{"/debug/pprof/nonsense", "letmein", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.key != "" {
+			r.Header.Set("X-Admin-Key", test.key)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.want {
+			t.Errorf("GET %s (key %q) = %d, want %d", test.path, test.key, w.Code, test.want)
+		}
+	}
+
+	// Nothing else serves the profiles unauthenticated.
+	if _, pattern := http.DefaultServeMux.Handler(httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)); pattern != "" {
+		t.Errorf("DefaultServeMux serves /debug/pprof/ (as %q)", pattern)
+	}
+}
@@ -0,0 +1,95 @@
+// Package analytics computes aggregate statistics over the dataset.
+package analytics
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"net/http"
+	"sort"
+
+	"github.com/kylelemons/rplacemap/dataset"
+)
+
+// A UserCount is the number of something attributed to a user.
+type UserCount struct {
+	UserHash [16]byte
+	Count    int64
+}
+
+// Placements counts how many pixels each user placed.
+func Placements(records []dataset.Record) []UserCount {
+	counts := make(map[[16]byte]int64)
+	for _, rec := range records {
+		counts[rec.UserHash]++
+	}
+	return leaderboard(counts)
+}
+
+// Survivors counts how many pixels of the final canvas each user placed,
+// that is, placements that were never painted over.
+// The records must be sorted by time.
+func Survivors(records []dataset.Record) []UserCount {
+	final := make(map[image.Point][16]byte)
+	for _, rec := range records {
+		final[image.Pt(int(rec.X), int(rec.Y))] = rec.UserHash
+	}
+
+	counts := make(map[[16]byte]int64)
+	for _, user := range final {
+		counts[user]++
+	}
+	return leaderboard(counts)
+}
+
+// leaderboard returns the counts in descending order, with ties broken by user hash.
+func leaderboard(counts map[[16]byte]int64) []UserCount {
+	board := make([]UserCount, 0, len(counts))
+	for user, count := range counts {
+		board = append(board, UserCount{user, count})
+	}
+	sort.Slice(board, func(i, j int) bool {
+		if board[i].Count != board[j].Count {
+			return board[i].Count > board[j].Count
+		}
+		return bytes.Compare(board[i].UserHash[:], board[j].UserHash[:]) < 0
+	})
+	return board
+}
+
+// LeaderboardSize is how many users are included in the leaderboard modules.
+const LeaderboardSize = 100
+
+func init() {
+	Register(leaderboardModule{"placements", Placements})
+	Register(leaderboardModule{"survivors", Survivors})
+}
+
+// leaderboardModule serves the top users of a leaderboard.
+type leaderboardModule struct {
+	name string
+	rank func([]dataset.Record) []UserCount
+}
+
+// leaderboardEntry is the JSON form of a UserCount.
+type leaderboardEntry struct {
+	UserHash string `json:"user_hash"`
+	Count    int64  `json:"count"`
+}
+
+func (m leaderboardModule) Name() string { return m.name }
+
+func (m leaderboardModule) Compute(ctx context.Context, records []dataset.Record) (any, error) {
+	board := m.rank(records)
+	if len(board) > LeaderboardSize {
+		board = board[:LeaderboardSize]
+	}
+	entries := make([]leaderboardEntry, len(board))
+	for i, uc := range board {
+		entries[i] = leaderboardEntry{base64.StdEncoding.EncodeToString(uc.UserHash[:]), uc.Count}
+	}
+	return entries, nil
+}
+
+func (m leaderboardModule) Routes() map[string]func(any) http.Handler { return nil }
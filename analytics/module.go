@@ -0,0 +1,139 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+// A Module is an analysis that runs against the loaded dataset and is served by the map server.
+//
+// Modules are added with Register, typically from an init function,
+// so a custom build can add its own by importing the package that defines them.
+type Module interface {
+	// Name identifies the module in URLs, under /analytics/{name}.
+	Name() string
+
+	// Compute analyzes the records, which are sorted by time.
+	// It is called once, the first time the module's results are requested,
+	// and the result is served as JSON at /analytics/{name}.
+	Compute(ctx context.Context, records []dataset.Record) (any, error)
+
+	// Routes returns any additional handlers for the module, keyed by the path
+	// under /analytics/{name}/, which are passed the computed result.
+	// It may return nil.
+	Routes() map[string]func(result any) http.Handler
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]Module{}
+)
+
+// Register adds a module to be served. It panics if the name is already taken.
+func Register(m Module) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	name := m.Name()
+	if name == "" || strings.Contains(name, "/") {
+		panic(fmt.Sprintf("analytics: invalid module name %q", name))
+	}
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("analytics: module %q registered twice", name))
+	}
+	registry[name] = m
+}
+
+// Modules returns the registered modules, sorted by name.
+func Modules() []Module {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	var mods []Module
+	for _, m := range registry {
+		mods = append(mods, m)
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		return mods[i].Name() < mods[j].Name()
+	})
+	return mods
+}
+
+// Handler serves the registered modules under /analytics/.
+// Each module's result is computed the first time it is requested.
+func Handler(records *gsync.Future[[]dataset.Record]) http.HandlerFunc {
+	type served struct {
+		module Module
+		result *gsync.Future[any]
+		routes map[string]func(any) http.Handler
+	}
+	modules := make(map[string]*served)
+	var names []string
+	for _, m := range Modules() {
+		m := m
+		modules[m.Name()] = &served{
+			module: m,
+			result: gsync.Lazy(func(ctx context.Context) (any, error) {
+				recs, err := records.Wait(ctx)
+				if err != nil {
+					return nil, err
+				}
+				result, err := m.Compute(ctx, recs)
+				if err != nil {
+					glog.Errorf("Analytics module %q failed: %s", m.Name(), err)
+					return nil, fmt.Errorf("module %q: %w", m.Name(), err)
+				}
+				return result, nil
+			}),
+			routes: m.Routes(),
+		}
+		names = append(names, m.Name())
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/analytics/")
+		if path == "" {
+			writeJSON(w, names)
+			return
+		}
+		name, route, _ := strings.Cut(path, "/")
+		mod, ok := modules[name]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		handler := mod.routes[route]
+		if route != "" && handler == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		result, err := mod.result.Wait(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		if route == "" {
+			writeJSON(w, result)
+			return
+		}
+		handler(result).ServeHTTP(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Warningf("Writing JSON response: %s", err)
+	}
+}
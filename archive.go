@@ -0,0 +1,256 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+
+	"github.com/kylelemons/rplacemap/analytics"
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/progress"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+var (
+	exportArchiveFlags     = flag.NewFlagSet("export archive", flag.ExitOnError)
+	exportArchiveOut       = exportArchiveFlags.String("out", "place.tar.zst", "Output file (.tar.zst, .tar.gz, or .tar)")
+	exportArchiveTimelapse = exportArchiveFlags.String("timelapse", "gif", "Comma-separated timelapse formats to include (gif, apng, mp4)")
+)
+
+var _ = register(exports, &command{
+	name: "archive",
+	help: "Export a single archive of the render products (timelapses, final canvas, heatmaps,\n" +
+		"analytics such as leaderboards, and metadata) for sharing offline.",
+	flags: exportArchiveFlags,
+	run:   runExportArchive,
+})
+
+// archiveMetadata is written to metadata.json in the archive.
+type archiveMetadata struct {
+	Dataset   string            `json:"dataset"`
+	Records   int64             `json:"records"`
+	Users     int               `json:"users"`
+	First     time.Time         `json:"first"`
+	Last      time.Time         `json:"last"`
+	Generated time.Time         `json:"generated"`
+	Interval  string            `json:"timelapse_interval,omitempty"`
+	Files     map[string]string `json:"files"` // path to description
+}
+
+func runExportArchive(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", args)
+	}
+	compression, err := archiveCompression(*exportArchiveOut)
+	if err != nil {
+		return err
+	}
+	var formats []string
+	for _, format := range strings.Split(*exportArchiveTimelapse, ",") {
+		if format = strings.TrimSpace(format); format == "" {
+			continue
+		}
+		if _, ok := timelapseEncoders[format]; !ok {
+			return fmt.Errorf("unsupported timelapse format %q", format)
+		}
+		formats = append(formats, format)
+	}
+
+	records, err := loadCachedRecords(ctx)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("dataset is empty")
+	}
+
+	sum := newSummary()
+	for _, rec := range records {
+		sum.add(rec)
+	}
+	meta := archiveMetadata{
+		Dataset:   datasetFile(),
+		Records:   sum.records,
+		Users:     len(sum.users),
+		First:     time.UnixMilli(sum.first).UTC(),
+		Last:      time.UnixMilli(sum.last).UTC(),
+		Generated: time.Now().UTC(),
+		Files:     make(map[string]string),
+	}
+
+	return writeFile(*exportArchiveOut, func(w io.Writer) error {
+		zw, err := archiveCompressor(compression, w)
+		if err != nil {
+			return err
+		}
+		tw := tar.NewWriter(zw)
+		add := func(path, desc string, write func(io.Writer) error) error {
+			glog.Infof("Adding %s", path)
+			buf := new(bytes.Buffer)
+			if err := write(buf); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			if err := tw.WriteHeader(&tar.Header{
+				Name:    path,
+				Mode:    0o644,
+				Size:    int64(buf.Len()),
+				ModTime: meta.Generated,
+			}); err != nil {
+				return err
+			}
+			if _, err := buf.WriteTo(tw); err != nil {
+				return err
+			}
+			if desc != "" {
+				meta.Files[path] = desc
+			}
+			return nil
+		}
+
+		// Images
+		bounds := timelapse.Bounds()
+		final := dataset.Snapshot(records, sum.last, bounds)
+		placed, churn := heatmaps(records)
+		for _, img := range []struct {
+			path, desc string
+			image.Image
+		}{
+			{"final.png", "the canvas at the end", final},
+			{"heatmap.png", "how many times each pixel was placed (log scale)", placed},
+			{"churn.png", "how many times each pixel changed color (log scale)", churn},
+		} {
+			if err := add(img.path, img.desc, func(w io.Writer) error {
+				return png.Encode(w, img.Image)
+			}); err != nil {
+				return err
+			}
+		}
+
+		// Analytics
+		for _, m := range analytics.Modules() {
+			result, err := m.Compute(ctx, records)
+			if err != nil {
+				return fmt.Errorf("analytics %s: %w", m.Name(), err)
+			}
+			path := "analytics/" + m.Name() + ".json"
+			if err := add(path, "analytics module "+m.Name(), func(w io.Writer) error {
+				enc := json.NewEncoder(w)
+				enc.SetIndent("", "  ")
+				return enc.Encode(result)
+			}); err != nil {
+				return err
+			}
+		}
+
+		// Timelapses
+		if len(formats) > 0 {
+			bar := progress.New("Timelapse", progress.Counter)
+			stopProgress := bar.Display()
+			frames := timelapse.RenderFrames(records, timelapse.DefaultInterval, bar)
+			stopProgress()
+			meta.Interval = timelapse.DefaultInterval.String()
+			for _, format := range formats {
+				encode := timelapseEncoders[format]
+				if err := add("timelapse."+format, format+" timelapse", func(w io.Writer) error {
+					return encode(w, frames)
+				}); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Metadata
+		if err := add("metadata.json", "", func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(meta)
+		}); err != nil {
+			return err
+		}
+
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+}
+
+// archiveCompression returns the compression indicated by the archive filename's extension.
+func archiveCompression(filename string) (string, error) {
+	switch {
+	case strings.HasSuffix(filename, ".tar.zst"):
+		return "zstd", nil
+	case strings.HasSuffix(filename, ".tar.gz"), strings.HasSuffix(filename, ".tgz"):
+		return "gzip", nil
+	case strings.HasSuffix(filename, ".tar"):
+		return "", nil
+	default:
+		return "", fmt.Errorf("unsupported archive %q (want .tar.zst, .tar.gz, or .tar)", filename)
+	}
+}
+
+// archiveCompressor returns a writer that applies the given compression.
+func archiveCompressor(compression string, w io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	case "gzip":
+		return pgzip.NewWriterLevel(w, pgzip.BestCompression)
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// heatmaps returns grayscale images of how many times each pixel was placed,
+// and how many times each pixel changed color, scaled logarithmically to the maximum.
+// The records must be sorted by time.
+func heatmaps(records []dataset.Record) (placed, churn *image.Gray) {
+	bounds := timelapse.Bounds()
+	placements := make([]int, bounds.Dx()*bounds.Dy())
+	changes := make([]int, len(placements))
+	colors := make([]uint8, len(placements)) // starts white, like Snapshot
+	for _, rec := range records {
+		i := int(rec.Y)*bounds.Dx() + int(rec.X)
+		placements[i]++
+		if rec.Color != colors[i] {
+			changes[i]++
+			colors[i] = rec.Color
+		}
+	}
+	return logScale(placements), logScale(changes)
+}
+
+func logScale(counts []int) *image.Gray {
+	img := image.NewGray(timelapse.Bounds())
+	var most int
+	for _, n := range counts {
+		most = max(most, n)
+	}
+	if most == 0 {
+		return img
+	}
+	scale := 255 / math.Log1p(float64(most))
+	for i, n := range counts {
+		img.Pix[i] = uint8(math.Log1p(float64(n)) * scale)
+	}
+	return img
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+// The events are exported in the Arrow IPC streaming format (https://arrow.apache.org/docs/format/Columnar.html),
+// as a schema followed by record batches of these columns, none of them nullable:
+//
+//	ts         timestamp[ms, tz=UTC]
+//	user_hash  fixed_size_binary[16]
+//	x, y       int16
+//	color      uint8
+//
+// The flatbuffers metadata of each message is written by hand (see fbTable),
+// since only a handful of tables of Schema.fbs and Message.fbs are needed.
+
+// arrowBatchRows is how many events are in each record batch.
+const arrowBatchRows = 1 << 16
+
+// Values from the Arrow flatbuffers schemas.
+const (
+	arrowMetadataV5 = 4 // MetadataVersion.V5
+
+	arrowHeaderSchema      = 1 // MessageHeader.Schema
+	arrowHeaderRecordBatch = 3 // MessageHeader.RecordBatch
+
+	arrowTypeInt             = 2  // Type.Int
+	arrowTypeTimestamp       = 10 // Type.Timestamp
+	arrowTypeFixedSizeBinary = 15 // Type.FixedSizeBinary
+
+	arrowMillisecond = 1 // TimeUnit.MILLISECOND
+)
+
+// arrowContentType is the media type of an Arrow IPC stream.
+const arrowContentType = "application/vnd.apache.arrow.stream"
+
+// arrowSchema is the Schema table of the exported events.
+var arrowSchema = fbTable{
+	nil, // endianness: Little (the default)
+	[]fbTable{ // fields
+		arrowField("ts", arrowTypeTimestamp, fbTable{int16(arrowMillisecond), "UTC"}),
+		arrowField("user_hash", arrowTypeFixedSizeBinary, fbTable{int32(len(dataset.Record{}.UserHash))}),
+		arrowField("x", arrowTypeInt, fbTable{int32(16), true}),
+		arrowField("y", arrowTypeInt, fbTable{int32(16), true}),
+		arrowField("color", arrowTypeInt, fbTable{int32(8), false}),
+	},
+}
+
+// arrowField returns a Field table for a (non-nullable) column of the given Type.
+func arrowField(name string, typeType uint8, typ fbTable) fbTable {
+	return fbTable{name, false, typeType, typ, nil, []fbTable{}}
+}
+
+// arrowEncoder writes events as an Arrow IPC stream.
+type arrowEncoder struct {
+	w       *bufio.Writer
+	started bool
+	batch   []dataset.Record
+}
+
+func newArrowEncoder(w io.Writer) eventEncoder {
+	return &arrowEncoder{w: bufio.NewWriter(w)}
+}
+
+func (e *arrowEncoder) Encode(rec dataset.Record) error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	e.batch = append(e.batch, rec)
+	if len(e.batch) == arrowBatchRows {
+		return e.writeBatch()
+	}
+	return nil
+}
+
+// Flush writes the final batch and the end of the stream, which must not be written to after.
+func (e *arrowEncoder) Flush() error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	if len(e.batch) > 0 {
+		if err := e.writeBatch(); err != nil {
+			return err
+		}
+	}
+	// The end-of-stream marker is a message with no metadata.
+	if _, err := e.w.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+// start writes the schema, if it hasn't been written yet.
+func (e *arrowEncoder) start() error {
+	if e.started {
+		return nil
+	}
+	e.started = true
+	return writeArrowMessage(e.w, arrowHeaderSchema, arrowSchema, nil)
+}
+
+func (e *arrowEncoder) writeBatch() error {
+	n := len(e.batch)
+	ts := make([]byte, 8*n)
+	users := make([]byte, 16*n)
+	xs := make([]byte, 2*n)
+	ys := make([]byte, 2*n)
+	colors := make([]byte, n)
+	for i, rec := range e.batch {
+		binary.LittleEndian.PutUint64(ts[8*i:], uint64(rec.UnixMillis))
+		copy(users[16*i:], rec.UserHash[:])
+		binary.LittleEndian.PutUint16(xs[2*i:], uint16(rec.X))
+		binary.LittleEndian.PutUint16(ys[2*i:], uint16(rec.Y))
+		colors[i] = rec.Color
+	}
+	e.batch = e.batch[:0]
+
+	// Each column has an (empty, since there are no nulls) validity bitmap and its values.
+	columns := [][]byte{ts, users, xs, ys, colors}
+	var (
+		nodes   [][2]int64 // FieldNode: length, null_count
+		buffers [][2]int64 // Buffer: offset, length
+		body    [][]byte
+		offset  int64
+	)
+	for _, values := range columns {
+		nodes = append(nodes, [2]int64{int64(n), 0})
+		buffers = append(buffers, [2]int64{offset, 0}, [2]int64{offset, int64(len(values))})
+		body = append(body, values)
+		offset += arrowPadded(len(values))
+	}
+	batch := fbTable{int64(n), nodes, buffers}
+	return writeArrowMessage(e.w, arrowHeaderRecordBatch, batch, body)
+}
+
+// arrowPadded returns n rounded up to the 8-byte alignment of message metadata and buffers.
+func arrowPadded(n int) int64 {
+	return int64(n+7) &^ 7
+}
+
+// writeArrowMessage writes an encapsulated message: its metadata (a Message table with the given header),
+// then its body, made up of the buffers (each padded to 8 bytes).
+func writeArrowMessage(w io.Writer, headerType uint8, header fbTable, buffers [][]byte) error {
+	var bodyLength int64
+	for _, buf := range buffers {
+		bodyLength += arrowPadded(len(buf))
+	}
+	message := fbTable{int16(arrowMetadataV5), headerType, header, bodyLength}
+	metadata := buildFlatbuffer(message)
+	metadata = append(metadata, make([]byte, arrowPadded(len(metadata))-int64(len(metadata)))...)
+
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[:4], 0xFFFFFFFF) // continuation
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(metadata)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(metadata); err != nil {
+		return err
+	}
+	var padding [8]byte
+	for _, buf := range buffers {
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		if _, err := w.Write(padding[:arrowPadded(len(buf))-int64(len(buf))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// arrowExportHandler serves /export/events.arrow?region=x0,y0,x1,y1&from=&to=, the events
+// (by default, all of them) as an Arrow IPC stream, in order of time.
+func arrowExportHandler(records *gsync.Future[[]dataset.Record]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var filter eventFilter
+		if s := r.FormValue("region"); s != "" {
+			var region regionFlag
+			if err := region.Set(s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			filter.region = region.Rectangle
+		}
+		for _, bound := range []struct {
+			param string
+			ms    *int64
+		}{{"from", &filter.from}, {"to", &filter.to}} {
+			if s := r.FormValue(bound.param); s != "" {
+				var t timeFlag
+				if err := t.Set(s); err != nil {
+					http.Error(w, fmt.Sprintf("%s: %s", bound.param, err), http.StatusBadRequest)
+					return
+				}
+				*bound.ms = t.UnixMilli()
+			}
+		}
+		recs, err := records.Wait(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+
+		// The records are sorted by time, so only those in the range need to be filtered.
+		start, end := 0, len(recs)
+		if filter.from != 0 {
+			start = sort.Search(len(recs), func(i int) bool { return recs[i].UnixMillis >= filter.from })
+		}
+		if filter.to != 0 {
+			end = sort.Search(len(recs), func(i int) bool { return recs[i].UnixMillis >= filter.to })
+		}
+		w.Header().Set("Content-Type", arrowContentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="events.arrow"`)
+		enc := newArrowEncoder(w)
+		for _, rec := range recs[start:max(start, end)] {
+			if !filter.match(rec) {
+				continue
+			}
+			if err := enc.Encode(rec); err != nil {
+				return // the client went away
+			}
+		}
+		enc.Flush()
+	}
+}
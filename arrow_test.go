@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/dataset/datasettest"
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+// fbView reads a table of a flatbuffer, as the official readers do.
+type fbView struct {
+	buf []byte
+	pos int
+}
+
+func fbRoot(buf []byte) fbView {
+	return fbView{buf, int(binary.LittleEndian.Uint32(buf))}
+}
+
+// field returns the position of a field, if it is present.
+func (t fbView) field(id int) (int, bool) {
+	vtable := t.pos - int(int32(binary.LittleEndian.Uint32(t.buf[t.pos:])))
+	if 4+2*id >= int(binary.LittleEndian.Uint16(t.buf[vtable:])) {
+		return 0, false
+	}
+	off := int(binary.LittleEndian.Uint16(t.buf[vtable+4+2*id:]))
+	return t.pos + off, off != 0
+}
+
+func (t fbView) uint(id, size int) uint64 {
+	pos, ok := t.field(id)
+	if !ok {
+		return 0
+	}
+	var v [8]byte
+	copy(v[:], t.buf[pos:pos+size])
+	return binary.LittleEndian.Uint64(v[:])
+}
+
+func (t fbView) deref(id int) int {
+	pos, ok := t.field(id)
+	if !ok {
+		return -1
+	}
+	return pos + int(binary.LittleEndian.Uint32(t.buf[pos:]))
+}
+
+func (t fbView) table(id int) fbView { return fbView{t.buf, t.deref(id)} }
+
+func (t fbView) str(id int) string {
+	pos := t.deref(id)
+	n := int(binary.LittleEndian.Uint32(t.buf[pos:]))
+	return string(t.buf[pos+4 : pos+4+n])
+}
+
+func (t fbView) tables(id int) []fbView {
+	pos := t.deref(id)
+	var tables []fbView
+	for i := 0; i < int(binary.LittleEndian.Uint32(t.buf[pos:])); i++ {
+		elem := pos + 4 + 4*i
+		tables = append(tables, fbView{t.buf, elem + int(binary.LittleEndian.Uint32(t.buf[elem:]))})
+	}
+	return tables
+}
+
+func (t fbView) pairs(id int) [][2]int64 {
+	pos := t.deref(id)
+	var pairs [][2]int64
+	for i := 0; i < int(binary.LittleEndian.Uint32(t.buf[pos:])); i++ {
+		elem := pos + 4 + 16*i
+		pairs = append(pairs, [2]int64{
+			int64(binary.LittleEndian.Uint64(t.buf[elem:])),
+			int64(binary.LittleEndian.Uint64(t.buf[elem+8:])),
+		})
+	}
+	return pairs
+}
+
+// readArrow decodes a stream written by arrowEncoder, checking its schema and layout.
+func readArrow(t *testing.T, stream []byte) []dataset.Record {
+	t.Helper()
+	r := bytes.NewReader(stream)
+	var records []dataset.Record
+	for i := 0; ; i++ {
+		var prefix [8]byte
+		if _, err := io.ReadFull(r, prefix[:]); err != nil {
+			t.Fatalf("message %d: %s", i, err)
+		}
+		if cont := binary.LittleEndian.Uint32(prefix[:]); cont != 0xFFFFFFFF {
+			t.Fatalf("message %d: continuation %#x, want 0xFFFFFFFF", i, cont)
+		}
+		size := int(binary.LittleEndian.Uint32(prefix[4:]))
+		if size == 0 {
+			if r.Len() != 0 {
+				t.Errorf("%d bytes after the end of the stream", r.Len())
+			}
+			return records
+		}
+		if size%8 != 0 {
+			t.Errorf("message %d: metadata size %d isn't a multiple of 8", i, size)
+		}
+		metadata := make([]byte, size)
+		io.ReadFull(r, metadata)
+		msg := fbRoot(metadata)
+		if v := msg.uint(0, 2); v != arrowMetadataV5 {
+			t.Errorf("message %d: version %d, want %d", i, v, arrowMetadataV5)
+		}
+		body := make([]byte, msg.uint(3, 8))
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatalf("message %d: body: %s", i, err)
+		}
+		header := msg.table(2)
+
+		switch kind := msg.uint(1, 1); {
+		case i == 0 && kind == arrowHeaderSchema:
+			type column struct {
+				name     string
+				typ      uint64
+				width    uint64 // bitWidth of Int, byteWidth of FixedSizeBinary, or unit of Timestamp
+				signed   bool
+				nullable bool
+			}
+			var got []column
+			for _, f := range header.tables(1) {
+				typ := f.table(3)
+				c := column{name: f.str(0), typ: f.uint(2, 1), width: typ.uint(0, 4), nullable: f.uint(1, 1) != 0}
+				switch c.typ {
+				case arrowTypeInt:
+					c.signed = typ.uint(1, 1) != 0
+				case arrowTypeTimestamp:
+					c.width = typ.uint(0, 2)
+					if tz := typ.str(1); tz != "UTC" {
+						t.Errorf("ts has time zone %q, want UTC", tz)
+					}
+				}
+				if n := len(f.tables(5)); n != 0 {
+					t.Errorf("column %s has %d children", c.name, n)
+				}
+				got = append(got, c)
+			}
+			want := []column{
+				{"ts", arrowTypeTimestamp, arrowMillisecond, false, false},
+				{"user_hash", arrowTypeFixedSizeBinary, 16, false, false},
+				{"x", arrowTypeInt, 16, true, false},
+				{"y", arrowTypeInt, 16, true, false},
+				{"color", arrowTypeInt, 8, false, false},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("schema = %+v, want %+v", got, want)
+			}
+		case i > 0 && kind == arrowHeaderRecordBatch:
+			n := int(header.uint(0, 8))
+			nodes, buffers := header.pairs(1), header.pairs(2)
+			if len(nodes) != 5 || len(buffers) != 10 {
+				t.Fatalf("batch %d has %d nodes and %d buffers, want 5 and 10", i, len(nodes), len(buffers))
+			}
+			for _, node := range nodes {
+				if node != [2]int64{int64(n), 0} {
+					t.Errorf("batch %d: node %v, want %d rows without nulls", i, node, n)
+				}
+			}
+			values := make([][]byte, 5)
+			for c := range values {
+				validity, data := buffers[2*c], buffers[2*c+1]
+				if validity[1] != 0 || data[0]%8 != 0 {
+					t.Errorf("batch %d column %d: buffers %v, %v; want no validity bitmap and aligned values", i, c, validity, data)
+				}
+				values[c] = body[data[0] : data[0]+data[1]]
+			}
+			for j := 0; j < n; j++ {
+				rec := dataset.Record{
+					UnixMillis: int64(binary.LittleEndian.Uint64(values[0][8*j:])),
+					X:          int16(binary.LittleEndian.Uint16(values[2][2*j:])),
+					Y:          int16(binary.LittleEndian.Uint16(values[3][2*j:])),
+					Color:      values[4][j],
+				}
+				copy(rec.UserHash[:], values[1][16*j:])
+				records = append(records, rec)
+			}
+		default:
+			t.Fatalf("message %d has header type %d", i, kind)
+		}
+	}
+}
+
+func TestArrowEncoder(t *testing.T) {
+	for _, events := range []int{0, 10, arrowBatchRows + 10} {
+		records := datasettest.Records(datasettest.Options{Events: events})
+		var buf bytes.Buffer
+		enc := newArrowEncoder(&buf)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				t.Fatalf("Encode: %s", err)
+			}
+		}
+		if err := enc.Flush(); err != nil {
+			t.Fatalf("Flush: %s", err)
+		}
+		if got := readArrow(t, buf.Bytes()); len(got) != len(records) || (len(got) > 0 && !reflect.DeepEqual(got, records)) {
+			t.Errorf("decoded %d records, want the %d encoded", len(got), len(records))
+		}
+	}
+}
+
+func TestArrowExportHandler(t *testing.T) {
+	records := datasettest.Records(datasettest.Options{Events: 1000})
+	future := gsync.NewFuture[[]dataset.Record]()
+	future.Provide(records)
+	handler := arrowExportHandler(future)
+
+	mid := records[500].Time()
+	filter := eventFilter{region: image.Rect(0, 0, 32, 32), from: mid.UnixMilli(), to: mid.Add(10 * time.Second).UnixMilli()}
+	var want []dataset.Record
+	for _, rec := range records {
+		if filter.match(rec) {
+			want = append(want, rec)
+		}
+	}
+	if len(want) == 0 {
+		t.Fatalf("no records in the test range")
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/export/events.arrow?region=0,0,32,32"+
+		"&from="+mid.Format(time.RFC3339Nano)+"&to="+mid.Add(10*time.Second).Format(time.RFC3339Nano), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET = %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != arrowContentType {
+		t.Errorf("Content-Type = %q, want %q", got, arrowContentType)
+	}
+	if got := readArrow(t, w.Body.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("GET returned %d records, want %d", len(got), len(want))
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/export/events.arrow?from=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GET with a bad time = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
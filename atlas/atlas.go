@@ -0,0 +1,183 @@
+// Package atlas reads the community r/place Atlas, which names and describes the artworks on the canvas,
+// and finds the artworks at each pixel.
+package atlas
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// An Entry is an artwork in the Atlas, outlined by a polygon on the canvas.
+type Entry struct {
+	ID          string       `json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Website     string       `json:"website,omitempty"`
+	Subreddit   string       `json:"subreddit,omitempty"`
+	Center      [2]float64   `json:"center"`
+	Path        [][2]float64 `json:"path"`
+
+	bounds image.Rectangle
+}
+
+// Bounds returns the smallest rectangle of pixels containing the entry's polygon.
+func (e *Entry) Bounds() image.Rectangle {
+	return e.bounds
+}
+
+// Contains reports whether the center of the pixel p is within the entry's polygon.
+func (e *Entry) Contains(p image.Point) bool {
+	if !p.In(e.bounds) {
+		return false
+	}
+	x, y := float64(p.X)+0.5, float64(p.Y)+0.5
+	inside := false
+	for i, j := 0, len(e.Path)-1; i < len(e.Path); j, i = i, i+1 {
+		a, b := e.Path[i], e.Path[j]
+		if (a[1] > y) != (b[1] > y) && x < (b[0]-a[0])*(y-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// area returns the area of the entry's polygon.
+func (e *Entry) area() float64 {
+	var sum float64
+	for i, j := 0, len(e.Path)-1; i < len(e.Path); j, i = i, i+1 {
+		sum += e.Path[j][0]*e.Path[i][1] - e.Path[i][0]*e.Path[j][1]
+	}
+	return math.Abs(sum) / 2
+}
+
+// cellSize is the width and height of the cells of the spatial index.
+const cellSize = 32
+
+// An Atlas is a set of entries, indexed by location.
+type Atlas struct {
+	Entries []*Entry // sorted by ID
+
+	byID  map[string]*Entry
+	cells map[image.Point][]*Entry // entries whose bounds overlap each cell, smallest first
+}
+
+// Parse reads the Atlas JSON, which is an array of entries.
+// IDs may be numbers (as in 2017) or strings; entries without a polygon are skipped.
+func Parse(r io.Reader) (*Atlas, error) {
+	var raw []struct {
+		Entry
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("parsing atlas: %w", err)
+	}
+
+	a := &Atlas{
+		byID:  make(map[string]*Entry),
+		cells: make(map[image.Point][]*Entry),
+	}
+	for i := range raw {
+		e := &raw[i].Entry
+		e.ID = strings.Trim(string(raw[i].ID), `"`)
+		if len(e.Path) < 3 {
+			continue
+		}
+		if _, dup := a.byID[e.ID]; dup {
+			return nil, fmt.Errorf("parsing atlas: duplicate id %q", e.ID)
+		}
+
+		minX, minY := math.Inf(1), math.Inf(1)
+		maxX, maxY := math.Inf(-1), math.Inf(-1)
+		for _, p := range e.Path {
+			minX, maxX = math.Min(minX, p[0]), math.Max(maxX, p[0])
+			minY, maxY = math.Min(minY, p[1]), math.Max(maxY, p[1])
+		}
+		e.bounds = image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX)), int(math.Ceil(maxY)))
+
+		a.Entries = append(a.Entries, e)
+		a.byID[e.ID] = e
+	}
+
+	sort.Slice(a.Entries, func(i, j int) bool {
+		return a.Entries[i].area() < a.Entries[j].area()
+	})
+	for _, e := range a.Entries {
+		b := e.bounds
+		for cy := floorDiv(b.Min.Y, cellSize); cy <= floorDiv(b.Max.Y-1, cellSize); cy++ {
+			for cx := floorDiv(b.Min.X, cellSize); cx <= floorDiv(b.Max.X-1, cellSize); cx++ {
+				cell := image.Pt(cx, cy)
+				a.cells[cell] = append(a.cells[cell], e)
+			}
+		}
+	}
+	sort.SliceStable(a.Entries, func(i, j int) bool {
+		return lessID(a.Entries[i].ID, a.Entries[j].ID)
+	})
+	return a, nil
+}
+
+func floorDiv(a, b int) int {
+	return int(math.Floor(float64(a) / float64(b)))
+}
+
+// lessID orders numeric IDs numerically, before any others.
+func lessID(a, b string) bool {
+	if len(a) != len(b) && isDigits(a) && isDigits(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// Load reads the Atlas from a file or an http(s) URL.
+func Load(ctx context.Context, source string) (*Atlas, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		return Parse(bytes.NewReader(data))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: status %q", source, resp.Status)
+	}
+	return Parse(resp.Body)
+}
+
+// Entry returns the entry with the given ID, or nil if there isn't one.
+func (a *Atlas) Entry(id string) *Entry {
+	return a.byID[id]
+}
+
+// At returns the entries containing the pixel, most specific (smallest) first.
+func (a *Atlas) At(p image.Point) []*Entry {
+	var found []*Entry
+	for _, e := range a.cells[image.Pt(floorDiv(p.X, cellSize), floorDiv(p.Y, cellSize))] {
+		if e.Contains(p) {
+			found = append(found, e)
+		}
+	}
+	return found
+}
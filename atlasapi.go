@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/atlas"
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+var atlasSource = serveFlags.String("atlas", "", "File or URL of the community Atlas JSON, to label artworks on the canvas")
+
+// atlasSummary is the form of an entry in /api/atlas/list.
+type atlasSummary struct {
+	ID     string     `json:"id"`
+	Name   string     `json:"name"`
+	Center [2]float64 `json:"center"`
+	Bounds [4]int     `json:"bounds"` // x0, y0, x1, y1
+}
+
+// atlasAPI serves the Atlas under /api/atlas, and the timelapses of its entries under /render/atlas.
+type atlasAPI struct {
+	atlas   *atlas.Atlas
+	records *gsync.Future[[]dataset.Record]
+
+	timelapses gsync.Cache[string, *timelapse.Artifact] // by entry ID and format
+	stats      gsync.Cache[string, *atlasStats]         // by entry ID
+}
+
+func newAtlasAPI(atl *atlas.Atlas, records *gsync.Future[[]dataset.Record]) *atlasAPI {
+	return &atlasAPI{
+		atlas:   atl,
+		records: records,
+		timelapses: gsync.Cache[string, *timelapse.Artifact]{
+			MaxEntries: 64,
+		},
+		stats: gsync.Cache[string, *atlasStats]{
+			MaxEntries: 1024,
+		},
+	}
+}
+
+// handleAt serves /api/atlas?x=&y=, the entries containing the pixel (most specific first).
+func (a *atlasAPI) handleAt(w http.ResponseWriter, r *http.Request) {
+	x, errX := strconv.Atoi(r.FormValue("x"))
+	y, errY := strconv.Atoi(r.FormValue("y"))
+	if errX != nil || errY != nil {
+		http.Error(w, "x and y are required", http.StatusBadRequest)
+		return
+	}
+	entries := a.atlas.At(image.Pt(x, y))
+	if entries == nil {
+		entries = []*atlas.Entry{}
+	}
+	writeJSON(w, entries)
+}
+
+// handle serves the paths below /api/atlas/: the list of entries, each entry, and their stats.
+func (a *atlasAPI) handle(w http.ResponseWriter, r *http.Request) {
+	switch rest := strings.TrimPrefix(r.URL.Path, "/api/atlas/"); rest {
+	case "list":
+		list := make([]atlasSummary, len(a.atlas.Entries))
+		for i, e := range a.atlas.Entries {
+			b := e.Bounds()
+			list[i] = atlasSummary{e.ID, e.Name, e.Center, [4]int{b.Min.X, b.Min.Y, b.Max.X, b.Max.Y}}
+		}
+		writeJSON(w, list)
+	default:
+		id, stats := strings.CutSuffix(rest, "/stats")
+		e := a.atlas.Entry(id)
+		if e == nil {
+			http.Error(w, fmt.Sprintf("no atlas entry %q", id), http.StatusNotFound)
+			return
+		}
+		if stats {
+			a.handleStats(w, r, e)
+			return
+		}
+		writeJSON(w, e)
+	}
+}
+
+// handleStats serves /api/atlas/<id>/stats, which are computed the first time they are requested.
+func (a *atlasAPI) handleStats(w http.ResponseWriter, r *http.Request, e *atlas.Entry) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stats, err := a.stats.Get(r.Context(), e.ID, func(ctx context.Context) (*atlasStats, error) {
+		records, err := a.records.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return computeAtlasStats(records, e), nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, stats.In(loc))
+}
+
+// renderTimelapse serves /render/atlas/<id>/timelapse.{apng,gif}, the evolution of the entry's artwork:
+// the region of the canvas within its bounds, with pixels outside its polygon left transparent.
+func (a *atlasAPI) renderTimelapse(w http.ResponseWriter, r *http.Request) {
+	id, file := path.Split(strings.TrimPrefix(r.URL.Path, "/render/atlas/"))
+	id = strings.TrimSuffix(id, "/")
+	var ctype string
+	switch file {
+	case "timelapse.apng":
+		ctype = "image/apng"
+	case "timelapse.gif":
+		ctype = "image/gif"
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	e := a.atlas.Entry(id)
+	if e == nil {
+		http.Error(w, fmt.Sprintf("no atlas entry %q", id), http.StatusNotFound)
+		return
+	}
+	bounds := e.Bounds().Intersect(timelapse.Bounds())
+	if bounds.Empty() {
+		http.Error(w, fmt.Sprintf("atlas entry %q is not on the canvas", id), http.StatusNotFound)
+		return
+	}
+
+	artifact, err := a.timelapses.Get(r.Context(), id+"/"+file, func(ctx context.Context) (*timelapse.Artifact, error) {
+		records, err := a.records.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		frames := timelapse.RenderRegion(records, timelapse.DefaultInterval, bounds, e.Contains)
+		buf := new(bytes.Buffer)
+		encode := timelapse.EncodeGIF
+		if ctype == "image/apng" {
+			encode = timelapse.EncodeAPNG
+		}
+		if err := encode(buf, frames); err != nil {
+			return nil, fmt.Errorf("encoding timelapse of atlas entry %q: %w", id, err)
+		}
+		glog.Infof("Rendered %d-frame %s of atlas entry %q (%.2fKiB) in %s",
+			len(frames), file, id, float64(buf.Len())/(1<<10), time.Since(start).Truncate(time.Millisecond))
+		return timelapse.NewArtifact(ctype, buf.Bytes()), nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+	artifact.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"image"
+	"sort"
+	"time"
+
+	"github.com/kylelemons/rplacemap/atlas"
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+// intactFraction is the fraction of an artwork's placed pixels which must show their final color
+// for it to be considered intact, both for when it was created and when it was destroyed.
+const intactFraction = 0.5
+
+// atlasStats is served by /api/atlas/<id>/stats.
+type atlasStats struct {
+	ID           string        `json:"id"`
+	Pixels       int           `json:"pixels"` // within the polygon (and on the canvas)
+	Placements   int64         `json:"placements"`
+	Contributors int           `json:"contributors"`
+	Churn        int64         `json:"churn"`             // placements that changed a pixel's color
+	Created      *time.Time    `json:"created,omitempty"` // when it first became intact
+	Destructions []destruction `json:"destructions"`      // times it stopped being intact after it was created
+
+	// Survivors is how many pixels were placed at all, and thus show the color of their last placement.
+	// SurvivalMedian is the median time for which they did so, until the end of the dataset.
+	Survivors      int     `json:"survivors"`
+	SurvivalMedian float64 `json:"survival_median_seconds"`
+}
+
+type destruction struct {
+	Start       time.Time  `json:"start"`
+	End         *time.Time `json:"end,omitempty"` // when it was intact again, if it was
+	MinFraction float64    `json:"min_fraction"`  // of the placed pixels showing their final color
+}
+
+// In returns a copy of the stats with times in loc.
+func (s *atlasStats) In(loc *time.Location) *atlasStats {
+	in := func(t *time.Time) *time.Time {
+		if t == nil {
+			return nil
+		}
+		local := t.In(loc)
+		return &local
+	}
+	c := *s
+	c.Created = in(s.Created)
+	c.Destructions = make([]destruction, len(s.Destructions))
+	for i, d := range s.Destructions {
+		c.Destructions[i] = destruction{d.Start.In(loc), in(d.End), d.MinFraction}
+	}
+	return &c
+}
+
+// computeAtlasStats computes the stats of the entry's artwork.
+// The records must be sorted by time.
+func computeAtlasStats(records []dataset.Record, e *atlas.Entry) *atlasStats {
+	stats := &atlasStats{ID: e.ID, Destructions: []destruction{}}
+	bounds := e.Bounds().Intersect(timelapse.Bounds())
+
+	// The records within the polygon, and the state of each of its pixels (indexed within bounds).
+	var recs []dataset.Record
+	inside := make([]bool, bounds.Dx()*bounds.Dy())
+	offset := func(x, y int) int { return (y-bounds.Min.Y)*bounds.Dx() + x - bounds.Min.X }
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if e.Contains(image.Pt(x, y)) {
+				inside[offset(x, y)] = true
+				stats.Pixels++
+			}
+		}
+	}
+	for _, rec := range records {
+		if p := image.Pt(int(rec.X), int(rec.Y)); p.In(bounds) && inside[offset(p.X, p.Y)] {
+			recs = append(recs, rec)
+		}
+	}
+	if len(recs) == 0 {
+		return stats
+	}
+
+	final := make([]uint8, len(inside))
+	placed := make([]bool, len(inside))
+	lastPlaced := make([]int64, len(inside))
+	users := make(map[[16]byte]bool)
+	current := make([]uint8, len(inside)) // starts white, like Snapshot
+	for _, rec := range recs {
+		i := offset(int(rec.X), int(rec.Y))
+		final[i], placed[i], lastPlaced[i] = rec.Color, true, rec.UnixMillis
+		users[rec.UserHash] = true
+		if rec.Color != current[i] {
+			stats.Churn++
+			current[i] = rec.Color
+		}
+	}
+	stats.Placements = int64(len(recs))
+	stats.Contributors = len(users)
+
+	end := records[len(records)-1].UnixMillis
+	var survival []int64
+	for i := range placed {
+		if placed[i] {
+			survival = append(survival, end-lastPlaced[i])
+		}
+	}
+	stats.Survivors = len(survival)
+	sort.Slice(survival, func(i, j int) bool { return survival[i] < survival[j] })
+	stats.SurvivalMedian = float64(survival[len(survival)/2]) / 1000
+
+	// Replay the placements, tracking how many placed pixels show their final color.
+	clear(current)
+	seen := make([]bool, len(inside))
+	var (
+		matching int
+		broken   *destruction
+	)
+	for _, rec := range recs {
+		i := offset(int(rec.X), int(rec.Y))
+		if seen[i] && current[i] == final[i] {
+			matching--
+		}
+		seen[i], current[i] = true, rec.Color
+		if current[i] == final[i] {
+			matching++
+		}
+
+		fraction := float64(matching) / float64(stats.Survivors)
+		t := rec.Time()
+		switch {
+		case fraction >= intactFraction && stats.Created == nil:
+			stats.Created = &t
+		case fraction >= intactFraction && broken != nil:
+			broken.End = &t
+			stats.Destructions = append(stats.Destructions, *broken)
+			broken = nil
+		case fraction < intactFraction && stats.Created != nil && broken == nil:
+			broken = &destruction{Start: t, MinFraction: fraction}
+		case broken != nil:
+			broken.MinFraction = min(broken.MinFraction, fraction)
+		}
+	}
+	if broken != nil {
+		stats.Destructions = append(stats.Destructions, *broken)
+	}
+	return stats
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+// bigQuerySchema describes jsonEvent as a BigQuery table schema,
+// which ClickHouse and other warehouses can also be pointed at.
+var bigQuerySchema = []struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Mode        string `json:"mode"`
+	Description string `json:"description"`
+}{
+	{"ts", "TIMESTAMP", "REQUIRED", "When the pixel was placed"},
+	{"user_hash", "STRING", "REQUIRED", "Pseudonymized user identifier (base64)"},
+	{"x", "INTEGER", "REQUIRED", "X coordinate, from the left"},
+	{"y", "INTEGER", "REQUIRED", "Y coordinate, from the top"},
+	{"color", "INTEGER", "REQUIRED", "Index into the 16-color palette"},
+}
+
+// bigQueryPartition is the layout of the hour in partition file names.
+const bigQueryPartition = "2006010215"
+
+// exportBigQuery exports the matching events into dir as newline-delimited JSON,
+// partitioned into one file per hour, along with the table schema in schema.json.
+//
+// The files can be loaded with, e.g.:
+//
+//	bq load --source_format=NEWLINE_DELIMITED_JSON \
+//	  --time_partitioning_field=ts --time_partitioning_type=HOUR \
+//	  dataset.place 'events-*.ndjson' schema.json
+func exportBigQuery(ctx context.Context, dir string, filter eventFilter) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating output directory: %w", err)
+	}
+	schema, err := json.MarshalIndent(bigQuerySchema, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "schema.json"), append(schema, '\n'), 0644); err != nil {
+		return fmt.Errorf("writing schema: %w", err) // contains filename
+	}
+
+	if err := ensureDataset(ctx); err != nil {
+		return err
+	}
+
+	// The dataset is not strictly in time order, so every partition stays open until the end.
+	type partition struct {
+		f   *os.File
+		buf *bufio.Writer
+		enc *json.Encoder
+	}
+	partitions := make(map[string]*partition)
+	defer func() {
+		for _, p := range partitions {
+			p.f.Close() // double close OK
+		}
+	}()
+
+	var exported int64
+	if err := dataset.Scan(ctx, datasetFile(), func(rec dataset.Record) error {
+		if !filter.match(rec) {
+			return nil
+		}
+		hour := rec.Time().Truncate(time.Hour).Format(bigQueryPartition)
+		p, ok := partitions[hour]
+		if !ok {
+			f, err := os.Create(filepath.Join(dir, "events-"+hour+".ndjson"))
+			if err != nil {
+				return fmt.Errorf("creating partition: %w", err) // contains filename
+			}
+			buf := bufio.NewWriter(f)
+			p = &partition{f: f, buf: buf, enc: json.NewEncoder(buf)}
+			partitions[hour] = p
+		}
+		exported++
+		return p.enc.Encode(newJSONEvent(rec))
+	}); err != nil {
+		return err
+	}
+
+	for _, p := range partitions {
+		if err := p.buf.Flush(); err != nil {
+			return fmt.Errorf("writing %q: %w", p.f.Name(), err)
+		}
+		if err := p.f.Close(); err != nil {
+			return fmt.Errorf("closing partition: %w", err) // contains filename
+		}
+	}
+	glog.Infof("Exported %s events in %d hourly partitions to %s",
+		progress.FormatCount(exported), len(partitions), dir)
+	return nil
+}
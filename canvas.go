@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/tiles"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+var canvasEpoch timeFlag
+
+func init() {
+	serveFlags.Var(&canvasEpoch, "epoch", "Time (UTC) at which the event began, reported by /api/canvas, e.g. \"2017-03-31 17:00\" (default: the first event)")
+}
+
+// whiteoutMinEvents is how many placements of white must end the dataset for them to be reported as
+// the canvas being wiped (as it was at the end of some years), rather than the last few happening to be white.
+const whiteoutMinEvents = 10000
+
+// canvasInfo is served by /api/canvas so that clients don't need to hard-code the canvas constants.
+type canvasInfo struct {
+	Year     int        `json:"year"`
+	Years    []int      `json:"years"` // available years
+	Width    int        `json:"width"`
+	Height   int        `json:"height"`
+	Epoch    int64      `json:"epoch"`        // UnixMillis of the start of the event (--epoch, or else the first event)
+	Start    time.Time  `json:"start"`        // of the first event
+	End      time.Time  `json:"end"`          // of the last event
+	Whiteout *time.Time `json:"whiteout"`     // when the canvas was wiped at the end, if it was
+	Stride   int64      `json:"chunk_stride"` // milliseconds between the keyframes at /api/keyframes
+	Events   int64      `json:"events"`
+	Users    int        `json:"users"`
+	TileSize int        `json:"tile_size"`
+	MaxZoom  int        `json:"max_zoom"`
+}
+
+// whiteout returns the time of the first of the placements of white which end the records (sorted by time),
+// if there are at least whiteoutMinEvents of them, because the canvas was wiped.
+func whiteout(records []dataset.Record, palette color.Palette) (time.Time, bool) {
+	white := -1
+	for i, c := range palette {
+		if r, g, b, _ := c.RGBA(); r == 0xFFFF && g == 0xFFFF && b == 0xFFFF {
+			white = i
+			break
+		}
+	}
+	if white < 0 {
+		return time.Time{}, false
+	}
+	start := len(records)
+	for start > 0 && int(records[start-1].Color) == white {
+		start--
+	}
+	if len(records)-start < whiteoutMinEvents {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(records[start].UnixMillis).UTC(), true
+}
+
+// canvasHandler serves the canvasInfo, once the records are loaded.
+func canvasHandler(records *gsync.Future[[]dataset.Record]) http.HandlerFunc {
+	info := gsync.Map(records, func(records []dataset.Record) (*canvasInfo, error) {
+		sum := newSummary()
+		for _, rec := range records {
+			sum.add(rec)
+		}
+		epoch := sum.first
+		if !canvasEpoch.IsZero() {
+			if epoch = canvasEpoch.UnixMilli(); epoch > sum.first {
+				glog.Warningf("--epoch=%s is after the first event (%s)", canvasEpoch.String(), time.UnixMilli(sum.first).UTC())
+			}
+		}
+		width, height := timelapse.Dimension, timelapse.Dimension
+		if source != dataset.Source2017 {
+			width, height = source.Width, source.Height
+		}
+		canvas := &canvasInfo{
+			Year:     *year,
+			Years:    []int{*year},
+			Width:    width,
+			Height:   height,
+			Epoch:    epoch,
+			Start:    time.UnixMilli(sum.first).UTC(),
+			End:      time.UnixMilli(sum.last).UTC(),
+			Stride:   keyframeInterval.Milliseconds(),
+			Events:   sum.records,
+			Users:    len(sum.users),
+			TileSize: tiles.DefaultTileSize,
+			MaxZoom:  tiles.MaxZoom,
+		}
+		if t, ok := whiteout(records, dataset.Palette); ok {
+			canvas.Whiteout = &t
+		}
+		return canvas, nil
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		loc, err := requestLocation(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+		defer cancel()
+
+		canvas, err := info.Wait(ctx)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("dataset not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		local := *canvas
+		local.Start, local.End = canvas.Start.In(loc), canvas.End.In(loc)
+		if canvas.Whiteout != nil {
+			t := canvas.Whiteout.In(loc)
+			local.Whiteout = &t
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(local)
+	}
+}
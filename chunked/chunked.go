@@ -0,0 +1,372 @@
+// Package chunked stores the events of a dataset by pixel, in chunks of the canvas,
+// so that the history of a pixel (or of a region) can be found without scanning every event.
+package chunked
+
+import (
+	"fmt"
+	"image"
+	"slices"
+	"sync"
+
+	"github.com/kylelemons/rplacemap/dataset"
+)
+
+// ChunkSize is the width and height of a chunk, in pixels.
+const ChunkSize = 256
+
+// A PixelEvent is an event at a pixel of a Dataset, packed into 8 bytes:
+// its DeltaMillis in the top 32 bits, then its UserIndex in 24, and its Color in the bottom 8.
+type PixelEvent uint64
+
+const (
+	// MaxDeltaMillis is the latest an event can be after the Start of its dataset (about 49 days).
+	MaxDeltaMillis = 1<<32 - 1
+
+	// MaxUsers is how many users a dataset can have.
+	MaxUsers = 1 << 24
+)
+
+func newPixelEvent(deltaMillis int64, userIndex int, color uint8) PixelEvent {
+	return PixelEvent(uint64(deltaMillis)<<32 | uint64(userIndex)<<8 | uint64(color))
+}
+
+// DeltaMillis returns the time of the event, in milliseconds since the Start of the dataset.
+func (ev PixelEvent) DeltaMillis() int64 {
+	return int64(ev >> 32)
+}
+
+// UserIndex returns the index of the user who placed the event, in the Users of the dataset.
+func (ev PixelEvent) UserIndex() int {
+	return int(ev >> 8 & (MaxUsers - 1))
+}
+
+// Color returns the color of the event, an index in the palette.
+func (ev PixelEvent) Color() uint8 {
+	return uint8(ev)
+}
+
+// ChunkInfo describes a chunk, which is known without loading its events.
+type ChunkInfo struct {
+	X, Y   int   // of the chunk, in chunks from the top left of the canvas
+	Events int64 // how many events there are at its pixels
+
+	// The activity in the chunk, so that work can skip chunks (or parts of them) with none:
+	// Active bounds the pixels with events, and First and Last are the DeltaMillis of its first and last events.
+	Active      image.Rectangle
+	First, Last int64
+}
+
+// activeIn reports whether the chunk has events within region, from and to (inclusive) DeltaMillis,
+// as far as its bounds and times can tell.
+func (info ChunkInfo) activeIn(region image.Rectangle, from, to int64) bool {
+	return info.Events > 0 && info.Active.Overlaps(region) && info.First <= to && info.Last >= from
+}
+
+// A Chunk holds the events at the pixels of a ChunkSize square of the canvas.
+type Chunk struct {
+	ChunkInfo
+
+	// The events at the pixel p (py*ChunkSize + px, within the chunk) are events[offsets[p]:offsets[p+1]],
+	// in order of time, so that all of them are in one allocation rather than one for each pixel.
+	offsets []uint32
+	events  []PixelEvent
+}
+
+// At returns the events at the pixel (px, py) within the chunk, in order of time.
+// The returned slice must not be modified.
+func (c *Chunk) At(px, py int) []PixelEvent {
+	p := py*ChunkSize + px
+	return c.events[c.offsets[p]:c.offsets[p+1]]
+}
+
+// A Dataset holds the events of a dataset by chunk: all of them in memory,
+// or (if it was opened with Open) those of the chunks used most recently,
+// or (if it was opened with Map) where they are in its mapped file.
+type Dataset struct {
+	Start  int64           // UnixMillis of the first event, from which PixelEvent.DeltaMillis counts
+	Bounds image.Rectangle // of the canvas
+	Users  [][16]byte      // by PixelEvent.UserIndex, at most MaxUsers
+
+	cols, rows int
+	infos      []ChunkInfo // of the chunks with events, by row and then column
+	total      int64
+
+	chunks []*Chunk    // by row and then column; nil where there are no events, or if they're in file
+	file   *chunksFile // from which the chunks are loaded as they're needed; nil if they're in memory
+
+	keyframes []keyframe // for SnapshotAt, in order of time
+	mu        sync.Mutex
+	decoded   struct { // the canvas of the keyframe decoded last, guarded by mu
+		index  int
+		canvas []uint8
+	}
+}
+
+// New stores the records, which must be sorted by time and be within bounds, by chunk.
+func New(records []dataset.Record, bounds image.Rectangle) (*Dataset, error) {
+	in := newIngester(bounds)
+	if len(records) > 0 {
+		in.d.Start = records[0].UnixMillis
+	}
+	for i, rec := range records {
+		if err := in.add(rec); err != nil {
+			return nil, fmt.Errorf("record %d: %w", i+1, err)
+		}
+	}
+	return in.finalize(), nil
+}
+
+func newDataset(bounds image.Rectangle) *Dataset {
+	d := &Dataset{
+		Bounds: bounds,
+		cols:   (bounds.Dx() + ChunkSize - 1) / ChunkSize,
+		rows:   (bounds.Dy() + ChunkSize - 1) / ChunkSize,
+	}
+	d.chunks = make([]*Chunk, d.cols*d.rows)
+	return d
+}
+
+// An ingester adds records to a Dataset, one by one.
+type ingester struct {
+	d      *Dataset
+	users  map[[16]byte]int
+	arena  arena
+	staged [][][]stagedEvent // blocks from the arena, by chunk, until they're finalized
+	frames *keyframer
+}
+
+// A stagedEvent is an event of a chunk which hasn't been placed with the others at its pixel yet.
+type stagedEvent struct {
+	pixel uint16 // py*ChunkSize + px
+	event PixelEvent
+}
+
+const (
+	// stagingBlock is how many events are staged in each block of a chunk.
+	stagingBlock = 4096
+
+	// arenaSlab is how many blocks are allocated at once by an arena.
+	arenaSlab = 64
+)
+
+// An arena carves the blocks in which events are staged out of larger slabs, so that staging
+// the events of a chunk doesn't repeatedly grow (and copy, and leave behind for the collector) a slice.
+type arena struct {
+	slab []stagedEvent
+}
+
+// block returns an empty block with room for stagingBlock events.
+func (a *arena) block() []stagedEvent {
+	if len(a.slab) == 0 {
+		a.slab = make([]stagedEvent, stagingBlock*arenaSlab)
+	}
+	b := a.slab[:0:stagingBlock]
+	a.slab = a.slab[stagingBlock:]
+	return b
+}
+
+func newIngester(bounds image.Rectangle) *ingester {
+	in := &ingester{
+		d:     newDataset(bounds),
+		users: make(map[[16]byte]int),
+	}
+	in.staged = make([][][]stagedEvent, len(in.d.chunks))
+	in.frames = newKeyframer(in.d)
+	return in
+}
+
+// add adds a record, which must be no earlier than those already added.
+func (in *ingester) add(rec dataset.Record) error {
+	d := in.d
+	p := image.Pt(int(rec.X), int(rec.Y))
+	if !p.In(d.Bounds) {
+		return fmt.Errorf("pixel %v is outside the canvas %v", p, d.Bounds)
+	}
+	delta := rec.UnixMillis - d.Start
+	if delta < 0 || delta > MaxDeltaMillis {
+		return fmt.Errorf("event at %s is not within %dms of the first one", rec.Time(), MaxDeltaMillis)
+	}
+	user, ok := in.users[rec.UserHash]
+	if !ok {
+		if len(d.Users) == MaxUsers {
+			return fmt.Errorf("more than %d users", MaxUsers)
+		}
+		user = len(d.Users)
+		in.users[rec.UserHash] = user
+		d.Users = append(d.Users, rec.UserHash)
+	}
+
+	cx, cy, px, py := d.locate(p.X, p.Y)
+	i := cy*d.cols + cx
+	blocks := in.staged[i]
+	if len(blocks) == 0 || len(blocks[len(blocks)-1]) == stagingBlock {
+		blocks = append(blocks, in.arena.block())
+		in.staged[i] = blocks
+	}
+	last := &blocks[len(blocks)-1]
+	*last = append(*last, stagedEvent{
+		pixel: uint16(py*ChunkSize + px),
+		event: newPixelEvent(delta, user, rec.Color),
+	})
+	in.frames.add(d, delta, i, p.X, p.Y, rec.Color)
+	return nil
+}
+
+// finalize places the staged events of each chunk by pixel and totals them,
+// and adds the last keyframe (with all of the events), returning the finished Dataset.
+// The events (and offsets) of all of the chunks are carved out of one allocation.
+func (in *ingester) finalize() *Dataset {
+	d := in.d
+	d.total = 0
+	if slices.Contains(in.frames.changed, true) {
+		in.frames.keyframe(d)
+	}
+	counts := make([]int, len(in.staged))
+	var chunks int
+	for i, blocks := range in.staged {
+		for _, b := range blocks {
+			counts[i] += len(b)
+		}
+		d.total += int64(counts[i])
+		if counts[i] > 0 {
+			chunks++
+		}
+	}
+	events := make([]PixelEvent, d.total)
+	offsets := make([]uint32, chunks*(ChunkSize*ChunkSize+1))
+	for i, blocks := range in.staged {
+		if counts[i] == 0 {
+			continue
+		}
+		c := &Chunk{
+			ChunkInfo: ChunkInfo{X: i % d.cols, Y: i / d.cols, Events: int64(counts[i])},
+			offsets:   offsets[: ChunkSize*ChunkSize+1 : ChunkSize*ChunkSize+1],
+			events:    events[:counts[i]:counts[i]],
+		}
+		offsets, events = offsets[ChunkSize*ChunkSize+1:], events[counts[i]:]
+
+		// Counting sort, which keeps the events at each pixel in order of time.
+		for _, b := range blocks {
+			for _, s := range b {
+				c.offsets[s.pixel+1]++
+			}
+		}
+		for p := 1; p < len(c.offsets); p++ {
+			c.offsets[p] += c.offsets[p-1]
+		}
+		next := append([]uint32(nil), c.offsets[:ChunkSize*ChunkSize]...)
+		for _, b := range blocks {
+			for _, s := range b {
+				c.events[next[s.pixel]] = s.event
+				next[s.pixel]++
+			}
+		}
+		c.findActivity(d)
+		d.chunks[i] = c
+		d.infos = append(d.infos, c.ChunkInfo)
+		in.staged[i] = nil
+	}
+	in.arena = arena{}
+	return d
+}
+
+// findActivity finds the Active bounds and the First and Last times of the chunk's events.
+func (c *Chunk) findActivity(d *Dataset) {
+	origin := d.ChunkBounds(c.X, c.Y).Min
+	c.First, c.Last = MaxDeltaMillis, 0
+	c.Active = image.Rectangle{}
+	for p := 0; p < ChunkSize*ChunkSize; p++ {
+		events := c.events[c.offsets[p]:c.offsets[p+1]]
+		if len(events) == 0 {
+			continue
+		}
+		pt := origin.Add(image.Pt(p%ChunkSize, p/ChunkSize))
+		c.Active = c.Active.Union(image.Rectangle{pt, pt.Add(image.Pt(1, 1))})
+		c.First = min(c.First, events[0].DeltaMillis())
+		c.Last = max(c.Last, events[len(events)-1].DeltaMillis())
+	}
+}
+
+// locate returns the chunk of the pixel (x, y), which must be in the canvas, and where it is within the chunk.
+func (d *Dataset) locate(x, y int) (cx, cy, px, py int) {
+	x, y = x-d.Bounds.Min.X, y-d.Bounds.Min.Y
+	return x / ChunkSize, y / ChunkSize, x % ChunkSize, y % ChunkSize
+}
+
+// TotalEvents returns how many events there are in the dataset.
+func (d *Dataset) TotalEvents() int64 {
+	return d.total
+}
+
+// Chunks describes the chunks which have events, by row and then column.
+func (d *Dataset) Chunks() []ChunkInfo {
+	return d.infos
+}
+
+// ChunksIn describes the chunks which may have events within region,
+// from and to (inclusive) the given DeltaMillis, by row and then column.
+func (d *Dataset) ChunksIn(region image.Rectangle, from, to int64) []ChunkInfo {
+	var infos []ChunkInfo
+	for _, info := range d.infos {
+		if info.activeIn(region, from, to) {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// chunkInfo describes the chunk with the given index (row*cols + column), without loading it;
+// with no Events if it has none.
+func (d *Dataset) chunkInfo(i int) ChunkInfo {
+	if d.file != nil {
+		return d.file.entries[i].ChunkInfo
+	}
+	if c := d.chunks[i]; c != nil {
+		return c.ChunkInfo
+	}
+	return ChunkInfo{}
+}
+
+// Chunk returns the chunk at (cx, cy), loading it if the dataset was opened with Open or Map;
+// nil if it has no events.
+func (d *Dataset) Chunk(cx, cy int) (*Chunk, error) {
+	if cx < 0 || cx >= d.cols || cy < 0 || cy >= d.rows {
+		return nil, nil
+	}
+	if d.file != nil {
+		return d.file.chunk(cy*d.cols + cx)
+	}
+	return d.chunks[cy*d.cols+cx], nil
+}
+
+// ChunkBounds returns the pixels of the canvas in the chunk at (cx, cy).
+func (d *Dataset) ChunkBounds(cx, cy int) image.Rectangle {
+	min := d.Bounds.Min.Add(image.Pt(cx*ChunkSize, cy*ChunkSize))
+	return image.Rectangle{min, min.Add(image.Pt(ChunkSize, ChunkSize))}.Intersect(d.Bounds)
+}
+
+// At returns the events at the pixel (x, y), in order of time; none if it's outside the canvas.
+// It only fails if the dataset was opened with Open or Map and the chunk of the pixel can't be loaded.
+// The returned slice must not be modified.
+func (d *Dataset) At(x, y int) ([]PixelEvent, error) {
+	if !image.Pt(x, y).In(d.Bounds) {
+		return nil, nil
+	}
+	cx, cy, px, py := d.locate(x, y)
+	c, err := d.Chunk(cx, cy)
+	if c == nil || err != nil {
+		return nil, err
+	}
+	return c.At(px, py), nil
+}
+
+// Record returns the event at the pixel (x, y) as a record.
+func (d *Dataset) Record(x, y int, ev PixelEvent) dataset.Record {
+	return dataset.Record{
+		UnixMillis: d.Start + ev.DeltaMillis(),
+		UserHash:   d.Users[ev.UserIndex()],
+		X:          int16(x),
+		Y:          int16(y),
+		Color:      ev.Color(),
+	}
+}
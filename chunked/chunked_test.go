@@ -0,0 +1,266 @@
+package chunked_test
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/chunked"
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/dataset/datasettest"
+)
+
+func TestNew(t *testing.T) {
+	ds := datasettest.Build(t, datasettest.Tiny())
+	d, err := chunked.New(ds.Records, ds.Bounds())
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if got, want := d.TotalEvents(), int64(len(ds.Records)); got != want {
+		t.Errorf("TotalEvents() = %d, want %d", got, want)
+	}
+	if got := len(d.Chunks()); got != 1 {
+		t.Errorf("%d chunks, want 1", got)
+	}
+
+	// Alice painted (1,1) twice.
+	events, err := d.At(1, 1)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("At(1,1) = %+v, want 2 events", events)
+	}
+	if got, want := d.Record(1, 1, events[0]), ds.Records[0]; got != want {
+		t.Errorf("first event at (1,1) = %+v, want %+v", got, want)
+	}
+	if got, want := d.Record(1, 1, events[1]), ds.Records[2]; got != want {
+		t.Errorf("second event at (1,1) = %+v, want %+v", got, want)
+	}
+	if ev := events[1]; ev.DeltaMillis() != time.Minute.Milliseconds() || ev.UserIndex() != 0 || ev.Color() != 3 {
+		t.Errorf("second event at (1,1) is %dms after the start by user %d in color %d; want 60000ms, user 0, and color 3",
+			ev.DeltaMillis(), ev.UserIndex(), ev.Color())
+	}
+	if got, err := d.At(0, 0); err != nil || len(got) != 0 {
+		t.Errorf("At(0,0) = %+v, %v; want no events", got, err)
+	}
+	if got, err := d.At(-1, 100); err != nil || got != nil {
+		t.Errorf("At(-1,100) = %+v, %v; want nil", got, err)
+	}
+
+	if _, err := chunked.New(ds.Records, image.Rect(0, 0, 4, 4)); err == nil {
+		t.Errorf("New with records outside the canvas succeeded, want an error")
+	}
+	late := append(ds.Records, dataset.Record{UnixMillis: ds.Records[0].UnixMillis + chunked.MaxDeltaMillis + 1})
+	if _, err := chunked.New(late, ds.Bounds()); err == nil {
+		t.Errorf("New with records more than MaxDeltaMillis apart succeeded, want an error")
+	}
+}
+
+// spread returns records spread over a canvas of several chunks.
+func spread() ([]dataset.Record, image.Rectangle) {
+	return datasettest.Records(datasettest.Options{Size: 600, Events: 5000}), image.Rect(0, 0, 600, 600)
+}
+
+func TestWriteFile(t *testing.T) {
+	records, bounds := spread()
+	d, err := chunked.New(records, bounds)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if got := len(d.Chunks()); got != 9 {
+		t.Errorf("%d chunks, want 9", got)
+	}
+	var sum int64
+	for _, c := range d.Chunks() {
+		sum += c.Events
+	}
+	if sum != int64(len(records)) || d.TotalEvents() != sum {
+		t.Errorf("chunks have %d events in total, TotalEvents() = %d; want %d", sum, d.TotalEvents(), len(records))
+	}
+
+	file := filepath.Join(t.TempDir(), "place.chunks")
+	if err := d.WriteFile(file, "v1"); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	loaded, err := chunked.Load(file, "v1")
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	checkSame(t, loaded, d)
+
+	// With only a row of chunks in memory at once, each row evicts the one before it.
+	opened, err := chunked.Open(file, "v1", 3)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer opened.Close()
+	if !reflect.DeepEqual(opened.Chunks(), d.Chunks()) {
+		t.Errorf("opened Chunks() = %+v, want %+v", opened.Chunks(), d.Chunks())
+	}
+	checkSame(t, opened, d)
+
+	mapped, err := chunked.Map(file, "v1")
+	if err != nil {
+		t.Fatalf("Map: %s", err)
+	}
+	checkSame(t, mapped, d)
+	// The file can be replaced while it's mapped, without changing the mapped dataset.
+	if err := d.WriteFile(file, "v1.1"); err != nil {
+		t.Fatalf("WriteFile over a mapped file: %s", err)
+	}
+	checkSame(t, mapped, d)
+	if err := mapped.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+
+	if _, err := chunked.Load(file, "v2"); !errors.Is(err, chunked.ErrStale) {
+		t.Errorf("Load of another version: %v, want ErrStale", err)
+	}
+	other := filepath.Join(t.TempDir(), "other.chunks")
+	os.WriteFile(other, []byte("not a chunked dataset, but long enough to have a footer"), 0o644)
+	if _, err := chunked.Load(other, "v1"); !errors.Is(err, chunked.ErrStale) {
+		t.Errorf("Load of another file: %v, want ErrStale", err)
+	}
+	if _, err := chunked.Load(filepath.Join(t.TempDir(), "missing.chunks"), "v1"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Load of a missing file: %v, want ErrNotExist", err)
+	}
+}
+
+// checkSame checks that got has the same events as want.
+func checkSame(t *testing.T, got, want *chunked.Dataset) {
+	t.Helper()
+	if got.TotalEvents() != want.TotalEvents() {
+		t.Errorf("TotalEvents() = %d, want %d", got.TotalEvents(), want.TotalEvents())
+	}
+	for y := want.Bounds.Min.Y; y < want.Bounds.Max.Y; y++ {
+		for x := want.Bounds.Min.X; x < want.Bounds.Max.X; x++ {
+			gotEvents, err := got.At(x, y)
+			if err != nil {
+				t.Fatalf("At(%d,%d): %s", x, y, err)
+			}
+			wantEvents, _ := want.At(x, y)
+			if len(gotEvents) != len(wantEvents) {
+				t.Fatalf("At(%d,%d) has %d events, want %d", x, y, len(gotEvents), len(wantEvents))
+			}
+			for i := range gotEvents {
+				if g, w := got.Record(x, y, gotEvents[i]), want.Record(x, y, wantEvents[i]); g != w {
+					t.Fatalf("event %d at (%d,%d) = %+v, want %+v", i, x, y, g, w)
+				}
+			}
+		}
+	}
+}
+
+func TestSnapshotAt(t *testing.T) {
+	// Over about seven hours, so that there are several keyframes.
+	records := datasettest.Records(datasettest.Options{Size: 600, Events: 5000, Rate: 0.2})
+	bounds := image.Rect(0, 0, 600, 600)
+	d, err := chunked.New(records, bounds)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	file := filepath.Join(t.TempDir(), "place.chunks")
+	if err := d.WriteFile(file, "v1"); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	opened, err := chunked.Open(file, "v1", 3)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer opened.Close()
+
+	start, end := records[0].UnixMillis, records[len(records)-1].UnixMillis
+	hour := chunked.KeyframeInterval.Milliseconds()
+	times := []int64{start - 1, start, records[100].UnixMillis, end, end + hour}
+	for at := start + hour; at < end; at += hour {
+		times = append(times, at-1, at)
+	}
+	// Backwards, too, since the keyframes are decoded forwards.
+	times = append(times, records[4000].UnixMillis, start+hour+1, records[10].UnixMillis)
+
+	for _, region := range []image.Rectangle{bounds, image.Rect(-10, -10, 1001, 1001), image.Rect(250, 100, 300, 520)} {
+		for _, at := range times {
+			want := dataset.Snapshot(records, at, region)
+			for name, d := range map[string]*chunked.Dataset{"new": d, "opened": opened} {
+				got, err := d.SnapshotAt(at, region)
+				if err != nil {
+					t.Fatalf("%s SnapshotAt(%d, %v): %s", name, at, region, err)
+				}
+				if got.Rect != want.Rect || !bytes.Equal(got.Pix, want.Pix) {
+					t.Errorf("%s SnapshotAt(%d, %v) differs from Snapshot", name, at-start, region)
+				}
+			}
+		}
+	}
+}
+
+func TestNewManyEvents(t *testing.T) {
+	// Enough events in one chunk to be staged in several blocks.
+	records := datasettest.Records(datasettest.Options{Events: 10000})
+	d, err := chunked.New(records, image.Rect(0, 0, 64, 64))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if got := d.Chunks(); len(got) != 1 || got[0].Events != int64(len(records)) {
+		t.Fatalf("Chunks() = %+v, want one with all %d events", got, len(records))
+	}
+	next := make(map[image.Point]int)
+	for _, rec := range records {
+		p := image.Pt(int(rec.X), int(rec.Y))
+		events, _ := d.At(p.X, p.Y)
+		if next[p] >= len(events) {
+			t.Fatalf("At%v has %d events, want more", p, len(events))
+		}
+		if got := d.Record(p.X, p.Y, events[next[p]]); got != rec {
+			t.Fatalf("event %d at %v = %+v, want %+v", next[p], p, got, rec)
+		}
+		next[p]++
+	}
+}
+
+func TestChunksIn(t *testing.T) {
+	records, bounds := spread()
+	d, err := chunked.New(records, bounds)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	start := records[0].UnixMillis
+
+	// The activity of each chunk covers exactly the records in it.
+	want := make(map[image.Point]chunked.ChunkInfo)
+	for _, rec := range records {
+		p := image.Pt(int(rec.X), int(rec.Y))
+		c := p.Div(chunked.ChunkSize)
+		info, ok := want[c]
+		if !ok {
+			info = chunked.ChunkInfo{X: c.X, Y: c.Y, First: rec.UnixMillis - start}
+		}
+		info.Events++
+		info.Active = info.Active.Union(image.Rectangle{p, p.Add(image.Pt(1, 1))})
+		info.Last = rec.UnixMillis - start
+		want[c] = info
+	}
+	for _, got := range d.Chunks() {
+		if w := want[image.Pt(got.X, got.Y)]; got != w {
+			t.Errorf("chunk (%d,%d) = %+v, want %+v", got.X, got.Y, got, w)
+		}
+	}
+
+	if got := d.ChunksIn(bounds, 0, chunked.MaxDeltaMillis); len(got) != len(d.Chunks()) {
+		t.Errorf("ChunksIn(the canvas) = %d chunks, want all %d", len(got), len(d.Chunks()))
+	}
+	corner := image.Rect(0, 0, 10, 10)
+	if got := d.ChunksIn(corner, 0, chunked.MaxDeltaMillis); len(got) != 1 || got[0].X != 0 || got[0].Y != 0 {
+		t.Errorf("ChunksIn(%v) = %+v, want the first chunk", corner, got)
+	}
+	if got := d.ChunksIn(image.Rect(600, 600, 700, 700), 0, chunked.MaxDeltaMillis); len(got) != 0 {
+		t.Errorf("ChunksIn(outside the canvas) = %+v, want none", got)
+	}
+	last := records[len(records)-1].UnixMillis - start
+	if got := d.ChunksIn(bounds, last+1, chunked.MaxDeltaMillis); len(got) != 0 {
+		t.Errorf("ChunksIn(after the last event) = %+v, want none", got)
+	}
+}
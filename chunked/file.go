@@ -0,0 +1,341 @@
+package chunked
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+// ErrStale is returned by Load if the file was built from a different dataset, or in an older format.
+var ErrStale = errors.New("chunked dataset is stale")
+
+// A chunked dataset file holds the encoded chunks, followed by an index of them
+// (with the rest of the Dataset) which is read from the end of the file:
+//
+//	chunk | chunk | ... | index | index size | fileMagic
+//
+// The index size is a little-endian uint64. Each chunk is laid out as it is in memory (see Chunk),
+// so that it can be used where it was read (or mapped, by Map) without decoding it:
+// its ChunkSize*ChunkSize+1 offsets as little-endian uint32s, padded to a multiple of 8 bytes,
+// and then its events as little-endian uint64s. The chunks start at multiples of 8 bytes.
+// The keyframes of the dataset are in the index.
+const fileMagic = "rplacemap/chunks/v4"
+
+// fileIndex is the index of a chunked dataset file.
+type fileIndex struct {
+	Version   string // identifies the dataset it was built from
+	Start     int64
+	Bounds    image.Rectangle
+	Users     [][16]byte
+	Chunks    []chunkEntry
+	Keyframes []keyframe
+}
+
+// A chunkEntry describes and locates a chunk in a chunked dataset file.
+// Its Events were counted when the chunk was built, so the file needn't be walked to count them.
+type chunkEntry struct {
+	ChunkInfo
+	Offset, Size int64
+}
+
+// WriteFile writes the dataset to filename, tagged with the version of the dataset it came from.
+func (d *Dataset) WriteFile(filename, version string) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("creating chunked dataset file: %w", err) // contains filename
+	}
+	defer os.Remove(tmp) // no-op after rename
+	defer f.Close()      // double close OK
+
+	buf := bufio.NewWriter(f)
+	index := fileIndex{
+		Version:   version,
+		Start:     d.Start,
+		Bounds:    d.Bounds,
+		Users:     d.Users,
+		Keyframes: d.keyframes,
+	}
+	var offset int64
+	for _, info := range d.Chunks() {
+		c, err := d.Chunk(info.X, info.Y)
+		if err != nil {
+			return err
+		}
+		data := c.encode()
+		if _, err := buf.Write(data); err != nil {
+			return fmt.Errorf("writing chunk: %w", err)
+		}
+		index.Chunks = append(index.Chunks, chunkEntry{info, offset, int64(len(data))})
+		offset += int64(len(data)) // a multiple of 8, as is the next chunk's offset
+	}
+	var encoded bytes.Buffer
+	if err := gob.NewEncoder(&encoded).Encode(index); err != nil {
+		return fmt.Errorf("encoding index: %w", err)
+	}
+	buf.Write(encoded.Bytes())
+	binary.Write(buf, binary.LittleEndian, uint64(encoded.Len()))
+	buf.WriteString(fileMagic)
+	if err := buf.Flush(); err != nil {
+		return fmt.Errorf("flushing chunked dataset to %q: %w", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing chunked dataset file: %w", err) // contains filename
+	}
+	return os.Rename(tmp, filename)
+}
+
+func (c *Chunk) encode() []byte {
+	data := make([]byte, 0, offsetsSize+8*len(c.events))
+	for _, o := range c.offsets {
+		data = binary.LittleEndian.AppendUint32(data, o)
+	}
+	data = data[:offsetsSize] // padded
+	for _, ev := range c.events {
+		data = binary.LittleEndian.AppendUint64(data, uint64(ev))
+	}
+	return data
+}
+
+// offsetsSize is how many bytes the offsets of an encoded chunk take up, with their padding.
+const offsetsSize = (4*(ChunkSize*ChunkSize+1) + 7) / 8 * 8
+
+// Load reads a dataset written by WriteFile into memory,
+// returning ErrStale if it was not built from the given version of the dataset.
+func Load(filename, version string) (*Dataset, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("opening chunked dataset file: %w", err) // contains filename
+	}
+	defer f.Close() // no data to flush
+
+	d, index, err := readDataset(f, version)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range index.Chunks {
+		c, err := readChunk(f, e, len(d.Users))
+		if err != nil {
+			return nil, err
+		}
+		d.chunks[e.Y*d.cols+e.X] = c
+	}
+	return d, nil
+}
+
+// Open opens a dataset written by WriteFile, like Load, but only reads its chunks as they're needed,
+// keeping (at most) the maxChunks used most recently in memory.
+// The dataset must be closed once it's no longer needed.
+func Open(filename, version string, maxChunks int) (*Dataset, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("opening chunked dataset file: %w", err) // contains filename
+	}
+	d, index, err := readDataset(f, version)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d.chunks = nil
+	d.file = &chunksFile{
+		f:       f,
+		users:   len(d.Users),
+		entries: make([]chunkEntry, d.cols*d.rows),
+		cache:   gsync.Cache[int, *Chunk]{MaxEntries: maxChunks},
+	}
+	for _, e := range index.Chunks {
+		d.file.entries[e.Y*d.cols+e.X] = e
+	}
+	return d, nil
+}
+
+// Map maps a dataset written by WriteFile into memory read-only, like Open,
+// so that the processes which map the same file share its memory (the page cache) rather than each having a copy.
+// The file can still be replaced (by WriteFile) while it's mapped. The dataset must be closed once it's no longer needed.
+//
+// On systems without mmap, the file is read into memory instead.
+func Map(filename, version string) (*Dataset, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("opening chunked dataset file: %w", err) // contains filename
+	}
+	d, index, err := readDataset(f, version)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	data, unmap, err := mapFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d.chunks = nil
+	d.file = &chunksFile{
+		f:       f,
+		data:    data,
+		unmap:   unmap,
+		users:   len(d.Users),
+		entries: make([]chunkEntry, d.cols*d.rows),
+	}
+	for _, e := range index.Chunks {
+		if e.Offset+e.Size > int64(len(data)) {
+			d.Close()
+			return nil, fmt.Errorf("%q has chunk (%d,%d) past its end", filename, e.X, e.Y)
+		}
+		d.file.entries[e.Y*d.cols+e.X] = e
+	}
+	return d, nil
+}
+
+// Close closes the file of a dataset opened with Open or Map.
+func (d *Dataset) Close() error {
+	if d.file == nil {
+		return nil
+	}
+	if d.file.unmap != nil {
+		if err := d.file.unmap(); err != nil {
+			d.file.f.Close()
+			return fmt.Errorf("unmapping %q: %w", d.file.f.Name(), err)
+		}
+	}
+	return d.file.f.Close()
+}
+
+// A chunksFile loads the chunks of a dataset opened with Open or Map.
+type chunksFile struct {
+	f       *os.File
+	data    []byte       // the whole file, if it was mapped by Map
+	unmap   func() error // of data
+	users   int
+	entries []chunkEntry // by row and then column; with no Events where there are none
+	cache   gsync.Cache[int, *Chunk]
+}
+
+// chunk returns the chunk with the given index in entries; nil if it has no events.
+func (cf *chunksFile) chunk(i int) (*Chunk, error) {
+	e := cf.entries[i]
+	if e.Events == 0 {
+		return nil, nil
+	}
+	return cf.cache.Get(context.Background(), i, func(context.Context) (*Chunk, error) {
+		if cf.data == nil {
+			return readChunk(cf.f, e, cf.users)
+		}
+		c, err := decodeChunk(cf.data[e.Offset:e.Offset+e.Size], e.ChunkInfo, cf.users)
+		if err != nil {
+			return nil, fmt.Errorf("decoding chunk (%d,%d) of %q: %w", e.X, e.Y, cf.f.Name(), err)
+		}
+		return c, nil
+	})
+}
+
+// readDataset reads the index of a chunked dataset file, returning a Dataset without any of its chunks.
+func readDataset(f *os.File, version string) (*Dataset, *fileIndex, error) {
+	index, err := readIndex(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	if index.Version != version {
+		return nil, nil, fmt.Errorf("%q has version %q, want %q: %w", f.Name(), index.Version, version, ErrStale)
+	}
+
+	d := newDataset(index.Bounds)
+	d.Start, d.Users = index.Start, index.Users
+	if len(d.Users) > MaxUsers {
+		return nil, nil, fmt.Errorf("%q has %d users, more than %d", f.Name(), len(d.Users), MaxUsers)
+	}
+	for _, e := range index.Chunks {
+		if e.Offset < 0 || e.Offset%8 != 0 || e.Size < 0 {
+			return nil, nil, fmt.Errorf("%q has a chunk at %d of %d bytes", f.Name(), e.Offset, e.Size)
+		}
+		if e.X < 0 || e.X >= d.cols || e.Y < 0 || e.Y >= d.rows || e.Events <= 0 ||
+			e.Active.Empty() || !e.Active.In(d.ChunkBounds(e.X, e.Y)) || e.First < 0 || e.First > e.Last || e.Last > MaxDeltaMillis {
+			return nil, nil, fmt.Errorf("%q has a bad chunk %+v for the canvas %v", f.Name(), e.ChunkInfo, d.Bounds)
+		}
+		d.infos = append(d.infos, e.ChunkInfo)
+		d.total += e.Events
+	}
+	d.keyframes = index.Keyframes
+	if err := d.checkKeyframes(); err != nil {
+		return nil, nil, fmt.Errorf("%q: %w", f.Name(), err)
+	}
+	return d, index, nil
+}
+
+// readChunk reads and decodes a chunk of a dataset with the given number of users.
+func readChunk(f *os.File, e chunkEntry, users int) (*Chunk, error) {
+	data := make([]byte, e.Size)
+	if _, err := f.ReadAt(data, e.Offset); err != nil {
+		return nil, fmt.Errorf("reading chunk (%d,%d): %w", e.X, e.Y, err) // contains filename
+	}
+	c, err := decodeChunk(data, e.ChunkInfo, users)
+	if err != nil {
+		return nil, fmt.Errorf("decoding chunk (%d,%d) of %q: %w", e.X, e.Y, f.Name(), err)
+	}
+	return c, nil
+}
+
+// readIndex reads the index from the end of a chunked dataset file.
+func readIndex(f *os.File) (*fileIndex, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("checking chunked dataset file: %w", err) // contains filename
+	}
+	footer := make([]byte, 8+len(fileMagic))
+	if stat.Size() < int64(len(footer)) {
+		return nil, fmt.Errorf("%q is too short to be a chunked dataset: %w", f.Name(), ErrStale)
+	}
+	if _, err := f.ReadAt(footer, stat.Size()-int64(len(footer))); err != nil {
+		return nil, fmt.Errorf("reading index size: %w", err) // contains filename
+	}
+	if magic := string(footer[8:]); magic != fileMagic {
+		return nil, fmt.Errorf("%q is not in the current chunked format (%q): %w", f.Name(), magic, ErrStale)
+	}
+	size := binary.LittleEndian.Uint64(footer)
+	if size > uint64(stat.Size())-uint64(len(footer)) {
+		return nil, fmt.Errorf("%q has an index of %d bytes, which is larger than the file", f.Name(), size)
+	}
+	section := io.NewSectionReader(f, stat.Size()-int64(len(footer))-int64(size), int64(size))
+	index := new(fileIndex)
+	if err := gob.NewDecoder(bufio.NewReader(section)).Decode(index); err != nil {
+		return nil, fmt.Errorf("decoding index of %q: %w", f.Name(), err)
+	}
+	return index, nil
+}
+
+// decodeChunk decodes the chunk described by info, of a dataset with the given number of users.
+// The chunk refers to data (rather than to a copy) where it can, so data must not be modified.
+func decodeChunk(data []byte, info ChunkInfo, users int) (*Chunk, error) {
+	events := info.Events
+	if len(data) < offsetsSize || len(data)%8 != 0 || events != int64(len(data)-offsetsSize)/8 {
+		return nil, fmt.Errorf("%d events can't be in %d bytes", events, len(data))
+	}
+	c := &Chunk{
+		ChunkInfo: info,
+		offsets:   uint32s(data[:4*(ChunkSize*ChunkSize+1)]),
+		events:    pixelEvents(data[offsetsSize:]),
+	}
+	if c.offsets[0] != 0 || c.offsets[ChunkSize*ChunkSize] != uint32(events) {
+		return nil, fmt.Errorf("offsets of %d to %d, want 0 to %d", c.offsets[0], c.offsets[ChunkSize*ChunkSize], events)
+	}
+	for p := 0; p < ChunkSize*ChunkSize; p++ {
+		if c.offsets[p] > c.offsets[p+1] {
+			return nil, fmt.Errorf("pixel %d has a bad offset", p)
+		}
+	}
+	for i, ev := range c.events {
+		if ev.UserIndex() >= users {
+			return nil, fmt.Errorf("event %d has a bad user", i)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,171 @@
+package chunked
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/kylelemons/rplacemap/dataset"
+)
+
+// KeyframeInterval is how often (after the Start of a dataset) the whole canvas is kept,
+// so that SnapshotAt can start from the canvas as of the last keyframe instead of from a blank one.
+const KeyframeInterval = time.Hour
+
+// A keyframe is the canvas as of the end of its interval: the keyframe k has the events
+// before (k+1)*KeyframeInterval after the Start of the dataset, and the last has all of them.
+type keyframe struct {
+	// Delta is the canvas (the color of each pixel of the dataset's Bounds, by row),
+	// XORed with that of the keyframe before it (or a blank canvas) and compressed with zstd,
+	// so that a keyframe is mostly the few pixels which changed during its interval.
+	Delta []byte
+
+	// Changed lists the chunks with events during its interval, by index (row*cols + column).
+	Changed []int32
+}
+
+// The encoder and decoder of keyframes, which are safe for concurrent use by EncodeAll and DecodeAll.
+var (
+	keyframeEncoder, _ = zstd.NewWriter(nil)
+	keyframeDecoder, _ = zstd.NewReader(nil)
+)
+
+// A keyframer collects the keyframes of the records added to an ingester, in order of time.
+type keyframer struct {
+	canvas, prev []uint8 // the canvas, and the canvas as of the last keyframe
+	changed      []bool  // by chunk, during the interval of the next keyframe
+}
+
+func newKeyframer(d *Dataset) *keyframer {
+	return &keyframer{
+		canvas:  make([]uint8, d.Bounds.Dx()*d.Bounds.Dy()),
+		prev:    make([]uint8, d.Bounds.Dx()*d.Bounds.Dy()),
+		changed: make([]bool, d.cols*d.rows),
+	}
+}
+
+// add adds the event with the given DeltaMillis in the chunk with the given index at the pixel (x, y),
+// after adding the keyframes which end before it to the dataset.
+func (k *keyframer) add(d *Dataset, deltaMillis int64, chunk, x, y int, color uint8) {
+	for deltaMillis >= int64(len(d.keyframes)+1)*KeyframeInterval.Milliseconds() {
+		k.keyframe(d)
+	}
+	k.canvas[(y-d.Bounds.Min.Y)*d.Bounds.Dx()+(x-d.Bounds.Min.X)] = color
+	k.changed[chunk] = true
+}
+
+// keyframe adds a keyframe of the canvas so far to the dataset.
+func (k *keyframer) keyframe(d *Dataset) {
+	var kf keyframe
+	delta := make([]uint8, len(k.canvas))
+	for i, c := range k.canvas {
+		delta[i] = c ^ k.prev[i]
+	}
+	kf.Delta = keyframeEncoder.EncodeAll(delta, nil)
+	copy(k.prev, k.canvas)
+	for i, changed := range k.changed {
+		if changed {
+			kf.Changed = append(kf.Changed, int32(i))
+			k.changed[i] = false
+		}
+	}
+	d.keyframes = append(d.keyframes, kf)
+}
+
+// checkKeyframes checks that the keyframes read from a file are of the dataset's chunks.
+func (d *Dataset) checkKeyframes() error {
+	for i, kf := range d.keyframes {
+		for _, c := range kf.Changed {
+			if c < 0 || int(c) >= d.cols*d.rows {
+				return fmt.Errorf("keyframe %d has a bad chunk %d", i, c)
+			}
+		}
+	}
+	return nil
+}
+
+// keyframeCanvas returns the canvas as of the keyframe k, which must be valid.
+// The returned canvas must not be modified, and is only valid until the next call, with d.mu held.
+func (d *Dataset) keyframeCanvas(k int) ([]uint8, error) {
+	if d.decoded.canvas == nil || d.decoded.index > k {
+		// The keyframes can only be decoded forwards, from the first.
+		d.decoded.canvas = make([]uint8, d.Bounds.Dx()*d.Bounds.Dy())
+		d.decoded.index = -1
+	}
+	for d.decoded.index < k {
+		next := d.decoded.index + 1
+		delta, err := keyframeDecoder.DecodeAll(d.keyframes[next].Delta, nil)
+		if err != nil || len(delta) != len(d.decoded.canvas) {
+			d.decoded.canvas = nil
+			return nil, fmt.Errorf("decoding keyframe %d: %v (%d bytes)", next, err, len(delta))
+		}
+		for i, c := range delta {
+			d.decoded.canvas[i] ^= c
+		}
+		d.decoded.index = next
+	}
+	return d.decoded.canvas, nil
+}
+
+// SnapshotAt returns the state of the canvas within bounds as of the given time,
+// including all events at or before unixMillis, like dataset.Snapshot does for records.
+// It starts from the latest keyframe at or before that time, replaying only the events since then.
+func (d *Dataset) SnapshotAt(unixMillis int64, bounds image.Rectangle) (*image.Paletted, error) {
+	img := image.NewPaletted(bounds, dataset.Palette)
+	delta := unixMillis - d.Start
+	if delta < 0 || len(d.keyframes) == 0 {
+		return img, nil
+	}
+	interval := KeyframeInterval.Milliseconds()
+	k := len(d.keyframes) - 1 // the latest keyframe with none of the events after delta
+	if delta < int64(k+1)*interval {
+		k = int((delta+1)/interval) - 1
+	}
+	within := bounds.Intersect(d.Bounds)
+
+	if k >= 0 {
+		d.mu.Lock()
+		canvas, err := d.keyframeCanvas(k)
+		if err != nil {
+			d.mu.Unlock()
+			return nil, err
+		}
+		for y := within.Min.Y; y < within.Max.Y; y++ {
+			row := canvas[(y-d.Bounds.Min.Y)*d.Bounds.Dx():]
+			copy(img.Pix[img.PixOffset(within.Min.X, y):img.PixOffset(within.Max.X, y)],
+				row[within.Min.X-d.Bounds.Min.X:within.Max.X-d.Bounds.Min.X])
+		}
+		d.mu.Unlock()
+	}
+	if k+1 >= len(d.keyframes) {
+		return img, nil // the last keyframe has all of the events
+	}
+
+	// Replay the events since the keyframe in the chunks which have any.
+	since := int64(k+1) * interval
+	for _, i := range d.keyframes[k+1].Changed {
+		info := d.chunkInfo(int(i))
+		if !info.activeIn(within, since, delta) {
+			continue
+		}
+		region := info.Active.Intersect(within)
+		c, err := d.Chunk(info.X, info.Y)
+		if err != nil {
+			return nil, err
+		}
+		for y := region.Min.Y; y < region.Max.Y; y++ {
+			for x := region.Min.X; x < region.Max.X; x++ {
+				_, _, px, py := d.locate(x, y)
+				events := c.At(px, py)
+				last := sort.Search(len(events), func(i int) bool { return events[i].DeltaMillis() > delta }) - 1
+				if last >= 0 && events[last].DeltaMillis() >= since {
+					img.SetColorIndex(x, y, events[last].Color())
+				}
+			}
+		}
+	}
+	return img, nil
+}
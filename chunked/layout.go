@@ -0,0 +1,42 @@
+package chunked
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// littleEndian is whether this machine stores integers as the chunked dataset files do,
+// in which case an encoded chunk can be used without decoding it.
+var littleEndian = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+// uint32s returns the little-endian uint32s in data,
+// referring to data itself if the layout in memory is the same.
+func uint32s(data []byte) []uint32 {
+	if len(data) == 0 {
+		return nil
+	}
+	if p := unsafe.SliceData(data); littleEndian && uintptr(unsafe.Pointer(p))%4 == 0 {
+		return unsafe.Slice((*uint32)(unsafe.Pointer(p)), len(data)/4)
+	}
+	s := make([]uint32, len(data)/4)
+	for i := range s {
+		s[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+	return s
+}
+
+// pixelEvents returns the little-endian PixelEvents in data,
+// referring to data itself if the layout in memory is the same.
+func pixelEvents(data []byte) []PixelEvent {
+	if len(data) == 0 {
+		return nil
+	}
+	if p := unsafe.SliceData(data); littleEndian && uintptr(unsafe.Pointer(p))%8 == 0 {
+		return unsafe.Slice((*PixelEvent)(unsafe.Pointer(p)), len(data)/8)
+	}
+	s := make([]PixelEvent, len(data)/8)
+	for i := range s {
+		s[i] = PixelEvent(binary.LittleEndian.Uint64(data[8*i:]))
+	}
+	return s
+}
@@ -0,0 +1,24 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package chunked
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// mapFile reads the whole of f into memory, since it can't be mapped here.
+func mapFile(f *os.File) ([]byte, func() error, error) {
+	data, err := io.ReadAll(f) // from the start, since it has only been read with ReadAt
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading chunked dataset file: %w", err) // contains filename
+	}
+	return data, func() error { return nil }, nil
+}
+
+// Lock would take an exclusive lock for writing filename, but files can't be locked here,
+// so processes sharing a file may each build it.
+func Lock(filename string) (unlock func() error, err error) {
+	return func() error { return nil }, nil
+}
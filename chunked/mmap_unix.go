@@ -0,0 +1,37 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package chunked
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mapFile maps the whole of f into memory read-only, returning a function which unmaps it.
+func mapFile(f *os.File) ([]byte, func() error, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("checking chunked dataset file: %w", err) // contains filename
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, fmt.Errorf("mapping %q: %w", f.Name(), err)
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
+
+// Lock takes an exclusive lock for writing filename (on filename+".lock"), waiting for any other
+// process which holds it, so that processes sharing a file build it once: the others wait,
+// and then use the file which was built. The returned function releases the lock.
+func Lock(filename string) (unlock func() error, err error) {
+	f, err := os.OpenFile(filename+".lock", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock: %w", err) // contains filename
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %q: %w", f.Name(), err)
+	}
+	return f.Close, nil // which releases the lock
+}
@@ -0,0 +1,38 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package chunked_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/chunked"
+)
+
+func TestLock(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "place.chunks")
+	unlock, err := chunked.Lock(file)
+	if err != nil {
+		t.Fatalf("Lock: %s", err)
+	}
+	locked := make(chan error)
+	go func() {
+		unlock, err := chunked.Lock(file)
+		if err == nil {
+			err = unlock()
+		}
+		locked <- err
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("Lock succeeded while the file was locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := unlock(); err != nil {
+		t.Fatalf("unlock: %s", err)
+	}
+	if err := <-locked; err != nil {
+		t.Errorf("Lock after unlocking: %s", err)
+	}
+}
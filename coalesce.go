@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+// coalescer serves simultaneous identical requests to expensive handlers (tiles, stats, queries) with
+// a single call to the handler, whose response is shared, so that a burst of traffic does the work once.
+//
+// Shared responses are held in memory, so it is only for handlers of small, bounded responses;
+// large render artifacts are shared by the caches they are served from instead.
+// The handler's call is canceled once every request waiting for it has gone away.
+type coalescer struct {
+	calls gsync.Group[string, *recordedResponse]
+}
+
+// maxCoalescedBody limits the size of a shared response. Requests for larger ones are served separately.
+const maxCoalescedBody = 4 << 20
+
+// errTooLarge is returned by the writes to a recordedResponse of more than maxCoalescedBody.
+var errTooLarge = errors.New("response too large to coalesce")
+
+// coalescedHeaders are the request headers which can change the response, besides the URL.
+var coalescedHeaders = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "Sec-CH-DPR", "DPR"}
+
+// wrap coalesces the GET and HEAD requests to h.
+func (c *coalescer) wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			h(w, r)
+			return
+		}
+		key := []string{r.Method, r.URL.String()}
+		for _, name := range coalescedHeaders {
+			key = append(key, r.Header.Get(name))
+		}
+
+		resp, err := c.calls.Do(r.Context(), strings.Join(key, "\n"), func(ctx context.Context) (*recordedResponse, error) {
+			rec := &recordedResponse{header: make(http.Header), status: http.StatusOK}
+			h(rec, r.WithContext(ctx))
+			return rec, nil
+		})
+		if err != nil {
+			glog.V(2).Infof("Gave up waiting for %q: %s", r.URL, err)
+			return // the client went away
+		}
+		if resp.tooLarge {
+			glog.Warningf("Response to %q is over %d bytes, serving it without coalescing", r.URL, maxCoalescedBody)
+			h(w, r)
+			return
+		}
+		for k, v := range resp.header {
+			w.Header()[k] = append([]string(nil), v...)
+		}
+		w.WriteHeader(resp.status)
+		w.Write(resp.body.Bytes())
+	}
+}
+
+// recordedResponse is an http.ResponseWriter which records the response, to be written to each coalesced request.
+type recordedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	tooLarge    bool // the body was cut off at maxCoalescedBody
+}
+
+func (r *recordedResponse) Header() http.Header { return r.header }
+
+func (r *recordedResponse) WriteHeader(status int) {
+	if r.wroteHeader {
+		return
+	}
+	r.status, r.wroteHeader = status, true
+}
+
+func (r *recordedResponse) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	if r.tooLarge || r.body.Len()+len(p) > maxCoalescedBody {
+		r.tooLarge = true
+		return 0, errTooLarge
+	}
+	return r.body.Write(p)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kylelemons/rplacemap/atlas"
+	"github.com/kylelemons/rplacemap/chunked"
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+// contextRegionSize is the width and height of the (aligned) region summarized by /api/context.
+const contextRegionSize = 16
+
+// pixelContext is served by /api/context: everything about a pixel that the sidebar shows.
+type pixelContext struct {
+	X       int            `json:"x"`
+	Y       int            `json:"y"`
+	Color   paletteEntry   `json:"color"` // final color
+	History []pixelEvent   `json:"history"`
+	Region  regionSummary  `json:"region"`
+	Atlas   []*atlas.Entry `json:"atlas,omitempty"` // most specific first
+}
+
+type pixelEvent struct {
+	Time     time.Time `json:"ts"`
+	UserHash string    `json:"user_hash"`
+	Color    uint8     `json:"color"`
+}
+
+type regionSummary struct {
+	X0          int        `json:"x0"`
+	Y0          int        `json:"y0"`
+	X1          int        `json:"x1"` // exclusive
+	Y1          int        `json:"y1"`
+	Placements  int64      `json:"placements"`
+	Users       int        `json:"users"`
+	Colors      []int64    `json:"colors"`       // placements by color
+	FinalColors []int64    `json:"final_colors"` // pixels by final color
+	First       *time.Time `json:"first,omitempty"`
+	Last        *time.Time `json:"last,omitempty"`
+}
+
+// pixelContexts looks up the pixelContext of pixels for /api/context and /ws/session,
+// in the records stored by chunk (see loadChunks).
+type pixelContexts struct {
+	chunks *gsync.Future[*chunked.Dataset]
+	atlas  *atlas.Atlas // may be nil
+}
+
+func newPixelContexts(chunks *gsync.Future[*chunked.Dataset], atl *atlas.Atlas) *pixelContexts {
+	return &pixelContexts{
+		chunks: chunks,
+		atlas:  atl,
+	}
+}
+
+// checkPixel returns an error unless (x, y) is in the canvas.
+func checkPixel(x, y int) error {
+	if !image.Pt(x, y).In(timelapse.Bounds()) {
+		return fmt.Errorf("(%d,%d) is outside the canvas", x, y)
+	}
+	return nil
+}
+
+// lookup returns the context of the pixel at (x, y), which must be in the canvas (see checkPixel),
+// with its times in loc. It only fails if the chunks aren't ready, or can't be loaded.
+func (p *pixelContexts) lookup(ctx context.Context, x, y int, loc *time.Location) (*pixelContext, error) {
+	chunks, err := p.chunks.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := chunks.At(x, y)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pixelContext{X: x, Y: y, History: []pixelEvent{}}
+	var final uint8 // white, if nothing was placed
+	for _, ev := range events {
+		rec := chunks.Record(x, y, ev)
+		resp.History = append(resp.History, pixelEvent{
+			Time:     rec.Time().In(loc),
+			UserHash: base64.StdEncoding.EncodeToString(rec.UserHash[:]),
+			Color:    rec.Color,
+		})
+		final = rec.Color
+	}
+	resp.Color = paletteEntry{int(final), dataset.ColorHex(final), dataset.ColorName(final)}
+	if p.atlas != nil {
+		resp.Atlas = p.atlas.At(image.Pt(x, y))
+	}
+	resp.Region, err = summarizeRegion(chunks, x/contextRegionSize*contextRegionSize, y/contextRegionSize*contextRegionSize, loc)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// contextHandler serves /api/context?x=&y=.
+func contextHandler(contexts *pixelContexts) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		x, errX := strconv.Atoi(r.FormValue("x"))
+		y, errY := strconv.Atoi(r.FormValue("y"))
+		if errX != nil || errY != nil {
+			http.Error(w, "x and y are required", http.StatusBadRequest)
+			return
+		}
+		if err := checkPixel(x, y); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		loc, err := requestLocation(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp, err := contexts.lookup(r.Context(), x, y, loc)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// summarizeRegion summarizes the contextRegionSize square region with its top left corner at (x0, y0).
+func summarizeRegion(chunks *chunked.Dataset, x0, y0 int, loc *time.Location) (regionSummary, error) {
+	sum := regionSummary{
+		X0:          x0,
+		Y0:          y0,
+		X1:          min(x0+contextRegionSize, timelapse.Bounds().Dx()),
+		Y1:          min(y0+contextRegionSize, timelapse.Bounds().Dy()),
+		Colors:      make([]int64, len(dataset.Palette)),
+		FinalColors: make([]int64, len(dataset.Palette)),
+	}
+	users := make(map[int]bool)
+	var first, last int64
+
+	// Only the pixels in the active parts of the chunks have events; the rest are left blank.
+	region := image.Rect(sum.X0, sum.Y0, sum.X1, sum.Y1)
+	sum.FinalColors[0] = int64(max(region.Dx(), 0) * max(region.Dy(), 0))
+	for _, info := range chunks.ChunksIn(region, 0, chunked.MaxDeltaMillis) {
+		active := info.Active.Intersect(region)
+		for y := active.Min.Y; y < active.Max.Y; y++ {
+			for x := active.Min.X; x < active.Max.X; x++ {
+				events, err := chunks.At(x, y)
+				if err != nil {
+					return regionSummary{}, err
+				}
+				var final uint8
+				for _, ev := range events {
+					if sum.Placements == 0 || ev.DeltaMillis() < first {
+						first = ev.DeltaMillis()
+					}
+					if sum.Placements == 0 || ev.DeltaMillis() > last {
+						last = ev.DeltaMillis()
+					}
+					sum.Placements++
+					users[ev.UserIndex()] = true
+					sum.Colors[ev.Color()]++
+					final = ev.Color()
+				}
+				sum.FinalColors[0]--
+				sum.FinalColors[final]++
+			}
+		}
+	}
+	sum.Users = len(users)
+	if sum.Placements > 0 {
+		f, l := time.UnixMilli(chunks.Start+first).In(loc), time.UnixMilli(chunks.Start+last).In(loc)
+		sum.First, sum.Last = &f, &l
+	}
+	return sum, nil
+}
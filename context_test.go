@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset/datasettest"
+)
+
+func TestSummarizeRegion(t *testing.T) {
+	chunks, err := newChunks(datasettest.Build(t, datasettest.Tiny()).Records)
+	if err != nil {
+		t.Fatalf("newChunks: %s", err)
+	}
+
+	sum, err := summarizeRegion(chunks, 0, 0, time.UTC)
+	if err != nil {
+		t.Fatalf("summarizeRegion(0,0): %s", err)
+	}
+	if sum.Placements != 4 || sum.Users != 3 {
+		t.Errorf("summarizeRegion(0,0) has %d placements by %d users, want 4 by 3", sum.Placements, sum.Users)
+	}
+	if got, want := sum.Colors[:4], []int64{0, 1, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("summarizeRegion(0,0) colors = %v, want %v", got, want)
+	}
+	// The rest of the 16x16 region is blank.
+	if got, want := sum.FinalColors[:4], []int64{253, 0, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("summarizeRegion(0,0) final colors = %v, want %v", got, want)
+	}
+	if sum.First == nil || !sum.First.Equal(datasettest.TinyStart) || !sum.Last.Equal(datasettest.TinyStart.Add(150*time.Second)) {
+		t.Errorf("summarizeRegion(0,0) from %v to %v, want from %v for 150s", sum.First, sum.Last, datasettest.TinyStart)
+	}
+
+	sum, err = summarizeRegion(chunks, 16, 0, time.UTC)
+	if err != nil {
+		t.Fatalf("summarizeRegion(16,0): %s", err)
+	}
+	if sum.Placements != 0 || sum.FinalColors[0] != 256 || sum.First != nil {
+		t.Errorf("summarizeRegion(16,0) = %+v, want 256 blank pixels", sum)
+	}
+}
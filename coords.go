@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+
+	"github.com/kylelemons/rplacemap/tiles"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+// coordsResponse is served by /api/coords, describing a point in each coordinate system.
+type coordsResponse struct {
+	X        int  `json:"x"` // canvas pixel
+	Y        int  `json:"y"`
+	InCanvas bool `json:"in_canvas"`
+
+	Lat float64 `json:"lat"` // map coordinates of the center of the pixel
+	Lng float64 `json:"lng"`
+
+	Tile struct {
+		X    int `json:"x"`
+		Y    int `json:"y"`
+		Z    int `json:"z"`
+		Size int `json:"size"`
+		PX   int `json:"px"` // position within the tile
+		PY   int `json:"py"`
+	} `json:"tile"`
+}
+
+// handleCoords converts map coordinates (lat and lng) or canvas pixel coordinates (x and y)
+// to all of the coordinate systems, including the tile at the given zoom (and size).
+func handleCoords(w http.ResponseWriter, r *http.Request) {
+	params := map[string]float64{"zoom": 0, "size": tiles.DefaultTileSize}
+	for _, name := range []string{"lat", "lng", "x", "y", "zoom", "size"} {
+		if s := r.FormValue(name); s != "" {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s: %s", name, err), http.StatusBadRequest)
+				return
+			}
+			params[name] = v
+		}
+	}
+	zoom, size := int(params["zoom"]), int(params["size"])
+	if zoom < 0 || zoom > tiles.MaxZoom || size <= 0 {
+		http.Error(w, fmt.Sprintf("zoom must be between 0 and %d, and size must be positive", tiles.MaxZoom), http.StatusBadRequest)
+		return
+	}
+
+	var pixel image.Point
+	_, hasLat := params["lat"]
+	_, hasLng := params["lng"]
+	_, hasX := params["x"]
+	_, hasY := params["y"]
+	switch {
+	case hasLat && hasLng:
+		pixel = tiles.LatLngToPixel(params["lat"], params["lng"])
+	case hasX && hasY:
+		pixel = image.Pt(int(params["x"]), int(params["y"]))
+	default:
+		http.Error(w, "either lat and lng, or x and y, are required", http.StatusBadRequest)
+		return
+	}
+	if !pixel.In(image.Rect(0, 0, tiles.WorldSize(), tiles.WorldSize())) {
+		http.Error(w, fmt.Sprintf("%v is outside the map", pixel), http.StatusBadRequest)
+		return
+	}
+
+	resp := coordsResponse{
+		X:        pixel.X,
+		Y:        pixel.Y,
+		InCanvas: pixel.In(timelapse.Bounds()),
+	}
+	resp.Lat, resp.Lng = tiles.PixelToLatLng(pixel)
+	tile, offset := tiles.PixelToTile(pixel, zoom, size)
+	resp.Tile.X, resp.Tile.Y, resp.Tile.Z, resp.Tile.Size = tile.X, tile.Y, zoom, size
+	resp.Tile.PX, resp.Tile.PY = offset.X, offset.Y
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
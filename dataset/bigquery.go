@@ -0,0 +1,310 @@
+package dataset
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// BigQueryScheme is the scheme of source URLs which name a BigQuery table of pixel events,
+// as bq://project/dataset.table, whose rows are streamed with a query instead of downloading a CSV.
+//
+// The columns are ts, user_hash, x_coordinate, y_coordinate, and color (as in the CSV header),
+// unless others are named by the URL's columns parameter, e.g. ?columns=timestamp,user,x,y,color.
+// Timestamps may be TIMESTAMPs, INTEGER milliseconds since the Unix epoch, or STRINGs in TimestampLayout.
+//
+// The rows are read as the CSV of the 2017 dataset (see RequiredHeader), so they can be parsed by Source2017.
+// The query is billed to ObjectStore.BigQueryProject, or the table's project if it is unset,
+// and is authenticated with ObjectStore.GCSToken.
+const BigQueryScheme = "bq"
+
+// bigQueryAPI is the base URL of the BigQuery REST API.
+const bigQueryAPI = "https://bigquery.googleapis.com/bigquery/v2"
+
+const (
+	bigQueryPageSize = 50000                                          // rows per page of results
+	bigQueryWait     = 10 * time.Second                               // how long each request waits for the query to complete
+	bigQueryColumns  = "ts,user_hash,x_coordinate,y_coordinate,color" // default, as in RequiredHeader
+)
+
+var (
+	bigQueryProject    = regexp.MustCompile(`^[a-z][a-z0-9.:-]*[a-z0-9]$`)
+	bigQueryIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// A bigQueryTable is the table (and its columns) named by a bq:// URL.
+type bigQueryTable struct {
+	project, dataset, table string
+	columns                 []string // ts, user, x, y, color
+}
+
+func parseBigQueryURL(u *url.URL) (*bigQueryTable, error) {
+	dataset, table, ok := strings.Cut(strings.TrimPrefix(u.Path, "/"), ".")
+	t := &bigQueryTable{
+		project: u.Host,
+		dataset: dataset,
+		table:   table,
+		columns: strings.Split(bigQueryColumns, ","),
+	}
+	if cols := u.Query().Get("columns"); cols != "" {
+		t.columns = strings.Split(cols, ",")
+	}
+	if !ok || !bigQueryProject.MatchString(t.project) || !bigQueryIdentifier.MatchString(t.dataset) || !bigQueryIdentifier.MatchString(t.table) {
+		return nil, fmt.Errorf("BigQuery URL %q is not of the form bq://project/dataset.table", u)
+	}
+	if len(t.columns) != csvColumns {
+		return nil, fmt.Errorf("BigQuery URL %q: %d columns, want %d", u, len(t.columns), csvColumns)
+	}
+	for _, col := range t.columns {
+		if !bigQueryIdentifier.MatchString(col) {
+			return nil, fmt.Errorf("BigQuery URL %q: invalid column name %q", u, col)
+		}
+	}
+	return t, nil
+}
+
+func (t *bigQueryTable) query() string {
+	return fmt.Sprintf("SELECT %s FROM `%s.%s.%s`", strings.Join(t.columns, ", "), t.project, t.dataset, t.table)
+}
+
+// billingProject returns the project in which the queries of t are run.
+func (t *bigQueryTable) billingProject() string {
+	if ObjectStore.BigQueryProject != "" {
+		return ObjectStore.BigQueryProject
+	}
+	return t.project
+}
+
+// bigQueryRequest is the body of a jobs.query request.
+type bigQueryRequest struct {
+	Query        string `json:"query"`
+	UseLegacySQL bool   `json:"useLegacySql"`
+	DryRun       bool   `json:"dryRun,omitempty"`
+	MaxResults   int    `json:"maxResults,omitempty"`
+	TimeoutMs    int64  `json:"timeoutMs,omitempty"`
+}
+
+// bigQueryResponse holds the parts of a jobs.query or jobs.getQueryResults response which are used.
+type bigQueryResponse struct {
+	JobComplete  bool `json:"jobComplete"`
+	JobReference struct {
+		ProjectID string `json:"projectId"`
+		JobID     string `json:"jobId"`
+		Location  string `json:"location"`
+	} `json:"jobReference"`
+	Schema struct {
+		Fields []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		} `json:"fields"`
+	} `json:"schema"`
+	Rows []struct {
+		F []struct {
+			V *string `json:"v"` // nil if NULL
+		} `json:"f"`
+	} `json:"rows"`
+	PageToken           string `json:"pageToken"`
+	TotalRows           string `json:"totalRows"`
+	TotalBytesProcessed string `json:"totalBytesProcessed"`
+}
+
+// call sends a request to the BigQuery API, decoding its response into resp.
+func (t *bigQueryTable) call(ctx context.Context, method, path string, body any, resp *bigQueryResponse) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, bigQueryAPI+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if ObjectStore.GCSToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ObjectStore.GCSToken)
+	}
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return transientError{err}
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		err := fmt.Errorf("BigQuery returned %q", r.Status)
+		if json.NewDecoder(r.Body).Decode(&apiErr) == nil && apiErr.Error.Message != "" {
+			err = fmt.Errorf("BigQuery returned %q: %s", r.Status, apiErr.Error.Message)
+		}
+		if transientStatus(r.StatusCode) {
+			return transientError{err}
+		}
+		return err
+	}
+	if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+		return transientError{err} // usually a truncated response
+	}
+	return nil
+}
+
+// start runs the query of t (or only checks it, if dryRun), returning its first results.
+func (t *bigQueryTable) start(ctx context.Context, dryRun bool) (*bigQueryResponse, error) {
+	resp := new(bigQueryResponse)
+	err := t.call(ctx, http.MethodPost, "/projects/"+url.PathEscape(t.billingProject())+"/queries", bigQueryRequest{
+		Query:      t.query(),
+		DryRun:     dryRun,
+		MaxResults: bigQueryPageSize,
+		TimeoutMs:  bigQueryWait.Milliseconds(),
+	}, resp)
+	return resp, err
+}
+
+// next returns the next results of the query after prev (which are the same ones, if it isn't yet complete).
+func (t *bigQueryTable) next(ctx context.Context, prev *bigQueryResponse) (*bigQueryResponse, error) {
+	job := prev.JobReference
+	params := url.Values{
+		"location":   {job.Location},
+		"maxResults": {strconv.Itoa(bigQueryPageSize)},
+		"timeoutMs":  {strconv.FormatInt(bigQueryWait.Milliseconds(), 10)},
+	}
+	if prev.JobComplete {
+		params.Set("pageToken", prev.PageToken)
+	}
+	resp := new(bigQueryResponse)
+	path := "/projects/" + url.PathEscape(job.ProjectID) + "/queries/" + url.PathEscape(job.JobID) + "?" + params.Encode()
+	return resp, t.call(ctx, http.MethodGet, path, nil, resp)
+}
+
+// fetchBigQuery starts the query of the table named by u, returning its rows as the CSV of the 2017 dataset.
+// The size of the CSV isn't known in advance, so it is returned as 0.
+func fetchBigQuery(ctx context.Context, u *url.URL) (io.ReadCloser, int64, error) {
+	t, err := parseBigQueryURL(u)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := t.start(ctx, false)
+	if err != nil {
+		return nil, 0, fmt.Errorf("querying %q: %w", u, err)
+	}
+	glog.Infof("Started BigQuery job %s for %q", resp.JobReference.JobID, u)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(t.stream(ctx, resp, pw))
+	}()
+	return pr, 0, nil
+}
+
+// stream writes the rows of the query, starting with resp, to w.
+func (t *bigQueryTable) stream(ctx context.Context, resp *bigQueryResponse, w io.Writer) error {
+	out := csv.NewWriter(w)
+	if _, err := io.WriteString(w, RequiredHeader+"\n"); err != nil {
+		return err
+	}
+	var rows int64
+	for {
+		if !resp.JobComplete {
+			var err error
+			if resp, err = t.next(ctx, resp); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(resp.Schema.Fields) != csvColumns {
+			return fmt.Errorf("BigQuery returned %d columns, want %d", len(resp.Schema.Fields), csvColumns)
+		}
+		for _, row := range resp.Rows {
+			rows++
+			record := make([]string, csvColumns)
+			for i, f := range row.F {
+				if f.V == nil {
+					continue
+				}
+				record[i] = *f.V
+			}
+			ts, err := bigQueryTimestamp(resp.Schema.Fields[0].Type, record[0])
+			if err != nil {
+				return fmt.Errorf("row %d: %w", rows, err)
+			}
+			record[0] = ts
+			if err := out.Write(record); err != nil {
+				return err
+			}
+		}
+		if out.Flush(); out.Error() != nil {
+			return out.Error()
+		}
+		if resp.PageToken == "" {
+			glog.V(2).Infof("Read %d of %s rows from BigQuery", rows, resp.TotalRows)
+			return nil
+		}
+		var err error
+		if resp, err = t.next(ctx, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// bigQueryTimestamp returns the timestamp v, of the given BigQuery type, in TimestampLayout.
+func bigQueryTimestamp(typ, v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	switch typ {
+	case "TIMESTAMP": // seconds since the epoch, e.g. "1.491004852123E9"
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return "", fmt.Errorf("timestamp %q invalid: %s", v, err)
+		}
+		return time.UnixMilli(int64(math.Round(secs * 1000))).UTC().Format(TimestampLayout), nil
+	case "INTEGER", "INT64":
+		millis, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("timestamp %q invalid: %s", v, err)
+		}
+		return time.UnixMilli(millis).UTC().Format(TimestampLayout), nil
+	case "STRING":
+		return v, nil
+	}
+	return "", fmt.Errorf("timestamp column has type %s, want TIMESTAMP, INTEGER, or STRING", typ)
+}
+
+// probeBigQuery checks the query of the table named by u with a dry run.
+func probeBigQuery(ctx context.Context, probe SourceProbe, u *url.URL) SourceProbe {
+	t, err := parseBigQueryURL(u)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	ctx, cancel := context.WithTimeout(ctx, ProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	resp, err := t.start(ctx, true)
+	probe.LatencyMillis = time.Since(start).Milliseconds()
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	probe.OK = true
+	probe.Status = fmt.Sprintf("dry run would process %s bytes", resp.TotalBytesProcessed)
+	return probe
+}
@@ -0,0 +1,141 @@
+package dataset
+
+import (
+	"crypto/md5"
+	"fmt"
+	"image"
+	"image/color"
+	"time"
+
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+// defaultCanvasSize is the width and height of the 2017 canvas.
+const defaultCanvasSize = 1000
+
+// A Dataset is a set of records held in memory, such as one made by a Builder.
+type Dataset struct {
+	Records []Record      // sorted by time
+	Size    int           // width of the canvas, and its height unless Height is set
+	Height  int           // of a canvas which isn't square
+	Palette color.Palette // of the canvas, indexed by Record.Color
+	Counts  Counts
+}
+
+// Bounds returns the bounds of the canvas.
+func (d *Dataset) Bounds() image.Rectangle {
+	if d.Height > 0 {
+		return image.Rect(0, 0, d.Size, d.Height)
+	}
+	return image.Rect(0, 0, d.Size, d.Size)
+}
+
+// size describes the size of the canvas, e.g. in errors about pixels outside it.
+func (d *Dataset) size() string {
+	if b := d.Bounds(); b.Dx() != b.Dy() {
+		return fmt.Sprintf("%dx%d", b.Dx(), b.Dy())
+	}
+	return fmt.Sprintf("%dpx", d.Size)
+}
+
+// Future returns the records as an already-provided future, as the server's handlers expect.
+func (d *Dataset) Future() *gsync.Future[[]Record] {
+	f := gsync.NewFuture[[]Record]()
+	f.Provide(d.Records)
+	return f
+}
+
+// A Builder constructs a small Dataset event by event, e.g. as a deterministic fixture
+// for exercising handlers and renderers without the real dataset.
+// The zero value is ready to use, with the canvas size and palette of the 2017 dataset
+// (or of the source in use, see Source.Use).
+type Builder struct {
+	size    int
+	height  int // if it isn't size
+	palette color.Palette
+	records []Record
+	err     error
+}
+
+// SetCanvasSize sets the width and height of the canvas.
+func (b *Builder) SetCanvasSize(size int) {
+	if size <= 0 || size > 1<<15 {
+		b.fail(fmt.Errorf("canvas size %d out of range", size))
+		return
+	}
+	b.size, b.height = size, 0
+}
+
+// SetCanvasBounds sets the width and height of a canvas which isn't square.
+func (b *Builder) SetCanvasBounds(width, height int) {
+	if width <= 0 || width > 1<<15 || height <= 0 || height > 1<<15 {
+		b.fail(fmt.Errorf("canvas size %dx%d out of range", width, height))
+		return
+	}
+	b.size, b.height = width, height
+}
+
+// SetPalette sets the palette of the canvas, which has at most 256 colors.
+func (b *Builder) SetPalette(palette color.Palette) {
+	if len(palette) == 0 || len(palette) > 256 {
+		b.fail(fmt.Errorf("%d colors in the palette, want 1 to 256", len(palette)))
+		return
+	}
+	b.palette = append(color.Palette(nil), palette...)
+}
+
+// AddEvent adds the placement of a pixel by a user, who is identified by any name
+// (which is hashed, so the same name is always the same user).
+// Events can be added in any order.
+func (b *Builder) AddEvent(t time.Time, user string, x, y int, color uint8) {
+	if int(int16(x)) != x || int(int16(y)) != y {
+		b.fail(fmt.Errorf("event %d: pixel (%d,%d) is outside any canvas", len(b.records)+1, x, y))
+		return
+	}
+	b.records = append(b.records, Record{
+		UnixMillis: t.UnixMilli(),
+		UserHash:   md5.Sum([]byte(user)),
+		X:          int16(x),
+		Y:          int16(y),
+		Color:      color,
+	})
+}
+
+func (b *Builder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Build returns the dataset of the events added so far, or the first problem with them
+// (such as a pixel outside the canvas, or a color not in its palette).
+func (b *Builder) Build() (*Dataset, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	d := &Dataset{
+		Records: append([]Record(nil), b.records...),
+		Size:    b.size,
+		Height:  b.height,
+		Palette: b.palette,
+	}
+	if d.Size == 0 {
+		d.Size = defaultCanvasSize
+	}
+	if d.Palette == nil {
+		d.Palette = append(color.Palette(nil), Palette...)
+	}
+	var counts counter
+	for i, rec := range d.Records {
+		if !image.Pt(int(rec.X), int(rec.Y)).In(d.Bounds()) {
+			return nil, fmt.Errorf("event %d: pixel (%d,%d) is outside the %s canvas", i+1, rec.X, rec.Y, d.size())
+		}
+		if int(rec.Color) >= len(d.Palette) {
+			return nil, fmt.Errorf("event %d: color %d is not in the %d-color palette", i+1, rec.Color, len(d.Palette))
+		}
+		counts.add(rec)
+	}
+	sortByTime(d.Records)
+	d.Counts = counts.Counts
+	return d, nil
+}
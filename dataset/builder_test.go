@@ -0,0 +1,135 @@
+package dataset_test
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/dataset/datasettest"
+)
+
+var t0 = datasettest.TinyStart
+
+func TestBuilder(t *testing.T) {
+	ds := datasettest.Build(t, datasettest.Tiny())
+	if got, want := ds.Bounds(), image.Rect(0, 0, 8, 8); got != want {
+		t.Errorf("Bounds = %v, want %v", got, want)
+	}
+	var times []time.Time
+	for _, rec := range ds.Records {
+		times = append(times, rec.Time())
+	}
+	want := []time.Time{t0, t0.Add(30 * time.Second), t0.Add(time.Minute), t0.Add(150 * time.Second)}
+	if !reflect.DeepEqual(times, want) {
+		t.Errorf("record times = %v, want %v", times, want)
+	}
+	if ds.Records[0].UserHash != ds.Records[2].UserHash || ds.Records[0].UserHash == ds.Records[1].UserHash {
+		t.Errorf("user hashes %x, %x, %x don't identify alice, bob, alice",
+			ds.Records[0].UserHash, ds.Records[1].UserHash, ds.Records[2].UserHash)
+	}
+
+	c := ds.Counts
+	last := t0.Add(150 * time.Second).UnixMilli()
+	if c.Records != 4 || c.Users != 3 || c.First != t0.UnixMilli() || c.Last != last {
+		t.Errorf("Counts = %+v, want 4 records by 3 users from %d to %d", c, t0.UnixMilli(), last)
+	}
+	if want := []int64{0, 1, 2, 1}; !reflect.DeepEqual(c.Colors, want) {
+		t.Errorf("Counts.Colors = %v, want %v", c.Colors, want)
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(*dataset.Builder)
+		want  string
+	}{
+		{"color", func(b *dataset.Builder) { b.AddEvent(t0, "alice", 0, 0, 16) }, "not in the 16-color palette"},
+		{"outside", func(b *dataset.Builder) { b.SetCanvasSize(4); b.AddEvent(t0, "alice", 4, 0, 0) }, "outside the 4px canvas"},
+		{"negative", func(b *dataset.Builder) { b.AddEvent(t0, "alice", -1, 0, 0) }, "outside the 1000px canvas"},
+		{"size", func(b *dataset.Builder) { b.SetCanvasSize(0) }, "canvas size 0 out of range"},
+		{"palette", func(b *dataset.Builder) {
+			b.AddEvent(t0, "alice", 0, 0, 1)
+			b.SetPalette(color.Palette{color.White})
+		}, "color 1 is not in the 1-color palette"},
+		{"empty palette", func(b *dataset.Builder) { b.SetPalette(nil) }, "0 colors in the palette"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var b dataset.Builder
+			test.build(&b)
+			if _, err := b.Build(); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Build error = %v, want one containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestBuilderRoundTrip(t *testing.T) {
+	ds := datasettest.Build(t, datasettest.Tiny())
+	for _, suffix := range dataset.FileSuffixes {
+		t.Run(suffix, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "tiny"+suffix)
+			if err := datasettest.WriteFile(file, ds.Records); err != nil {
+				t.Fatalf("WriteFile: %s", err)
+			}
+			got, err := dataset.Load(context.Background(), file)
+			if err != nil {
+				t.Fatalf("Load: %s", err)
+			}
+			if !reflect.DeepEqual(got, ds.Records) {
+				t.Errorf("Load = %+v, want %+v", got, ds.Records)
+			}
+
+			info, err := dataset.ReadFileInfo(file)
+			if err != nil {
+				t.Fatalf("ReadFileInfo: %s", err)
+			}
+			if info.Counts == nil || !reflect.DeepEqual(*info.Counts, ds.Counts) {
+				t.Errorf("ReadFileInfo Counts = %+v, want %+v", info.Counts, ds.Counts)
+			}
+		})
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ds := datasettest.Build(t, datasettest.Tiny())
+	tests := []struct {
+		at   time.Time
+		want map[image.Point]uint8 // the pixels which aren't 0
+	}{
+		{t0.Add(-time.Second), map[image.Point]uint8{}},
+		{t0, map[image.Point]uint8{{1, 1}: 1}},
+		{t0.Add(45 * time.Second), map[image.Point]uint8{{1, 1}: 1, {6, 2}: 2}},
+		{t0.Add(time.Hour), map[image.Point]uint8{{1, 1}: 3, {6, 2}: 2, {3, 7}: 2}},
+	}
+	for _, test := range tests {
+		img := dataset.Snapshot(ds.Records, test.at.UnixMilli(), ds.Bounds())
+		got := make(map[image.Point]uint8)
+		for y := 0; y < ds.Size; y++ {
+			for x := 0; x < ds.Size; x++ {
+				if c := img.ColorIndexAt(x, y); c != 0 {
+					got[image.Pt(x, y)] = c
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Snapshot at %s = %v, want %v", test.at.Format(time.TimeOnly), got, test.want)
+		}
+	}
+
+	// Only the pixels within the bounds are drawn.
+	img := dataset.Snapshot(ds.Records, t0.Add(time.Hour).UnixMilli(), image.Rect(2, 1, 8, 8))
+	if got := img.ColorIndexAt(1, 1); got != 0 {
+		t.Errorf("Snapshot outside its bounds at (1,1) = %d, want 0", got)
+	}
+	if got := img.ColorIndexAt(6, 2); got != 2 {
+		t.Errorf("Snapshot within its bounds at (6,2) = %d, want 2", got)
+	}
+}
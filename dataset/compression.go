@@ -0,0 +1,70 @@
+package dataset
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// File suffixes for the supported compression formats.
+//
+// New files should use ZstdFileSuffix, which is much faster to write and read
+// than gzip at a similar ratio; GzipFileSuffix is still supported for existing caches.
+const (
+	ZstdFileSuffix = ".gob.zst"
+	GzipFileSuffix = ".gob.gz"
+)
+
+// FileSuffixes lists the suffixes of supported dataset files, in order of preference.
+var FileSuffixes = []string{ZstdFileSuffix, GzipFileSuffix}
+
+// fileComment is recorded in the file header, where the format supports it.
+const fileComment = "r/place 2017 dataset"
+
+func checkSuffix(filename string) error {
+	for _, suffix := range FileSuffixes {
+		if strings.HasSuffix(filename, suffix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("file %q does not have one of the required suffixes %q", filename, FileSuffixes)
+}
+
+// Compression returns a human-readable name for the compression used by filename.
+func Compression(filename string) string {
+	if strings.HasSuffix(filename, GzipFileSuffix) {
+		return "gzip"
+	}
+	return "zstd"
+}
+
+// compress returns a writer that compresses into w, in the format indicated by the filename.
+// Both formats compress blocks in parallel on all cores.
+func compress(filename string, w io.Writer) (io.WriteCloser, error) {
+	if strings.HasSuffix(filename, GzipFileSuffix) {
+		gz, err := pgzip.NewWriterLevel(w, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		gz.Comment = fileComment
+		return gz, nil
+	}
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+}
+
+// decompress returns a reader that decompresses r, in the format indicated by the filename.
+// Both formats decompress ahead of the reader in the background.
+func decompress(filename string, r io.Reader) (io.ReadCloser, error) {
+	if strings.HasSuffix(filename, GzipFileSuffix) {
+		return pgzip.NewReader(r)
+	}
+	dec, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
@@ -0,0 +1,74 @@
+package dataset
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// MaxMissingShards is how many shards DownloadShards may fail to download (after retrying them, see DownloadRetry)
+// and still complete with the rest of them, recording the ones it's missing in the file's Coverage.
+var MaxMissingShards = 0
+
+// Coverage records which shards of a sharded dataset are in its file.
+// The file of a dataset which isn't sharded, or which has all of its shards, has no Coverage (see ReadCoverage).
+type Coverage struct {
+	Shards  int            `json:"shards"`
+	Missing []MissingShard `json:"missing,omitempty"`
+}
+
+// Complete reports whether none of the shards are missing.
+func (c Coverage) Complete() bool {
+	return len(c.Missing) == 0
+}
+
+// A MissingShard is a shard which couldn't be downloaded.
+type MissingShard struct {
+	Index int    `json:"index"` // in the source's Shards, from 0
+	URL   string `json:"url"`
+	Error string `json:"error,omitempty"`
+
+	// The shards are published in order of time, so the events a shard would have added are
+	// after the last event of the shard before it and before the first of the shard after it,
+	// of those which were downloaded (nil if there are none).
+	After  *time.Time `json:"after,omitempty"`
+	Before *time.Time `json:"before,omitempty"`
+}
+
+// CoverageFile returns the name of the file in which the Coverage of datasetFile is kept.
+func CoverageFile(datasetFile string) string {
+	return datasetFile + ".coverage.json"
+}
+
+// ReadCoverage returns the Coverage of datasetFile, which is complete if none was written.
+func ReadCoverage(datasetFile string) (Coverage, error) {
+	data, err := os.ReadFile(CoverageFile(datasetFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return Coverage{}, nil
+	} else if err != nil {
+		return Coverage{}, err
+	}
+	var c Coverage
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Coverage{}, fmt.Errorf("%s: %w", CoverageFile(datasetFile), err)
+	}
+	return c, nil
+}
+
+// writeCoverage records the Coverage of datasetFile, or removes that of an earlier download if it's complete.
+func writeCoverage(datasetFile string, c Coverage) error {
+	file := CoverageFile(datasetFile)
+	if c.Complete() {
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
@@ -1,224 +1,451 @@
+// Package dataset downloads, stores, and reads the r/place pixel events.
+//
+// Records can be downloaded from the original CSV with Download (or read from a CSV with Import),
+// written with Create, read back with Load or Scan, and queried with Snapshot.
+// Small datasets (e.g. test fixtures) can be made in memory with a Builder.
 package dataset
 
 import (
 	"bufio"
 	"compress/gzip"
-	"encoding/base64"
+	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"image"
 	"image/color"
 	"io"
-	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"runtime"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
+	"unsafe"
 
 	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/progress"
 )
 
 type Record struct {
 	UnixMillis int64
 	UserHash   [16]byte // pseudonymized user identifier
 	X, Y       int16    // coordinates, can represent +/-32k
-	Color      uint8    // 16-color palette
+	Color      uint8    // index into the palette
+}
+
+// Time returns the time of the record, in UTC.
+func (r Record) Time() time.Time {
+	return time.UnixMilli(r.UnixMillis).UTC()
 }
 
 const (
-	FileSuffix     = ".gob.gz"
 	RequiredHeader = "ts,user_hash,x_coordinate,y_coordinate,color"
+
+	// TimestampLayout is the layout of the timestamps in the CSV dataset.
+	TimestampLayout = "2006-01-02 15:04:05.999 MST"
 )
 
-func Download(outputFile string, datasetURL *url.URL) ([]Record, error) {
-	if !strings.HasSuffix(outputFile, FileSuffix) {
-		return nil, fmt.Errorf("output file %q does not have required suffix %q", outputFile, FileSuffix)
+// Download downloads the CSV dataset from datasetURL, writing it to outputFile, and returns its records
+// sorted by time. Malformed rows are errors; see DownloadMode to skip them instead.
+// The bytes downloaded are reported to bar.
+func Download(ctx context.Context, outputFile string, datasetURL *url.URL, bar *progress.Bar) ([]Record, error) {
+	records, _, err := DownloadMode(ctx, outputFile, datasetURL, Strict, bar)
+	return records, err
+}
+
+// DownloadMode is like Download, but treats malformed rows according to mode,
+// and also returns a summary of the rows parsed.
+func DownloadMode(ctx context.Context, outputFile string, datasetURL *url.URL, mode ParseMode, bar *progress.Bar) ([]Record, ParseSummary, error) {
+	return download(ctx, outputFile, datasetURL, Source2017, mode, bar)
+}
+
+// download downloads the dataset with downloadOnce, retrying transient failures according to DownloadRetry.
+func download(ctx context.Context, outputFile string, datasetURL *url.URL, src *Source, mode ParseMode, bar *progress.Bar) ([]Record, ParseSummary, error) {
+	source := bar.Sub(path.Base(datasetURL.Path))
+	for attempt := 1; ; attempt++ {
+		records, summary, err := downloadOnce(ctx, outputFile, datasetURL, src, mode, bar, source)
+		if err == nil || attempt >= DownloadRetry.Attempts || !isTransient(err) || ctx.Err() != nil {
+			return records, summary, err
+		}
+		delay := DownloadRetry.delay(attempt)
+		glog.Warningf("Download attempt %d of %d failed, retrying in %s: %s",
+			attempt, DownloadRetry.Attempts, delay.Truncate(time.Millisecond), err)
+		source.Reset()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ParseSummary{}, ctx.Err()
+		}
 	}
+}
 
-	// TODO: write to tempfile and then move?
+// downloadOnce downloads (or resumes downloading) the dataset, reporting its progress to source, a Sub of bar.
+func downloadOnce(ctx context.Context, outputFile string, datasetURL *url.URL, src *Source, mode ParseMode, bar, source *progress.Bar) ([]Record, ParseSummary, error) {
+	out, err := Create(outputFile)
+	if err != nil {
+		return nil, ParseSummary{}, err
+	}
+	defer out.Abort() // don't leave a partial file behind
 
-	f, err := os.Create(outputFile)
+	start := time.Now()
+	body, total, err := fetch(ctx, outputFile, datasetURL)
 	if err != nil {
-		return nil, fmt.Errorf("creating output file: %w", err) // contains filename
+		return nil, ParseSummary{}, err
+	}
+	defer body.Close()
+	glog.Infof("Starting download of %q", datasetURL)
+
+	// Progress updates:
+	//   Print a progress update periodically.
+	//   We should be loading a static file, so content length should be provided (except for query results).
+	//   The aggregate progress is displayed normally; per-source progress is logged at V(2).
+	source.SetTotal(total)
+	stopProgress := bar.Display()
+	defer stopProgress()
+	stopSourceProgress := source.LogEveryV(2, progress.LogInterval)
+	defer stopSourceProgress()
+
+	// The progress of a compressed body is that of the compressed bytes, whose total is known.
+	var r io.Reader = body
+	parsed := source
+	if isGzipped(datasetURL) {
+		gz, err := gzip.NewReader(&countingReader{body, source})
+		if err != nil {
+			return nil, ParseSummary{}, fmt.Errorf("decompressing %q: %w", datasetURL, err)
+		}
+		r, parsed = gz, progress.New(source.Label(), progress.Bytes)
 	}
-	defer f.Close() // double close OK
 
-	writeBuffer := bufio.NewWriterSize(f, 10*1024)
-	compression, err := gzip.NewWriterLevel(writeBuffer, gzip.BestCompression)
+	records, summary, err := parseCSV(ctx, r, out, src, mode, parsed)
 	if err != nil {
-		glog.Fatalf("NewWriterlevel: %s", err) // should never happen, means our level was wrong
+		return nil, ParseSummary{}, fmt.Errorf("downloading %q: %w", datasetURL, err)
+	}
+	if processed := source.Progress(); total > 0 && processed != total {
+		glog.Warningf("Processed %d/%d bytes; incomplete download?", processed, total)
 	}
-	enc := gob.NewEncoder(compression)
+	stopSourceProgress()
+	stopProgress() // everyone likes the 100% downloaded bit :)
 
-	start := time.Now()
-	resp, err := http.DefaultClient.Get(datasetURL.String())
+	if err := out.Close(); err != nil {
+		return nil, ParseSummary{}, err
+	}
+	removePartial(outputFile)
+
+	sortByTime(records)
+	glog.Infof("Downloaded dataset (%.2fMiB, took %s)",
+		float64(total)/(1<<20), time.Since(start).Truncate(time.Second))
+	glog.Infof("  Wrote to: %s", outputFile)
+	logParseSummary(summary)
+
+	return records, summary, nil
+}
+
+// Import parses a dataset in the CSV format of Download from r (e.g. an upload of a private canvas),
+// writing it to outputFile. The bytes read are reported to bar.
+// Malformed rows are errors; see ImportMode to skip them instead.
+func Import(ctx context.Context, outputFile string, r io.Reader, bar *progress.Bar) ([]Record, error) {
+	records, _, err := ImportMode(ctx, outputFile, r, Strict, bar)
+	return records, err
+}
+
+// ImportMode is like Import, but treats malformed rows according to mode,
+// and also returns a summary of the rows parsed.
+func ImportMode(ctx context.Context, outputFile string, r io.Reader, mode ParseMode, bar *progress.Bar) ([]Record, ParseSummary, error) {
+	return importCSV(ctx, outputFile, r, Source2017, mode, bar)
+}
+
+func importCSV(ctx context.Context, outputFile string, r io.Reader, src *Source, mode ParseMode, bar *progress.Bar) ([]Record, ParseSummary, error) {
+	out, err := Create(outputFile)
 	if err != nil {
-		return nil, fmt.Errorf("starting download of %q: %w", datasetURL, err)
+		return nil, ParseSummary{}, err
 	}
-	defer resp.Body.Close()
+	defer out.Abort() // don't leave a partial file behind
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GET %q returned %q", datasetURL, resp.Status)
+	records, summary, err := parseCSV(ctx, r, out, src, mode, bar)
+	if err != nil {
+		return nil, ParseSummary{}, err
 	}
-	if resp.ContentLength <= 0 {
-		return nil, fmt.Errorf("GET %q returned unknown Content-Length", datasetURL)
+	if err := out.Close(); err != nil {
+		return nil, ParseSummary{}, err
 	}
-	glog.Infof("Starting download of %q", datasetURL)
+	sortByTime(records)
+	logParseSummary(summary)
+	return records, summary, nil
+}
 
-	// Progress updates:
-	//   Print a progress update periodically.
-	//   We should be loading a static file, so content length should be provided.
-	var processed, total int64 = 0, resp.ContentLength
-	progress := time.NewTicker(3 * time.Second)
-	defer progress.Stop()
-	printProgress := func() {
-		percent := processed * 100 / total
-		glog.Infof("Progress: %3d%% [% -50s]", percent, progressBar[:percent/2])
+func logParseSummary(s ParseSummary) {
+	glog.Infof("  Parsed %d rows (skipped %d incomplete and %d malformed)", s.Rows, s.Incomplete, s.Malformed)
+	if s.FirstError != "" {
+		glog.Warningf("  First malformed row: %s", s.FirstError)
 	}
+}
 
-	readBuffer := bufio.NewReaderSize(resp.Body, 10*1024)
+// parseCSV parses the CSV dataset of the source from r, writing the records to out (in their original order)
+// and reporting the bytes read to bar. The returned records are not yet sorted.
+func parseCSV(ctx context.Context, r io.Reader, out *Writer, src *Source, mode ParseMode, bar *progress.Bar) ([]Record, ParseSummary, error) {
+	// Parsing is the bottleneck, so lines are parsed in batches on a pool of workers.
+	// The parsed batches are encoded (and collected) in their original order by a single goroutine.
+	pool := gsync.NewPool(ctx, 0)
+	type parsedBatch struct {
+		records []Record
+		summary ParseSummary
+	}
+	batches := make(chan *gsync.Future[parsedBatch], 2*runtime.GOMAXPROCS(0))
+	var records []Record
+	var summary ParseSummary
+	encoded := make(chan error, 1)
+	go func() {
+		var encodeErr error
+		for batch := range batches {
+			parsed, err := batch.Get()
+			if encodeErr != nil {
+				continue // drain
+			}
+			if err != nil {
+				encodeErr = err
+				continue
+			}
+			summary.add(parsed.summary)
+			for _, rec := range parsed.records {
+				if err := out.Write(rec); err != nil {
+					encodeErr = fmt.Errorf("record %d: encoding record: %w", len(records)+1, err)
+					break
+				}
+				records = append(records, rec)
+			}
+		}
+		encoded <- encodeErr
+	}()
+
+	readBuffer := bufio.NewReaderSize(r, 10*1024)
 	lines := bufio.NewScanner(readBuffer)
 	var lineno int
-	var records []Record
+	var headerErr error
+	batch := make([]string, 0, parseBatchSize)
+	parse := func() (ok bool) {
+		lines, first := batch, lineno-len(batch)+1
+		batch = make([]string, 0, parseBatchSize)
+
+		parsed := gsync.NewFuture[parsedBatch]()
+		batches <- parsed
+		if !pool.Go(func(context.Context) error {
+			recs, summary, err := src.parseLines(lines, first, mode)
+			if err != nil {
+				parsed.Reject(err)
+				return err
+			}
+			parsed.Provide(parsedBatch{recs, summary})
+			return nil
+		}) {
+			parsed.Cancel()
+			return false // an earlier batch failed
+		}
+		return true
+	}
 	for lines.Scan() {
 		line := lines.Text()
-		processed += int64(len(line)) + 1 // count the newline that isn't returned
+		bar.Add(int64(len(line)) + 1) // count the newline that isn't returned
 		lineno++
 
-		select {
-		case <-progress.C:
-			printProgress()
-		default:
-		}
-
 		if lineno == 1 {
-			if got, want := line, RequiredHeader; got != want {
-				return nil, fmt.Errorf("header mismatch, dataset contains %q, expecting %q", got, want)
+			if got, want := strings.TrimSuffix(line, "\r"), src.Header; want != "" && got != want {
+				headerErr = fmt.Errorf("header mismatch, dataset contains %q, expecting %q", got, want)
+				break
 			}
 			glog.V(3).Infof("Header: %q", line)
 			continue
 		}
 
-		fields := strings.Split(line, ",")
-		if got, want := len(fields), 5; got != want {
-			return nil, fmt.Errorf("line %d: columns = %v, want %v: line %q", lineno, got, want, line)
-		}
-		var (
-			tsStr       = fields[0]
-			userHashStr = fields[1]
-			xStr, yStr  = fields[2], fields[3]
-			colorStr    = fields[4]
-		)
-		if len(xStr) == 0 || len(yStr) == 0 || len(colorStr) == 0 {
-			continue
-		}
-
-		const TimestampLayout = "2006-01-02 15:04:05.999 MST"
-		ts, err := time.Parse(TimestampLayout, tsStr)
-		if err != nil {
-			return nil, fmt.Errorf("line %d: timestamp %q invalid: %s", lineno, tsStr, err)
-		}
-		userHash, err := base64.StdEncoding.DecodeString(userHashStr)
-		if err != nil {
-			return nil, fmt.Errorf("line %d: user hash %q invalid: %s", lineno, userHashStr, err)
-		}
-		x, err := strconv.ParseInt(xStr, 10, 16)
-		if err != nil {
-			return nil, fmt.Errorf("line %d: x coordinate %q invalid: %s", lineno, xStr, err)
-		}
-		y, err := strconv.ParseInt(yStr, 10, 16)
-		if err != nil {
-			return nil, fmt.Errorf("line %d: y coordinate %q invalid: %s", lineno, yStr, err)
-		}
-		color, err := strconv.ParseUint(colorStr, 10, 8)
-		if err != nil {
-			return nil, fmt.Errorf("line %d: color %q invalid: %s", lineno, colorStr, err)
-		}
-
-		rec := Record{
-			UnixMillis: ts.UnixNano() / 1e6,
-			UserHash:   *((*[16]byte)(userHash)),
-			X:          int16(x),
-			Y:          int16(y),
-			Color:      uint8(color),
-		}
-		if err := enc.Encode(rec); err != nil {
-			return nil, fmt.Errorf("line %d: record %d: encoding record: %w", lineno, records, err)
+		batch = append(batch, line)
+		if len(batch) == cap(batch) && !parse() {
+			break
 		}
-		records = append(records, rec)
+	}
+	if len(batch) > 0 {
+		parse()
+	}
+	close(batches)
+	parseErr := pool.Wait()
+	encodeErr := <-encoded
+	if headerErr != nil {
+		return nil, ParseSummary{}, headerErr
 	}
 	if err := lines.Err(); err != nil {
-		return nil, fmt.Errorf("downloading %q: %w", datasetURL, err)
+		return nil, ParseSummary{}, err
 	}
-	if processed != total {
-		glog.Warningf("Processed %d/%d bytes; incomplete download?", processed, total)
+	if parseErr != nil {
+		return nil, ParseSummary{}, parseErr
 	}
-	printProgress() // everyone likes the 100% downloaded bit :)
+	if encodeErr != nil {
+		return nil, ParseSummary{}, encodeErr
+	}
+	return records, summary, nil
+}
 
-	compression.Comment = "r/place 2017 dataset"
-	if err := compression.Close(); err != nil {
-		return nil, fmt.Errorf("finalizing gzip data: %w", err)
+func Load(ctx context.Context, filename string) ([]Record, error) {
+	start := time.Now()
+	info, err := ReadFileInfo(filename)
+	if err != nil {
+		return nil, err
 	}
-	if err := writeBuffer.Flush(); err != nil {
-		return nil, fmt.Errorf("flushing buffer to file %q: %w", outputFile, err)
+	var records []Record
+	if c := info.Counts; c != nil {
+		glog.Infof("Loading %d records by %d users (%.2fMiB in memory)",
+			c.Records, c.Users, float64(c.Records*int64(unsafe.Sizeof(Record{})))/(1<<20))
+		records = make([]Record, 0, capacityHint(c.Records, info.Size))
 	}
-	if err := f.Close(); err != nil {
-		return nil, fmt.Errorf("closing output file: %w", err) // contains filename
+	if err := Scan(ctx, filename, func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
 	sortByTime(records)
-	glog.Infof("Downloaded dataset (%.2fMiB, took %s)",
-		float64(total)/(1<<20), time.Since(start).Truncate(time.Second))
-	glog.Infof("  Wrote to: %s", outputFile)
-
+	glog.Infof("Decoded %d records in %s", len(records), time.Since(start).Truncate(time.Millisecond))
 	return records, nil
 }
 
-func Load(filename string) ([]Record, error) {
-	if !strings.HasSuffix(filename, FileSuffix) {
-		return nil, fmt.Errorf("input file %q does not have required suffix %q", filename, FileSuffix)
+// minEncodedRecord is the fewest bytes which a record of the real dataset takes up in a dataset file:
+// its user hash is random, so it doesn't compress.
+const minEncodedRecord = 16
+
+// capacityHint returns how many records to allocate room for when loading a file of the given size
+// whose trailer says it holds n of them. The trailer isn't covered by the checksum, so n is trusted
+// only as far as the file is big enough to hold that many records.
+func capacityHint(n, fileSize int64) int64 {
+	return max(0, min(n, fileSize/minEncodedRecord))
+}
+
+// Scan calls fn for each record in the dataset file, in the order they are stored
+// (which is not necessarily sorted by time), without loading them all into memory.
+// If fn returns an error, scanning stops and the error is returned.
+//
+// If the file has a checksum, it is verified once all records have been read,
+// and if a record cannot be decoded; a mismatch is reported as ErrCorrupt.
+func Scan(ctx context.Context, filename string, fn func(Record) error) error {
+	if err := checkSuffix(filename); err != nil {
+		return fmt.Errorf("input: %w", err)
 	}
 
 	f, err := os.Open(filename)
 	if err != nil {
-		return nil, fmt.Errorf("opening input file: %w", err) // contains filename
+		return fmt.Errorf("opening input file: %w", err) // contains filename
 	}
 	defer f.Close() // no data to flush
 
-	readBuffer := bufio.NewReaderSize(f, 10*1024)
-	compression, err := gzip.NewReader(readBuffer)
+	payload, err := openPayload(f)
+	if err != nil {
+		return err
+	}
+	readBuffer := bufio.NewReaderSize(payload, 10*1024)
+	compression, err := decompress(filename, readBuffer)
 	if err != nil {
-		return nil, fmt.Errorf("initializing decompression of %q: %w", filename, err)
+		if verr := payload.verify(); verr != nil {
+			return verr
+		}
+		return fmt.Errorf("initializing decompression of %q: %w", filename, err)
 	}
 	defer compression.Close()
 	dec := gob.NewDecoder(compression)
 
-	start := time.Now()
-	var records []Record
-	for {
+	// finish checks the checksum before reporting the result of decoding,
+	// since a corrupt file is more useful to know about than the decode error it causes.
+	finish := func(err error) error {
+		compression.Close() // stop any read-ahead before reading the rest of the payload
+		if verr := payload.verify(); verr != nil {
+			return verr
+		}
+		return err
+	}
+
+	for count := 0; ; count++ {
+		if count%checkContextEvery == 0 && ctx.Err() != nil {
+			return fmt.Errorf("decoding %q: %w", filename, ctx.Err())
+		}
+
 		var rec Record
 		if err := dec.Decode(&rec); errors.Is(err, io.EOF) {
-			break
+			return finish(nil)
 		} else if err != nil {
-			return nil, fmt.Errorf("decoding record %d: %w", len(records)+1, err)
+			return finish(fmt.Errorf("decoding record %d: %w", count+1, err))
+		}
+		if err := fn(rec); err != nil {
+			return err
 		}
-		records = append(records, rec)
 	}
+}
 
-	sortByTime(records)
-	glog.Infof("Decoded %d records in %s", len(records), time.Since(start).Truncate(time.Millisecond))
-	return records, nil
+// FileInfo is metadata about a dataset file.
+type FileInfo struct {
+	Compression string
+	Comment     string    // only recorded by gzip
+	ModTime     time.Time // zero if not recorded
+	Size        int64     // compressed size
+	Checksum    []byte    // SHA-256 of the compressed payload, nil if not recorded
+	Counts      *Counts   // nil if not recorded
 }
 
-func sortByTime(records []Record) {
-	sort.Slice(records, func(i, j int) bool {
-		return records[i].UnixMillis < records[j].UnixMillis
+// ReadFileInfo returns metadata about the dataset file without decoding its records.
+func ReadFileInfo(filename string) (FileInfo, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("opening input file: %w", err) // contains filename
+	}
+	defer f.Close() // no data to flush
+
+	stat, err := f.Stat()
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("checking input file: %w", err) // contains filename
+	}
+	trailer, err := readTrailer(f)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info := FileInfo{
+		Compression: Compression(filename),
+		Size:        stat.Size(),
+		Checksum:    trailer.checksum,
+		Counts:      trailer.counts,
+	}
+	if info.Compression != "gzip" {
+		return info, nil
+	}
+
+	compression, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("reading gzip header of %q: %w", filename, err)
+	}
+	defer compression.Close()
+
+	info.Comment = compression.Comment
+	info.ModTime = compression.ModTime
+	return info, nil
+}
+
+// Snapshot returns the state of the canvas within bounds as of the given time,
+// including all records at or before unixMillis.
+// The records must be sorted by time, as they are when returned from Load or Download.
+func Snapshot(records []Record, unixMillis int64, bounds image.Rectangle) *image.Paletted {
+	end := sort.Search(len(records), func(i int) bool {
+		return records[i].UnixMillis > unixMillis
 	})
+
+	img := image.NewPaletted(bounds, Palette)
+	for _, rec := range records[:end] {
+		if p := image.Pt(int(rec.X), int(rec.Y)); p.In(bounds) {
+			img.SetColorIndex(p.X, p.Y, rec.Color)
+		}
+	}
+	return img
 }
 
-var progressBar = strings.Repeat("#", 50)
+// checkContextEvery is how many records are decoded between checks for cancellation.
+const checkContextEvery = 1 << 16
 
 var Palette = color.Palette{
 	0:  color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF},
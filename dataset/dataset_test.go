@@ -0,0 +1,347 @@
+package dataset_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/dataset/datasettest"
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+// benchOptions is the synthetic dataset the benchmarks ingest, save, and load.
+var benchOptions = datasettest.Options{Size: 1000, Users: 10000, Events: 100000}
+
+// TestLoadCounts checks that the counts in the trailer of a file, which aren't covered by its
+// checksum, can't make Load fail (or allocate) more than the payload warrants.
+func TestLoadCounts(t *testing.T) {
+	records := datasettest.Records(datasettest.Options{Events: 1000})
+	tests := []struct {
+		name    string
+		records int64
+		wantErr error
+	}{
+		{"huge", math.MaxInt64, nil},
+		{"fewer than users", 1, dataset.ErrCorrupt},
+		{"negative", -1, dataset.ErrCorrupt},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "counts"+dataset.FileSuffixes[0])
+			if err := datasettest.WriteFile(file, records); err != nil {
+				t.Fatalf("WriteFile: %s", err)
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The counts start with Records, right after the magic of their section.
+			at := bytes.LastIndex(data, []byte("rplacemap/counts/v2")) + len("rplacemap/counts/v2")
+			binary.LittleEndian.PutUint64(data[at:], uint64(test.records))
+			if err := os.WriteFile(file, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := dataset.Load(context.Background(), file)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("Load error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %s", err)
+			}
+			if len(got) != len(records) || !reflect.DeepEqual(got[0], records[0]) {
+				t.Errorf("Load returned %d records starting with %+v, want %d starting with %+v",
+					len(got), got[0], len(records), records[0])
+			}
+		})
+	}
+}
+
+func TestCountsColors(t *testing.T) {
+	records := datasettest.Records(datasettest.Options{Events: 1000})
+	for i := range records {
+		records[i].Color = uint8(i % 200)
+	}
+	file := filepath.Join(t.TempDir(), "colors"+dataset.FileSuffixes[0])
+	if err := datasettest.WriteFile(file, records); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	info, err := dataset.ReadFileInfo(file)
+	if err != nil {
+		t.Fatalf("ReadFileInfo: %s", err)
+	}
+	if info.Counts == nil {
+		t.Fatalf("ReadFileInfo has no counts")
+	}
+	if got, want := len(info.Counts.Colors), 200; got != want {
+		t.Fatalf("counted %d colors, want %d", got, want)
+	}
+	if got, want := info.Counts.Colors[199], int64(5); got != want {
+		t.Errorf("counted %d of color 199, want %d", got, want)
+	}
+}
+
+// TestCountsV1 checks that the fixed-size counts of files written before they had a size are still read.
+func TestCountsV1(t *testing.T) {
+	records := datasettest.Records(datasettest.Options{Events: 1000})
+	file := filepath.Join(t.TempDir(), "v1"+dataset.FileSuffixes[0])
+	if err := datasettest.WriteFile(file, records); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	want, err := dataset.ReadFileInfo(file)
+	if err != nil {
+		t.Fatalf("ReadFileInfo: %s", err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the counts section with one in the old format, leaving the payload and checksum section.
+	old := struct {
+		Records, Users int64
+		Colors         [16]int64
+		First, Last    int64
+	}{Records: want.Counts.Records, Users: want.Counts.Users, First: want.Counts.First, Last: want.Counts.Last}
+	copy(old.Colors[:], want.Counts.Colors)
+	var v1 bytes.Buffer
+	v1.Write(data[:bytes.LastIndex(data, []byte("rplacemap/counts/v2"))])
+	v1.WriteString("rplacemap/counts")
+	binary.Write(&v1, binary.LittleEndian, old)
+	v1.Write(data[len(data)-len("rplacemap/sha256")-sha256.Size:])
+	if err := os.WriteFile(file, v1.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := dataset.ReadFileInfo(file)
+	if err != nil {
+		t.Fatalf("ReadFileInfo: %s", err)
+	}
+	wantCounts := *want.Counts
+	wantCounts.Colors = old.Colors[:]
+	if got.Counts == nil || !reflect.DeepEqual(*got.Counts, wantCounts) {
+		t.Errorf("ReadFileInfo counts = %+v, want %+v", got.Counts, wantCounts)
+	}
+	if !bytes.Equal(got.Checksum, want.Checksum) {
+		t.Errorf("ReadFileInfo checksum = %x, want %x", got.Checksum, want.Checksum)
+	}
+	loaded, err := dataset.Load(context.Background(), file)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if len(loaded) != len(records) {
+		t.Errorf("Load returned %d records, want %d", len(loaded), len(records))
+	}
+}
+
+func TestDownloadShards(t *testing.T) {
+	dir := t.TempDir()
+	records := datasettest.Records(datasettest.Options{Events: 1000})
+	half := len(records) / 2
+
+	// The first shard was already downloaded (so its URL is never fetched), and the second is gzipped.
+	out := filepath.Join(dir, "sharded"+dataset.FileSuffixes[0])
+	first := filepath.Join(dir, "sharded.shard000"+dataset.FileSuffixes[0])
+	if err := datasettest.WriteFile(first, records[:half]); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(datasettest.CSV(records[half:]))
+	zw.Close()
+	second := filepath.Join(dir, "second.csv.gzip")
+	if err := os.WriteFile(second, gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := &dataset.Source{
+		Name:    "test-shards",
+		Shards:  []string{filepath.Join(dir, "missing.csv"), second},
+		Header:  dataset.RequiredHeader,
+		Columns: []string{dataset.ColumnTime, dataset.ColumnUser, dataset.ColumnX, dataset.ColumnY, dataset.ColumnColor},
+	}
+	if err := dataset.RegisterSource(src); err != nil {
+		t.Fatalf("RegisterSource: %s", err)
+	}
+
+	got, summary, coverage, err := src.DownloadShards(context.Background(), out, dataset.Strict, progress.New("Shards", progress.Bytes))
+	if err != nil {
+		t.Fatalf("DownloadShards: %s", err)
+	}
+	if !coverage.Complete() {
+		t.Errorf("DownloadShards is missing shards %+v", coverage.Missing)
+	}
+	if !reflect.DeepEqual(got, records) {
+		t.Errorf("DownloadShards returned %d records, want the %d written", len(got), len(records))
+	}
+	if want := int64(len(records) - half); summary.Rows != want {
+		t.Errorf("DownloadShards parsed %d rows, want %d (of the second shard)", summary.Rows, want)
+	}
+	loaded, err := dataset.Load(context.Background(), out)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if !reflect.DeepEqual(loaded, records) {
+		t.Errorf("Load returned %d records, want the %d downloaded", len(loaded), len(records))
+	}
+	if _, err := os.Stat(first); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("shard file %s is left behind: %v", first, err)
+	}
+}
+
+func TestDownloadShardsMissing(t *testing.T) {
+	dir := t.TempDir()
+	records := datasettest.Records(datasettest.Options{Events: 900})
+	third := len(records) / 3
+	var shards []string
+	for i, recs := range [][]dataset.Record{records[:third], nil, records[2*third:]} {
+		shard := filepath.Join(dir, fmt.Sprintf("shard%d.csv", i))
+		if recs != nil {
+			if err := os.WriteFile(shard, datasettest.CSV(recs), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		shards = append(shards, shard)
+	}
+	src := &dataset.Source{
+		Name:    "test-missing-shards",
+		Shards:  shards,
+		Header:  dataset.RequiredHeader,
+		Columns: []string{dataset.ColumnTime, dataset.ColumnUser, dataset.ColumnX, dataset.ColumnY, dataset.ColumnColor},
+	}
+	if err := dataset.RegisterSource(src); err != nil {
+		t.Fatalf("RegisterSource: %s", err)
+	}
+	out := filepath.Join(dir, "partial"+dataset.FileSuffixes[0])
+	bar := progress.New("Shards", progress.Bytes)
+
+	if _, _, _, err := src.DownloadShards(context.Background(), out, dataset.Strict, bar); err == nil {
+		t.Fatalf("DownloadShards without a shard succeeded, want an error (with no missing shards allowed)")
+	}
+
+	defer func(max int) { dataset.MaxMissingShards = max }(dataset.MaxMissingShards)
+	dataset.MaxMissingShards = 1
+	got, _, coverage, err := src.DownloadShards(context.Background(), out, dataset.Strict, bar)
+	if err != nil {
+		t.Fatalf("DownloadShards: %s", err)
+	}
+	want := append(append([]dataset.Record(nil), records[:third]...), records[2*third:]...)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DownloadShards returned %d records, want the %d of the shards which exist", len(got), len(want))
+	}
+	if coverage.Shards != 3 || len(coverage.Missing) != 1 {
+		t.Fatalf("coverage = %+v, want 1 of 3 shards missing", coverage)
+	}
+	missing := coverage.Missing[0]
+	if missing.Index != 1 || missing.URL != shards[1] || missing.Error == "" {
+		t.Errorf("missing shard = %+v, want shard 1 (%s) with its error", missing, shards[1])
+	}
+	if after, before := records[third-1].Time(), records[2*third].Time(); missing.After == nil || !missing.After.Equal(after) ||
+		missing.Before == nil || !missing.Before.Equal(before) {
+		t.Errorf("missing shard is between %v and %v, want %v and %v", missing.After, missing.Before, after, before)
+	}
+	if read, err := dataset.ReadCoverage(out); err != nil || !reflect.DeepEqual(read, coverage) {
+		t.Errorf("ReadCoverage = %+v, %v; want %+v", read, err, coverage)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partial.shard000"+dataset.FileSuffixes[0])); err != nil {
+		t.Errorf("the downloaded shards weren't kept for the next download: %s", err)
+	}
+
+	// Once the shard is published, downloading again completes the dataset.
+	if err := os.WriteFile(shards[1], datasettest.CSV(records[third:2*third]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, coverage, err = src.DownloadShards(context.Background(), out, dataset.Strict, bar); err != nil {
+		t.Fatalf("DownloadShards: %s", err)
+	}
+	if !reflect.DeepEqual(got, records) || !coverage.Complete() {
+		t.Errorf("DownloadShards again returned %d records (missing %+v), want all %d", len(got), coverage.Missing, len(records))
+	}
+	if _, err := os.Stat(dataset.CoverageFile(out)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the coverage of the partial download is left behind: %v", err)
+	}
+}
+
+// TestImportHeaderMismatch checks that a CSV with the wrong header is rejected
+// without leaving the parsing and encoding goroutines behind.
+func TestImportHeaderMismatch(t *testing.T) {
+	before := runtime.NumGoroutine()
+	out := filepath.Join(t.TempDir(), "mismatch"+dataset.FileSuffixes[0])
+	csv := "when,who,x,y,color\n" + strings.SplitN(string(datasettest.CSV(datasettest.Records(datasettest.Options{Events: 10}))), "\n", 2)[1]
+	_, err := dataset.Import(context.Background(), out, strings.NewReader(csv), progress.New("Import", progress.Bytes))
+	if err == nil || !strings.Contains(err.Error(), "header mismatch") {
+		t.Fatalf("Import = %v, want a header mismatch", err)
+	}
+	if _, err := os.Stat(out); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Import left %s behind: %v", out, err)
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Import left %d goroutines running", runtime.NumGoroutine()-before)
+		}
+	}
+}
+
+func BenchmarkImport(b *testing.B) {
+	csv := datasettest.CSV(datasettest.Records(benchOptions))
+	out := filepath.Join(b.TempDir(), "bench"+dataset.FileSuffixes[0])
+	b.SetBytes(int64(len(csv)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bar := progress.New("Import", progress.Bytes)
+		if _, err := dataset.Import(context.Background(), out, bytes.NewReader(csv), bar); err != nil {
+			b.Fatalf("Import: %s", err)
+		}
+	}
+}
+
+func BenchmarkSave(b *testing.B) {
+	records := datasettest.Records(benchOptions)
+	out := filepath.Join(b.TempDir(), "bench"+dataset.FileSuffixes[0])
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := datasettest.WriteFile(out, records); err != nil {
+			b.Fatalf("WriteFile: %s", err)
+		}
+	}
+}
+
+func BenchmarkLoad(b *testing.B) {
+	records := datasettest.Records(benchOptions)
+	for _, suffix := range dataset.FileSuffixes {
+		b.Run(suffix, func(b *testing.B) {
+			file := filepath.Join(b.TempDir(), "bench"+suffix)
+			if err := datasettest.WriteFile(file, records); err != nil {
+				b.Fatalf("WriteFile: %s", err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				got, err := dataset.Load(context.Background(), file)
+				if err != nil {
+					b.Fatalf("Load: %s", err)
+				}
+				if len(got) != len(records) {
+					b.Fatalf("Load returned %d records, want %d", len(got), len(records))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+// Package datasettest generates small synthetic datasets, for exercising and
+// measuring the dataset pipeline without the real multi-gigabyte download,
+// and checks what is rendered from them against golden images.
+package datasettest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+)
+
+// Options configures a synthetic dataset.
+// Zero fields use the defaults described below.
+type Options struct {
+	Size   int     // width and height of the canvas (default 64)
+	Users  int     // number of distinct users (default 100)
+	Events int     // number of placements (default 10000)
+	Rate   float64 // average placements per second (default 10)
+	Start  time.Time
+	Seed   int64
+}
+
+// DefaultStart is the time of the first placement if Options.Start is zero.
+var DefaultStart = time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)
+
+func (o Options) withDefaults() Options {
+	if o.Size <= 0 {
+		o.Size = 64
+	}
+	if o.Users <= 0 {
+		o.Users = 100
+	}
+	if o.Events <= 0 {
+		o.Events = 10000
+	}
+	if o.Rate <= 0 {
+		o.Rate = 10
+	}
+	if o.Start.IsZero() {
+		o.Start = DefaultStart
+	}
+	return o
+}
+
+// Records returns the records of a synthetic dataset, sorted by time.
+//
+// Placements arrive at exponentially distributed intervals, and each user
+// tends to paint near the same spot in the same color, which is enough
+// structure for rendered canvases to look like something.
+// The same options always produce the same records.
+func Records(opts Options) []dataset.Record {
+	opts = opts.withDefaults()
+	rng := rand.New(rand.NewSource(opts.Seed))
+
+	type user struct {
+		hash  [16]byte
+		x, y  int
+		color uint8
+	}
+	users := make([]user, opts.Users)
+	for i := range users {
+		rng.Read(users[i].hash[:])
+		users[i].x, users[i].y = rng.Intn(opts.Size), rng.Intn(opts.Size)
+		users[i].color = uint8(rng.Intn(len(dataset.Palette)))
+	}
+
+	records := make([]dataset.Record, opts.Events)
+	millis := opts.Start.UnixMilli()
+	for i := range records {
+		millis += int64(rng.ExpFloat64() / opts.Rate * 1000)
+		u := users[rng.Intn(len(users))]
+		color := u.color
+		if rng.Intn(4) == 0 {
+			color = uint8(rng.Intn(len(dataset.Palette)))
+		}
+		records[i] = dataset.Record{
+			UnixMillis: millis,
+			UserHash:   u.hash,
+			X:          int16(wrap(u.x+rng.Intn(9)-4, opts.Size)),
+			Y:          int16(wrap(u.y+rng.Intn(9)-4, opts.Size)),
+			Color:      color,
+		}
+	}
+	return records
+}
+
+func wrap(v, size int) int {
+	return (v%size + size) % size
+}
+
+// CSV returns the records in the format of the original CSV dataset, including the header.
+func CSV(records []dataset.Record) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(dataset.RequiredHeader + "\n")
+
+	var line []byte
+	for _, rec := range records {
+		line = rec.Time().AppendFormat(line[:0], dataset.TimestampLayout)
+		line = append(line, ',')
+		line = append(line, base64.StdEncoding.EncodeToString(rec.UserHash[:])...)
+		line = append(line, ',')
+		line = strconv.AppendInt(line, int64(rec.X), 10)
+		line = append(line, ',')
+		line = strconv.AppendInt(line, int64(rec.Y), 10)
+		line = append(line, ',')
+		line = strconv.AppendUint(line, uint64(rec.Color), 10)
+		line = append(line, '\n')
+		buf.Write(line)
+	}
+	return buf.Bytes()
+}
+
+// Server returns a server that serves the records as a CSV dataset at any path,
+// suitable for passing to dataset.Download. The caller must close it.
+func Server(records []dataset.Record) *httptest.Server {
+	data := CSV(records)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Write(data)
+	}))
+}
+
+// WriteFile writes the records to a dataset file, as dataset.Download would.
+func WriteFile(filename string, records []dataset.Record) error {
+	out, err := dataset.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+
+	for _, rec := range records {
+		if err := out.Write(rec); err != nil {
+			return fmt.Errorf("writing %q: %w", filename, err)
+		}
+	}
+	return out.Close()
+}
@@ -0,0 +1,66 @@
+package datasettest
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// update is set (with go test -update) to rewrite golden images instead of comparing against them.
+var update = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+// CheckGolden compares img, pixel by pixel, against the golden PNG testdata/<name>.png,
+// which is (re)written instead when the tests are run with -update.
+// The golden image has its origin at img.Bounds().Min.
+func CheckGolden(t testing.TB, name string, img image.Image) {
+	t.Helper()
+	file := filepath.Join("testdata", name+".png")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatalf("creating testdata: %s", err)
+		}
+		f, err := os.Create(file)
+		if err != nil {
+			t.Fatalf("writing golden image: %s", err)
+		}
+		defer f.Close()
+		if err := png.Encode(f, img); err != nil {
+			t.Fatalf("encoding %s: %s", file, err)
+		}
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("reading golden image (run with -update to create it): %s", err)
+	}
+	defer f.Close()
+	golden, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("decoding %s: %s", file, err)
+	}
+	bounds := img.Bounds()
+	if got, want := bounds.Size(), golden.Bounds().Size(); got != want {
+		t.Fatalf("%s: image is %v, golden image is %v", name, got, want)
+	}
+	var diffs int
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			got := color.RGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y))
+			want := color.RGBAModel.Convert(golden.At(golden.Bounds().Min.X+x, golden.Bounds().Min.Y+y))
+			if got == want {
+				continue
+			}
+			if diffs++; diffs <= 5 {
+				t.Errorf("%s: pixel (%d,%d) = %v, golden image has %v", name, x, y, got, want)
+			}
+		}
+	}
+	if diffs > 5 {
+		t.Errorf("%s: %d pixels differ from the golden image in all", name, diffs)
+	}
+}
@@ -0,0 +1,52 @@
+package datasettest
+
+import (
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+)
+
+// FourColors is the palette of the Tiny dataset, which is unlike any of the real ones,
+// so that golden images show whether it was used.
+var FourColors = color.Palette{
+	color.RGBA{0xFF, 0xFF, 0xF0, 0xFF},
+	color.RGBA{0xC0, 0x20, 0x20, 0xFF},
+	color.RGBA{0x20, 0x80, 0x20, 0xFF},
+	color.RGBA{0x20, 0x20, 0xC0, 0xFF},
+}
+
+// TinyStart is the time of the first event of the Tiny dataset.
+var TinyStart = time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC)
+
+// Tiny returns a builder of a dataset small enough to check by hand: three users painting
+// (over each other) in FourColors on an 8px canvas, a minute or two apart:
+//
+//	TinyStart         alice  (1,1)  color 1
+//	TinyStart+30s     bob    (6,2)  color 2
+//	TinyStart+1m      alice  (1,1)  color 3, over her own pixel
+//	TinyStart+2m30s   carol  (3,7)  color 2
+//
+// The events are added out of order, which Build sorts out. Tests can add more events
+// (or resize the canvas) before building it, e.g. with Build.
+func Tiny() *dataset.Builder {
+	b := new(dataset.Builder)
+	b.SetCanvasSize(8)
+	b.SetPalette(FourColors)
+	b.AddEvent(TinyStart, "alice", 1, 1, 1)
+	b.AddEvent(TinyStart.Add(time.Minute), "alice", 1, 1, 3)
+	b.AddEvent(TinyStart.Add(30*time.Second), "bob", 6, 2, 2)
+	b.AddEvent(TinyStart.Add(150*time.Second), "carol", 3, 7, 2)
+	return b
+}
+
+// Build builds the dataset, failing the test if it can't.
+func Build(t testing.TB, b *dataset.Builder) *dataset.Dataset {
+	t.Helper()
+	ds, err := b.Build()
+	if err != nil {
+		t.Fatalf("Build: %s", err)
+	}
+	return ds
+}
@@ -0,0 +1,99 @@
+package dataset
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+// FileScheme is the scheme of source URLs which name a file on the local disk,
+// e.g. a copy of the dataset CSV which was already downloaded.
+const FileScheme = "file"
+
+// ParseSourceURL parses the URL of a source, which can also be a path to a local file.
+func ParseSourceURL(s string) (*url.URL, error) {
+	// A Windows path such as C:\data.csv would otherwise parse as a URL with the scheme "c".
+	if filepath.VolumeName(s) == "" && !filepath.IsAbs(s) {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "" {
+			return u, nil
+		}
+	}
+	abs, err := filepath.Abs(s)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.ToSlash(abs)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path // file:///C:/data.csv
+	}
+	return &url.URL{Scheme: FileScheme, Path: path}, nil
+}
+
+// IsLocal reports whether the URL of a source names a local file.
+func IsLocal(u *url.URL) bool {
+	return u.Scheme == FileScheme
+}
+
+// localPath returns the path of the local file named by a file:// URL.
+func localPath(u *url.URL) (string, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("file URL %q names a remote host (want file:///path)", u)
+	}
+	if u.Path == "" {
+		return "", fmt.Errorf("file URL %q has no path", u)
+	}
+	path := u.Path
+	if filepath.VolumeName(strings.TrimPrefix(path, "/")) != "" {
+		path = path[1:] // /C:/data.csv
+	}
+	return filepath.FromSlash(path), nil
+}
+
+// openLocal opens the local file named by u, returning it and its size.
+func openLocal(u *url.URL) (*os.File, int64, error) {
+	name, err := localPath(u)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, 0, fmt.Errorf("%s is not a regular file", name)
+	}
+	return f, fi.Size(), nil
+}
+
+// isGzipped reports whether the body of a source URL is gzip-compressed, judging by its name
+// (e.g. .csv.gz, or .csv.gzip as the 2023 shards are named).
+func isGzipped(u *url.URL) bool {
+	return strings.HasSuffix(u.Path, ".gz") || strings.HasSuffix(u.Path, ".gzip")
+}
+
+// countingReader reports the bytes read from r to bar.
+type countingReader struct {
+	r   io.Reader
+	bar *progress.Bar
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.bar.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,42 @@
+package dataset_test
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/kylelemons/rplacemap/dataset"
+)
+
+func TestParseSourceURL(t *testing.T) {
+	abs, err := filepath.Abs("place.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		source string
+		want   string
+		goos   string // if only on one OS
+	}{
+		{source: "https://example.com/place.csv", want: "https://example.com/place.csv"},
+		{source: "gs://bucket/place.csv.gz", want: "gs://bucket/place.csv.gz"},
+		{source: "file:///data/place.csv", want: "file:///data/place.csv"},
+		{source: "place.csv", want: "file://" + filepath.ToSlash(abs), goos: "linux"},
+		{source: "/data/place.csv", want: "file:///data/place.csv", goos: "linux"},
+		{source: `C:\data\place.csv`, want: "file:///C:/data/place.csv", goos: "windows"},
+		{source: `c:/data/place.csv`, want: "file:///c:/data/place.csv", goos: "windows"},
+	}
+	for _, test := range tests {
+		if test.goos != "" && test.goos != runtime.GOOS {
+			continue
+		}
+		u, err := dataset.ParseSourceURL(test.source)
+		if err != nil {
+			t.Errorf("ParseSourceURL(%q): %s", test.source, err)
+			continue
+		}
+		if got := u.String(); got != test.want {
+			t.Errorf("ParseSourceURL(%q) = %q, want %q", test.source, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package dataset
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The schemes of source URLs which name objects in Google Cloud Storage (gs://bucket/object)
+// and Amazon S3 or a compatible store (s3://bucket/key). They are fetched over HTTPS,
+// authenticated with the credentials in ObjectStore.
+const (
+	GCSScheme = "gs"
+	S3Scheme  = "s3"
+)
+
+// ObjectStoreAuth holds the credentials (and endpoints) with which gs:// and s3:// sources are fetched.
+// Objects are fetched anonymously if there are no credentials for their store, e.g. in a public bucket.
+type ObjectStoreAuth struct {
+	GCSToken        string // OAuth2 access token (also for bq:// sources), e.g. from `gcloud auth print-access-token`
+	BigQueryProject string // project billed for the queries of bq:// sources (default: the table's)
+
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	S3SessionToken    string // for temporary credentials
+	S3Region          string // default us-east-1
+	S3Endpoint        string // default https://s3.<region>.amazonaws.com; buckets are addressed by path
+}
+
+// ObjectStore holds the credentials for gs:// and s3:// sources,
+// which are initially read from the usual environment variables (see ObjectStoreAuthFromEnv).
+var ObjectStore = ObjectStoreAuthFromEnv()
+
+// ObjectStoreAuthFromEnv returns the credentials in the environment:
+// GOOGLE_OAUTH_ACCESS_TOKEN and GOOGLE_CLOUD_PROJECT for GCS and BigQuery, and AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// AWS_SESSION_TOKEN, AWS_REGION (or AWS_DEFAULT_REGION), and AWS_ENDPOINT_URL_S3 for S3.
+func ObjectStoreAuthFromEnv() ObjectStoreAuth {
+	auth := ObjectStoreAuth{
+		GCSToken:          os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"),
+		BigQueryProject:   os.Getenv("GOOGLE_CLOUD_PROJECT"),
+		S3AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		S3SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		S3SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		S3Region:          os.Getenv("AWS_REGION"),
+		S3Endpoint:        os.Getenv("AWS_ENDPOINT_URL_S3"),
+	}
+	if auth.S3Region == "" {
+		auth.S3Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return auth
+}
+
+// newSourceRequest returns a request for the source URL with the given headers,
+// translating (and authenticating) gs:// and s3:// URLs into requests to their stores.
+func newSourceRequest(ctx context.Context, method string, source *url.URL, header http.Header) (*http.Request, error) {
+	if (source.Scheme == GCSScheme || source.Scheme == S3Scheme) && source.Host == "" {
+		return nil, fmt.Errorf("%s URL %q has no bucket", source.Scheme, source)
+	}
+	target := source
+	switch source.Scheme {
+	case GCSScheme:
+		target = &url.URL{Scheme: "https", Host: "storage.googleapis.com", Path: "/" + source.Host + source.Path}
+	case S3Scheme:
+		endpoint := ObjectStore.S3Endpoint
+		if endpoint == "" {
+			endpoint = "https://s3." + ObjectStore.s3Region() + ".amazonaws.com"
+		}
+		base, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("S3 endpoint: %w", err)
+		}
+		target = base.JoinPath(source.Host, source.Path)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	switch source.Scheme {
+	case GCSScheme:
+		if ObjectStore.GCSToken != "" {
+			req.Header.Set("Authorization", "Bearer "+ObjectStore.GCSToken)
+		}
+	case S3Scheme:
+		if ObjectStore.S3AccessKeyID != "" {
+			ObjectStore.signS3(req, time.Now())
+		}
+	}
+	return req, nil
+}
+
+// IsObjectStore reports whether u names an object in GCS (gs://) or S3 (s3://).
+func IsObjectStore(u *url.URL) bool {
+	return u.Scheme == GCSScheme || u.Scheme == S3Scheme
+}
+
+// FetchObject copies the object named by the gs:// or s3:// URL to the local file,
+// which is only replaced once the whole object has been received.
+// If there is no such object, the error wraps os.ErrNotExist.
+func FetchObject(ctx context.Context, u *url.URL, file string) error {
+	req, err := newSourceRequest(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching %q: %w", u, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("fetching %q: %w", u, os.ErrNotExist)
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("GET %q returned %q", u, resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".fetch*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // if it isn't renamed
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("fetching %q: %w", u, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// StoreObject uploads the local file as the object named by the gs:// or s3:// URL, replacing it if it exists.
+func StoreObject(ctx context.Context, file string, u *url.URL) error {
+	if !IsObjectStore(u) {
+		return fmt.Errorf("%q is not a gs:// or s3:// URL", u)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	if u.Scheme == S3Scheme {
+		header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	}
+	req, err := newSourceRequest(ctx, http.MethodPut, u, header)
+	if err != nil {
+		return err
+	}
+	req.Body, req.ContentLength = f, fi.Size()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("storing %q: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("PUT %q returned %q", u, resp.Status)
+	}
+	return nil
+}
+
+func (a ObjectStoreAuth) s3Region() string {
+	if a.S3Region == "" {
+		return "us-east-1"
+	}
+	return a.S3Region
+}
+
+// emptySHA256 is the hex SHA-256 of the (empty) body of the requests which are signed.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// unsignedPayload is the payload hash of a request to S3 whose body isn't signed, e.g. an upload
+// which is streamed from a file (over HTTPS, which protects it instead).
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// signS3 signs the request to S3 with AWS Signature Version 4. Its payload hash is the
+// X-Amz-Content-Sha256 header, if set, or that of an empty body.
+// Only the host and x-amz-* headers are signed, so others (e.g. Range) may be set afterward.
+func (a ObjectStoreAuth) signS3(req *http.Request, now time.Time) {
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	}
+	if a.S3SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.S3SessionToken)
+	}
+	a.signV4(req, now, "s3")
+}
+
+// signV4 signs the request to the service with AWS Signature Version 4, as signS3 does,
+// but without the headers which only S3 requires.
+func (a ObjectStoreAuth) signV4(req *http.Request, now time.Time, service string) {
+	now = now.UTC()
+	amzDate, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	// The path is sent exactly as it is signed.
+	segments := strings.Split(req.URL.Path, "/")
+	for i, s := range segments {
+		segments[i] = uriEncode(s)
+	}
+	req.URL.RawPath = strings.Join(segments, "/")
+
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = emptySHA256
+	}
+
+	signed := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			signed[k] = strings.TrimSpace(v[0])
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for k := range signed {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, signed[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.RawPath,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + a.s3Region() + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := []byte("AWS4" + a.S3SecretAccessKey)
+	for _, part := range []string{day, a.s3Region(), service, "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		a.S3AccessKeyID, scope, signedHeaders, hmacSHA256(signingKey, stringToSign)))
+}
+
+// canonicalQuery returns the query parameters sorted by name (then value) and escaped with uriEncode,
+// including those without values (as "name=").
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return uriEncode(keys[i]) < uriEncode(keys[j]) })
+	var params []string
+	for _, k := range keys {
+		values := make([]string, len(query[k]))
+		for i, v := range query[k] {
+			values[i] = uriEncode(v)
+		}
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, uriEncode(k)+"="+v)
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode escapes everything but the unreserved characters of RFC 3986, as Signature Version 4 requires.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,197 @@
+package dataset
+
+import (
+	"fmt"
+	"image/color"
+	"strconv"
+)
+
+// Year is the year of r/place whose palette and data this package handles.
+const Year = 2017
+
+// PaletteNames holds human-friendly names for the colors of each year's palette, by index.
+var PaletteNames = map[int][]string{
+	2017: {
+		"White",
+		"Light Gray",
+		"Gray",
+		"Black",
+		"Pink",
+		"Red",
+		"Orange",
+		"Brown",
+		"Yellow",
+		"Light Green",
+		"Green",
+		"Cyan",
+		"Blue",
+		"Dark Blue",
+		"Magenta",
+		"Purple",
+	},
+	2023: {
+		"White",
+		"Light Gray",
+		"Gray",
+		"Dark Gray",
+		"Black",
+		"Burgundy",
+		"Dark Red",
+		"Red",
+		"Orange",
+		"Yellow",
+		"Pale Yellow",
+		"Dark Green",
+		"Green",
+		"Light Green",
+		"Dark Teal",
+		"Teal",
+		"Light Teal",
+		"Dark Blue",
+		"Blue",
+		"Light Blue",
+		"Indigo",
+		"Periwinkle",
+		"Lavender",
+		"Dark Purple",
+		"Purple",
+		"Pale Purple",
+		"Magenta",
+		"Pink",
+		"Light Pink",
+		"Dark Brown",
+		"Brown",
+		"Beige",
+	},
+}
+
+// colorNames holds the names of the colors of Palette, which are those of another source after Source.Use.
+var colorNames = PaletteNames[Year]
+
+// ColorName returns the name of the color in Palette.
+func ColorName(color uint8) string {
+	if int(color) < len(colorNames) {
+		return colorNames[color]
+	}
+	return fmt.Sprintf("Color %d", color)
+}
+
+// ColorHex returns the color in Palette as "#RRGGBB".
+func ColorHex(color uint8) string {
+	if int(color) >= len(Palette) {
+		return ""
+	}
+	r, g, b, _ := Palette[color].RGBA()
+	return fmt.Sprintf("#%02X%02X%02X", r>>8, g>>8, b>>8)
+}
+
+// PaletteVariants are alternatives to Palette for viewers with color vision deficiencies,
+// by name. Each has the same number of colors as Palette, in the same order.
+//
+// The deuteranopia, protanopia, and tritanopia variants were precomputed by nudging each
+// (non-gray) color of Palette to make the colors as easy to tell apart as possible (in CIELAB)
+// when seen with the deficiency (as simulated by Viénot, Brettel, and Mollon),
+// while staying close to the originals. The highcontrast variant saturates every color.
+var PaletteVariants = map[string]color.Palette{
+	"deuteranopia": {
+		color.RGBA{0xFF, 0xFF, 0xFF, 0xFF},
+		color.RGBA{0xE4, 0xE4, 0xE4, 0xFF},
+		color.RGBA{0x88, 0x88, 0x88, 0xFF},
+		color.RGBA{0x22, 0x22, 0x22, 0xFF},
+		color.RGBA{0xFF, 0xAF, 0x98, 0xFF},
+		color.RGBA{0xC6, 0x00, 0x00, 0xFF},
+		color.RGBA{0xF6, 0xA3, 0x04, 0xFF},
+		color.RGBA{0xA1, 0x6E, 0x4A, 0xFF},
+		color.RGBA{0xFF, 0xF6, 0x03, 0xFF},
+		color.RGBA{0xA6, 0xF9, 0x77, 0xFF},
+		color.RGBA{0x00, 0xBA, 0x06, 0xFF},
+		color.RGBA{0x10, 0xE6, 0xF1, 0xFF},
+		color.RGBA{0x30, 0x72, 0xA4, 0xFF},
+		color.RGBA{0x00, 0x00, 0xEA, 0xFF},
+		color.RGBA{0xE0, 0x4A, 0xFF, 0xFF},
+		color.RGBA{0x81, 0x00, 0x83, 0xFF},
+	},
+	"protanopia": {
+		color.RGBA{0xFF, 0xFF, 0xFF, 0xFF},
+		color.RGBA{0xE4, 0xE4, 0xE4, 0xFF},
+		color.RGBA{0x88, 0x88, 0x88, 0xFF},
+		color.RGBA{0x22, 0x22, 0x22, 0xFF},
+		color.RGBA{0xE2, 0x56, 0x97, 0xFF},
+		color.RGBA{0xFA, 0x00, 0x48, 0xFF},
+		color.RGBA{0xC4, 0x6D, 0x06, 0xFF},
+		color.RGBA{0x8A, 0x4F, 0x2D, 0xFF},
+		color.RGBA{0xFF, 0xFD, 0x07, 0xFF},
+		color.RGBA{0xAE, 0xFF, 0x8C, 0xFF},
+		color.RGBA{0x2C, 0xC8, 0x00, 0xFF},
+		color.RGBA{0x00, 0xDA, 0xFB, 0xFF},
+		color.RGBA{0x00, 0x95, 0xEC, 0xFF},
+		color.RGBA{0x00, 0x00, 0xEA, 0xFF},
+		color.RGBA{0xE0, 0x4A, 0xFF, 0xFF},
+		color.RGBA{0x82, 0x00, 0x80, 0xFF},
+	},
+	"tritanopia": {
+		color.RGBA{0xFF, 0xFF, 0xFF, 0xFF},
+		color.RGBA{0xE4, 0xE4, 0xE4, 0xFF},
+		color.RGBA{0x88, 0x88, 0x88, 0xFF},
+		color.RGBA{0x22, 0x22, 0x22, 0xFF},
+		color.RGBA{0xE9, 0xBD, 0xE7, 0xFF},
+		color.RGBA{0xCB, 0x00, 0x00, 0xFF},
+		color.RGBA{0xF1, 0x9F, 0x16, 0xFF},
+		color.RGBA{0xA8, 0x81, 0x57, 0xFF},
+		color.RGBA{0xFF, 0xFC, 0x0B, 0xFF},
+		color.RGBA{0x94, 0xE0, 0x44, 0xFF},
+		color.RGBA{0x11, 0xBF, 0x01, 0xFF},
+		color.RGBA{0x2F, 0xE8, 0xF1, 0xFF},
+		color.RGBA{0x05, 0x84, 0xC8, 0xFF},
+		color.RGBA{0x00, 0x02, 0xEB, 0xFF},
+		color.RGBA{0x96, 0x5A, 0xFF, 0xFF},
+		color.RGBA{0x73, 0x00, 0x7A, 0xFF},
+	},
+	"highcontrast": {
+		color.RGBA{0xFF, 0xFF, 0xFF, 0xFF},
+		color.RGBA{0xC0, 0xC0, 0xC0, 0xFF},
+		color.RGBA{0x80, 0x80, 0x80, 0xFF},
+		color.RGBA{0x00, 0x00, 0x00, 0xFF},
+		color.RGBA{0xFF, 0x80, 0xC0, 0xFF},
+		color.RGBA{0xFF, 0x00, 0x00, 0xFF},
+		color.RGBA{0xFF, 0x80, 0x00, 0xFF},
+		color.RGBA{0x80, 0x40, 0x00, 0xFF},
+		color.RGBA{0xFF, 0xFF, 0x00, 0xFF},
+		color.RGBA{0x80, 0xFF, 0x00, 0xFF},
+		color.RGBA{0x00, 0x80, 0x00, 0xFF},
+		color.RGBA{0x00, 0xFF, 0xFF, 0xFF},
+		color.RGBA{0x00, 0x80, 0xFF, 0xFF},
+		color.RGBA{0x00, 0x00, 0xA0, 0xFF},
+		color.RGBA{0xFF, 0x00, 0xFF, 0xFF},
+		color.RGBA{0x80, 0x00, 0x80, 0xFF},
+	},
+}
+
+// PaletteVariant returns the named palette variant, or Palette itself for "" or "default".
+func PaletteVariant(name string) (color.Palette, error) {
+	return PaletteVariantOf(Palette, name)
+}
+
+// PaletteVariantOf is like PaletteVariant, but for another palette than Palette (e.g. from YearPalette).
+func PaletteVariantOf(base color.Palette, name string) (color.Palette, error) {
+	if name == "" || name == "default" {
+		return base, nil
+	}
+	if p, ok := PaletteVariants[name]; ok {
+		if len(p) != len(base) {
+			return nil, fmt.Errorf("palette %q has %d colors, but the dataset has %d", name, len(p), len(base))
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown palette %q", name)
+}
+
+// YearPalette returns the palette of the official dataset of a year of r/place,
+// and the names of its colors (from PaletteNames).
+func YearPalette(year int) (color.Palette, []string, bool) {
+	s, ok := LookupSource(strconv.Itoa(year))
+	if !ok || s.Year != year {
+		return nil, nil, false
+	}
+	return s.palette, PaletteNames[year], true
+}
@@ -0,0 +1,260 @@
+package dataset
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseBatchSize is the number of lines parsed by each task during Download.
+const parseBatchSize = 16 * 1024
+
+// A ParseMode determines what happens to malformed rows of the CSV dataset.
+type ParseMode int
+
+const (
+	Strict  ParseMode = iota // fail on the first malformed row
+	Lenient                  // skip (and count) malformed rows
+)
+
+var parseModeNames = []string{Strict: "strict", Lenient: "lenient"}
+
+func (m ParseMode) String() string {
+	if int(m) < len(parseModeNames) {
+		return parseModeNames[m]
+	}
+	return fmt.Sprintf("ParseMode(%d)", int(m))
+}
+
+// Set parses the name of a mode, so that a *ParseMode can be used as a flag.
+func (m *ParseMode) Set(s string) error {
+	for mode, name := range parseModeNames {
+		if s == name {
+			*m = ParseMode(mode)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown parse mode %q (want strict or lenient)", s)
+}
+
+// A ParseSummary counts the rows of a parsed CSV dataset.
+type ParseSummary struct {
+	Rows       int64  `json:"rows"`       // excluding the header
+	Incomplete int64  `json:"incomplete"` // skipped for missing coordinates or color (as in the 2017 dataset)
+	Malformed  int64  `json:"malformed"`  // skipped in lenient mode
+	FirstError string `json:"first_error,omitempty"`
+}
+
+// Skipped returns the number of rows which are not records.
+func (s ParseSummary) Skipped() int64 {
+	return s.Incomplete + s.Malformed
+}
+
+func (s *ParseSummary) add(o ParseSummary) {
+	s.Rows += o.Rows
+	s.Incomplete += o.Incomplete
+	s.Malformed += o.Malformed
+	if s.FirstError == "" {
+		s.FirstError = o.FirstError
+	}
+}
+
+// parseLines parses CSV lines from the source's dataset, the first of which is line number first.
+func (s *Source) parseLines(lines []string, first int, mode ParseMode) ([]Record, ParseSummary, error) {
+	parse := s.parseRow
+	if s.fast {
+		parse = parseLine
+	}
+	var ts timestampParser
+	records := make([]Record, 0, len(lines))
+	summary := ParseSummary{Rows: int64(len(lines))}
+	for i, line := range lines {
+		rec, ok, err := parse(line, &ts)
+		switch {
+		case err != nil && mode == Strict:
+			return nil, summary, fmt.Errorf("line %d: %w", first+i, err)
+		case err != nil:
+			if summary.Malformed++; summary.FirstError == "" {
+				summary.FirstError = fmt.Sprintf("line %d: %s", first+i, err)
+			}
+		case !ok:
+			summary.Incomplete++
+		default:
+			records = append(records, rec)
+		}
+	}
+	return records, summary, nil
+}
+
+// csvColumns is the number of columns in each line of the CSV dataset.
+const csvColumns = 5
+
+// parseLine parses a line of the CSV dataset.
+// Lines with missing coordinates or colors are skipped (ok is false).
+//
+// This is called for every one of the millions of lines in the dataset,
+// so it scans the fields in place instead of splitting the line.
+// Lines with quoted fields (which the original dataset doesn't have) are split by encoding/csv instead.
+func parseLine(line string, ts *timestampParser) (rec Record, ok bool, err error) {
+	line = strings.TrimSuffix(line, "\r")
+
+	var fields [csvColumns]string
+	if strings.IndexByte(line, '"') >= 0 {
+		quoted, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil {
+			return Record{}, false, fmt.Errorf("%w: line %q", err, line)
+		}
+		if len(quoted) != csvColumns {
+			return Record{}, false, fmt.Errorf("columns = %v, want %v: line %q", len(quoted), csvColumns, line)
+		}
+		copy(fields[:], quoted)
+	} else {
+		rest := line
+		for i := range fields {
+			if i == len(fields)-1 {
+				if strings.IndexByte(rest, ',') >= 0 {
+					return Record{}, false, fmt.Errorf("columns = %v, want %v: line %q", strings.Count(line, ",")+1, csvColumns, line)
+				}
+				fields[i] = rest
+				break
+			}
+			comma := strings.IndexByte(rest, ',')
+			if comma < 0 {
+				return Record{}, false, fmt.Errorf("columns = %v, want %v: line %q", i+1, csvColumns, line)
+			}
+			fields[i], rest = rest[:comma], rest[comma+1:]
+		}
+	}
+	var (
+		tsStr       = fields[0]
+		userHashStr = fields[1]
+		xStr, yStr  = fields[2], fields[3]
+		colorStr    = fields[4]
+	)
+	if len(xStr) == 0 || len(yStr) == 0 || len(colorStr) == 0 {
+		return Record{}, false, nil
+	}
+
+	millis, err := ts.parse(tsStr)
+	if err != nil {
+		return Record{}, false, fmt.Errorf("timestamp %q invalid: %s", tsStr, err)
+	}
+	var userHash [16]byte
+	if err := decodeUserHash(&userHash, userHashStr); err != nil {
+		return Record{}, false, fmt.Errorf("user hash %q invalid: %s", userHashStr, err)
+	}
+	x, err := strconv.ParseInt(xStr, 10, 16)
+	if err != nil {
+		return Record{}, false, fmt.Errorf("x coordinate %q invalid: %s", xStr, err)
+	}
+	y, err := strconv.ParseInt(yStr, 10, 16)
+	if err != nil {
+		return Record{}, false, fmt.Errorf("y coordinate %q invalid: %s", yStr, err)
+	}
+	color, err := strconv.ParseUint(colorStr, 10, 8)
+	if err != nil {
+		return Record{}, false, fmt.Errorf("color %q invalid: %s", colorStr, err)
+	}
+
+	return Record{
+		UnixMillis: millis,
+		UserHash:   userHash,
+		X:          int16(x),
+		Y:          int16(y),
+		Color:      uint8(color),
+	}, true, nil
+}
+
+// userHashLen is the length of a base64-encoded user hash.
+var userHashLen = base64.StdEncoding.EncodedLen(len(Record{}.UserHash))
+
+// ParseUserHash parses a user hash in the base64 form used by the CSV dataset.
+func ParseUserHash(s string) ([16]byte, error) {
+	var hash [16]byte
+	if err := decodeUserHash(&hash, s); err != nil {
+		return hash, fmt.Errorf("user hash %q invalid: %w", s, err)
+	}
+	return hash, nil
+}
+
+// decodeUserHash decodes a base64 user hash directly into its fixed-size form,
+// without allocating an intermediate slice for each of the millions of records.
+func decodeUserHash(dst *[16]byte, s string) error {
+	if len(s) != userHashLen {
+		return fmt.Errorf("length %d, want %d", len(s), userHashLen)
+	}
+	var buf [18]byte // base64.StdEncoding.DecodedLen(userHashLen), which includes the padding
+	n, err := base64.StdEncoding.Decode(buf[:], []byte(s))
+	if err != nil {
+		return err
+	}
+	if n != len(dst) {
+		return fmt.Errorf("decoded %d bytes, want %d", n, len(dst))
+	}
+	copy(dst[:], buf[:n])
+	return nil
+}
+
+// A timestampParser parses timestamps in TimestampLayout into UnixMillis.
+//
+// Consecutive records are usually in the same second, so it caches the
+// parsed value of the most recent "2006-01-02 15:04:05" prefix and only
+// parses the milliseconds by hand, falling back to time.Parse for anything
+// that isn't in the expected UTC form.
+type timestampParser struct {
+	prefix string
+	base   int64 // UnixMillis of prefix
+}
+
+const (
+	timestampSecondsLayout = "2006-01-02 15:04:05"
+	timestampZoneSuffix    = " UTC"
+)
+
+func (p *timestampParser) parse(s string) (int64, error) {
+	if len(s) < len(timestampSecondsLayout)+len(timestampZoneSuffix) || !strings.HasSuffix(s, timestampZoneSuffix) {
+		return p.slowParse(s)
+	}
+
+	prefix := s[:len(timestampSecondsLayout)]
+	if prefix != p.prefix {
+		t, err := time.Parse(timestampSecondsLayout, prefix)
+		if err != nil {
+			return p.slowParse(s)
+		}
+		p.prefix, p.base = prefix, t.UnixMilli()
+	}
+
+	// The fraction is optional and has trailing zeroes trimmed, so it may be ".1" through ".999".
+	frac := s[len(timestampSecondsLayout) : len(s)-len(timestampZoneSuffix)]
+	if frac == "" {
+		return p.base, nil
+	}
+	if len(frac) < 2 || len(frac) > 4 || frac[0] != '.' {
+		return p.slowParse(s)
+	}
+	var millis int64
+	for i := 1; i < 4; i++ {
+		millis *= 10
+		if i >= len(frac) {
+			continue
+		}
+		d := frac[i]
+		if d < '0' || d > '9' {
+			return p.slowParse(s)
+		}
+		millis += int64(d - '0')
+	}
+	return p.base + millis, nil
+}
+
+func (p *timestampParser) slowParse(s string) (int64, error) {
+	ts, err := time.Parse(TimestampLayout, s)
+	if err != nil {
+		return 0, err
+	}
+	return ts.UnixMilli(), nil
+}
@@ -0,0 +1,299 @@
+package dataset
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testHash = "ovTZk4GyTS1mDQnTbV+vDg=="
+	testLine = "2017-04-01 12:00:00.123 UTC," + testHash + ",1,2,3"
+)
+
+var testRecord = Record{
+	UnixMillis: time.Date(2017, 4, 1, 12, 0, 0, 123e6, time.UTC).UnixMilli(),
+	UserHash:   [16]byte{0xa2, 0xf4, 0xd9, 0x93, 0x81, 0xb2, 0x4d, 0x2d, 0x66, 0x0d, 0x09, 0xd3, 0x6d, 0x5f, 0xaf, 0x0e},
+	X:          1,
+	Y:          2,
+	Color:      3,
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Record
+		ok      bool
+		wantErr string
+	}{
+		{name: "plain", line: testLine, want: testRecord, ok: true},
+		{name: "crlf", line: testLine + "\r", want: testRecord, ok: true},
+		{name: "quoted", line: `"2017-04-01 12:00:00.123 UTC","` + testHash + `","1","2","3"`, want: testRecord, ok: true},
+		{name: "quoted comma", line: `"2017-04-01 12:00:00.123 UTC","a,b",1,2,3`, wantErr: "user hash"},
+		{name: "whole seconds", line: "2017-04-01 12:00:00 UTC," + testHash + ",1,2,3",
+			want: Record{UnixMillis: testRecord.UnixMillis - 123, UserHash: testRecord.UserHash, X: 1, Y: 2, Color: 3}, ok: true},
+		{name: "incomplete", line: "2017-04-01 12:00:00.123 UTC," + testHash + ",,,"},
+		{name: "too few columns", line: "2017-04-01 12:00:00.123 UTC," + testHash + ",1,2", wantErr: "columns = 4, want 5"},
+		{name: "too many columns", line: testLine + ",4", wantErr: "columns = 6, want 5"},
+		{name: "bad timestamp", line: "yesterday," + testHash + ",1,2,3", wantErr: "timestamp"},
+		{name: "bad fraction", line: "2017-04-01 12:00:00.1x3 UTC," + testHash + ",1,2,3", wantErr: "timestamp"},
+		{name: "bad hash", line: "2017-04-01 12:00:00.123 UTC,nope,1,2,3", wantErr: "user hash"},
+		{name: "bad x", line: "2017-04-01 12:00:00.123 UTC," + testHash + ",x,2,3", wantErr: "x coordinate"},
+		{name: "huge y", line: "2017-04-01 12:00:00.123 UTC," + testHash + ",1,99999,3", wantErr: "y coordinate"},
+		{name: "bad color", line: "2017-04-01 12:00:00.123 UTC," + testHash + ",1,2,256", wantErr: "color"},
+		{name: "unterminated quote", line: `"2017-04-01,` + testHash + ",1,2,3", wantErr: "line"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ts timestampParser
+			got, ok, err := parseLine(test.line, &ts)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("parseLine(%q) error = %v, want one containing %q", test.line, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLine(%q) error = %v", test.line, err)
+			}
+			if got != test.want || ok != test.ok {
+				t.Errorf("parseLine(%q) = %+v, %v, want %+v, %v", test.line, got, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func BenchmarkParseLine(b *testing.B) {
+	lines := map[string]string{
+		"plain":  testLine,
+		"quoted": `"2017-04-01 12:00:00.123 UTC","` + testHash + `","1","2","3"`,
+	}
+	for name, line := range lines {
+		b.Run(name, func(b *testing.B) {
+			var ts timestampParser
+			b.SetBytes(int64(len(line)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := parseLine(line, &ts); err != nil {
+					b.Fatalf("parseLine(%q): %s", line, err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseLines(t *testing.T) {
+	lines := []string{
+		testLine,
+		"2017-04-01 12:00:00.123 UTC," + testHash + ",,,", // incomplete
+		"garbage",
+		testLine + "\r",
+		"2017-04-01 12:00:00.123 UTC," + testHash + ",1,2,x",
+	}
+	t.Run("strict", func(t *testing.T) {
+		_, _, err := Source2017.parseLines(lines, 10, Strict)
+		if err == nil || !strings.HasPrefix(err.Error(), "line 12: ") {
+			t.Errorf("parseLines error = %v, want one for line 12", err)
+		}
+	})
+	t.Run("lenient", func(t *testing.T) {
+		records, summary, err := Source2017.parseLines(lines, 10, Lenient)
+		if err != nil {
+			t.Fatalf("parseLines error = %v", err)
+		}
+		if len(records) != 2 || records[0] != testRecord || records[1] != testRecord {
+			t.Errorf("parseLines records = %+v, want 2 of %+v", records, testRecord)
+		}
+		want := ParseSummary{Rows: 5, Incomplete: 1, Malformed: 2}
+		if got := summary; got.Rows != want.Rows || got.Incomplete != want.Incomplete || got.Malformed != want.Malformed {
+			t.Errorf("parseLines summary = %+v, want %+v", got, want)
+		}
+		if !strings.HasPrefix(summary.FirstError, "line 12: ") {
+			t.Errorf("parseLines FirstError = %q, want the error for line 12", summary.FirstError)
+		}
+	})
+}
+
+// testSource is a source whose rows are laid out differently from the 2017 dataset.
+func testSource(t testing.TB) *Source {
+	s := &Source{
+		Name:            "test",
+		Columns:         []string{ColumnX, ColumnY, "", ColumnColor, ColumnUser, ColumnTime},
+		TimestampLayout: UnixMillis,
+		Palette:         []string{"#000000", "#FFFFFF", "#FF4500"},
+		CanvasSize:      500,
+	}
+	if err := s.compile(); err != nil {
+		t.Fatalf("compile: %s", err)
+	}
+	return s
+}
+
+func TestParseRow(t *testing.T) {
+	src := testSource(t)
+	millis := testRecord.UnixMillis
+	tests := []struct {
+		name    string
+		line    string
+		want    Record
+		ok      bool
+		wantErr string
+	}{
+		{name: "index", line: fmt.Sprintf("1,2,ignored,2,%s,%d", testHash, millis), want: Record{millis, testRecord.UserHash, 1, 2, 2}, ok: true},
+		{name: "hex", line: fmt.Sprintf("1,2,,#ff4500,%s,%d\r", testHash, millis), want: Record{millis, testRecord.UserHash, 1, 2, 2}, ok: true},
+		{name: "quoted", line: fmt.Sprintf(`"1","2","a,b","#FFFFFF","%s","%d"`, testHash, millis), want: Record{millis, testRecord.UserHash, 1, 2, 1}, ok: true},
+		{name: "incomplete", line: fmt.Sprintf(",,,,%s,%d", testHash, millis)},
+		{name: "outside", line: fmt.Sprintf("500,2,,1,%s,%d", testHash, millis), wantErr: "outside the 500px canvas"},
+		{name: "not in palette", line: fmt.Sprintf("1,2,,#123456,%s,%d", testHash, millis), wantErr: "not in the palette"},
+		{name: "index out of palette", line: fmt.Sprintf("1,2,,3,%s,%d", testHash, millis), wantErr: "3-color palette"},
+		{name: "columns", line: "1,2,3", wantErr: "columns = 3, want 6"},
+		{name: "timestamp", line: fmt.Sprintf("1,2,,1,%s,soon", testHash), wantErr: "timestamp"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok, err := src.parseRow(test.line, new(timestampParser))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("parseRow(%q) error = %v, want one containing %q", test.line, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRow(%q) error = %v", test.line, err)
+			}
+			if got != test.want || ok != test.ok {
+				t.Errorf("parseRow(%q) = %+v, %v, want %+v, %v", test.line, got, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func TestParseRow2023(t *testing.T) {
+	millis := time.Date(2023, 7, 20, 13, 0, 26, 88e6, time.UTC).UnixMilli()
+	user := "w9yIB0HLTrzS5SVwGfv/L9M2FUjcgAsX93NQxBu4FRuzMUR8Fr4TDWzCKEDivjkTr0sRJi3BXdo2aYbf6KBcfA=="
+	hash := md5.Sum([]byte(user))
+	tests := []struct {
+		name    string
+		line    string
+		want    Record
+		ok      bool
+		wantErr string
+	}{
+		{name: "center", line: `2023-07-20 13:00:26.088 UTC,` + user + `,"0,0",#FF4500`, want: Record{millis, hash, 1500, 1000, 7}, ok: true},
+		{name: "top left", line: `2023-07-20 13:00:26.088 UTC,` + user + `,"-1500,-1000",#ffffff`, want: Record{millis, hash, 0, 0, 0}, ok: true},
+		{name: "bottom right", line: `2023-07-20 13:00:26.088 UTC,` + user + `,"1499,999",#000000`, want: Record{millis, hash, 2999, 1999, 4}, ok: true},
+		{name: "rectangle", line: `2023-07-20 13:00:26.088 UTC,` + user + `,"-10,-10,10,10",#FFFFFF`},
+		{name: "circle", line: `2023-07-20 13:00:26.088 UTC,` + user + `,"{X: 10, Y: 20, R: 5}",#FFFFFF`},
+		{name: "outside", line: `2023-07-20 13:00:26.088 UTC,` + user + `,"1500,0",#FFFFFF`, wantErr: "outside the 3000x2000 canvas"},
+		{name: "one number", line: `2023-07-20 13:00:26.088 UTC,` + user + `,"12",#FFFFFF`, wantErr: "is not x,y"},
+		{name: "not in palette", line: `2023-07-20 13:00:26.088 UTC,` + user + `,"0,0",#123456`, wantErr: "not in the palette"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok, err := Source2023.parseRow(test.line, new(timestampParser))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("parseRow(%q) error = %v, want one containing %q", test.line, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRow(%q) error = %v", test.line, err)
+			}
+			if got != test.want || ok != test.ok {
+				t.Errorf("parseRow(%q) = %+v, %v, want %+v, %v", test.line, got, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func TestSourceColumnsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []string
+		want    string
+	}{
+		{"x and coordinate", []string{ColumnTime, ColumnUser, ColumnX, ColumnCoordinate, ColumnColor}, `"x" is also in column 4`},
+		{"two coordinates", []string{ColumnTime, ColumnUser, ColumnCoordinate, ColumnCoordinate, ColumnColor}, `"coordinate" is also column 3`},
+		{"no y", []string{ColumnTime, ColumnUser, ColumnX, ColumnColor}, `no "y" column`},
+	}
+	for _, test := range tests {
+		s := &Source{Name: "test", Columns: test.columns}
+		if err := s.compile(); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: compile error = %v, want one containing %q", test.name, err, test.want)
+		}
+	}
+}
+
+// formatLine formats a record as a line of the 2017 dataset.
+func formatLine(rec Record) string {
+	return fmt.Sprintf("%s,%s,%d,%d,%d", rec.Time().Format(TimestampLayout),
+		base64.StdEncoding.EncodeToString(rec.UserHash[:]), rec.X, rec.Y, rec.Color)
+}
+
+// FuzzParseLine checks that parseLine doesn't panic, and that whatever it parses
+// is the same record when formatted and parsed again.
+func FuzzParseLine(f *testing.F) {
+	for _, seed := range []string{
+		testLine,
+		testLine + "\r",
+		"2017-04-01 12:00:00 UTC," + testHash + ",1,2,3",
+		"2017-04-01 12:00:00.1 UTC," + testHash + ",999,999,15",
+		"2017-04-01 12:00:00.123 UTC," + testHash + ",,,",
+		`"2017-04-01 12:00:00.123 UTC","` + testHash + `","1","2","3"`,
+		`"unterminated,` + testHash + ",1,2,3",
+		"2017-04-01 12:00:00.12345 UTC," + testHash + ",1,2,3",
+		"2017-04-01 12:00:00.-12 UTC," + testHash + ",1,2,3",
+		"2017-04-01 12:00:00.123 PST," + testHash + ",1,2,3",
+		"2017-04-01 12:00:00.123 UTC," + testHash + ",-1,-32768,0",
+		",,,,",
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		rec, ok, err := parseLine(line, new(timestampParser))
+		if err != nil || !ok {
+			return
+		}
+		again, ok, err := parseLine(formatLine(rec), new(timestampParser))
+		if err != nil || !ok || again != rec {
+			t.Errorf("parseLine(%q) = %+v, but parsing it again as %q = %+v, %v, %v", line, rec, formatLine(rec), again, ok, err)
+		}
+	})
+}
+
+// FuzzParseRow checks that parseRow doesn't panic, and that whatever it parses is on the canvas and in the palette.
+func FuzzParseRow(f *testing.F) {
+	for _, seed := range []string{
+		fmt.Sprintf("1,2,,2,%s,%d", testHash, testRecord.UnixMillis),
+		fmt.Sprintf("1,2,,#ff4500,%s,%d\r", testHash, testRecord.UnixMillis),
+		fmt.Sprintf(`"1","2","a,b","#FFFFFF","%s","%d"`, testHash, testRecord.UnixMillis),
+		"499,499,,0,any user,0",
+		"500,0,,0,u,0",
+		"-1,0,,0,u,0",
+		"0,0,,#,u,0",
+		",,,,u,0",
+		`"`,
+		"",
+	} {
+		f.Add(seed)
+	}
+	src := testSource(f)
+	f.Fuzz(func(t *testing.T, line string) {
+		rec, ok, err := src.parseRow(line, new(timestampParser))
+		if err != nil || !ok {
+			return
+		}
+		if rec.X < 0 || int(rec.X) >= src.CanvasSize || rec.Y < 0 || int(rec.Y) >= src.CanvasSize {
+			t.Errorf("parseRow(%q) = %+v, which is outside the %dpx canvas", line, rec, src.CanvasSize)
+		}
+		if int(rec.Color) >= len(src.palette) {
+			t.Errorf("parseRow(%q) = %+v, whose color isn't in the %d-color palette", line, rec, len(src.palette))
+		}
+	})
+}
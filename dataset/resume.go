@@ -0,0 +1,175 @@
+package dataset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// A download in progress keeps the bytes received so far next to its output file, so that
+// an interrupted download can be resumed with a Range request instead of starting over.
+// The partial body is accompanied by a small file recording the URL it came from and the
+// validator (ETag or Last-Modified) which the server is asked to match with If-Range.
+const (
+	partialSuffix   = ".partial"
+	validatorSuffix = ".partial.validator"
+)
+
+// partialFiles returns the paths of the partial body and its validator for outputFile.
+func partialFiles(outputFile string) (body, validator string) {
+	return outputFile + partialSuffix, outputFile + validatorSuffix
+}
+
+// removePartial removes the partial download for outputFile, if any.
+func removePartial(outputFile string) {
+	body, validator := partialFiles(outputFile)
+	for _, name := range []string{body, validator} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			glog.Warningf("Failed to remove partial download: %s", err)
+		}
+	}
+}
+
+// resumeOffset returns how many bytes of datasetURL were previously received for outputFile,
+// and the validator with which they can be resumed. The offset is 0 if there is nothing to resume.
+func resumeOffset(outputFile string, datasetURL *url.URL) (offset int64, validator string) {
+	bodyFile, validatorFile := partialFiles(outputFile)
+	meta, err := os.ReadFile(validatorFile)
+	if err != nil {
+		return 0, ""
+	}
+	fromURL, validator, ok := strings.Cut(strings.TrimSuffix(string(meta), "\n"), "\n")
+	if !ok || fromURL != datasetURL.String() || validator == "" {
+		return 0, ""
+	}
+	fi, err := os.Stat(bodyFile)
+	if err != nil {
+		return 0, ""
+	}
+	return fi.Size(), validator
+}
+
+// fetch starts (or, if part of it was already received, resumes) the download of datasetURL
+// for outputFile. It returns the whole body, from the start, and its total size.
+// The bytes received are appended to the partial download as they are read from the body.
+// Local files are simply opened, and BigQuery tables are queried.
+func fetch(ctx context.Context, outputFile string, datasetURL *url.URL) (io.ReadCloser, int64, error) {
+	if IsLocal(datasetURL) {
+		f, size, err := openLocal(datasetURL)
+		if err != nil {
+			return nil, 0, fmt.Errorf("opening %q: %w", datasetURL, err)
+		}
+		return f, size, nil
+	}
+	if datasetURL.Scheme == BigQueryScheme {
+		return fetchBigQuery(ctx, datasetURL)
+	}
+
+	offset, validator := resumeOffset(outputFile, datasetURL)
+
+	header := make(http.Header)
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		header.Set("If-Range", validator)
+	}
+	req, err := newSourceRequest(ctx, http.MethodGet, datasetURL, header)
+	if err != nil {
+		return nil, 0, fmt.Errorf("creating request for %q: %w", datasetURL, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, transientError{fmt.Errorf("starting download of %q: %w", datasetURL, err)}
+	}
+	body := transientReader{resp.Body}
+
+	bodyFile, validatorFile := partialFiles(outputFile)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		var start, end, total int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil || start != offset {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("GET %q returned Content-Range %q, expecting bytes from %d",
+				datasetURL, resp.Header.Get("Content-Range"), offset)
+		}
+		received, err := os.Open(bodyFile)
+		if err != nil {
+			resp.Body.Close()
+			return nil, 0, err
+		}
+		rest, err := os.OpenFile(bodyFile, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			received.Close()
+			resp.Body.Close()
+			return nil, 0, err
+		}
+		glog.Infof("Resuming download of %q at %d of %d bytes", datasetURL, offset, total)
+		return &partialBody{
+			Reader:  io.MultiReader(io.LimitReader(received, offset), io.TeeReader(body, rest)),
+			closers: []io.Closer{resp.Body, received, rest},
+		}, total, nil
+
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial download doesn't match what the server has; start over.
+		resp.Body.Close()
+		glog.Warningf("Discarding partial download of %q: server returned %q", datasetURL, resp.Status)
+		removePartial(outputFile)
+		return fetch(ctx, outputFile, datasetURL)
+
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		err := fmt.Errorf("GET %q returned %q", datasetURL, resp.Status)
+		if transientStatus(resp.StatusCode) {
+			return nil, 0, transientError{err}
+		}
+		return nil, 0, err
+	case resp.ContentLength <= 0:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("GET %q returned unknown Content-Length", datasetURL)
+	}
+
+	// The whole body is being sent (e.g. the file changed since it was partially received).
+	if offset > 0 {
+		glog.Warningf("Restarting download of %q: server sent the whole file", datasetURL)
+	}
+	removePartial(outputFile)
+	rest, err := os.Create(bodyFile)
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+	// Without a strong validator, a later request can't tell whether the file changed, so it can't resume.
+	validator = resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if validator != "" {
+		if err := os.WriteFile(validatorFile, []byte(datasetURL.String()+"\n"+validator+"\n"), 0644); err != nil {
+			glog.Warningf("Download of %q won't be resumable: %s", datasetURL, err)
+		}
+	}
+	return &partialBody{
+		Reader:  io.TeeReader(body, rest),
+		closers: []io.Closer{resp.Body, rest},
+	}, resp.ContentLength, nil
+}
+
+// partialBody is a response body which is also being saved as a partial download.
+type partialBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *partialBody) Close() error {
+	var errs []error
+	for _, c := range b.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
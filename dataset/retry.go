@@ -0,0 +1,72 @@
+package dataset
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// A RetryPolicy says how often (and how soon) a download which failed transiently,
+// e.g. because of a network error or a 5xx response, is retried.
+// A retried download resumes where the previous attempt left off, if the server supports it.
+type RetryPolicy struct {
+	Attempts   int           // in all, including the first; 1 or less to never retry
+	Backoff    time.Duration // before the first retry, doubled before each one after that
+	MaxBackoff time.Duration // at most, between attempts (unless Backoff is longer)
+}
+
+// DownloadRetry is the retry policy of Download.
+var DownloadRetry = RetryPolicy{
+	Attempts:   4,
+	Backoff:    time.Second,
+	MaxBackoff: 30 * time.Second,
+}
+
+// delay returns how long to wait after the given (failed) attempt, which is the backoff with
+// up to half of it taken off at random, so that many clients don't all retry at once.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d, limit := p.Backoff, max(p.Backoff, p.MaxBackoff)
+	for i := 1; i < attempt && d < limit; i++ {
+		d *= 2
+	}
+	d = min(d, limit)
+	if d <= 0 {
+		return 0
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// A transientError is an error which may not happen again if the download is retried.
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string { return e.err.Error() }
+func (e transientError) Unwrap() error { return e.err }
+
+// isTransient reports whether err (which didn't come from the context being done) is worth retrying.
+func isTransient(err error) bool {
+	var t transientError
+	return errors.As(err, &t) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// transientStatus reports whether a response with the given status may succeed if retried.
+func transientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// transientReader marks the errors reading from a response body (other than its end) as transient.
+type transientReader struct {
+	io.ReadCloser
+}
+
+func (r transientReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = transientError{err}
+	}
+	return n, err
+}
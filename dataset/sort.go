@@ -0,0 +1,93 @@
+package dataset
+
+import (
+	"context"
+	"runtime"
+	"sort"
+
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+// minParallelSort is the minimum number of records for which sortByTime sorts in parallel.
+const minParallelSort = 1 << 16
+
+// sortByTime stably sorts the records by time.
+//
+// The records are split into one run per CPU, which are sorted in parallel
+// (or skipped if already sorted, which is common since the dataset is mostly
+// in time order already) and then merged pairwise, also in parallel.
+func sortByTime(records []Record) {
+	if isSortedByTime(records) {
+		return
+	}
+	workers := runtime.GOMAXPROCS(0)
+	if len(records) < minParallelSort || workers == 1 {
+		sortRun(records)
+		return
+	}
+
+	n := len(records)
+	width := (n + workers - 1) / workers
+
+	pool := gsync.NewPool(context.Background(), workers)
+	for lo := 0; lo < n; lo += width {
+		run := records[lo:min(lo+width, n)]
+		pool.Go(func(context.Context) error {
+			sortRun(run)
+			return nil
+		})
+	}
+	pool.Wait()
+
+	src, dst := records, make([]Record, n)
+	for ; width < n; width *= 2 {
+		pool := gsync.NewPool(context.Background(), workers)
+		for lo := 0; lo < n; lo += 2 * width {
+			lo, mid, hi := lo, min(lo+width, n), min(lo+2*width, n)
+			pool.Go(func(context.Context) error {
+				mergeByTime(dst[lo:hi], src[lo:mid], src[mid:hi])
+				return nil
+			})
+		}
+		pool.Wait()
+		src, dst = dst, src
+	}
+	if &src[0] != &records[0] {
+		copy(records, src)
+	}
+}
+
+func isSortedByTime(records []Record) bool {
+	for i := 1; i < len(records); i++ {
+		if records[i].UnixMillis < records[i-1].UnixMillis {
+			return false
+		}
+	}
+	return true
+}
+
+func sortRun(run []Record) {
+	if isSortedByTime(run) {
+		return
+	}
+	sort.SliceStable(run, func(i, j int) bool {
+		return run[i].UnixMillis < run[j].UnixMillis
+	})
+}
+
+// mergeByTime merges the sorted runs a and b into dst, preferring a for equal times.
+func mergeByTime(dst, a, b []Record) {
+	i, j, k := 0, 0, 0
+	for i < len(a) && j < len(b) {
+		if b[j].UnixMillis < a[i].UnixMillis {
+			dst[k] = b[j]
+			j++
+		} else {
+			dst[k] = a[i]
+			i++
+		}
+		k++
+	}
+	k += copy(dst[k:], a[i:])
+	copy(dst[k:], b[j:])
+}
@@ -0,0 +1,532 @@
+package dataset
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+// The fields of a record, as named in Source.Columns.
+const (
+	ColumnTime  = "ts"
+	ColumnUser  = "user"
+	ColumnX     = "x"
+	ColumnY     = "y"
+	ColumnColor = "color"
+
+	// ColumnCoordinate holds both coordinates of a pixel, as "x,y" (instead of ColumnX and ColumnY).
+	ColumnCoordinate = "coordinate"
+)
+
+var sourceFields = [...]string{ColumnTime, ColumnUser, ColumnX, ColumnY, ColumnColor}
+
+// Layouts for Source.TimestampLayout which aren't time.Parse layouts.
+const (
+	UnixSeconds = "unix"
+	UnixMillis  = "unix_ms"
+)
+
+// maxSourceColors is the most colors a source's palette can have, one for each value of Record.Color.
+const maxSourceColors = 256
+
+// A Source describes a CSV dataset of pixel events: where it can be downloaded from,
+// and how its rows are laid out. It can be read from JSON (e.g. a --source-config file).
+type Source struct {
+	Name string   `json:"name"`
+	URLs []string `json:"urls,omitempty"` // in order of preference; file:// URLs (or paths) are local files, and gs:// and s3:// are objects
+	// Shards holds the URLs of the parts of a dataset which is published in pieces (instead of URLs),
+	// each with its own header, which are downloaded in turn by DownloadShards.
+	Shards []string `json:"shards,omitempty"`
+	Year   int      `json:"year,omitempty"` // of r/place, for the official datasets
+
+	// Header is the required first line, or "" if the first line (which must be a header) isn't checked.
+	Header string `json:"header,omitempty"`
+	// Columns holds what each column of a row is: ts, user, x, y, coordinate, or color (or "" if it is ignored).
+	// A coordinate column can hold the x and y of a pixel instead of separate columns.
+	// Users are either the base64 hashes of the 2017 dataset or any other IDs, which are hashed.
+	// Colors are either indices into the palette, or "#RRGGBB" colors in it.
+	Columns []string `json:"columns"`
+	// TimestampLayout is the time.Parse layout of the timestamps (default TimestampLayout),
+	// or unix or unix_ms for seconds or milliseconds since the Unix epoch.
+	TimestampLayout string `json:"timestamp_layout,omitempty"`
+	// Palette holds the "#RRGGBB" colors (up to 256) of the canvas, by index (default: the 2017 palette).
+	Palette    []string `json:"palette,omitempty"`
+	ColorNames []string `json:"color_names,omitempty"`
+	CanvasSize int      `json:"canvas_size,omitempty"` // width and height of a square canvas (default: 1000, as in 2017)
+	Width      int      `json:"width,omitempty"`       // of a canvas which isn't square (default: CanvasSize)
+	Height     int      `json:"height,omitempty"`
+	// OriginX and OriginY are the coordinates in the CSV of the top-left pixel of the canvas
+	// (e.g. -1500,-1000 for the 2023 canvas, which is centered on 0,0), which is at 0,0 in the records.
+	OriginX int `json:"origin_x,omitempty"`
+	OriginY int `json:"origin_y,omitempty"`
+
+	fast       bool                   // parsed by parseLine, as the 2017 dataset
+	columns    [len(sourceFields)]int // of each field
+	coordinate int                    // column of ColumnCoordinate, or -1
+	palette    color.Palette
+	colorIndex map[string]uint8 // of each "#RRGGBB" color
+}
+
+// Source2017 is the 2017 dataset, which is parsed by a faster path than other sources.
+var Source2017 = &Source{
+	Name:            "2017",
+	Year:            Year,
+	URLs:            []string{"https://storage.googleapis.com/justin_bassett/place_tiles"},
+	Header:          RequiredHeader,
+	Columns:         sourceFields[:],
+	TimestampLayout: TimestampLayout,
+	CanvasSize:      defaultCanvasSize,
+	fast:            true,
+}
+
+// Source2023 is the 2023 dataset, which was published in 53 gzipped shards. Its canvas is 3000x2000,
+// centered on 0,0, and its palette has 32 colors (with white first, since color 0 is that of a blank canvas).
+// Moderators' edits of whole regions, which are rectangles or circles instead of pixels, are skipped
+// (as incomplete rows).
+var Source2023 = &Source{
+	Name:            "2023",
+	Year:            2023,
+	Shards:          shardURLs("https://placedata.reddit.com/data/canvas-history/2023/2023_place_canvas_history-%012d.csv.gzip", 53),
+	Header:          "timestamp,user,coordinate,pixel_color",
+	Columns:         []string{ColumnTime, ColumnUser, ColumnCoordinate, ColumnColor},
+	TimestampLayout: TimestampLayout,
+	Palette: []string{
+		"#FFFFFF", "#D4D7D9", "#898D90", "#515252", "#000000", "#6D001A", "#BE0039", "#FF4500",
+		"#FFA800", "#FFD635", "#FFF8B8", "#00A368", "#00CC78", "#7EED56", "#00756F", "#009EAA",
+		"#00CCC0", "#2450A4", "#3690EA", "#51E9F4", "#493AC1", "#6A5CFF", "#94B3FF", "#811E9F",
+		"#B44AC0", "#E4ABFF", "#DE107F", "#FF3881", "#FF99AA", "#6D482F", "#9C6926", "#FFB470",
+	},
+	ColorNames: PaletteNames[2023],
+	Width:      3000,
+	Height:     2000,
+	OriginX:    -1500,
+	OriginY:    -1000,
+}
+
+// shardURLs returns the URLs of n shards, numbered from 0 in the format.
+func shardURLs(format string, n int) []string {
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf(format, i)
+	}
+	return urls
+}
+
+var (
+	sourcesMu sync.Mutex
+	sources   = make(map[string]*Source)
+)
+
+func init() {
+	for _, s := range []*Source{Source2017, Source2023} {
+		if err := RegisterSource(s); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterSource checks the source and adds it to the sources which can be found by LookupSource.
+func RegisterSource(s *Source) error {
+	if err := s.compile(); err != nil {
+		return fmt.Errorf("source %q: %w", s.Name, err)
+	}
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	if _, ok := sources[s.Name]; ok {
+		return fmt.Errorf("source %q is already registered", s.Name)
+	}
+	sources[s.Name] = s
+	return nil
+}
+
+// LookupSource returns the registered source with the given name.
+func LookupSource(name string) (*Source, bool) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	s, ok := sources[name]
+	return s, ok
+}
+
+// SourceNames returns the names of the registered sources, sorted.
+func SourceNames() []string {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compile checks the source, fills in its defaults, and prepares it for parsing.
+func (s *Source) compile() error {
+	if s.Name == "" {
+		return fmt.Errorf("no name")
+	}
+	for _, urls := range [][]string{s.URLs, s.Shards} {
+		for _, u := range urls {
+			if _, err := url.Parse(u); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range s.columns {
+		s.columns[i] = -1
+	}
+	s.coordinate = -1
+	for col, field := range s.Columns {
+		if field == "" {
+			continue
+		}
+		if field == ColumnCoordinate {
+			if s.coordinate >= 0 {
+				return fmt.Errorf("column %d: %q is also column %d", col+1, field, s.coordinate+1)
+			}
+			s.coordinate = col
+			continue
+		}
+		i := indexOf(sourceFields[:], field)
+		if i < 0 {
+			return fmt.Errorf("column %d: unknown field %q (want one of %q)", col+1, field, sourceFields)
+		}
+		if s.columns[i] >= 0 {
+			return fmt.Errorf("column %d: %q is also column %d", col+1, field, s.columns[i]+1)
+		}
+		s.columns[i] = col
+	}
+	for i, col := range s.columns {
+		inCoordinate := s.coordinate >= 0 && (sourceFields[i] == ColumnX || sourceFields[i] == ColumnY)
+		switch {
+		case inCoordinate && col >= 0:
+			return fmt.Errorf("column %d: %q is also in column %d (%q)", col+1, sourceFields[i], s.coordinate+1, ColumnCoordinate)
+		case col < 0 && !inCoordinate:
+			return fmt.Errorf("no %q column", sourceFields[i])
+		}
+	}
+	if s.TimestampLayout == "" {
+		s.TimestampLayout = TimestampLayout
+	}
+	if s.CanvasSize == 0 && s.Width == 0 && s.Height == 0 {
+		s.CanvasSize = defaultCanvasSize
+	}
+	if s.Width == 0 {
+		s.Width = s.CanvasSize
+	}
+	if s.Height == 0 {
+		s.Height = s.CanvasSize
+	}
+	if s.Width <= 0 || s.Width > 1<<15 || s.Height <= 0 || s.Height > 1<<15 {
+		return fmt.Errorf("canvas size %s out of range", s.size())
+	}
+
+	s.palette = Palette
+	if len(s.Palette) > 0 {
+		if len(s.Palette) > maxSourceColors {
+			return fmt.Errorf("%d colors in the palette, the most is %d", len(s.Palette), maxSourceColors)
+		}
+		s.palette = make(color.Palette, len(s.Palette))
+		for i, hex := range s.Palette {
+			c, err := parseHexColor(hex)
+			if err != nil {
+				return fmt.Errorf("palette: %w", err)
+			}
+			s.palette[i] = c
+		}
+	}
+	s.colorIndex = make(map[string]uint8, len(s.palette))
+	for i, c := range s.palette {
+		r, g, b, _ := c.RGBA()
+		s.colorIndex[fmt.Sprintf("#%02X%02X%02X", r>>8, g>>8, b>>8)] = uint8(i)
+	}
+	return nil
+}
+
+// size describes the size of the canvas, e.g. in errors about pixels outside it.
+func (s *Source) size() string {
+	if s.Width == s.Height {
+		return fmt.Sprintf("%dpx", s.Width)
+	}
+	return fmt.Sprintf("%dx%d", s.Width, s.Height)
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func parseHexColor(s string) (color.RGBA, error) {
+	hex, ok := strings.CutPrefix(s, "#")
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if !ok || len(hex) != 6 || err != nil {
+		return color.RGBA{}, fmt.Errorf("color %q is not #RRGGBB", s)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xFF}, nil
+}
+
+// ParsedURLs returns the URLs of the source, parsed (see ParseSourceURL).
+func (s *Source) ParsedURLs() ([]*url.URL, error) {
+	urls := make([]*url.URL, len(s.URLs))
+	for i, raw := range s.URLs {
+		u, err := ParseSourceURL(raw)
+		if err != nil {
+			return nil, fmt.Errorf("source %q: %w", s.Name, err)
+		}
+		urls[i] = u
+	}
+	return urls, nil
+}
+
+// WithURLs returns a copy of the source, which is downloaded from the given URLs instead (and not its shards).
+func (s *Source) WithURLs(urls ...string) *Source {
+	c := *s
+	c.URLs, c.Shards = urls, nil
+	return &c
+}
+
+// Use makes the palette, color names, and canvas of the source those of the package
+// (Palette, ColorName, and CanvasBounds), e.g. for a server showing its dataset.
+// It must be called before any records are rendered.
+func (s *Source) Use() {
+	Palette, colorNames = s.palette, s.ColorNames
+	canvasWidth, canvasHeight = s.Width, s.Height
+	if colorNames == nil && len(s.Palette) == 0 {
+		colorNames = PaletteNames[Year]
+	}
+}
+
+// canvasWidth and canvasHeight are the size of the canvas of the source in use (see Source.Use).
+var canvasWidth, canvasHeight = defaultCanvasSize, defaultCanvasSize
+
+// CanvasBounds returns the bounds of the canvas of the source in use (see Source.Use), within which its records are.
+func CanvasBounds() image.Rectangle {
+	return image.Rect(0, 0, canvasWidth, canvasHeight)
+}
+
+// Download is like the package's DownloadMode, but parses the rows of the source.
+func (s *Source) Download(ctx context.Context, outputFile string, datasetURL *url.URL, mode ParseMode, bar *progress.Bar) ([]Record, ParseSummary, error) {
+	return download(ctx, outputFile, datasetURL, s, mode, bar)
+}
+
+// DownloadShards downloads each of the source's Shards in turn (like Download, retrying each as it does),
+// and writes all of their records to outputFile. Each shard is kept in a file of its own next to outputFile
+// until all of them have been downloaded, so that an interrupted download resumes with the shard it was on.
+// The summary is of the rows parsed by this call, not those of shards which were already downloaded.
+//
+// Up to MaxMissingShards shards may fail to download, in which case outputFile has the rest of them
+// and the returned Coverage (also kept next to it, see ReadCoverage) records which are missing.
+// The files of the shards which were downloaded are kept, so that downloading again only fetches the others.
+func (s *Source) DownloadShards(ctx context.Context, outputFile string, mode ParseMode, bar *progress.Bar) ([]Record, ParseSummary, Coverage, error) {
+	if len(s.Shards) == 0 {
+		return nil, ParseSummary{}, Coverage{}, fmt.Errorf("source %q has no shards", s.Name)
+	}
+	var (
+		records  []Record
+		summary  ParseSummary
+		coverage = Coverage{Shards: len(s.Shards)}
+		files    []string
+		spans    = make([][2]int64, len(s.Shards)) // first and last UnixMillis of each shard, if downloaded
+	)
+	for i, raw := range s.Shards {
+		u, err := ParseSourceURL(raw)
+		if err != nil {
+			return nil, ParseSummary{}, Coverage{}, fmt.Errorf("source %q: %w", s.Name, err)
+		}
+		file := shardFile(outputFile, i)
+		files = append(files, file)
+		var recs []Record
+		if _, err = os.Stat(file); err == nil {
+			if recs, err = Load(ctx, file); err != nil {
+				glog.Warningf("Downloading shard %d of %d again: %s", i+1, len(s.Shards), err)
+			}
+		}
+		if err != nil {
+			var sum ParseSummary
+			recs, sum, err = download(ctx, file, u, s, mode, bar)
+			if err != nil {
+				if ctx.Err() != nil || len(coverage.Missing) >= MaxMissingShards {
+					return nil, ParseSummary{}, Coverage{}, fmt.Errorf("shard %d of %d: %w", i+1, len(s.Shards), err)
+				}
+				glog.Warningf("Continuing without shard %d of %d: %s", i+1, len(s.Shards), err)
+				coverage.Missing = append(coverage.Missing, MissingShard{Index: i, URL: raw, Error: err.Error()})
+				continue
+			}
+			summary.add(sum)
+		}
+		if len(recs) > 0 {
+			spans[i] = [2]int64{recs[0].UnixMillis, recs[0].UnixMillis}
+			for _, rec := range recs {
+				spans[i][0] = min(spans[i][0], rec.UnixMillis)
+				spans[i][1] = max(spans[i][1], rec.UnixMillis)
+			}
+		}
+		records = append(records, recs...)
+	}
+	if len(records) == 0 {
+		return nil, ParseSummary{}, Coverage{}, fmt.Errorf("none of the %d shards have any records", len(s.Shards))
+	}
+	for i, missing := range coverage.Missing {
+		for j := missing.Index - 1; j >= 0; j-- {
+			if spans[j] != ([2]int64{}) {
+				t := time.UnixMilli(spans[j][1]).UTC()
+				coverage.Missing[i].After = &t
+				break
+			}
+		}
+		for j := missing.Index + 1; j < len(spans); j++ {
+			if spans[j] != ([2]int64{}) {
+				t := time.UnixMilli(spans[j][0]).UTC()
+				coverage.Missing[i].Before = &t
+				break
+			}
+		}
+	}
+
+	out, err := Create(outputFile)
+	if err != nil {
+		return nil, ParseSummary{}, Coverage{}, err
+	}
+	defer out.Abort() // don't leave a partial file behind
+	sortByTime(records)
+	for i, rec := range records {
+		if err := out.Write(rec); err != nil {
+			return nil, ParseSummary{}, Coverage{}, fmt.Errorf("record %d: encoding record: %w", i+1, err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return nil, ParseSummary{}, Coverage{}, err
+	}
+	if err := writeCoverage(outputFile, coverage); err != nil {
+		return nil, ParseSummary{}, Coverage{}, fmt.Errorf("recording coverage: %w", err)
+	}
+	if !coverage.Complete() {
+		glog.Warningf("Combined %d of %d shards (%d records) into %s", len(files)-len(coverage.Missing), len(files), len(records), outputFile)
+		return records, summary, coverage, nil
+	}
+	for _, file := range files {
+		os.Remove(file)
+	}
+	glog.Infof("Combined %d shards (%d records) into %s", len(files), len(records), outputFile)
+	return records, summary, coverage, nil
+}
+
+// shardFile returns the name of the file in which the i'th shard of outputFile is kept until all have been downloaded.
+func shardFile(outputFile string, i int) string {
+	base, suffix := outputFile, FileSuffixes[0]
+	for _, s := range FileSuffixes {
+		if strings.HasSuffix(outputFile, s) {
+			base, suffix = strings.TrimSuffix(outputFile, s), s
+			break
+		}
+	}
+	return fmt.Sprintf("%s.shard%03d%s", base, i, suffix)
+}
+
+// Import is like the package's ImportMode, but parses the rows of the source.
+func (s *Source) Import(ctx context.Context, outputFile string, r io.Reader, mode ParseMode, bar *progress.Bar) ([]Record, ParseSummary, error) {
+	return importCSV(ctx, outputFile, r, s, mode, bar)
+}
+
+// parseRow parses a row of the source, which isn't the 2017 dataset.
+// Like parseLine, rows with missing coordinates or colors are skipped (ok is false).
+func (s *Source) parseRow(line string, ts *timestampParser) (rec Record, ok bool, err error) {
+	line = strings.TrimSuffix(line, "\r")
+	var fields []string
+	if strings.IndexByte(line, '"') >= 0 {
+		if fields, err = csv.NewReader(strings.NewReader(line)).Read(); err != nil {
+			return Record{}, false, fmt.Errorf("%w: line %q", err, line)
+		}
+	} else {
+		fields = strings.Split(line, ",")
+	}
+	if len(fields) != len(s.Columns) {
+		return Record{}, false, fmt.Errorf("columns = %v, want %v: line %q", len(fields), len(s.Columns), line)
+	}
+	var (
+		tsStr      = fields[s.columns[0]]
+		userStr    = fields[s.columns[1]]
+		xStr, yStr string
+		colorStr   = fields[s.columns[4]]
+	)
+	if s.coordinate >= 0 {
+		coord := fields[s.coordinate]
+		if strings.HasPrefix(coord, "{") || strings.Count(coord, ",") == 3 {
+			return Record{}, false, nil // a circle or rectangle drawn by a moderator, not a pixel
+		}
+		var ok bool
+		if xStr, yStr, ok = strings.Cut(coord, ","); !ok && coord != "" {
+			return Record{}, false, fmt.Errorf("coordinate %q is not x,y", coord)
+		}
+	} else {
+		xStr, yStr = fields[s.columns[2]], fields[s.columns[3]]
+	}
+	if len(xStr) == 0 || len(yStr) == 0 || len(colorStr) == 0 {
+		return Record{}, false, nil
+	}
+
+	switch s.TimestampLayout {
+	case UnixSeconds, UnixMillis:
+		v, err := strconv.ParseInt(tsStr, 10, 64)
+		if err != nil {
+			return Record{}, false, fmt.Errorf("timestamp %q invalid: %s", tsStr, err)
+		}
+		if rec.UnixMillis = v; s.TimestampLayout == UnixSeconds {
+			rec.UnixMillis = v * 1000
+		}
+	case TimestampLayout:
+		if rec.UnixMillis, err = ts.parse(tsStr); err != nil {
+			return Record{}, false, fmt.Errorf("timestamp %q invalid: %s", tsStr, err)
+		}
+	default:
+		t, err := time.Parse(s.TimestampLayout, tsStr)
+		if err != nil {
+			return Record{}, false, fmt.Errorf("timestamp %q invalid: %s", tsStr, err)
+		}
+		rec.UnixMillis = t.UnixMilli()
+	}
+	if decodeUserHash(&rec.UserHash, userStr) != nil {
+		rec.UserHash = md5.Sum([]byte(userStr)) // as a Builder identifies users
+	}
+	x, err := strconv.ParseInt(xStr, 10, 16)
+	if x -= int64(s.OriginX); err != nil || x < 0 || int(x) >= s.Width {
+		return Record{}, false, fmt.Errorf("x coordinate %q invalid or outside the %s canvas", xStr, s.size())
+	}
+	y, err := strconv.ParseInt(yStr, 10, 16)
+	if y -= int64(s.OriginY); err != nil || y < 0 || int(y) >= s.Height {
+		return Record{}, false, fmt.Errorf("y coordinate %q invalid or outside the %s canvas", yStr, s.size())
+	}
+	rec.X, rec.Y = int16(x), int16(y)
+	if strings.HasPrefix(colorStr, "#") {
+		c, ok := s.colorIndex[strings.ToUpper(colorStr)]
+		if !ok {
+			return Record{}, false, fmt.Errorf("color %q is not in the palette", colorStr)
+		}
+		rec.Color = c
+	} else {
+		c, err := strconv.ParseUint(colorStr, 10, 8)
+		if err != nil || int(c) >= len(s.palette) {
+			return Record{}, false, fmt.Errorf("color %q invalid or not in the %d-color palette", colorStr, len(s.palette))
+		}
+		rec.Color = uint8(c)
+	}
+	return rec, true, nil
+}
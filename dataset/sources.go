@@ -0,0 +1,93 @@
+package dataset
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ProbeTimeout limits how long each source is given to respond to a probe.
+const ProbeTimeout = 10 * time.Second
+
+// A SourceProbe is the result of checking whether a dataset source is usable.
+type SourceProbe struct {
+	URL           string `json:"url"`
+	OK            bool   `json:"ok"`
+	Status        string `json:"status,omitempty"`
+	Size          int64  `json:"size"` // -1 if unknown
+	LatencyMillis int64  `json:"latency_ms"`
+	Error         string `json:"error,omitempty"`
+}
+
+// ProbeSources sends a HEAD request to each of the sources concurrently,
+// and returns the results in the same order.
+// A source is OK if it responds successfully with a known Content-Length,
+// which Download requires, if it is a local file which can be opened,
+// or if it is a BigQuery table which can be queried.
+func ProbeSources(ctx context.Context, sources []*url.URL) []SourceProbe {
+	probes := make([]SourceProbe, len(sources))
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probes[i] = probeSource(ctx, source)
+		}()
+	}
+	wg.Wait()
+	return probes
+}
+
+func probeSource(ctx context.Context, source *url.URL) SourceProbe {
+	probe := SourceProbe{
+		URL:  source.String(),
+		Size: -1,
+	}
+	if source.Scheme == BigQueryScheme {
+		return probeBigQuery(ctx, probe, source)
+	}
+	if IsLocal(source) {
+		start := time.Now()
+		f, size, err := openLocal(source)
+		probe.LatencyMillis = time.Since(start).Milliseconds()
+		if err != nil {
+			probe.Error = err.Error()
+			return probe
+		}
+		f.Close()
+		probe.OK, probe.Size = true, size
+		return probe
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ProbeTimeout)
+	defer cancel()
+	req, err := newSourceRequest(ctx, http.MethodHead, source, nil)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	probe.LatencyMillis = time.Since(start).Milliseconds()
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	resp.Body.Close()
+
+	probe.Status = resp.Status
+	probe.Size = resp.ContentLength
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		probe.Error = fmt.Sprintf("HEAD returned %q", resp.Status)
+	case resp.ContentLength <= 0:
+		probe.Error = "unknown Content-Length"
+	default:
+		probe.OK = true
+	}
+	return probe
+}
@@ -0,0 +1,262 @@
+package dataset
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// ErrCorrupt is returned when a dataset file does not match its recorded checksum.
+var ErrCorrupt = errors.New("dataset file is corrupt")
+
+// The compressed payload of a dataset file is followed by trailer sections,
+// each of which starts with a magic string identifying it, so that they can be
+// read from the end of the file before the payload is decoded:
+//
+//	payload | countsMagic | counts | size | checksumMagic | checksum
+//
+// The checksum section has a fixed size. The counts section is followed by the size of its
+// counts (as a little-endian uint32), which end with the count of each color, prefixed by
+// how many colors there are. Files written before a section was added don't have it,
+// and files written before the counts had a size have countsMagicV1 and fixed-size countsV1.
+//
+// Only the payload is covered by the checksum, so the counts are checked for consistency
+// (see Counts.valid), and are never trusted to say how much memory decoding the payload takes.
+const (
+	checksumMagic = "rplacemap/sha256"
+	countsMagic   = "rplacemap/counts/v2"
+	countsMagicV1 = "rplacemap/counts"
+)
+
+var (
+	checksumSize   = len(checksumMagic) + sha256.Size
+	countsSizeV1   = len(countsMagicV1) + binary.Size(countsV1{})
+	countsFixed    = binary.Size(countsHeader{})
+	maxCountsBytes = countsFixed + 4 + 256*8 // with a count for every possible color
+)
+
+// Counts summarizes the records in a dataset file.
+type Counts struct {
+	Records     int64
+	Users       int64
+	Colors      []int64 // by color index, up to the highest color of a record
+	First, Last int64   // UnixMillis
+}
+
+// countsHeader is the fixed-size part of the encoded Counts, which is followed by the Colors.
+type countsHeader struct {
+	Records, Users, First, Last int64
+}
+
+// countsV1 is the encoding of Counts in files written before it had a size, which only counted 16 colors.
+type countsV1 struct {
+	Records     int64
+	Users       int64
+	Colors      [16]int64
+	First, Last int64
+}
+
+// valid reports whether the counts are consistent with each other.
+func (c *Counts) valid() bool {
+	if c.Records < 0 || c.Users < 0 || c.Users > c.Records || c.First > c.Last || len(c.Colors) > 256 {
+		return false
+	}
+	var colors int64
+	for _, n := range c.Colors {
+		if n < 0 {
+			return false
+		}
+		colors += n
+	}
+	return colors <= c.Records
+}
+
+// A counter accumulates Counts as records are written.
+type counter struct {
+	Counts
+	users map[[16]byte]bool
+}
+
+func (c *counter) add(rec Record) {
+	if c.users == nil {
+		c.users = make(map[[16]byte]bool)
+	}
+	if c.Records == 0 || rec.UnixMillis < c.First {
+		c.First = rec.UnixMillis
+	}
+	if c.Records == 0 || rec.UnixMillis > c.Last {
+		c.Last = rec.UnixMillis
+	}
+	c.Records++
+	c.users[rec.UserHash] = true
+	c.Users = int64(len(c.users))
+	if int(rec.Color) >= len(c.Colors) {
+		c.Colors = append(c.Colors, make([]int64, int(rec.Color)+1-len(c.Colors))...)
+	}
+	c.Colors[rec.Color]++
+}
+
+// encode returns the encoded counts, as they appear in the counts section.
+func (c *Counts) encode() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, countsHeader{c.Records, c.Users, c.First, c.Last}) // can't fail, all fields are fixed-size
+	binary.Write(&buf, binary.LittleEndian, uint32(len(c.Colors)))
+	binary.Write(&buf, binary.LittleEndian, c.Colors)
+	return buf.Bytes()
+}
+
+// decodeCounts decodes counts encoded by Counts.encode.
+func decodeCounts(data []byte) (*Counts, error) {
+	if len(data) < countsFixed+4 {
+		return nil, fmt.Errorf("%d bytes of counts, want at least %d", len(data), countsFixed+4)
+	}
+	var h countsHeader
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &h) // can't fail, it's long enough
+	n := binary.LittleEndian.Uint32(data[countsFixed:])
+	colors := data[countsFixed+4:]
+	if n > 256 || len(colors) != int(n)*8 {
+		return nil, fmt.Errorf("%d bytes of counts for %d colors", len(colors), n)
+	}
+	c := &Counts{Records: h.Records, Users: h.Users, First: h.First, Last: h.Last, Colors: make([]int64, n)}
+	for i := range c.Colors {
+		c.Colors[i] = int64(binary.LittleEndian.Uint64(colors[8*i:]))
+	}
+	return c, nil
+}
+
+// writeTrailer writes the trailer sections for a payload whose hash is sum.
+func writeTrailer(w io.Writer, counts Counts, sum hash.Hash) error {
+	var buf bytes.Buffer
+	encoded := counts.encode()
+	buf.WriteString(countsMagic)
+	buf.Write(encoded)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(encoded)))
+	buf.WriteString(checksumMagic)
+	buf.Write(sum.Sum(nil))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// A trailer holds the sections read from the end of a dataset file.
+type trailer struct {
+	checksum    []byte  // nil if not recorded
+	counts      *Counts // nil if not recorded
+	payloadSize int64
+}
+
+func readTrailer(f *os.File) (trailer, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return trailer{}, fmt.Errorf("checking input file: %w", err) // contains filename
+	}
+	t := trailer{payloadSize: stat.Size()}
+
+	// section returns the body of the section that ends at the current end of the payload,
+	// if it has the given magic, and removes it from the payload.
+	section := func(magic string, size int) ([]byte, error) {
+		if t.payloadSize < int64(size) {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		if _, err := f.ReadAt(buf, t.payloadSize-int64(size)); err != nil {
+			return nil, fmt.Errorf("reading trailer: %w", err) // contains filename
+		}
+		body, ok := bytes.CutPrefix(buf, []byte(magic))
+		if !ok {
+			return nil, nil
+		}
+		t.payloadSize -= int64(size)
+		return body, nil
+	}
+
+	if t.checksum, err = section(checksumMagic, checksumSize); err != nil || t.checksum == nil {
+		return t, err
+	}
+	end := t.payloadSize
+	if t.counts, err = readCounts(section); err != nil {
+		return trailer{}, fmt.Errorf("decoding counts of %q: %w", f.Name(), err)
+	}
+	if t.counts == nil {
+		t.payloadSize = end // what readCounts read wasn't a counts section after all
+		return t, nil
+	}
+	if !t.counts.valid() {
+		return trailer{}, fmt.Errorf("%w: %q has inconsistent counts %+v; delete it or re-download it", ErrCorrupt, f.Name(), *t.counts)
+	}
+	return t, nil
+}
+
+// readCounts reads the counts section (in either format) with section, returning nil if there isn't one
+// (in which case it may still have removed bytes from the payload).
+func readCounts(section func(magic string, size int) ([]byte, error)) (*Counts, error) {
+	size, err := section("", 4)
+	if err != nil || size == nil {
+		return nil, err
+	}
+	n := int(binary.LittleEndian.Uint32(size))
+	if n <= maxCountsBytes {
+		body, err := section(countsMagic, len(countsMagic)+n)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			return decodeCounts(body)
+		}
+	}
+
+	// The size wasn't followed by the counts section, so it's part of one in the old format instead.
+	v1, err := section("", countsSizeV1-4)
+	if err != nil || v1 == nil {
+		return nil, err
+	}
+	body, ok := bytes.CutPrefix(append(v1, size...), []byte(countsMagicV1))
+	if !ok {
+		return nil, nil
+	}
+	var old countsV1
+	if err := binary.Read(bytes.NewReader(body), binary.LittleEndian, &old); err != nil {
+		return nil, err
+	}
+	return &Counts{Records: old.Records, Users: old.Users, Colors: old.Colors[:], First: old.First, Last: old.Last}, nil
+}
+
+// A payload reads the compressed payload of a dataset file, hashing it along the way.
+type payload struct {
+	io.Reader
+	filename string
+	sum      hash.Hash
+	want     []byte // nil if the file has no checksum
+}
+
+func openPayload(f *os.File) (*payload, error) {
+	t, err := readTrailer(f)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.New()
+	return &payload{
+		Reader:   io.TeeReader(io.NewSectionReader(f, 0, t.payloadSize), sum),
+		filename: f.Name(),
+		sum:      sum,
+		want:     t.checksum,
+	}, nil
+}
+
+// verify reads the rest of the payload and checks it against the recorded checksum, if any.
+func (p *payload) verify() error {
+	if p.want == nil {
+		return nil
+	}
+	if _, err := io.Copy(io.Discard, p); err != nil {
+		return fmt.Errorf("reading %q: %w", p.filename, err)
+	}
+	if got := p.sum.Sum(nil); !bytes.Equal(got, p.want) {
+		return fmt.Errorf("%w: %q has checksum %x, expected %x; delete it or re-download it", ErrCorrupt, p.filename, got, p.want)
+	}
+	return nil
+}
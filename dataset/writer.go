@@ -0,0 +1,123 @@
+package dataset
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A Writer writes records to a dataset file, in the format indicated by its suffix.
+type Writer struct {
+	filename    string
+	f           *os.File
+	buf         *bufio.Writer
+	checksum    hash.Hash
+	compression io.WriteCloser
+	enc         *gob.Encoder
+	counts      counter
+	closed      bool
+}
+
+// Create creates (or truncates) a dataset file for writing.
+func Create(filename string) (*Writer, error) {
+	if err := checkSuffix(filename); err != nil {
+		return nil, fmt.Errorf("output: %w", err)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("creating output file: %w", err) // contains filename
+	}
+	checksum := sha256.New()
+	buf := bufio.NewWriterSize(io.MultiWriter(f, checksum), 10*1024)
+	compression, err := compress(filename, buf)
+	if err != nil {
+		f.Close()
+		os.Remove(filename)
+		return nil, fmt.Errorf("creating compressor: %w", err)
+	}
+	return &Writer{
+		filename:    filename,
+		f:           f,
+		buf:         buf,
+		checksum:    checksum,
+		compression: compression,
+		enc:         gob.NewEncoder(compression),
+	}, nil
+}
+
+// Write appends a record to the file.
+func (w *Writer) Write(rec Record) error {
+	w.counts.add(rec)
+	return w.enc.Encode(rec)
+}
+
+// Close finishes the compressed stream, appends the trailer (counts and checksum), and closes the file.
+func (w *Writer) Close() error {
+	w.closed = true
+	if err := w.compression.Close(); err != nil {
+		w.f.Close()
+		return fmt.Errorf("finalizing compressed data: %w", err)
+	}
+	if err := w.buf.Flush(); err != nil {
+		w.f.Close()
+		return fmt.Errorf("flushing buffer to file %q: %w", w.filename, err)
+	}
+	if err := writeTrailer(w.f, w.counts.Counts, w.checksum); err != nil {
+		w.f.Close()
+		return fmt.Errorf("writing trailer: %w", err) // contains filename
+	}
+	if err := w.f.Close(); err != nil {
+		return fmt.Errorf("closing output file: %w", err) // contains filename
+	}
+	return nil
+}
+
+// Abort closes and removes the file, unless Close has already been called.
+// It is intended to be deferred to clean up after failures.
+func (w *Writer) Abort() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.compression.Close()
+	w.f.Close()
+	os.Remove(w.filename)
+}
+
+// Rewrite copies the records of the dataset file src into a new file dst,
+// in the format indicated by dst's suffix, and returns how many records were copied.
+// The records are copied in the order they are stored.
+//
+// The new file is written under a temporary name and renamed into place once complete,
+// so dst may be the same as src.
+func Rewrite(ctx context.Context, src, dst string) (int64, error) {
+	tmp := filepath.Join(filepath.Dir(dst), "tmp-"+filepath.Base(dst))
+	out, err := Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Abort()
+
+	var count int64
+	if err := Scan(ctx, src, func(rec Record) error {
+		count++
+		return out.Write(rec)
+	}); err != nil {
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("replacing output file: %w", err) // contains filenames
+	}
+	return count, nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/progress"
+	"github.com/kylelemons/rplacemap/tiles"
+)
+
+var datasetsDir = serveFlags.String("datasets-dir", "", "Directory in which datasets uploaded to /api/datasets are kept (default: in the cache directory)")
+
+// maxDatasetUpload limits the size of a CSV uploaded to /api/datasets.
+const maxDatasetUpload = 1 << 30
+
+// datasetName matches the names of uploaded datasets, which appear in URLs and file names.
+var datasetName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// uploadedDatasetSuffix is the suffix of the files of uploaded datasets.
+var uploadedDatasetSuffix = dataset.FileSuffixes[0]
+
+// uploadPrefix starts the names of the files of uploads in progress, which (unlike the names of datasets)
+// start with a dot, so that one left behind by a crash is never mistaken for a dataset.
+const uploadPrefix = ".upload-"
+
+// staleUpload is how long after it was last written an incomplete upload is removed.
+const staleUpload = 24 * time.Hour
+
+// datasetKeySuffix is the suffix of the file next to each uploaded dataset which holds its access key.
+const datasetKeySuffix = ".key"
+
+// uploadedDataset is the JSON form of an uploaded dataset, listed by /api/datasets.
+type uploadedDataset struct {
+	Name     string    `json:"name"`
+	Year     int       `json:"year"` // of the CSV template
+	Events   int64     `json:"events"`
+	Users    int64     `json:"users"`
+	Start    time.Time `json:"start"` // of the first event
+	End      time.Time `json:"end"`   // of the last event
+	Uploaded time.Time `json:"uploaded"`
+	Key      string    `json:"key"`   // with which its tiles are requested
+	Tiles    string    `json:"tiles"` // root of the dataset's tiles, to be requested with ?key=
+	Map      string    `json:"map"`   // the map, showing the dataset (including its key)
+
+	tiles http.Handler
+}
+
+// datasetRegistry holds the datasets uploaded for private canvases, each of which
+// is served (like the main dataset) at /datasets/<name>/tiles/.
+//
+// The datasets are private: their tiles are only served with the key generated for each
+// when it was uploaded (which is in the map link returned by the upload), and only
+// authorized requests can list them (with their keys) or upload them.
+type datasetRegistry struct {
+	dir        string
+	authorized func(*http.Request) bool // for listing and uploading
+
+	mu        sync.Mutex
+	datasets  map[string]*uploadedDataset
+	uploading map[string]bool
+}
+
+// loadDatasets returns the registry of the datasets previously uploaded to dir.
+// Their records are only loaded once their tiles are requested.
+// Listing and uploading datasets is only allowed for authorized requests.
+func loadDatasets(dir string, authorized func(*http.Request) bool) (*datasetRegistry, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	reg := &datasetRegistry{
+		dir:        dir,
+		authorized: authorized,
+		datasets:   make(map[string]*uploadedDataset),
+		uploading:  make(map[string]bool),
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*"+uploadedDatasetSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), uploadedDatasetSuffix)
+		if strings.HasPrefix(name, uploadPrefix) {
+			// Another server sharing the directory could still be writing it, so only remove it once it's stale.
+			if fi, err := os.Stat(file); err == nil && time.Since(fi.ModTime()) > staleUpload {
+				glog.Warningf("Removing incomplete upload %s", file)
+				os.Remove(file)
+			}
+			continue
+		}
+		if !datasetName.MatchString(name) {
+			continue
+		}
+		info, err := dataset.ReadFileInfo(file)
+		if err != nil {
+			glog.Warningf("Ignoring uploaded dataset %s: %s", file, err)
+			continue
+		}
+		key, err := reg.key(name)
+		if err != nil {
+			glog.Warningf("Ignoring uploaded dataset %s: %s", file, err)
+			continue
+		}
+		reg.add(name, info, key)
+	}
+	if len(reg.datasets) > 0 {
+		glog.Infof("Found %d uploaded datasets in %s", len(reg.datasets), dir)
+	}
+	return reg, nil
+}
+
+// key returns the access key of the named dataset, generating it if it doesn't have one yet
+// (e.g. because it was uploaded before datasets had them).
+func (reg *datasetRegistry) key(name string) (string, error) {
+	file := filepath.Join(reg.dir, name+datasetKeySuffix)
+	data, err := os.ReadFile(file)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	key := hex.EncodeToString(id)
+	if err := os.WriteFile(file, []byte(key+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("saving access key: %w", err)
+	}
+	return key, nil
+}
+
+// add registers the dataset, with the info from its file and its access key.
+//
+// Its canvas is only loaded from the file once its tiles are first requested, and
+// only the flattened canvas is kept in memory, not its records.
+func (reg *datasetRegistry) add(name string, info dataset.FileInfo, key string) {
+	file := filepath.Join(reg.dir, name+uploadedDatasetSuffix)
+	pixels := gsync.Lazy(func(ctx context.Context) ([][]uint8, error) {
+		records, err := dataset.Load(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		return tiles.Flatten(records)
+	})
+	d := &uploadedDataset{
+		Name:  name,
+		Year:  dataset.Year,
+		Key:   key,
+		Tiles: "/datasets/" + name + "/tiles/",
+		Map:   "/static/index.html?dataset=" + name + "&key=" + key,
+		tiles: http.StripPrefix("/datasets/"+name, tiles.GridHandler(pixels)),
+	}
+	if c := info.Counts; c != nil {
+		d.Events, d.Users = c.Records, c.Users
+		d.Start, d.End = time.UnixMilli(c.First).UTC(), time.UnixMilli(c.Last).UTC()
+	}
+	if fi, err := os.Stat(file); err == nil {
+		d.Uploaded = fi.ModTime()
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.datasets[name] = d
+}
+
+// handle serves /api/datasets: GET lists the uploaded datasets, and POST uploads a new one.
+func (reg *datasetRegistry) handle(w http.ResponseWriter, r *http.Request) {
+	if !reg.authorized(r) {
+		http.Error(w, "datasets require a valid X-Admin-Key", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		reg.mu.Lock()
+		list := make([]*uploadedDataset, 0, len(reg.datasets))
+		for _, d := range reg.datasets {
+			list = append(list, d)
+		}
+		reg.mu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		writeJSON(w, list)
+	case http.MethodPost:
+		reg.upload(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+// upload serves POST /api/datasets?name=&year=&mode=, whose body is a CSV in the format of the given year's
+// dataset (the only template so far being 2017's). The dataset is ingested into the registry.
+func (reg *datasetRegistry) upload(w http.ResponseWriter, r *http.Request) {
+	// The body is the CSV, so the parameters are only read from the URL (not with FormValue).
+	query := r.URL.Query()
+	name := query.Get("name")
+	if !datasetName.MatchString(name) {
+		http.Error(w, fmt.Sprintf("name: %q must be lowercase letters, digits, - and _ (up to 64)", name), http.StatusBadRequest)
+		return
+	}
+	if s := query.Get("year"); s != "" {
+		if year, err := strconv.Atoi(s); err != nil || year != dataset.Year {
+			http.Error(w, fmt.Sprintf("year: no CSV template for %q (want %d)", s, dataset.Year), http.StatusBadRequest)
+			return
+		}
+	}
+	var mode dataset.ParseMode
+	if s := query.Get("mode"); s != "" {
+		if err := mode.Set(s); err != nil {
+			http.Error(w, fmt.Sprintf("mode: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	reg.mu.Lock()
+	_, exists := reg.datasets[name]
+	exists = exists || reg.uploading[name]
+	if !exists {
+		reg.uploading[name] = true
+	}
+	reg.mu.Unlock()
+	if exists {
+		http.Error(w, fmt.Sprintf("dataset %q already exists", name), http.StatusConflict)
+		return
+	}
+	defer func() {
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+		delete(reg.uploading, name)
+	}()
+
+	start := time.Now()
+	file := filepath.Join(reg.dir, name+uploadedDatasetSuffix)
+	tmp := filepath.Join(reg.dir, uploadPrefix+name+"-"+strconv.FormatInt(start.UnixNano(), 36)+uploadedDatasetSuffix)
+	body := http.MaxBytesReader(w, r.Body, maxDatasetUpload)
+	records, summary, err := dataset.ImportMode(r.Context(), tmp, body, mode, progress.New("Upload "+name, progress.Bytes))
+	if err == nil {
+		err = checkUploadedRecords(records)
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		http.Error(w, fmt.Sprintf("importing dataset: %s", err), http.StatusBadRequest)
+		return
+	}
+	count := len(records)
+	records = nil // loaded again (as at startup) once its tiles are requested
+
+	info, err := dataset.ReadFileInfo(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	key, err := reg.key(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reg.add(name, info, key)
+	glog.Infof("Imported dataset %q (%d records) in %s", name, count, time.Since(start).Truncate(time.Millisecond))
+
+	reg.mu.Lock()
+	d := reg.datasets[name]
+	reg.mu.Unlock()
+	w.Header().Set("Location", d.Map)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, struct {
+		*uploadedDataset
+		Parse dataset.ParseSummary `json:"parse"`
+	}{d, summary})
+}
+
+// checkUploadedRecords checks that the records can be drawn on the canvas.
+func checkUploadedRecords(records []dataset.Record) error {
+	if len(records) == 0 {
+		return fmt.Errorf("no records")
+	}
+	for _, rec := range records {
+		if rec.X < 0 || rec.X >= tiles.CanvasSize || rec.Y < 0 || rec.Y >= tiles.CanvasSize {
+			return fmt.Errorf("pixel (%d,%d) is outside the %dpx canvas", rec.X, rec.Y, tiles.CanvasSize)
+		}
+		if int(rec.Color) >= len(dataset.Palette) {
+			return fmt.Errorf("color %d is not in the %d-color palette", rec.Color, len(dataset.Palette))
+		}
+	}
+	return nil
+}
+
+// serve serves /datasets/<name>/tiles/, the tiles of an uploaded dataset, given its key.
+// Without the key, a dataset is indistinguishable from one that doesn't exist.
+func (reg *datasetRegistry) serve(w http.ResponseWriter, r *http.Request) {
+	name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/datasets/"), "/")
+	reg.mu.Lock()
+	d, ok := reg.datasets[name]
+	reg.mu.Unlock()
+	if !ok || subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("key")), []byte(d.Key)) != 1 {
+		http.Error(w, fmt.Sprintf("no dataset %q", name), http.StatusNotFound)
+		return
+	}
+	d.tiles.ServeHTTP(w, r)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset/datasettest"
+)
+
+func TestLoadDatasetsSkipsUploads(t *testing.T) {
+	dir := t.TempDir()
+	records := datasettest.Records(datasettest.Options{Events: 10})
+	inProgress := filepath.Join(dir, uploadPrefix+"mine-abc"+uploadedDatasetSuffix)
+	stale := filepath.Join(dir, uploadPrefix+"old-abc"+uploadedDatasetSuffix)
+	for _, file := range []string{filepath.Join(dir, "mine"+uploadedDatasetSuffix), inProgress, stale} {
+		if err := datasettest.WriteFile(file, records); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+	}
+	old := time.Now().Add(-2 * staleUpload)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := loadDatasets(dir, func(*http.Request) bool { return true })
+	if err != nil {
+		t.Fatalf("loadDatasets: %s", err)
+	}
+	if got := len(reg.datasets); got != 1 || reg.datasets["mine"] == nil {
+		t.Errorf("loadDatasets registered %d datasets (%v), want only mine", got, reg.datasets)
+	}
+	if _, err := os.Stat(inProgress); err != nil {
+		t.Errorf("upload in progress was removed: %s", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale upload was not removed: %v", err)
+	}
+}
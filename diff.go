@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+var (
+	diffFlags = flag.NewFlagSet("diff", flag.ExitOnError)
+	diffPNG   = diffFlags.String("png", "", "If set, write an image of the final canvas of b highlighting pixels that differ from a")
+)
+
+var _ = register(commands, &command{
+	name:  "diff",
+	args:  "<a.gob.zst> <b.gob.zst>",
+	help:  "Compare the contents of two dataset files.",
+	flags: diffFlags,
+	run:   runDiff,
+})
+
+func runDiff(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("want exactly two dataset files, got %q", args)
+	}
+
+	var (
+		records [2][]dataset.Record
+		sums    [2]*summary
+	)
+	for i, filename := range args {
+		recs, err := dataset.Load(ctx, filename)
+		if err != nil {
+			return err
+		}
+		sum := newSummary()
+		for _, rec := range recs {
+			sum.add(rec)
+		}
+		records[i], sums[i] = recs, sum
+	}
+	a, b := sums[0], sums[1]
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "\ta\tb\tb-a\t\n")
+	count := func(label string, a, b int64) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%+d\t\n", label, progress.FormatCount(a), progress.FormatCount(b), b-a)
+	}
+	count("Records:", a.records, b.records)
+	count("Users:", int64(len(a.users)), int64(len(b.users)))
+	fmt.Fprintf(tw, "Users only in a:\t%s\t\t\t\n", progress.FormatCount(int64(missingUsers(a, b))))
+	fmt.Fprintf(tw, "Users only in b:\t\t%s\t\t\n", progress.FormatCount(int64(missingUsers(b, a))))
+	for i := range a.colors {
+		count(fmt.Sprintf("Color %2d:", i), a.colors[i], b.colors[i])
+	}
+	fmt.Fprintf(tw, "First:\t%s\t%s\t%s\t\n", formatMillis(a.first), formatMillis(b.first), time.Duration(b.first-a.first)*time.Millisecond)
+	fmt.Fprintf(tw, "Last:\t%s\t%s\t%s\t\n", formatMillis(a.last), formatMillis(b.last), time.Duration(b.last-a.last)*time.Millisecond)
+	fmt.Fprintf(tw, "Canvas:\t%v\t%v\t\t\n", a.bounds, b.bounds)
+
+	bounds := a.bounds.Union(b.bounds)
+	canvasA := dataset.Snapshot(records[0], math.MaxInt64, bounds)
+	canvasB := dataset.Snapshot(records[1], math.MaxInt64, bounds)
+	var differ int64
+	for i := range canvasA.Pix {
+		if canvasA.Pix[i] != canvasB.Pix[i] {
+			differ++
+		}
+	}
+	fmt.Fprintf(tw, "Final pixels differing:\t\t%s\t\t\n", progress.FormatCount(differ))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if *diffPNG != "" {
+		if err := writeFile(*diffPNG, func(w io.Writer) error {
+			return png.Encode(w, diffImage(canvasA, canvasB))
+		}); err != nil {
+			return err
+		}
+		glog.Infof("Wrote diff image to %s", *diffPNG)
+	}
+	return nil
+}
+
+// missingUsers returns how many of the users in a are not in b.
+func missingUsers(a, b *summary) int {
+	var missing int
+	for user := range a.users {
+		if !b.users[user] {
+			missing++
+		}
+	}
+	return missing
+}
+
+func formatMillis(unixMillis int64) string {
+	return time.UnixMilli(unixMillis).UTC().Format(time.RFC3339)
+}
+
+// diffImage returns canvas b with the pixels that are the same in canvas a faded out,
+// so that the differences stand out.
+func diffImage(a, b *image.Paletted) image.Image {
+	img := image.NewRGBA(b.Bounds())
+	for y := b.Rect.Min.Y; y < b.Rect.Max.Y; y++ {
+		for x := b.Rect.Min.X; x < b.Rect.Max.X; x++ {
+			c := b.Palette[b.ColorIndexAt(x, y)].(color.RGBA)
+			if a.ColorIndexAt(x, y) == b.ColorIndexAt(x, y) {
+				c = color.RGBA{R: fade(c.R), G: fade(c.G), B: fade(c.B), A: 0xFF}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// fade blends a color channel three quarters of the way to white.
+func fade(v uint8) uint8 {
+	return 0xFF - (0xFF-v)/4
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"net/http"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+const (
+	defaultDominanceBucket = 30 * time.Minute
+	minDominanceBucket     = time.Minute
+)
+
+// dominanceBucket is the state of the canvas at the end of a bucket of time, served by /api/stats/dominance.
+type dominanceBucket struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Fractions []float64 `json:"fractions"` // of the region covered by each color
+}
+
+type dominance struct {
+	Bucket  string            `json:"bucket"`
+	Region  [4]int            `json:"region"` // x0, y0, x1, y1
+	Buckets []dominanceBucket `json:"buckets"`
+}
+
+type dominanceKey struct {
+	bucket time.Duration
+	region image.Rectangle
+}
+
+// dominanceHandler serves /api/stats/dominance?bucket=&region=x0,y0,x1,y1, how much of the region
+// (default: the whole canvas) was covered by each color at the end of each bucket of time.
+func dominanceHandler(records *gsync.Future[[]dataset.Record]) http.HandlerFunc {
+	cache := &gsync.Cache[dominanceKey, []dominanceBucket]{
+		MaxEntries: 32,
+	}
+	canvas := timelapse.Bounds()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := dominanceKey{bucket: defaultDominanceBucket, region: canvas}
+		if s := r.FormValue("bucket"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("bucket: %s", err), http.StatusBadRequest)
+				return
+			}
+			if d < minDominanceBucket {
+				http.Error(w, fmt.Sprintf("bucket: must be at least %s", minDominanceBucket), http.StatusBadRequest)
+				return
+			}
+			key.bucket = d
+		}
+		if s := r.FormValue("region"); s != "" {
+			var region regionFlag
+			if err := region.Set(s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if key.region = region.Intersect(canvas); key.region.Empty() {
+				http.Error(w, fmt.Sprintf("region %v is outside the canvas", region.Rectangle), http.StatusBadRequest)
+				return
+			}
+		}
+		loc, err := requestLocation(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		buckets, err := cache.Get(r.Context(), key, func(ctx context.Context) ([]dominanceBucket, error) {
+			recs, err := records.Wait(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return colorDominance(recs, key.bucket, key.region), nil
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+
+		resp := dominance{
+			Bucket:  key.bucket.String(),
+			Region:  [4]int{key.region.Min.X, key.region.Min.Y, key.region.Max.X, key.region.Max.Y},
+			Buckets: make([]dominanceBucket, len(buckets)),
+		}
+		for i, b := range buckets {
+			resp.Buckets[i] = dominanceBucket{b.Start.In(loc), b.End.In(loc), b.Fractions}
+		}
+		writeJSON(w, resp)
+	}
+}
+
+// colorDominance returns the fraction of the region covered by each color at the end of each bucket,
+// starting with the bucket containing the first record. The records must be sorted by time.
+func colorDominance(records []dataset.Record, bucket time.Duration, region image.Rectangle) []dominanceBucket {
+	if len(records) == 0 {
+		return []dominanceBucket{}
+	}
+	colors := image.NewPaletted(region, dataset.Palette) // starts white, like Snapshot
+	counts := make([]int, len(dataset.Palette))
+	counts[0] = region.Dx() * region.Dy()
+
+	var buckets []dominanceBucket
+	start := records[0].Time().Truncate(bucket)
+	emit := func() {
+		end := start.Add(bucket)
+		fractions := make([]float64, len(counts))
+		for i, n := range counts {
+			fractions[i] = float64(n) / float64(region.Dx()*region.Dy())
+		}
+		buckets = append(buckets, dominanceBucket{start, end, fractions})
+		start = end
+	}
+	for _, rec := range records {
+		for !rec.Time().Before(start.Add(bucket)) {
+			emit()
+		}
+		if p := image.Pt(int(rec.X), int(rec.Y)); p.In(region) {
+			counts[colors.ColorIndexAt(p.X, p.Y)]--
+			counts[rec.Color]++
+			colors.SetColorIndex(p.X, p.Y, rec.Color)
+		}
+	}
+	emit()
+	return buckets
+}
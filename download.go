@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+var downloadFlags = flag.NewFlagSet("download", flag.ExitOnError)
+
+var _ = register(commands, &command{
+	name:  "download",
+	help:  "Download (or re-download) the r/place dataset into the cache.",
+	flags: downloadFlags,
+	run:   runDownload,
+})
+
+func runDownload(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", args)
+	}
+
+	bar := progress.New("Download", progress.Bytes)
+	records, err := loadRecords(ctx, bar, true)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Downloaded %s records to %s\n", progress.FormatCount(int64(len(records))), datasetFile())
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+var (
+	exportFlags  = flag.NewFlagSet("export", flag.ExitOnError)
+	exportFormat = exportFlags.String("format", "csv", "Output format (csv, ndjson, arrow, or bigquery)")
+	exportOut    = exportFlags.String("out", "-", "Output file (- for standard output), or directory for bigquery")
+	exportRegion regionFlag
+	exportFrom   timeFlag
+	exportTo     timeFlag
+)
+
+func init() {
+	exportFlags.Var(&exportRegion, "region", "Only export events within x0,y0,x1,y1 (default: everything)")
+	exportFlags.Var(&exportFrom, "from", "Only export events at or after this time (UTC)")
+	exportFlags.Var(&exportTo, "to", "Only export events before this time (UTC)")
+}
+
+var _ = register(commands, &command{
+	name: "export",
+	help: "Export events from the cached dataset as CSV, newline-delimited JSON, or an Arrow IPC stream.\n\n" +
+		"Events are streamed in the order they are stored, which is not strictly by time.\n\n" +
+		"The bigquery format writes newline-delimited JSON partitioned into one file per hour,\n" +
+		"along with a schema.json describing the columns, into the --out directory.\n\n" +
+		"Other exports, with their own flags:\n" +
+		"  export archive  single archive of the timelapse, images, and leaderboards, for sharing\n" +
+		"  export site     static copy of the whole map, for hosting without the server\n" +
+		"  export sqlite   SQLite database, for exploring with SQL",
+	flags: exportFlags,
+	run:   runExport,
+})
+
+// exports are the subcommands of the export command, for formats that need their own flags.
+var exports = map[string]*command{}
+
+// eventFilter selects events by region and time.
+type eventFilter struct {
+	region   image.Rectangle // empty means everywhere
+	from, to int64           // UnixMillis; zero means unbounded
+}
+
+func (f eventFilter) match(rec dataset.Record) bool {
+	if !f.region.Empty() && !image.Pt(int(rec.X), int(rec.Y)).In(f.region) {
+		return false
+	}
+	if f.from != 0 && rec.UnixMillis < f.from {
+		return false
+	}
+	if f.to != 0 && rec.UnixMillis >= f.to {
+		return false
+	}
+	return true
+}
+
+func runExport(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		if sub, ok := exports[args[0]]; ok {
+			sub.parse("export "+sub.name, args[1:])
+			return sub.run(ctx, sub.flags.Args())
+		}
+		return fmt.Errorf("unexpected arguments %q", args)
+	}
+
+	filter := eventFilter{region: exportRegion.Rectangle}
+	if !exportFrom.IsZero() {
+		filter.from = exportFrom.UnixMilli()
+	}
+	if !exportTo.IsZero() {
+		filter.to = exportTo.UnixMilli()
+	}
+
+	var newEncoder func(io.Writer) eventEncoder
+	switch *exportFormat {
+	case "csv":
+		newEncoder = newCSVEncoder
+	case "ndjson":
+		newEncoder = newNDJSONEncoder
+	case "arrow":
+		newEncoder = newArrowEncoder
+	case "bigquery":
+		if *exportOut == "-" {
+			return fmt.Errorf("--format=bigquery requires an --out directory")
+		}
+		return exportBigQuery(ctx, *exportOut, filter)
+	default:
+		return fmt.Errorf("unknown format %q", *exportFormat)
+	}
+
+	if err := ensureDataset(ctx); err != nil {
+		return err
+	}
+
+	var exported int64
+	export := func(w io.Writer) error {
+		enc := newEncoder(w)
+		if err := dataset.Scan(ctx, datasetFile(), func(rec dataset.Record) error {
+			if !filter.match(rec) {
+				return nil
+			}
+			exported++
+			return enc.Encode(rec)
+		}); err != nil {
+			return err
+		}
+		return enc.Flush()
+	}
+
+	if *exportOut == "-" {
+		out := bufio.NewWriter(os.Stdout)
+		if err := export(out); err != nil {
+			return err
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+	} else if err := writeFile(*exportOut, export); err != nil {
+		return err
+	}
+	glog.Infof("Exported %s events", progress.FormatCount(exported))
+	return nil
+}
+
+// ensureDataset downloads the dataset if it is not already cached.
+func ensureDataset(ctx context.Context) error {
+	if _, err := os.Stat(datasetFile()); err == nil {
+		return nil
+	}
+	_, err := loadCachedRecords(ctx)
+	return err
+}
+
+type eventEncoder interface {
+	Encode(dataset.Record) error
+	Flush() error
+}
+
+// csvEncoder writes events in the same format as the original dataset.
+type csvEncoder struct {
+	w       *bufio.Writer
+	started bool
+	line    []byte
+	hash    [24]byte // base64 of a 16-byte hash
+}
+
+func newCSVEncoder(w io.Writer) eventEncoder {
+	return &csvEncoder{w: bufio.NewWriter(w)}
+}
+
+func (e *csvEncoder) Encode(rec dataset.Record) error {
+	if !e.started {
+		e.started = true
+		if _, err := e.w.WriteString(dataset.RequiredHeader + "\n"); err != nil {
+			return err
+		}
+	}
+
+	line := e.line[:0]
+	line = rec.Time().AppendFormat(line, dataset.TimestampLayout)
+	line = append(line, ',')
+	base64.StdEncoding.Encode(e.hash[:], rec.UserHash[:])
+	line = append(line, e.hash[:]...)
+	line = append(line, ',')
+	line = strconv.AppendInt(line, int64(rec.X), 10)
+	line = append(line, ',')
+	line = strconv.AppendInt(line, int64(rec.Y), 10)
+	line = append(line, ',')
+	line = strconv.AppendUint(line, uint64(rec.Color), 10)
+	line = append(line, '\n')
+	e.line = line
+
+	_, err := e.w.Write(line)
+	return err
+}
+
+func (e *csvEncoder) Flush() error {
+	return e.w.Flush()
+}
+
+type ndjsonEncoder struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONEncoder(w io.Writer) eventEncoder {
+	buf := bufio.NewWriter(w)
+	return &ndjsonEncoder{w: buf, enc: json.NewEncoder(buf)}
+}
+
+// jsonEvent is the JSON representation of a dataset.Record.
+type jsonEvent struct {
+	Time     time.Time `json:"ts"`
+	UserHash string    `json:"user_hash"`
+	X        int16     `json:"x"`
+	Y        int16     `json:"y"`
+	Color    uint8     `json:"color"`
+}
+
+func newJSONEvent(rec dataset.Record) jsonEvent {
+	return jsonEvent{
+		Time:     rec.Time(),
+		UserHash: base64.StdEncoding.EncodeToString(rec.UserHash[:]),
+		X:        rec.X,
+		Y:        rec.Y,
+		Color:    rec.Color,
+	}
+}
+
+func (e *ndjsonEncoder) Encode(rec dataset.Record) error {
+	return e.enc.Encode(newJSONEvent(rec))
+}
+
+func (e *ndjsonEncoder) Flush() error {
+	return e.w.Flush()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strings"
+	"time"
+)
+
+// timeLayouts are the layouts accepted for times on the command line, which are interpreted as UTC.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// timeFlag is a flag.Value holding an (optional) point in time.
+type timeFlag struct {
+	time.Time
+}
+
+func (f *timeFlag) String() string {
+	if f.IsZero() {
+		return ""
+	}
+	return f.Format(time.RFC3339)
+}
+
+func (f *timeFlag) Set(s string) error {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			f.Time = t
+			return nil
+		}
+	}
+	return fmt.Errorf("time %q does not match any of %q", s, timeLayouts)
+}
+
+// regionFlag is a flag.Value holding an (optional) rectangle of canvas pixels,
+// specified as "x0,y0,x1,y1" (with the maximum point excluded).
+type regionFlag struct {
+	image.Rectangle
+}
+
+func (f *regionFlag) String() string {
+	if f.Empty() {
+		return ""
+	}
+	r := f.Rectangle
+	return fmt.Sprintf("%d,%d,%d,%d", r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+}
+
+func (f *regionFlag) Set(s string) error {
+	var r image.Rectangle
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "%d,%d,%d,%d", &r.Min.X, &r.Min.Y, &r.Max.X, &r.Max.Y); err != nil {
+		return fmt.Errorf("region %q is not of the form x0,y0,x1,y1: %w", s, err)
+	}
+	if r.Empty() {
+		return fmt.Errorf("region %q is empty", s)
+	}
+	f.Rectangle = r
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// An fbTable is a flatbuffers table to be built by buildFlatbuffer, with its fields by ID
+// (nil for those which are absent). A union takes up two IDs, for its type and its value.
+//
+// Fields are scalars (bool, uint8, int16, int32, or int64) or are written after the table
+// and referred to by offset: strings, tables (fbTable), vectors of tables ([]fbTable),
+// and vectors of structs of two longs ([][2]int64), which are all that Arrow's metadata needs.
+type fbTable []any
+
+// buildFlatbuffer returns the flatbuffer whose root table is root.
+//
+// Unlike the usual flatbuffers builders, which build from the end of the buffer back,
+// this writes each table before the objects it refers to and patches in their offsets.
+func buildFlatbuffer(root fbTable) []byte {
+	b := &fbBuilder{buf: make([]byte, 4)}
+	b.putOffset(0, b.table(root))
+	return b.buf
+}
+
+type fbBuilder struct {
+	buf []byte
+}
+
+// align pads the buffer so that an object written after extra more bytes is aligned to n bytes.
+func (b *fbBuilder) align(n, extra int) {
+	for (len(b.buf)+extra)%n != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+// putOffset sets the (forward) offset at pos to refer to target.
+func (b *fbBuilder) putOffset(pos, target int) {
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(target-pos))
+}
+
+// fbSize returns the size of a field in its table.
+func fbSize(v any) int {
+	switch v.(type) {
+	case bool, uint8:
+		return 1
+	case int16:
+		return 2
+	case int64:
+		return 8
+	default: // int32, or an offset
+		return 4
+	}
+}
+
+// table writes the table (after its vtable) and then the objects it refers to, returning its position.
+func (b *fbBuilder) table(t fbTable) int {
+	// The fields are laid out largest first, after the table's offset to its vtable,
+	// and the table is placed so that the first of them is 8-byte aligned.
+	ids := make([]int, 0, len(t))
+	for id, v := range t {
+		if v != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.SliceStable(ids, func(i, j int) bool { return fbSize(t[ids[i]]) > fbSize(t[ids[j]]) })
+	fieldOffsets := make([]int, len(t))
+	size := 4
+	for _, id := range ids {
+		fieldOffsets[id] = size
+		size += fbSize(t[id])
+	}
+
+	b.align(2, 0)
+	vtable := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(4+2*len(t)))
+	b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(size))
+	for _, off := range fieldOffsets {
+		b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(off))
+	}
+
+	b.align(8, 4)
+	table := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(table-vtable)) // vtable = table - soffset
+	type ref struct {
+		pos int
+		v   any
+	}
+	var refs []ref
+	for _, id := range ids {
+		switch v := t[id].(type) {
+		case bool:
+			if v {
+				b.buf = append(b.buf, 1)
+			} else {
+				b.buf = append(b.buf, 0)
+			}
+		case uint8:
+			b.buf = append(b.buf, v)
+		case int16:
+			b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(v))
+		case int32:
+			b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(v))
+		case int64:
+			b.buf = binary.LittleEndian.AppendUint64(b.buf, uint64(v))
+		case string, fbTable, []fbTable, [][2]int64:
+			refs = append(refs, ref{len(b.buf), v})
+			b.buf = append(b.buf, 0, 0, 0, 0)
+		default:
+			panic(fmt.Sprintf("flatbuffers: unsupported field %T", v))
+		}
+	}
+	for _, r := range refs {
+		b.putOffset(r.pos, b.object(r.v))
+	}
+	return table
+}
+
+// object writes an object referred to by a table, returning its position.
+func (b *fbBuilder) object(v any) int {
+	switch v := v.(type) {
+	case fbTable:
+		return b.table(v)
+	case string:
+		b.align(4, 0)
+		pos := len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		b.buf = append(b.buf, v...)
+		b.buf = append(b.buf, 0)
+		return pos
+	case []fbTable:
+		b.align(4, 0)
+		pos := len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		b.buf = append(b.buf, make([]byte, 4*len(v))...)
+		for i, t := range v {
+			b.putOffset(pos+4+4*i, b.table(t))
+		}
+		return pos
+	case [][2]int64:
+		b.align(8, 4)
+		pos := len(b.buf)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+		for _, s := range v {
+			b.buf = binary.LittleEndian.AppendUint64(b.buf, uint64(s[0]))
+			b.buf = binary.LittleEndian.AppendUint64(b.buf, uint64(s[1]))
+		}
+		return pos
+	default:
+		panic(fmt.Sprintf("flatbuffers: unsupported object %T", v))
+	}
+}
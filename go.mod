@@ -1,10 +1,13 @@
 module github.com/kylelemons/rplacemap
 
-go 1.18
+go 1.24
 
 require (
-	github.com/emersion/go-appdir v1.1.2 // indirect
-	github.com/golang/glog v1.0.0 // indirect
-	github.com/kettek/apng v0.0.0-20191108220231-414630eed80f // indirect
-	golang.org/x/sys v0.0.0-20201211090839-8ad439b19e0f // indirect
+	github.com/emersion/go-appdir v1.1.2
+	github.com/golang/glog v1.0.0
+	github.com/kettek/apng v0.0.0-20191108220231-414630eed80f
+	github.com/klauspost/compress v1.18.0
+	github.com/klauspost/pgzip v1.2.6
 )
+
+require golang.org/x/sys v0.0.0-20201211090839-8ad439b19e0f // indirect
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// gRPC (https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md) is served by net/http's
+// HTTP/2 server, which supports the trailers it needs, with the messages framed and encoded by hand.
+
+var (
+	grpcAddr = serveFlags.String("grpc", "", "Address on which to serve the gRPC API (see rplacemap.proto) over HTTP/2, e.g. localhost:9090; disabled if empty")
+	grpcCert = serveFlags.String("grpc-cert", "", "TLS certificate file for --grpc; without it (and --grpc-key), the gRPC API is served unencrypted")
+	grpcKey  = serveFlags.String("grpc-key", "", "TLS key file for --grpc-cert")
+)
+
+// maxGRPCRequest is the largest request message accepted; requests are a few scalars.
+const maxGRPCRequest = 64 << 10
+
+// gRPC status codes.
+const (
+	grpcOK                = 0
+	grpcCanceled          = 1
+	grpcUnknown           = 2
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// A grpcStatus is the status of a call which failed.
+type grpcStatus struct {
+	code    int
+	message string
+}
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcStatus{code, fmt.Sprintf(format, args...)}
+}
+
+func (s *grpcStatus) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", s.code, s.message)
+}
+
+// A grpcMethod handles a call with its (encoded) request, sending its response with send:
+// once, or any number of times for a method which streams its responses.
+type grpcMethod func(r *http.Request, req []byte, send func(pbMessage) error) error
+
+// A grpcServer serves the methods of a gRPC service, by their names.
+type grpcServer struct {
+	service string // fully qualified, e.g. "rplacemap.v1.RPlaceMap"
+	methods map[string]grpcMethod
+}
+
+func (s *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "gRPC calls are POSTs", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && !strings.HasPrefix(ct, "application/grpc+proto") {
+		http.Error(w, fmt.Sprintf("unsupported content type %q", ct), http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	err := s.call(w, r)
+	status := &grpcStatus{code: grpcOK}
+	switch {
+	case err == nil:
+	case errors.As(err, &status):
+	case errors.Is(err, context.DeadlineExceeded):
+		status = &grpcStatus{grpcDeadlineExceeded, "deadline exceeded"}
+	case errors.Is(err, context.Canceled):
+		status = &grpcStatus{grpcCanceled, "canceled"}
+	default:
+		glog.Warningf("gRPC %s: %s", r.URL.Path, err)
+		status = &grpcStatus{grpcInternal, "internal error (see the server log)"}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(status.code))
+	if status.message != "" {
+		w.Header().Set("Grpc-Message", grpcEscape(status.message))
+	}
+}
+
+// call reads the request of the call and runs its method.
+func (s *grpcServer) call(w http.ResponseWriter, r *http.Request) error {
+	service, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	method, ok := s.methods[name]
+	if service != s.service || !ok {
+		return grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+	}
+	if enc := r.Header.Get("Grpc-Encoding"); enc != "" && enc != "identity" {
+		return grpcErrorf(grpcUnimplemented, "unsupported compression %q", enc)
+	}
+	if timeout := r.Header.Get("Grpc-Timeout"); timeout != "" {
+		d, err := parseGRPCTimeout(timeout)
+		if err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%s", err)
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	var prefix [5]byte
+	if _, err := io.ReadFull(r.Body, prefix[:]); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "reading request: %s", err)
+	}
+	if prefix[0] != 0 {
+		return grpcErrorf(grpcUnimplemented, "compressed requests are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxGRPCRequest {
+		return grpcErrorf(grpcResourceExhausted, "request of %d bytes is larger than %d", size, maxGRPCRequest)
+	}
+	req := make([]byte, size)
+	if _, err := io.ReadFull(r.Body, req); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "reading request: %s", err)
+	}
+
+	return method(r, req, func(msg pbMessage) error {
+		var prefix [5]byte
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+		if _, err := w.Write(prefix[:]); err != nil {
+			return err
+		}
+		_, err := w.Write(msg)
+		return err
+	})
+}
+
+// parseGRPCTimeout parses the value of a grpc-timeout header: an integer of up to 8 digits and a unit.
+func parseGRPCTimeout(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("bad grpc-timeout %q", s)
+	}
+	unit, ok := units[s[len(s)-1]]
+	n, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("bad grpc-timeout %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// grpcEscape percent-encodes a status message, as the grpc-message trailer requires.
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// listenGRPC listens on --grpc, if it's set, and serves the gRPC API there until ctx is done.
+func listenGRPC(ctx context.Context, api http.Handler) error {
+	if *grpcAddr == "" {
+		return nil
+	}
+	if (*grpcCert == "") != (*grpcKey == "") {
+		return fmt.Errorf("--grpc-cert and --grpc-key must be set together")
+	}
+	lis, err := net.Listen("tcp", *grpcAddr)
+	if err != nil {
+		return fmt.Errorf("--grpc: listening on %q: %w", *grpcAddr, err)
+	}
+	srv := &http.Server{Handler: api, Protocols: new(http.Protocols)}
+	srv.Protocols.SetHTTP2(true)
+	if *grpcCert != "" {
+		cert, err := tls.LoadX509KeyPair(*grpcCert, *grpcKey)
+		if err != nil {
+			lis.Close()
+			return fmt.Errorf("--grpc-cert: %w", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	} else {
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			glog.Infof("Serving gRPC on %s (TLS)", lis.Addr())
+			err = srv.ServeTLS(lis, "", "")
+		} else {
+			glog.Infof("Serving gRPC on %s", lis.Addr())
+			err = srv.Serve(lis)
+		}
+		if err != http.ErrServerClosed {
+			glog.Errorf("gRPC Serve exited: %s", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/dataset/datasettest"
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+func TestProtobuf(t *testing.T) {
+	msg := pbMessage(nil).
+		int64(1, 150).
+		int64(2, 0). // left out
+		int64(3, -1).
+		string(4, "testing").
+		packed(5, []int64{3, 270})
+	if got, want := msg[:3], []byte{0x08, 0x96, 0x01}; !bytes.Equal(got, want) {
+		t.Errorf("field 1 = %x, want %x", got, want)
+	}
+
+	type field struct {
+		num, wireType int
+		v             uint64
+		b             string
+	}
+	var got []field
+	err := decodeProtobuf(msg, func(num, wireType int, v uint64, b []byte) error {
+		got = append(got, field{num, wireType, v, string(b)})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decodeProtobuf: %s", err)
+	}
+	want := []field{
+		{1, pbVarint, 150, ""},
+		{3, pbVarint, 1<<64 - 1, ""},
+		{4, pbBytes, 0, "testing"},
+		{5, pbBytes, 0, "\x03\x8e\x02"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("decoded %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("field %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	for _, bad := range []string{"\x08", "\x22\x05abc", "\x0b", "\x09\x01\x02"} {
+		if err := decodeProtobuf([]byte(bad), func(int, int, uint64, []byte) error { return nil }); err == nil {
+			t.Errorf("decodeProtobuf(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want time.Duration
+	}{
+		{"1H", time.Hour},
+		{"30S", 30 * time.Second},
+		{"250m", 250 * time.Millisecond},
+		{"99999999n", 99999999},
+	} {
+		if got, err := parseGRPCTimeout(test.in); err != nil || got != test.want {
+			t.Errorf("parseGRPCTimeout(%q) = %v, %v; want %v", test.in, got, err, test.want)
+		}
+	}
+	for _, bad := range []string{"", "S", "1", "1s", "-1S", "123456789S"} {
+		if _, err := parseGRPCTimeout(bad); err == nil {
+			t.Errorf("parseGRPCTimeout(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+// grpcCall calls a method of the gRPC API, returning its responses and status.
+func grpcCall(t *testing.T, server *httptest.Server, method string, req pbMessage) (resps []pbMessage, code int, message string) {
+	t.Helper()
+	body := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(req)))
+	body = append(body, req...)
+	hreq, _ := http.NewRequest(http.MethodPost, server.URL+"/"+grpcService+"/"+method, bytes.NewReader(body))
+	hreq.Header.Set("Content-Type", "application/grpc")
+	hreq.Header.Set("TE", "trailers")
+	resp, err := server.Client().Do(hreq)
+	if err != nil {
+		t.Fatalf("%s: %s", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: %s over %s, want 200 over HTTP/2", method, resp.Status, resp.Proto)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s: reading responses: %s", method, err)
+	}
+	for len(data) > 0 {
+		if len(data) < 5 || data[0] != 0 || uint32(len(data)-5) < binary.BigEndian.Uint32(data[1:]) {
+			t.Fatalf("%s: bad response framing %x", method, data)
+		}
+		size := 5 + int(binary.BigEndian.Uint32(data[1:]))
+		resps, data = append(resps, data[5:size]), data[size:]
+	}
+	code, err = strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("%s: Grpc-Status %q: %s", method, resp.Trailer.Get("Grpc-Status"), err)
+	}
+	return resps, code, resp.Trailer.Get("Grpc-Message")
+}
+
+// pbFields decodes the varint fields of a message, by field number.
+func pbFields(t *testing.T, msg pbMessage) map[int]int64 {
+	t.Helper()
+	fields := make(map[int]int64)
+	err := decodeProtobuf(msg, func(num, wireType int, v uint64, b []byte) error {
+		if wireType == pbVarint {
+			fields[num] = int64(v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("decoding %x: %s", msg, err)
+	}
+	return fields
+}
+
+func TestGRPC(t *testing.T) {
+	records := gsync.NewFuture[[]dataset.Record]()
+	records.Provide(datasettest.Build(t, datasettest.Tiny()).Records)
+	limits := &renderLimits{quota: 3, active: make(map[string]int), used: make(map[string]int)}
+	server := httptest.NewUnstartedServer(newGRPCAPI(records, newPixelContexts(gsync.Map(records, newChunks), nil), limits))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	start := datasettest.TinyStart.UnixMilli()
+
+	// Alice painted (1,1) twice.
+	resps, code, msg := grpcCall(t, server, "PixelEvents", pbMessage(nil).int64(1, 1).int64(2, 1))
+	if code != grpcOK || len(resps) != 2 {
+		t.Fatalf("PixelEvents(1,1) = %d events, status %d %q; want 2 events", len(resps), code, msg)
+	}
+	for i, color := range []int64{1, 3} {
+		if got := pbFields(t, resps[i]); got[3] != 1 || got[4] != 1 || got[5] != color {
+			t.Errorf("PixelEvents(1,1) event %d = %v, want color %d at (1,1)", i, got, color)
+		}
+	}
+
+	// All but alice's first event are after the start.
+	resps, code, msg = grpcCall(t, server, "RegionQuery", pbMessage(nil).int64(3, 8).int64(4, 8).int64(5, start+1))
+	if code != grpcOK || len(resps) != 3 {
+		t.Fatalf("RegionQuery after the start = %d events, status %d %q; want 3 events", len(resps), code, msg)
+	}
+	if got := pbFields(t, resps[0]); got[1] != start+30000 || got[3] != 6 || got[4] != 2 {
+		t.Errorf("RegionQuery's first event = %v, want bob's at (6,2)", got)
+	}
+
+	resps, code, msg = grpcCall(t, server, "Snapshot", pbMessage(nil).int64(1, start+45000))
+	if code != grpcOK || len(resps) != 1 {
+		t.Fatalf("Snapshot = %d responses, status %d %q; want an image", len(resps), code, msg)
+	}
+	var img []byte
+	decodeProtobuf(resps[0], func(num, _ int, _ uint64, b []byte) error {
+		if num == 1 {
+			img = b
+		}
+		return nil
+	})
+	snap, err := png.Decode(bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("Snapshot's PNG: %s", err)
+	}
+	r, g, b, _ := snap.At(6, 2).RGBA()
+	wr, wg, wb, _ := dataset.Palette[2].RGBA()
+	if r != wr || g != wg || b != wb {
+		t.Errorf("Snapshot (6,2) = %v, want color 2", snap.At(6, 2))
+	}
+
+	resps, code, msg = grpcCall(t, server, "Stats", nil)
+	if code != grpcOK || len(resps) != 1 {
+		t.Fatalf("Stats = %d responses, status %d %q; want 1", len(resps), code, msg)
+	}
+	if got := pbFields(t, resps[0]); got[4] != 4 || got[5] != 3 || got[6] != start {
+		t.Errorf("Stats = %v, want 4 events by 3 users from %d", got, start)
+	}
+
+	for _, test := range []struct {
+		method string
+		req    pbMessage
+		code   int
+	}{
+		{"PixelEvents", pbMessage(nil).int64(1, -1), grpcInvalidArgument},
+		{"PixelEvents", pbMessage("\x0a\x01x"), grpcInvalidArgument},
+		{"Snapshot", pbMessage(nil).string(2, "sepia"), grpcInvalidArgument},
+		{"Dance", nil, grpcUnimplemented},
+	} {
+		if _, code, msg := grpcCall(t, server, test.method, test.req); code != test.code || msg == "" {
+			t.Errorf("%s(%x): status %d %q, want %d", test.method, test.req, code, msg, test.code)
+		}
+	}
+
+	// The quota of three renders is used up by the region query and snapshots.
+	if _, code, _ := grpcCall(t, server, "Snapshot", nil); code != grpcResourceExhausted {
+		t.Errorf("Snapshot over the quota: status %d, want %d", code, grpcResourceExhausted)
+	}
+}
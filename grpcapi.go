@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+// grpcService is the name of the service of rplacemap.proto.
+const grpcService = "rplacemap.v1.RPlaceMap"
+
+// grpcAPI implements the methods of the service of rplacemap.proto, whose messages are encoded
+// and decoded here by their field numbers.
+type grpcAPI struct {
+	records  *gsync.Future[[]dataset.Record]
+	contexts *pixelContexts
+	limits   *renderLimits
+	summary  *gsync.Future[pbMessage] // StatsResponse
+}
+
+// newGRPCAPI returns a server of the gRPC API, to be served with listenGRPC.
+func newGRPCAPI(records *gsync.Future[[]dataset.Record], contexts *pixelContexts, limits *renderLimits) *grpcServer {
+	a := &grpcAPI{
+		records:  records,
+		contexts: contexts,
+		limits:   limits,
+		summary: gsync.Map(records, func(records []dataset.Record) (pbMessage, error) {
+			sum := newSummary()
+			colors := make([]int64, len(dataset.Palette))
+			for _, rec := range records {
+				sum.add(rec)
+				if int(rec.Color) < len(colors) {
+					colors[rec.Color]++
+				}
+			}
+			bounds := timelapse.Bounds()
+			return pbMessage(nil).
+				int64(1, int64(*year)).
+				int64(2, int64(bounds.Dx())).
+				int64(3, int64(bounds.Dy())).
+				int64(4, sum.records).
+				int64(5, int64(len(sum.users))).
+				int64(6, sum.first).
+				int64(7, sum.last).
+				packed(8, colors), nil
+		}),
+	}
+	return &grpcServer{
+		service: grpcService,
+		methods: map[string]grpcMethod{
+			"PixelEvents": a.pixelEvents,
+			"RegionQuery": a.limited(a.regionQuery),
+			"Snapshot":    a.limited(a.snapshot),
+			"Stats":       a.stats,
+		},
+	}
+}
+
+// limited limits calls of the method as the renders are limited (see renderLimits.wrap).
+func (a *grpcAPI) limited(method grpcMethod) grpcMethod {
+	return func(r *http.Request, req []byte, send func(pbMessage) error) error {
+		client, err := a.limits.client(r)
+		if err != nil {
+			return grpcErrorf(grpcUnauthenticated, "%s", err)
+		}
+		done, retry, err := a.limits.start(client)
+		if err != nil {
+			return grpcErrorf(grpcResourceExhausted, "%s (retry after %s)", err, retry.Round(time.Second))
+		}
+		defer done()
+		return method(r, req, send)
+	}
+}
+
+// ready waits for the future (e.g. of the records), failing as Unavailable if it failed.
+func ready[T any](ctx context.Context, f *gsync.Future[T]) (T, error) {
+	v, err := f.Wait(ctx)
+	if err != nil && ctx.Err() == nil {
+		return v, grpcErrorf(grpcUnavailable, "not ready: %s", err)
+	}
+	return v, err
+}
+
+// decodeRequest decodes the scalar fields of a request into vars, by field number, ignoring any others.
+// Each of vars is an *int64 (for int32 and int64 fields) or a *string.
+func decodeRequest(req []byte, vars map[int]any) error {
+	err := decodeProtobuf(req, func(field, wireType int, v uint64, b []byte) error {
+		switch ptr := vars[field].(type) {
+		case *int64:
+			if wireType != pbVarint {
+				return fmt.Errorf("field %d is not a varint", field)
+			}
+			*ptr = int64(v)
+		case *string:
+			if wireType != pbBytes {
+				return fmt.Errorf("field %d is not a string", field)
+			}
+			*ptr = string(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "bad request: %s", err)
+	}
+	return nil
+}
+
+// pbEvent encodes a record as an Event.
+func pbEvent(rec dataset.Record) pbMessage {
+	return pbMessage(nil).
+		int64(1, rec.UnixMillis).
+		bytes(2, rec.UserHash[:]).
+		int64(3, int64(rec.X)).
+		int64(4, int64(rec.Y)).
+		int64(5, int64(rec.Color))
+}
+
+func (a *grpcAPI) pixelEvents(r *http.Request, req []byte, send func(pbMessage) error) error {
+	var x, y int64
+	if err := decodeRequest(req, map[int]any{1: &x, 2: &y}); err != nil {
+		return err
+	}
+	if err := checkPixel(int(x), int(y)); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	chunks, err := ready(r.Context(), a.contexts.chunks)
+	if err != nil {
+		return err
+	}
+	events, err := chunks.At(int(x), int(y))
+	if err != nil {
+		return err
+	}
+	for _, ev := range events {
+		if err := send(pbEvent(chunks.Record(int(x), int(y), ev))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *grpcAPI) regionQuery(r *http.Request, req []byte, send func(pbMessage) error) error {
+	var x0, y0, x1, y1, from, to int64
+	if err := decodeRequest(req, map[int]any{1: &x0, 2: &y0, 3: &x1, 4: &y1, 5: &from, 6: &to}); err != nil {
+		return err
+	}
+	filter := eventFilter{region: image.Rect(int(x0), int(y0), int(x1), int(y1)), from: from, to: to}
+	recs, err := ready(r.Context(), a.records)
+	if err != nil {
+		return err
+	}
+	chunks, err := ready(r.Context(), a.contexts.chunks)
+	if err != nil {
+		return err
+	}
+
+	// Only the chunks active within the region (and range of time) can have matching records,
+	// so the range of time can be narrowed to when those were active.
+	last := int64(math.MaxInt64)
+	if to != 0 {
+		last = to - 1
+	}
+	active := chunks.ChunksIn(filter.region, max(from, chunks.Start)-chunks.Start, max(last, chunks.Start)-chunks.Start)
+	if len(active) == 0 {
+		return nil
+	}
+	first, final := active[0].First, active[0].Last
+	for _, info := range active[1:] {
+		first, final = min(first, info.First), max(final, info.Last)
+	}
+	from, to = max(from, chunks.Start+first), min(last, chunks.Start+final)+1
+
+	// As for /export/events.arrow, only the records in the range of time need to be filtered.
+	start, end := 0, len(recs)
+	if from != 0 {
+		start = sort.Search(len(recs), func(i int) bool { return recs[i].UnixMillis >= from })
+	}
+	if to != 0 {
+		end = sort.Search(len(recs), func(i int) bool { return recs[i].UnixMillis >= to })
+	}
+	for _, rec := range recs[start:max(start, end)] {
+		if !filter.match(rec) {
+			continue
+		}
+		if err := send(pbEvent(rec)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *grpcAPI) snapshot(r *http.Request, req []byte, send func(pbMessage) error) error {
+	var (
+		at   int64
+		name string
+	)
+	if err := decodeRequest(req, map[int]any{1: &at, 2: &name}); err != nil {
+		return err
+	}
+	palette, err := dataset.PaletteVariant(name)
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	if at == 0 {
+		at = math.MaxInt64
+	}
+	chunks, err := ready(r.Context(), a.contexts.chunks)
+	if err != nil {
+		return err
+	}
+	bounds := timelapse.Bounds()
+	img, err := chunks.SnapshotAt(at, bounds)
+	if err != nil {
+		return err
+	}
+	img.Palette = palette
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return err
+	}
+	return send(pbMessage(nil).
+		bytes(1, buf.Bytes()).
+		int64(2, int64(bounds.Dx())).
+		int64(3, int64(bounds.Dy())))
+}
+
+func (a *grpcAPI) stats(r *http.Request, req []byte, send func(pbMessage) error) error {
+	if _, err := ready(r.Context(), a.records); err != nil {
+		return err
+	}
+	summary, err := a.summary.Wait(r.Context())
+	if err != nil {
+		return err
+	}
+	return send(summary)
+}
@@ -0,0 +1,177 @@
+package gsync
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// A Cache memoizes the results of computations by key.
+//
+// Concurrent requests for the same key share a single computation.
+// Successful results are retained (subject to TTL and MaxEntries);
+// failed results are shared with the callers that were already waiting,
+// but are then forgotten so that the next request tries again.
+//
+// The zero value is an empty cache with no limits.
+type Cache[K comparable, V any] struct {
+	// TTL, if nonzero, limits how long a successful result is retained.
+	TTL time.Duration
+
+	// MaxEntries, if nonzero, limits how many results are retained.
+	// The least recently used results are evicted first.
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[K]*cacheEntry[K, V]
+	recency *list.List // of *cacheEntry[K, V], most recently used first
+}
+
+type cacheEntry[K comparable, V any] struct {
+	key     K
+	future  *Future[V]
+	created time.Time
+	elem    *list.Element
+}
+
+// Get returns the cached value for key, calling compute to produce it if necessary.
+//
+// The context only limits how long this caller is willing to wait;
+// compute is called with a background context so that the result can still be
+// cached for others if this caller goes away.
+func (c *Cache[K, V]) Get(ctx context.Context, key K, compute func(context.Context) (V, error)) (V, error) {
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[K]*cacheEntry[K, V])
+		c.recency = list.New()
+	}
+	e, ok := c.entries[key]
+	if ok && c.expired(e) {
+		c.remove(e)
+		ok = false
+	}
+	if ok {
+		c.recency.MoveToFront(e.elem)
+	} else {
+		e = &cacheEntry[K, V]{
+			key:     key,
+			future:  NewFuture[V](),
+			created: time.Now(),
+		}
+		e.elem = c.recency.PushFront(e)
+		c.entries[key] = e
+		c.evict()
+		go c.compute(e, compute)
+	}
+	c.mu.Unlock()
+
+	return e.future.Wait(ctx)
+}
+
+func (c *Cache[K, V]) compute(e *cacheEntry[K, V], compute func(context.Context) (V, error)) {
+	v, err := compute(context.Background())
+	if err != nil {
+		e.future.Reject(err)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.entries[e.key] == e {
+			c.remove(e)
+		}
+		return
+	}
+	e.future.Provide(v)
+}
+
+// Peek returns the value cached for key, if it has been computed successfully (and hasn't expired),
+// without computing it otherwise.
+func (c *Cache[K, V]) Peek(key K) (v V, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || c.expired(e) {
+		return v, false
+	}
+	select {
+	case <-e.future.Done():
+	default:
+		return v, false // still computing
+	}
+	v, err := e.future.Get()
+	if err != nil {
+		return v, false
+	}
+	c.recency.MoveToFront(e.elem)
+	return v, true
+}
+
+// Put caches v as the value for key, which was computed elsewhere.
+// Callers already waiting for an in-progress computation are not affected.
+func (c *Cache[K, V]) Put(key K, v V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[K]*cacheEntry[K, V])
+		c.recency = list.New()
+	}
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	e := &cacheEntry[K, V]{
+		key:     key,
+		future:  NewFuture[V](),
+		created: time.Now(),
+	}
+	e.future.Provide(v)
+	e.elem = c.recency.PushFront(e)
+	c.entries[key] = e
+	c.evict()
+}
+
+// Forget removes any cached value for key.
+// Callers already waiting for an in-progress computation are not affected.
+func (c *Cache[K, V]) Forget(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
+
+// Len returns the number of entries (completed or in progress) in the cache.
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
+
+func (c *Cache[K, V]) expired(e *cacheEntry[K, V]) bool {
+	if c.TTL <= 0 {
+		return false
+	}
+	select {
+	case <-e.future.Done():
+		return time.Since(e.created) > c.TTL
+	default:
+		return false // still computing
+	}
+}
+
+func (c *Cache[K, V]) remove(e *cacheEntry[K, V]) {
+	delete(c.entries, e.key)
+	c.recency.Remove(e.elem)
+}
+
+func (c *Cache[K, V]) evict() {
+	if c.MaxEntries <= 0 {
+		return
+	}
+	for len(c.entries) > c.MaxEntries {
+		c.remove(c.recency.Back().Value.(*cacheEntry[K, V]))
+	}
+}
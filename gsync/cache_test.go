@@ -0,0 +1,123 @@
+package gsync_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+// counted returns a computation of v which counts its calls in n.
+func counted(n *atomic.Int32, v string) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		n.Add(1)
+		return v, nil
+	}
+}
+
+func TestCacheShared(t *testing.T) {
+	var c gsync.Cache[string, string]
+	var calls atomic.Int32
+	release := make(chan struct{})
+	slow := func(context.Context) (string, error) {
+		calls.Add(1)
+		<-release
+		return "v", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := c.Get(context.Background(), "k", slow); got != "v" || err != nil {
+				t.Errorf("Get = %q, %v; want %q, nil", got, err, "v")
+			}
+		}()
+	}
+	for c.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if got, _ := c.Get(context.Background(), "k", slow); got != "v" {
+		t.Errorf("Get after computing = %q, want %q", got, "v")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("computed %d times, want 1", n)
+	}
+}
+
+func TestCacheErrorsForgotten(t *testing.T) {
+	var c gsync.Cache[string, string]
+	errBoom := errors.New("boom")
+	if _, err := c.Get(context.Background(), "k", func(context.Context) (string, error) { return "", errBoom }); !errors.Is(err, errBoom) {
+		t.Fatalf("Get = %v, want %v", err, errBoom)
+	}
+	for c.Len() > 0 {
+		time.Sleep(time.Millisecond) // the failure is forgotten after its waiters are told
+	}
+	if _, ok := c.Peek("k"); ok {
+		t.Errorf("Peek found a failed result")
+	}
+	var calls atomic.Int32
+	if got, err := c.Get(context.Background(), "k", counted(&calls, "ok")); got != "ok" || err != nil {
+		t.Errorf("Get after a failure = %q, %v; want %q, nil", got, err, "ok")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := gsync.Cache[string, string]{TTL: 20 * time.Millisecond}
+	var calls atomic.Int32
+	c.Get(context.Background(), "k", counted(&calls, "v"))
+	c.Get(context.Background(), "k", counted(&calls, "v"))
+	if n := calls.Load(); n != 1 {
+		t.Errorf("computed %d times within the TTL, want 1", n)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Peek("k"); ok {
+		t.Errorf("Peek found an expired result")
+	}
+	c.Get(context.Background(), "k", counted(&calls, "v"))
+	if n := calls.Load(); n != 2 {
+		t.Errorf("computed %d times after the TTL, want 2", n)
+	}
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	c := gsync.Cache[string, string]{MaxEntries: 2}
+	c.Put("a", "1")
+	c.Put("b", "2")
+	if _, ok := c.Peek("a"); !ok { // a is now more recently used than b
+		t.Fatalf("Peek(a) missed")
+	}
+	c.Put("c", "3")
+	if got := c.Len(); got != 2 {
+		t.Errorf("Len = %d, want 2", got)
+	}
+	if _, ok := c.Peek("b"); ok {
+		t.Errorf("least recently used entry b was not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Peek(key); !ok {
+			t.Errorf("entry %s was evicted", key)
+		}
+	}
+}
+
+func TestCachePutForget(t *testing.T) {
+	var c gsync.Cache[string, string]
+	c.Put("k", "put")
+	var calls atomic.Int32
+	if got, _ := c.Get(context.Background(), "k", counted(&calls, "computed")); got != "put" {
+		t.Errorf("Get after Put = %q, want %q", got, "put")
+	}
+	c.Forget("k")
+	if got, _ := c.Get(context.Background(), "k", counted(&calls, "computed")); got != "computed" {
+		t.Errorf("Get after Forget = %q, want %q", got, "computed")
+	}
+}
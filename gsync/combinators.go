@@ -0,0 +1,122 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// All returns a future that resolves with the values of all of the given futures
+// (in order) once they have all resolved successfully.
+// If any of the futures fails, the returned future fails with the first error observed.
+func All[T any](futures ...*Future[T]) *Future[[]T] {
+	all := NewFuture[[]T]()
+	if len(futures) == 0 {
+		all.Provide(nil)
+		return all
+	}
+
+	type result struct {
+		idx int
+		val T
+		err error
+	}
+	results := make(chan result, len(futures))
+	for i, f := range futures {
+		i, f := i, f
+		go func() {
+			v, err := f.Get()
+			results <- result{i, v, err}
+		}()
+	}
+
+	go func() {
+		values := make([]T, len(futures))
+		for range futures {
+			res := <-results
+			if res.err != nil {
+				all.Reject(fmt.Errorf("future %d: %w", res.idx, res.err))
+				return
+			}
+			values[res.idx] = res.val
+		}
+		all.Provide(values)
+	}()
+	return all
+}
+
+// Any returns a future that resolves with the value of the first of the given futures
+// to resolve successfully.
+// If all of the futures fail, the returned future fails with all of their errors.
+func Any[T any](futures ...*Future[T]) *Future[T] {
+	first := NewFuture[T]()
+	if len(futures) == 0 {
+		first.Reject(errors.New("no futures provided"))
+		return first
+	}
+
+	type result struct {
+		idx int
+		err error
+	}
+	results := make(chan result, len(futures))
+	for i, f := range futures {
+		i, f := i, f
+		go func() {
+			v, err := f.Get()
+			if err != nil {
+				results <- result{i, err}
+				return
+			}
+			first.Provide(v)
+			results <- result{i, nil}
+		}()
+	}
+
+	go func() {
+		var errs MultiError
+		for range futures {
+			res := <-results
+			if res.err == nil {
+				return
+			}
+			errs.Add(fmt.Sprintf("future %d", res.idx), res.err)
+		}
+		first.Reject(errs.Err())
+	}()
+	return first
+}
+
+// AfterCtx returns a future that resolves with the result of calling fn on the value of f.
+//
+// If f fails, the returned future fails with the same error without calling fn.
+// If ctx is canceled before f resolves, the returned future is canceled;
+// ctx is also passed to fn so that it can stop early.
+func AfterCtx[T, U any](ctx context.Context, f *Future[T], fn func(context.Context, T) (U, error)) *Future[U] {
+	after := NewFuture[U]()
+	go func() {
+		v, err := f.Wait(ctx)
+		if ctx.Err() != nil {
+			after.Cancel()
+			return
+		}
+		if err != nil {
+			after.Reject(err)
+			return
+		}
+		u, err := fn(ctx, v)
+		if err != nil {
+			after.Reject(err)
+			return
+		}
+		after.Provide(u)
+	}()
+	return after
+}
+
+// Map is like AfterCtx, but without cancellation.
+func Map[T, U any](f *Future[T], fn func(T) (U, error)) *Future[U] {
+	return AfterCtx(context.Background(), f, func(_ context.Context, v T) (U, error) {
+		return fn(v)
+	})
+}
@@ -0,0 +1,85 @@
+package gsync_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+func resolved[T any](v T) *gsync.Future[T] {
+	f := gsync.NewFuture[T]()
+	f.Provide(v)
+	return f
+}
+
+func rejected[T any](err error) *gsync.Future[T] {
+	f := gsync.NewFuture[T]()
+	f.Reject(err)
+	return f
+}
+
+func TestAll(t *testing.T) {
+	pending := gsync.NewFuture[int]()
+	all := gsync.All(resolved(1), pending, resolved(3))
+	pending.Provide(2)
+	got, err := all.Get()
+	if err != nil {
+		t.Fatalf("All: %s", err)
+	}
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Errorf("All = %v, want [1 2 3]", got)
+	}
+
+	errBoom := errors.New("boom")
+	if _, err := gsync.All(resolved(1), rejected[int](errBoom)).Get(); !errors.Is(err, errBoom) {
+		t.Errorf("All with a failure = %v, want %v", err, errBoom)
+	}
+	if got, err := gsync.All[int]().Get(); got != nil || err != nil {
+		t.Errorf("All() = %v, %v; want nil, nil", got, err)
+	}
+}
+
+func TestAny(t *testing.T) {
+	errA, errB := errors.New("a"), errors.New("b")
+	if got, err := gsync.Any(rejected[int](errA), resolved(2)).Get(); got != 2 || err != nil {
+		t.Errorf("Any = %v, %v; want 2, nil", got, err)
+	}
+	_, err := gsync.Any(rejected[int](errA), rejected[int](errB)).Get()
+	if !errors.Is(err, errA) || !errors.Is(err, errB) {
+		t.Errorf("Any with every future failing = %v, want both errors", err)
+	}
+	if _, err := gsync.Any[int]().Get(); err == nil {
+		t.Errorf("Any() succeeded, want an error")
+	}
+}
+
+func TestMap(t *testing.T) {
+	f := gsync.Map(resolved(12), func(n int) (string, error) { return strconv.Itoa(n), nil })
+	if got, err := f.Get(); got != "12" || err != nil {
+		t.Errorf("Map = %q, %v; want %q, nil", got, err, "12")
+	}
+
+	errBoom := errors.New("boom")
+	f = gsync.Map(rejected[int](errBoom), func(int) (string, error) {
+		t.Errorf("Map called fn on a failed future")
+		return "", nil
+	})
+	if _, err := f.Get(); !errors.Is(err, errBoom) {
+		t.Errorf("Map of a failed future = %v, want %v", err, errBoom)
+	}
+}
+
+func TestAfterCtxCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	after := gsync.AfterCtx(ctx, gsync.NewFuture[int](), func(context.Context, int) (int, error) {
+		t.Errorf("AfterCtx called fn on a future that never resolved")
+		return 0, nil
+	})
+	cancel()
+	if _, err := after.Get(); !errors.Is(err, gsync.ErrCanceled) {
+		t.Errorf("AfterCtx after cancellation = %v, want %v", err, gsync.ErrCanceled)
+	}
+}
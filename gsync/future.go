@@ -0,0 +1,117 @@
+// Package gsync contains generic synchronization helpers.
+package gsync
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrCanceled is returned to waiters of a Future that was canceled before it resolved.
+var ErrCanceled = errors.New("future canceled")
+
+// A Future holds a value (or an error) that will be provided exactly once,
+// possibly after consumers have started waiting for it.
+//
+// The zero value is not usable; use NewFuture.
+type Future[T any] struct {
+	once  sync.Once
+	done  chan struct{}
+	value T
+	err   error
+
+	start sync.Once
+	lazy  func() // if non-nil, called (once) when the first waiter arrives
+}
+
+func NewFuture[T any]() *Future[T] {
+	return &Future[T]{
+		done: make(chan struct{}),
+	}
+}
+
+// Provide resolves the future with v.
+//
+// Only the first call to Provide, Reject, or Cancel has any effect;
+// the return value reports whether this call was the one that resolved the future.
+func (f *Future[T]) Provide(v T) bool {
+	return f.resolve(v, nil)
+}
+
+// Reject resolves the future with an error, which will be returned to all waiters.
+func (f *Future[T]) Reject(err error) bool {
+	if err == nil {
+		err = errors.New("future rejected with nil error")
+	}
+	var zero T
+	return f.resolve(zero, err)
+}
+
+// Cancel resolves the future with ErrCanceled.
+func (f *Future[T]) Cancel() bool {
+	var zero T
+	return f.resolve(zero, ErrCanceled)
+}
+
+// ProvideFunc resolves the future with the result of calling fn with ctx.
+// If fn fails, the future is rejected with its error.
+//
+// If ctx is canceled before fn returns, the future is canceled immediately
+// so that waiters are not held up by a producer that is slow to notice.
+func (f *Future[T]) ProvideFunc(ctx context.Context, fn func(context.Context) (T, error)) bool {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.Cancel()
+		case <-stop:
+		}
+	}()
+
+	v, err := fn(ctx)
+	if err != nil {
+		return f.Reject(err)
+	}
+	return f.Provide(v)
+}
+
+func (f *Future[T]) resolve(v T, err error) (resolved bool) {
+	f.once.Do(func() {
+		f.value, f.err = v, err
+		close(f.done)
+		resolved = true
+	})
+	return resolved
+}
+
+func (f *Future[T]) kick() {
+	if f.lazy != nil {
+		f.start.Do(f.lazy)
+	}
+}
+
+// Done returns a channel that is closed once the future is resolved.
+func (f *Future[T]) Done() <-chan struct{} {
+	f.kick()
+	return f.done
+}
+
+// Wait blocks until the future is resolved or the context expires.
+func (f *Future[T]) Wait(ctx context.Context) (T, error) {
+	f.kick()
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// Get blocks until the future is resolved.
+func (f *Future[T]) Get() (T, error) {
+	f.kick()
+	<-f.done
+	return f.value, f.err
+}
@@ -0,0 +1,106 @@
+package gsync_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+func TestFutureResolvesOnce(t *testing.T) {
+	errBoom := errors.New("boom")
+	tests := []struct {
+		name    string
+		resolve func(f *gsync.Future[int]) bool
+		want    int
+		wantErr error
+	}{
+		{"provide", func(f *gsync.Future[int]) bool { return f.Provide(42) }, 42, nil},
+		{"reject", func(f *gsync.Future[int]) bool { return f.Reject(errBoom) }, 0, errBoom},
+		{"cancel", func(f *gsync.Future[int]) bool { return f.Cancel() }, 0, gsync.ErrCanceled},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := gsync.NewFuture[int]()
+			if !test.resolve(f) {
+				t.Fatalf("first resolution returned false")
+			}
+			if f.Provide(7) || f.Reject(errors.New("late")) || f.Cancel() {
+				t.Errorf("later resolution returned true")
+			}
+			got, err := f.Get()
+			if got != test.want || !errors.Is(err, test.wantErr) {
+				t.Errorf("Get = %v, %v; want %v, %v", got, err, test.want, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFutureRejectNil(t *testing.T) {
+	f := gsync.NewFuture[int]()
+	f.Reject(nil)
+	if _, err := f.Get(); err == nil {
+		t.Errorf("Get after Reject(nil) succeeded, want an error")
+	}
+}
+
+func TestFutureConcurrentWaiters(t *testing.T) {
+	f := gsync.NewFuture[string]()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := f.Wait(context.Background()); got != "done" || err != nil {
+				t.Errorf("Wait = %q, %v; want %q, nil", got, err, "done")
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.Provide("done")
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFutureWaitContext(t *testing.T) {
+	f := gsync.NewFuture[int]()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := f.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait on an unresolved future = %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-f.Done():
+		t.Errorf("future resolved by a waiter's context expiring")
+	default:
+	}
+}
+
+func TestFutureProvideFunc(t *testing.T) {
+	f := gsync.NewFuture[int]()
+	f.ProvideFunc(context.Background(), func(context.Context) (int, error) { return 3, nil })
+	if got, err := f.Get(); got != 3 || err != nil {
+		t.Errorf("Get = %v, %v; want 3, nil", got, err)
+	}
+
+	// A producer which ignores its context doesn't hold up the waiters once it's canceled.
+	f = gsync.NewFuture[int]()
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	go f.ProvideFunc(ctx, func(context.Context) (int, error) {
+		<-release
+		return 4, nil
+	})
+	cancel()
+	if _, err := f.Get(); !errors.Is(err, gsync.ErrCanceled) {
+		t.Errorf("Get after canceling the producer = %v, want %v", err, gsync.ErrCanceled)
+	}
+	close(release)
+}
@@ -0,0 +1,75 @@
+package gsync
+
+import (
+	"context"
+	"sync"
+)
+
+// A Group coalesces concurrent calls with the same key into a single call whose result they share.
+//
+// Unlike a Cache, results are not retained: once a call completes, the next call with its key starts a new one.
+//
+// The zero value is ready to use.
+type Group[K comparable, V any] struct {
+	mu    sync.Mutex
+	calls map[K]*groupCall[V]
+}
+
+type groupCall[V any] struct {
+	future  *Future[V]
+	waiters int // guarded by the Group's mu
+	cancel  context.CancelFunc
+}
+
+// Do calls fn and returns its result, unless a call with the same key is already in progress,
+// in which case it waits for that call's result instead.
+//
+// The context only limits how long this caller is willing to wait;
+// fn is called with the first caller's context without its cancellation,
+// so that the others still get a result if that caller goes away.
+// Once every caller waiting for it has gone away, the context of fn is canceled.
+func (g *Group[K, V]) Do(ctx context.Context, key K, fn func(context.Context) (V, error)) (V, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[K]*groupCall[V])
+	}
+	call, ok := g.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &groupCall[V]{future: NewFuture[V](), cancel: cancel}
+		g.calls[key] = call
+		go g.call(callCtx, key, call, fn)
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	v, err := call.future.Wait(ctx)
+
+	g.mu.Lock()
+	if call.waiters--; call.waiters == 0 && err != nil {
+		// Nobody is left to use the result. A new call is started for the next caller.
+		call.cancel()
+		if g.calls[key] == call {
+			delete(g.calls, key)
+		}
+	}
+	g.mu.Unlock()
+	return v, err
+}
+
+func (g *Group[K, V]) call(ctx context.Context, key K, call *groupCall[V], fn func(context.Context) (V, error)) {
+	v, err := fn(ctx)
+	call.cancel()
+
+	g.mu.Lock()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+
+	if err != nil {
+		call.future.Reject(err)
+		return
+	}
+	call.future.Provide(v)
+}
@@ -0,0 +1,78 @@
+package gsync_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+func TestGroupCoalesces(t *testing.T) {
+	var g gsync.Group[string, int]
+	var calls, waiting atomic.Int32
+	release := make(chan struct{})
+	fn := func(context.Context) (int, error) {
+		calls.Add(1)
+		<-release
+		return 8, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			waiting.Add(1)
+			if got, err := g.Do(context.Background(), "k", fn); got != 8 || err != nil {
+				t.Errorf("Do = %v, %v; want 8, nil", got, err)
+			}
+		}()
+	}
+	for waiting.Load() < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // for them to join the call
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fn called %d times, want 1", n)
+	}
+
+	// The result isn't retained.
+	g.Do(context.Background(), "k", fn)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("fn called %d times after the first call completed, want 2", n)
+	}
+}
+
+func TestGroupAbandoned(t *testing.T) {
+	var g gsync.Group[string, int]
+	canceled := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err := g.Do(ctx, "k", func(ctx context.Context) (int, error) {
+		<-ctx.Done() // canceled once its only caller goes away
+		close(canceled)
+		return 0, ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Do = %v, want %v", err, context.Canceled)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("fn wasn't canceled after its only caller went away")
+	}
+
+	// The next caller starts a new call.
+	if got, err := g.Do(context.Background(), "k", func(context.Context) (int, error) { return 9, nil }); got != 9 || err != nil {
+		t.Errorf("Do after abandoning = %v, %v; want 9, nil", got, err)
+	}
+}
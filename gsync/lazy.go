@@ -0,0 +1,26 @@
+package gsync
+
+import (
+	"context"
+)
+
+// Lazy returns a future whose value is computed by calling compute the first time
+// anyone waits on it (via Wait, Get, or Done).
+// The result is shared by all subsequent waiters.
+//
+// The computation runs in its own goroutine and is not tied to the context of the
+// waiter that triggered it, so a canceled request does not spoil the result for others.
+func Lazy[T any](compute func(context.Context) (T, error)) *Future[T] {
+	f := NewFuture[T]()
+	f.lazy = func() {
+		go func() {
+			v, err := compute(context.Background())
+			if err != nil {
+				f.Reject(err)
+				return
+			}
+			f.Provide(v)
+		}()
+	}
+	return f
+}
@@ -0,0 +1,57 @@
+package gsync_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+func TestLazy(t *testing.T) {
+	var calls atomic.Int32
+	f := gsync.Lazy(func(context.Context) (int, error) {
+		calls.Add(1)
+		return 5, nil
+	})
+	time.Sleep(10 * time.Millisecond)
+	if n := calls.Load(); n != 0 {
+		t.Fatalf("Lazy computed its value %d times before anyone waited", n)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got, err := f.Wait(context.Background()); got != 5 || err != nil {
+				t.Errorf("Wait = %v, %v; want 5, nil", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Lazy computed its value %d times, want 1", n)
+	}
+}
+
+func TestLazyCanceledWaiter(t *testing.T) {
+	release := make(chan struct{})
+	f := gsync.Lazy(func(ctx context.Context) (int, error) {
+		<-release
+		return 6, ctx.Err()
+	})
+
+	// The first waiter gives up, but that doesn't spoil the result for the next.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := f.Wait(ctx); err != context.Canceled {
+		t.Errorf("Wait with a canceled context = %v, want %v", err, context.Canceled)
+	}
+	close(release)
+	if got, err := f.Get(); got != 6 || err != nil {
+		t.Errorf("Get = %v, %v; want 6, nil", got, err)
+	}
+}
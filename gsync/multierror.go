@@ -0,0 +1,63 @@
+package gsync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A MultiError collects the errors from a set of independent operations
+// (e.g. shards of a download) so that all of them can be reported.
+//
+// The zero value is an empty collection.
+type MultiError struct {
+	Errors []error
+}
+
+// Add records err (if non-nil) as the failure of the operation identified by id.
+// If id is empty, err is recorded as-is.
+func (m *MultiError) Add(id string, err error) {
+	if err == nil {
+		return
+	}
+	if id != "" {
+		err = fmt.Errorf("%s: %w", id, err)
+	}
+	m.Errors = append(m.Errors, err)
+}
+
+// Err returns nil if no errors were recorded, the error itself if only one was recorded,
+// and the MultiError otherwise.
+func (m *MultiError) Err() error {
+	switch len(m.Errors) {
+	case 0:
+		return nil
+	case 1:
+		return m.Errors[0]
+	default:
+		return m
+	}
+}
+
+func (m *MultiError) Error() string {
+	msgs := make([]string, len(m.Errors))
+	for i, err := range m.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors: %s", len(m.Errors), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the collected errors.
+func (m *MultiError) Unwrap() []error {
+	return m.Errors
+}
+
+// Is reports whether any of the collected errors matches target.
+func (m *MultiError) Is(target error) bool {
+	for _, err := range m.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
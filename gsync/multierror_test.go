@@ -0,0 +1,33 @@
+package gsync_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+func TestMultiError(t *testing.T) {
+	var m gsync.MultiError
+	if err := m.Err(); err != nil {
+		t.Errorf("empty Err = %v, want nil", err)
+	}
+	m.Add("ignored", nil)
+	m.Add("shard 1", io.ErrUnexpectedEOF)
+	if err := m.Err(); err == nil || err.Error() != "shard 1: unexpected EOF" || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Err of one error = %v, want it annotated and unwrappable", err)
+	}
+	m.Add("", os.ErrNotExist)
+	err := m.Err()
+	if want := "2 errors: shard 1: unexpected EOF; file does not exist"; err == nil || err.Error() != want {
+		t.Errorf("Err of two errors = %v, want %q", err, want)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("errors.Is doesn't find both collected errors in %v", err)
+	}
+	if errors.Is(err, io.EOF) {
+		t.Errorf("errors.Is(%v, io.EOF) = true, want false", err)
+	}
+}
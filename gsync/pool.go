@@ -0,0 +1,99 @@
+package gsync
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// A Pool runs tasks on a bounded number of goroutines.
+//
+// The first task to fail cancels the context passed to the remaining tasks,
+// and tasks that have not yet started are skipped.
+// Errors from all tasks that failed (other than because of that cancellation)
+// are reported together by Wait.
+type Pool struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{}
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	errs   MultiError
+	failed bool
+}
+
+// NewPool returns a pool that runs at most workers tasks at a time.
+// If workers is zero or less, GOMAXPROCS is used.
+func NewPool(ctx context.Context, workers int) *Pool {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &Pool{
+		ctx:    ctx,
+		cancel: cancel,
+		slots:  make(chan struct{}, workers),
+	}
+}
+
+// Go runs task on the pool, blocking until a worker is available.
+// If the pool's context is canceled first, the task is not run and Go returns false.
+func (p *Pool) Go(task func(ctx context.Context) error) bool {
+	return p.GoID("", task)
+}
+
+// GoID is like Go, but any error from the task is annotated with id.
+func (p *Pool) GoID(id string, task func(ctx context.Context) error) bool {
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.ctx.Done():
+		return false
+	}
+	if p.ctx.Err() != nil {
+		// Both cases were ready, and select chose the slot at random.
+		<-p.slots
+		return false
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.slots }()
+
+		if err := task(p.ctx); err != nil {
+			p.fail(id, err)
+		}
+	}()
+	return true
+}
+
+func (p *Pool) fail(id string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.failed && errors.Is(err, context.Canceled) {
+		return // most likely a consequence of an earlier failure
+	}
+	p.errs.Add(id, err)
+	p.failed = true
+	p.cancel()
+}
+
+// Wait waits for all started tasks to complete and returns their errors, if any,
+// as a MultiError if there was more than one.
+// If no task failed but the parent context was canceled, its error is returned.
+func (p *Pool) Wait() error {
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.errs.Err(); err != nil {
+		return err
+	}
+	err := p.ctx.Err()
+	p.cancel()
+	return err
+}
@@ -0,0 +1,90 @@
+package gsync_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+func TestPoolCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := gsync.NewPool(ctx, 4)
+	for i := 0; i < 100; i++ {
+		if p.Go(func(context.Context) error {
+			t.Errorf("task %d ran after the pool was canceled", i)
+			return nil
+		}) {
+			t.Errorf("Go %d = true after the pool was canceled, want false", i)
+		}
+	}
+	if err := p.Wait(); err != context.Canceled {
+		t.Errorf("Wait = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestPoolBounded(t *testing.T) {
+	p := gsync.NewPool(context.Background(), 3)
+	var running, peak atomic.Int32
+	for i := 0; i < 20; i++ {
+		p.Go(func(context.Context) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				old := peak.Load()
+				if n <= old || peak.CompareAndSwap(old, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatalf("Wait: %s", err)
+	}
+	if got := peak.Load(); got > 3 {
+		t.Errorf("%d tasks ran at once, want at most 3", got)
+	}
+}
+
+func TestPoolFailure(t *testing.T) {
+	p := gsync.NewPool(context.Background(), 2)
+	errBoom := errors.New("boom")
+	p.GoID("first", func(context.Context) error { return errBoom })
+	p.GoID("second", func(ctx context.Context) error {
+		<-ctx.Done() // canceled by the first failure
+		return ctx.Err()
+	})
+	err := p.Wait()
+	if !errors.Is(err, errBoom) || !strings.Contains(err.Error(), "first") {
+		t.Errorf("Wait = %v, want %v annotated with its id", err, errBoom)
+	}
+	if errors.Is(err, context.Canceled) {
+		t.Errorf("Wait = %v, want the cancellation it caused left out", err)
+	}
+	if p.Go(func(context.Context) error { return nil }) {
+		t.Errorf("Go after a failure = true, want false")
+	}
+}
+
+func TestPoolErrors(t *testing.T) {
+	p := gsync.NewPool(context.Background(), 2)
+	start := make(chan struct{})
+	for _, id := range []string{"a", "b"} {
+		p.GoID(id, func(context.Context) error {
+			<-start // both are running before either fails
+			return errors.New("failed")
+		})
+	}
+	close(start)
+	var multi *gsync.MultiError
+	if err := p.Wait(); !errors.As(err, &multi) || len(multi.Errors) != 2 {
+		t.Errorf("Wait = %v, want a MultiError of both failures", err)
+	}
+}
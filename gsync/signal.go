@@ -0,0 +1,69 @@
+package gsync
+
+import (
+	"context"
+	"sync"
+)
+
+// A Signal holds a value that can be replaced over time,
+// broadcasting each change to anyone watching it.
+//
+// This is intended for things like the loaded dataset, from which other subsystems
+// derive state that they need to rebuild when it is swapped out.
+//
+// The zero value holds the zero value of T.
+type Signal[T any] struct {
+	mu      sync.Mutex
+	value   T
+	changed chan struct{} // closed (and replaced) when the value changes
+}
+
+func NewSignal[T any](initial T) *Signal[T] {
+	return &Signal[T]{
+		value: initial,
+	}
+}
+
+// Set replaces the value and notifies all watchers.
+func (s *Signal[T]) Set(v T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.value = v
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// Get returns the current value along with a channel that will be closed
+// the next time the value changes.
+func (s *Signal[T]) Get() (T, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	return s.value, s.changed
+}
+
+// Watch calls fn with the current value and then again with each new value,
+// until ctx is canceled.
+//
+// Calls are made sequentially from a single goroutine; if the value changes
+// more than once while fn is running, only the latest value is delivered.
+func (s *Signal[T]) Watch(ctx context.Context, fn func(T)) {
+	go func() {
+		for {
+			v, changed := s.Get()
+			fn(v)
+
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,70 @@
+package gsync_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+func TestSignalGet(t *testing.T) {
+	s := gsync.NewSignal("a")
+	v, changed := s.Get()
+	if v != "a" {
+		t.Errorf("Get = %q, want %q", v, "a")
+	}
+	select {
+	case <-changed:
+		t.Fatalf("changed is closed before Set")
+	default:
+	}
+	s.Set("b")
+	select {
+	case <-changed:
+	default:
+		t.Fatalf("changed isn't closed after Set")
+	}
+	if v, _ := s.Get(); v != "b" {
+		t.Errorf("Get after Set = %q, want %q", v, "b")
+	}
+
+	var zero gsync.Signal[int]
+	if v, _ := zero.Get(); v != 0 {
+		t.Errorf("zero Signal Get = %d, want 0", v)
+	}
+}
+
+func TestSignalWatch(t *testing.T) {
+	s := gsync.NewSignal(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	seen := make(chan int, 10)
+	s.Watch(ctx, func(v int) { seen <- v })
+
+	want := func(v int) {
+		t.Helper()
+		select {
+		case got := <-seen:
+			if got != v {
+				t.Errorf("Watch saw %d, want %d", got, v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Watch didn't see %d", v)
+		}
+	}
+	want(0)
+	s.Set(1)
+	want(1)
+	s.Set(2)
+	want(2)
+
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	s.Set(3)
+	select {
+	case got := <-seen:
+		t.Errorf("Watch saw %d after its context was canceled", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
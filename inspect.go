@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+var inspectFlags = flag.NewFlagSet("inspect", flag.ExitOnError)
+
+var _ = register(commands, &command{
+	name:  "inspect",
+	args:  "[file.gob.zst|file.gob.gz]",
+	help:  "Print what a dataset file contains (default: the cached dataset).",
+	flags: inspectFlags,
+	run:   runInspect,
+})
+
+func runInspect(ctx context.Context, args []string) error {
+	filename := datasetFile()
+	switch len(args) {
+	case 0:
+	case 1:
+		filename = args[0]
+	default:
+		return fmt.Errorf("too many arguments %q", args)
+	}
+
+	info, err := dataset.ReadFileInfo(filename)
+	if err != nil {
+		return err
+	}
+
+	sum := newSummary()
+	if err := dataset.Scan(ctx, filename, func(rec dataset.Record) error {
+		sum.add(rec)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "File:\t%s\n", filename)
+	fmt.Fprintf(tw, "Size:\t%s\n", progress.FormatBytes(info.Size))
+	fmt.Fprintf(tw, "Format:\tgob records, %s compressed\n", info.Compression)
+	if info.Comment != "" {
+		fmt.Fprintf(tw, "Comment:\t%s\n", info.Comment)
+	}
+	if info.Checksum != nil {
+		fmt.Fprintf(tw, "SHA-256:\t%x\n", info.Checksum)
+	}
+	if !info.ModTime.IsZero() {
+		fmt.Fprintf(tw, "Written:\t%s\n", info.ModTime.UTC().Format(time.RFC3339))
+	}
+	if sum.records == 0 {
+		fmt.Fprintf(tw, "Records:\t0\n")
+		return tw.Flush()
+	}
+	sum.print(tw)
+	return tw.Flush()
+}
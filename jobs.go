@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/progress"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+var (
+	jobsDir       = serveFlags.String("jobs-dir", "", "Directory in which render jobs and their outputs are kept across restarts (default: in the cache directory)")
+	jobWorkers    = serveFlags.Int("job-workers", 1, "How many render jobs run at once")
+	jobQueueSize  = serveFlags.Int("job-queue", 100, "How many render jobs can be waiting to run")
+	jobsPerClient = serveFlags.Int("job-queue-per-client", 10, "How many of the render jobs waiting to run can be from each client (by API key or IP address; 0 for no limit)")
+)
+
+// jobRetention is how long finished jobs (and their outputs) are kept.
+const jobRetention = 7 * 24 * time.Hour
+
+// jobSweepInterval is how often finished jobs are checked for having outlived jobRetention.
+const jobSweepInterval = time.Hour
+
+// Job states.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// A renderJob is a render requested with POST /api/jobs/render, which runs in the background.
+// It is saved as JSON in the jobs directory, alongside its output.
+type renderJob struct {
+	ID       string            `json:"id"`
+	Kind     string            `json:"kind"`
+	Params   map[string]string `json:"params,omitempty"`
+	State    string            `json:"state"`
+	Error    string            `json:"error,omitempty"`
+	Output   string            `json:"output,omitempty"` // file name, once done
+	Created  time.Time         `json:"created"`
+	Started  *time.Time        `json:"started,omitempty"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Client   string            `json:"client,omitempty"` // hash of who submitted it; not in responses
+
+	// Only in responses:
+	Progress *progress.Snapshot `json:"progress,omitempty"` // while running
+	URL      string             `json:"url,omitempty"`      // of the output, once done
+}
+
+// A jobSpec is a validated render job: the extension of its output, and how to produce it.
+type jobSpec struct {
+	ext    string
+	render func(records []dataset.Record, bar *progress.Bar, w io.Writer) error
+}
+
+// parseJobSpec validates the parameters of a render job of the given kind:
+//
+//	timelapse: format (gif, apng, or mp4), interval, palette, region
+//	snapshot: t, palette, region
+func parseJobSpec(kind string, params map[string]string) (*jobSpec, error) {
+	known := map[string][]string{
+		"timelapse": {"format", "interval", "palette", "region"},
+		"snapshot":  {"t", "palette", "region"},
+	}
+	allowed, ok := known[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown job kind %q (want timelapse or snapshot)", kind)
+	}
+	for name := range params {
+		if !contains(allowed, name) {
+			return nil, fmt.Errorf("unknown %s parameter %q (want one of %q)", kind, name, allowed)
+		}
+	}
+
+	palette, err := dataset.PaletteVariant(params["palette"])
+	if err != nil {
+		return nil, err
+	}
+	bounds := timelapse.Bounds()
+	if s := params["region"]; s != "" {
+		var region regionFlag
+		if err := region.Set(s); err != nil {
+			return nil, err
+		}
+		if bounds = region.Intersect(bounds); bounds.Empty() {
+			return nil, fmt.Errorf("region %v is outside the canvas", region.Rectangle)
+		}
+	}
+	whole := bounds == timelapse.Bounds()
+
+	switch kind {
+	case "timelapse":
+		format := params["format"]
+		if format == "" {
+			format = "gif"
+		}
+		encode, ok := timelapseEncoders[format]
+		if !ok {
+			return nil, fmt.Errorf("unsupported timelapse format %q", format)
+		}
+		interval := timelapse.DefaultInterval
+		if s := params["interval"]; s != "" {
+			if interval, err = time.ParseDuration(s); err != nil {
+				return nil, fmt.Errorf("interval: %w", err)
+			}
+			if interval < time.Minute {
+				return nil, fmt.Errorf("interval: must be at least 1m")
+			}
+		}
+		return &jobSpec{format, func(records []dataset.Record, bar *progress.Bar, w io.Writer) error {
+			var frames []*image.Paletted
+			if whole {
+				frames = timelapse.RenderFrames(records, interval, bar)
+			} else {
+				frames = timelapse.RenderRegion(records, interval, bounds, func(image.Point) bool { return true })
+			}
+			return encode(w, timelapse.WithPalette(frames, palette))
+		}}, nil
+	default: // snapshot
+		var at timeFlag
+		if s := params["t"]; s != "" {
+			if err := at.Set(s); err != nil {
+				return nil, err
+			}
+		}
+		return &jobSpec{"png", func(records []dataset.Record, bar *progress.Bar, w io.Writer) error {
+			t := records[len(records)-1].UnixMillis
+			if !at.IsZero() {
+				t = at.UnixMilli()
+			}
+			img := dataset.Snapshot(records, t, bounds)
+			img.Palette = palette
+			return png.Encode(w, img)
+		}}, nil
+	}
+}
+
+// renderJobs runs render jobs on a bounded pool of workers, and serves their status and outputs.
+type renderJobs struct {
+	dir     string
+	records *gsync.Future[[]dataset.Record]
+	signer  *urlSigner
+	hooks   *webhooks
+	client  func(*http.Request) (string, error) // identifies who submits a job
+	queue   chan *renderJob
+
+	mu   sync.Mutex
+	all  map[string]*renderJob
+	bars map[string]*progress.Bar // of running jobs
+}
+
+// loadJobs returns the jobs saved in dir, queueing any which were unfinished,
+// and removing those which finished more than jobRetention ago.
+// Each client (as identified by the client function) can only have --job-queue-per-client jobs queued.
+func loadJobs(dir string, records *gsync.Future[[]dataset.Record], signer *urlSigner, hooks *webhooks, client func(*http.Request) (string, error)) (*renderJobs, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	j := &renderJobs{
+		dir:     dir,
+		records: records,
+		signer:  signer,
+		hooks:   hooks,
+		client:  client,
+		queue:   make(chan *renderJob, *jobQueueSize),
+		all:     make(map[string]*renderJob),
+		bars:    make(map[string]*progress.Bar),
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var pending []*renderJob
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		job := new(renderJob)
+		if err := json.Unmarshal(data, job); err != nil {
+			glog.Warningf("Ignoring job %s: %s", file, err)
+			continue
+		}
+		if expired(job, time.Now()) {
+			j.remove(job)
+			continue
+		}
+		j.all[job.ID] = job
+		if job.State == jobQueued || job.State == jobRunning {
+			pending = append(pending, job)
+		}
+	}
+	sort.Slice(pending, func(a, b int) bool { return pending[a].Created.Before(pending[b].Created) })
+	for _, job := range pending {
+		job.State, job.Started = jobQueued, nil
+		if !j.enqueue(job) {
+			now := time.Now()
+			job.State, job.Error, job.Finished = jobFailed, "too many queued jobs at restart", &now
+			j.save(job)
+		}
+	}
+	if len(j.all) > 0 {
+		glog.Infof("Loaded %d render jobs (%d pending) from %s", len(j.all), len(pending), dir)
+	}
+	return j, nil
+}
+
+// expired reports whether the job finished more than jobRetention before now.
+func expired(job *renderJob, now time.Time) bool {
+	return job.Finished != nil && now.Sub(*job.Finished) > jobRetention
+}
+
+// run runs the queued jobs on --job-workers workers, and removes expired jobs every jobSweepInterval,
+// until ctx is canceled.
+func (j *renderJobs) run(ctx context.Context, workers int) {
+	go func() {
+		tick := time.NewTicker(jobSweepInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case now := <-tick.C:
+				j.sweep(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case job := <-j.queue:
+					j.runJob(ctx, job)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (j *renderJobs) runJob(ctx context.Context, job *renderJob) {
+	spec, err := parseJobSpec(job.Kind, job.Params)
+	if err != nil {
+		j.finish(ctx, job, 0, err) // only if the job was saved by an incompatible version
+		return
+	}
+
+	start := time.Now()
+	bar := progress.New(fmt.Sprintf("Job %s", job.ID), progress.Counter)
+	j.mu.Lock()
+	job.State, job.Started = jobRunning, &start
+	j.bars[job.ID] = bar
+	j.mu.Unlock()
+	j.save(job)
+	glog.Infof("Running %s job %s %v", job.Kind, job.ID, job.Params)
+
+	err = func() error {
+		records, err := j.records.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return fmt.Errorf("dataset is empty")
+		}
+		output := job.ID + "." + spec.ext
+		if err := writeFile(filepath.Join(j.dir, output), func(w io.Writer) error {
+			return spec.render(records, bar, w)
+		}); err != nil {
+			return err
+		}
+		j.mu.Lock()
+		job.Output = output
+		j.mu.Unlock()
+		return nil
+	}()
+	if ctx.Err() != nil {
+		return // shutting down; the job is still running as far as the next start is concerned
+	}
+	j.finish(ctx, job, time.Since(start), err)
+}
+
+// finish records the outcome of the job and notifies the webhooks.
+func (j *renderJobs) finish(ctx context.Context, job *renderJob, dur time.Duration, err error) {
+	now := time.Now()
+	j.mu.Lock()
+	job.State, job.Finished = jobDone, &now
+	if err != nil {
+		job.State, job.Error = jobFailed, err.Error()
+	}
+	delete(j.bars, job.ID)
+	j.mu.Unlock()
+	j.save(job)
+
+	var artifact string
+	if err == nil {
+		artifact = "/render/jobs/" + job.Output
+		glog.Infof("Finished %s job %s in %s", job.Kind, job.ID, dur.Truncate(time.Millisecond))
+	} else {
+		glog.Errorf("Failed %s job %s: %s", job.Kind, job.ID, err)
+	}
+	j.hooks.jobFinished(ctx, "job:"+job.Kind, job.Params, artifact, dur, err)
+}
+
+// sweep removes the jobs which had expired as of now.
+func (j *renderJobs) sweep(now time.Time) {
+	var removed []*renderJob
+	j.mu.Lock()
+	for id, job := range j.all {
+		if expired(job, now) {
+			delete(j.all, id)
+			removed = append(removed, job)
+		}
+	}
+	j.mu.Unlock()
+	for _, job := range removed {
+		j.remove(job)
+	}
+	if len(removed) > 0 {
+		glog.Infof("Removed %d expired render jobs", len(removed))
+	}
+}
+
+// enqueue adds the job to the queue, unless it is full.
+func (j *renderJobs) enqueue(job *renderJob) bool {
+	select {
+	case j.queue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// save writes the job's JSON to the jobs directory.
+func (j *renderJobs) save(job *renderJob) {
+	j.mu.Lock()
+	data, err := json.MarshalIndent(job, "", "  ")
+	j.mu.Unlock()
+	if err == nil {
+		file := filepath.Join(j.dir, job.ID+".json")
+		err = os.WriteFile(file+".tmp", data, 0644)
+		if err == nil {
+			err = os.Rename(file+".tmp", file)
+		}
+	}
+	if err != nil {
+		glog.Errorf("Saving job %s: %s", job.ID, err)
+	}
+}
+
+// remove deletes the saved job and its output.
+func (j *renderJobs) remove(job *renderJob) {
+	for _, file := range []string{job.ID + ".json", job.Output} {
+		if file == "" {
+			continue
+		}
+		if err := os.Remove(filepath.Join(j.dir, file)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			glog.Warningf("Removing expired job: %s", err)
+		}
+	}
+}
+
+// jobRequest is the JSON body of POST /api/jobs/render.
+type jobRequest struct {
+	Kind   string            `json:"kind"`
+	Params map[string]string `json:"params"`
+}
+
+// submit serves POST /api/jobs/render, which queues a job and responds with its status.
+func (j *renderJobs) submit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var req jobRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("decoding request: %s", err), http.StatusBadRequest)
+		return
+	}
+	if _, err := parseJobSpec(req.Kind, req.Params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	client, err := j.client(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	sum := sha256.Sum256([]byte(client)) // which may be an API key, so it isn't saved as is
+	client = hex.EncodeToString(sum[:8])
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	job := &renderJob{
+		ID:      hex.EncodeToString(id),
+		Kind:    req.Kind,
+		Params:  req.Params,
+		State:   jobQueued,
+		Created: time.Now(),
+		Client:  client,
+	}
+	j.mu.Lock()
+	queued := 0
+	for _, other := range j.all {
+		if other.State == jobQueued && other.Client == client {
+			queued++
+		}
+	}
+	if *jobsPerClient > 0 && queued >= *jobsPerClient {
+		j.mu.Unlock()
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, fmt.Sprintf("too many queued jobs (%d) from this client", queued), http.StatusTooManyRequests)
+		return
+	}
+	j.all[job.ID] = job
+	j.mu.Unlock()
+	j.save(job)
+	if !j.enqueue(job) {
+		j.mu.Lock()
+		delete(j.all, job.ID)
+		j.mu.Unlock()
+		j.remove(job)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many queued jobs", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Location", "/api/jobs/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(j.status(job))
+}
+
+// handle serves GET /api/jobs/<id>, the status of a job.
+func (j *renderJobs) handle(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+	j.mu.Lock()
+	job, ok := j.all[id]
+	j.mu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no job %q", id), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, j.status(job))
+}
+
+// status returns a copy of the job for a response, with its progress or output URL.
+func (j *renderJobs) status(job *renderJob) *renderJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := *job
+	s.Client = ""
+	if bar, ok := j.bars[job.ID]; ok {
+		snap := bar.Snapshot()
+		s.Progress = &snap
+	}
+	if job.State == jobDone {
+		u := &url.URL{Path: "/render/jobs/" + job.Output}
+		if j.signer != nil {
+			u = j.signer.sign(u, time.Now().Add(webhookLinkTTL))
+		}
+		s.URL = u.String()
+	}
+	return &s
+}
+
+var jobOutputPath = regexp.MustCompile(`^/render/jobs/([0-9a-f]+)\.[a-z0-9]+$`)
+
+// download serves /render/jobs/<id>.<ext>, the output of a finished job.
+func (j *renderJobs) download(w http.ResponseWriter, r *http.Request) {
+	m := jobOutputPath.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	j.mu.Lock()
+	job, ok := j.all[m[1]]
+	ok = ok && job.State == jobDone && "/render/jobs/"+job.Output == r.URL.Path
+	j.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// ServeFile supports Range requests, and sets the Content-Type from the extension.
+	http.ServeFile(w, r, filepath.Join(j.dir, job.Output))
+}
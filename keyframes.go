@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kylelemons/rplacemap/chunked"
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/static"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+var keyframeInterval = serveFlags.Duration("keyframes", 1*time.Hour, "Interval between the keyframes served for the time slider")
+
+// keyframeCacheSize is how many rendered keyframes are kept in memory.
+const keyframeCacheSize = 64
+
+// keyframeLinkWindow is the granularity of the expiry of signed keyframe URLs, which is rounded
+// so that the URLs (and so the images cached at them) stay the same for a while.
+const keyframeLinkWindow = 24 * time.Hour
+
+// keyframeTimes returns the times of the canvas snapshots between first and last:
+// every multiple of interval, followed by last itself.
+func keyframeTimes(first, last time.Time, interval time.Duration) []time.Time {
+	var times []time.Time
+	for t := first.Truncate(interval).Add(interval); t.Before(last); t = t.Add(interval) {
+		times = append(times, t)
+	}
+	return append(times, last)
+}
+
+// A keyframe is an entry in the /api/keyframes listing.
+type keyframe struct {
+	Index int       `json:"index"`
+	Time  time.Time `json:"time"`
+	URL   string    `json:"url"`
+}
+
+// keyframes serves /api/keyframes, listing the keyframes available for the time slider,
+// and /render/keyframe/<n>.png, the images of those keyframes.
+//
+// Since a keyframe never changes, its image is served with immutable caching
+// at a URL which includes its time, so that the frontend can prefetch them freely.
+// Without the time, the URL could name a different keyframe once the keyframes change, so it isn't cached.
+type keyframes struct {
+	times    *gsync.Future[[]time.Time]
+	chunks   *gsync.Future[*chunked.Dataset]
+	signer   *urlSigner
+	rendered gsync.Cache[keyframeKey, []byte]
+}
+
+type keyframeKey struct {
+	index   int
+	palette string
+}
+
+func newKeyframes(records *gsync.Future[[]dataset.Record], chunks *gsync.Future[*chunked.Dataset], interval time.Duration, signer *urlSigner) *keyframes {
+	return &keyframes{
+		times: gsync.Map(records, func(records []dataset.Record) ([]time.Time, error) {
+			if len(records) == 0 {
+				return nil, nil
+			}
+			first := records[0].Time().UTC()
+			last := records[len(records)-1].Time().UTC()
+			return keyframeTimes(first, last, interval), nil
+		}),
+		chunks:   chunks,
+		signer:   signer,
+		rendered: gsync.Cache[keyframeKey, []byte]{MaxEntries: keyframeCacheSize},
+	}
+}
+
+func (k *keyframes) list(w http.ResponseWriter, r *http.Request) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+	defer cancel()
+
+	times, err := k.times.Wait(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("dataset not ready: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	// Valid for at least webhookLinkTTL, and the same until the next window.
+	expires := time.Now().Add(webhookLinkTTL).Truncate(keyframeLinkWindow).Add(keyframeLinkWindow)
+	list := make([]keyframe, len(times))
+	for i, t := range times {
+		u := &url.URL{
+			Path:     fmt.Sprintf("/render/keyframe/%d.png", i),
+			RawQuery: url.Values{"t": {strconv.FormatInt(t.UnixMilli(), 10)}}.Encode(),
+		}
+		if k.signer != nil {
+			u = k.signer.sign(u, expires)
+		}
+		list[i] = keyframe{i, t.In(loc), u.String()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (k *keyframes) render(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/render/keyframe/"), ".png"))
+	if err != nil || !strings.HasSuffix(r.URL.Path, ".png") {
+		http.NotFound(w, r)
+		return
+	}
+	times, err := k.times.Wait(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+	if n < 0 || n >= len(times) {
+		http.NotFound(w, r)
+		return
+	}
+	if t := r.FormValue("t"); t != "" && t != strconv.FormatInt(times[n].UnixMilli(), 10) {
+		http.NotFound(w, r) // from a different set of keyframes
+		return
+	}
+
+	name := r.FormValue("palette")
+	palette, err := dataset.PaletteVariant(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img, err := k.rendered.Get(r.Context(), keyframeKey{n, name}, func(ctx context.Context) ([]byte, error) {
+		chunks, err := k.chunks.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		snapshot, err := chunks.SnapshotAt(times[n].UnixMilli(), timelapse.Bounds())
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Palette = palette
+		buf := new(bytes.Buffer)
+		if err := png.Encode(buf, snapshot); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("rendering keyframe: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if r.FormValue("t") != "" {
+		w.Header().Set("Cache-Control", static.ImmutableCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, "", times[n], bytes.NewReader(img))
+}
@@ -0,0 +1,76 @@
+package live
+
+import (
+	"sync"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+// A Dataset is a dataset which grows as events arrive from a feed, for views of the canvas
+// (such as analytics) which should include them.
+// Its records are those of a base dataset followed by the events appended to it since.
+//
+// The records are only ever appended to, so each snapshot of them stays valid as the dataset grows.
+type Dataset struct {
+	base *gsync.Future[[]dataset.Record]
+
+	mu       sync.Mutex
+	records  []dataset.Record // the base records (once loaded) and the events in snapshots so far
+	pending  []dataset.Record // appended since the last snapshot
+	snapshot *gsync.Future[[]dataset.Record]
+}
+
+// NewDataset returns a dataset of the base records, to which events can be appended.
+// The base records must be sorted by time, and are not modified.
+func NewDataset(base *gsync.Future[[]dataset.Record]) *Dataset {
+	return &Dataset{
+		base:     base,
+		snapshot: base,
+	}
+}
+
+// Append appends the event to the dataset, to be included in the next snapshot.
+func (d *Dataset) Append(rec dataset.Record) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending = append(d.pending, rec)
+}
+
+// Snapshot returns the records of the dataset so far, sorted by time, and whether any events
+// have been added to them since the last snapshot. Until the base records are loaded, they are
+// the only records (so events are held until then).
+//
+// So that the records stay sorted, an event which is older than the last record is added as of
+// the time of the last record (which, since events arrive as they happen, is only a little later).
+func (d *Dataset) Snapshot() (records *gsync.Future[[]dataset.Record], changed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.pending) == 0 {
+		return d.snapshot, false
+	}
+	if d.records == nil {
+		select {
+		case <-d.base.Done():
+		default:
+			return d.snapshot, false
+		}
+		base, err := d.base.Get()
+		if err != nil {
+			return d.snapshot, false
+		}
+		d.records = base[:len(base):len(base)] // so that appending copies, rather than writing past the base
+	}
+	for _, rec := range d.pending {
+		if n := len(d.records); n > 0 && rec.UnixMillis < d.records[n-1].UnixMillis {
+			rec.UnixMillis = d.records[n-1].UnixMillis
+		}
+		d.records = append(d.records, rec)
+	}
+	d.pending = d.pending[:0]
+
+	d.snapshot = gsync.NewFuture[[]dataset.Record]()
+	d.snapshot.Provide(d.records[:len(d.records):len(d.records)])
+	return d.snapshot, true
+}
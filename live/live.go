@@ -0,0 +1,155 @@
+// Package live follows feeds of pixel events as they happen,
+// for viewing r/place-like canvases that are still being drawn.
+package live
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+)
+
+// Backoff limits how long Follow waits between attempts to reconnect to a feed.
+var (
+	MinBackoff = 1 * time.Second
+	MaxBackoff = 1 * time.Minute
+)
+
+// An event is the JSON form of a pixel event in a feed,
+// which is the same as that written by `rplacemap export --format=ndjson`.
+type event struct {
+	Time     time.Time `json:"ts"`
+	UserHash string    `json:"user_hash"`
+	X        int16     `json:"x"`
+	Y        int16     `json:"y"`
+	Color    uint8     `json:"color"`
+}
+
+func (e event) record() (dataset.Record, error) {
+	rec := dataset.Record{
+		UnixMillis: e.Time.UnixMilli(),
+		X:          e.X,
+		Y:          e.Y,
+		Color:      e.Color,
+	}
+	if e.UserHash != "" {
+		hash, err := dataset.ParseUserHash(e.UserHash)
+		if err != nil {
+			return rec, err
+		}
+		rec.UserHash = hash
+	}
+	return rec, nil
+}
+
+// Follow sends the events from the feed to events until ctx is canceled,
+// reconnecting (with exponential backoff) whenever the connection is lost.
+//
+// The feed is either server-sent events (Content-Type text/event-stream) with one event
+// in the data of each message, or a stream of newline-delimited JSON events.
+// When reconnecting to server-sent events, the id of the last event is sent as Last-Event-ID,
+// so that feeds which support it can resume after it.
+func Follow(ctx context.Context, feed *url.URL, events chan<- dataset.Record) error {
+	backoff := MinBackoff
+	var lastID string
+	for {
+		start := time.Now()
+		err := follow(ctx, feed, events, &lastID)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Since(start) > MaxBackoff {
+			backoff = MinBackoff // the connection was healthy for a while
+		}
+		glog.Warningf("Live feed %s disconnected (reconnecting in %s): %s", feed, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > MaxBackoff {
+			backoff = MaxBackoff
+		}
+	}
+}
+
+func follow(ctx context.Context, feed *url.URL, events chan<- dataset.Record, lastID *string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed.String(), nil)
+	if err != nil {
+		return fmt.Errorf("creating request for %q: %w", feed, err)
+	}
+	req.Header.Set("Accept", "text/event-stream, application/x-ndjson")
+	if *lastID != "" {
+		req.Header.Set("Last-Event-ID", *lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("connecting to %q: %w", feed, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %q returned %q", feed, resp.Status)
+	}
+	sse := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+	glog.Infof("Following live feed %s", feed)
+
+	lines := bufio.NewScanner(resp.Body)
+	var received int64
+	id := *lastID // of the message being read, which is the last once it is complete
+	for lines.Scan() {
+		line := lines.Text()
+		if sse {
+			// Only single-line data fields are supported; comments and event types are ignored.
+			if line == "" {
+				*lastID = id
+				continue
+			}
+			if v, ok := strings.CutPrefix(line, "id:"); ok {
+				id = strings.TrimPrefix(v, " ")
+				continue
+			}
+			data, ok := strings.CutPrefix(line, "data:")
+			if !ok {
+				continue
+			}
+			line = strings.TrimPrefix(data, " ")
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		var e event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			glog.V(1).Infof("Ignoring malformed event %q: %s", line, err)
+			continue
+		}
+		rec, err := e.record()
+		if err != nil {
+			glog.V(1).Infof("Ignoring malformed event %q: %s", line, err)
+			continue
+		}
+
+		select {
+		case events <- rec:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if received++; received == 1 || received%10000 == 0 {
+			glog.V(1).Infof("Received %d live events from %s", received, feed)
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return fmt.Errorf("reading %q: %w", feed, err)
+	}
+	return fmt.Errorf("feed %q ended after %d events", feed, received)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/live"
+)
+
+var liveRefresh = serveFlags.Duration("live-refresh", 10*time.Minute, "How often the analytics and timelapse are recomputed to include the events received from --live (if any have arrived)")
+
+// A liveView serves handlers which derive something from the records (e.g. analytics, or the timelapse)
+// from those of a live dataset, rebuilding them periodically to include the events which have arrived.
+// Without a live dataset, the handlers are simply built from the records.
+type liveView struct {
+	data *live.Dataset // nil without --live
+
+	mu     sync.Mutex
+	routes []*liveRoute
+}
+
+// A liveRoute is a handler built from a snapshot of the live dataset.
+type liveRoute struct {
+	build func(*gsync.Future[[]dataset.Record]) http.Handler
+
+	mu      sync.RWMutex
+	handler http.Handler
+}
+
+func (r *liveRoute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	h := r.handler
+	r.mu.RUnlock()
+	h.ServeHTTP(w, req)
+}
+
+// handler returns a handler which serves with the one built from the records,
+// which is rebuilt whenever the view is refreshed with new events.
+func (v *liveView) handler(records *gsync.Future[[]dataset.Record], build func(*gsync.Future[[]dataset.Record]) http.Handler) http.HandlerFunc {
+	if v.data == nil {
+		return build(records).ServeHTTP
+	}
+	snapshot, _ := v.data.Snapshot()
+	route := &liveRoute{build: build, handler: build(snapshot)}
+	v.mu.Lock()
+	v.routes = append(v.routes, route)
+	v.mu.Unlock()
+	return route.ServeHTTP
+}
+
+// run refreshes the handlers every interval until ctx is canceled.
+func (v *liveView) run(ctx context.Context, interval time.Duration) {
+	if v.data == nil {
+		return
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			v.refresh()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh rebuilds the handlers from a snapshot of the live dataset, if events have arrived since the last.
+func (v *liveView) refresh() {
+	snapshot, changed := v.data.Snapshot()
+	if !changed {
+		return
+	}
+	v.mu.Lock()
+	routes := append([]*liveRoute(nil), v.routes...)
+	v.mu.Unlock()
+	for _, route := range routes {
+		h := route.build(snapshot)
+		route.mu.Lock()
+		route.handler = h
+		route.mu.Unlock()
+	}
+	if records, err := snapshot.Get(); err == nil {
+		glog.V(1).Infof("Refreshed %d live views with %d records", len(routes), len(records))
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/chunked"
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/progress"
+	"github.com/kylelemons/rplacemap/tiles"
+)
+
+var parseMode dataset.ParseMode
+
+func init() {
+	flag.Var(&parseMode, "parse-mode", "How to treat malformed rows of the dataset CSV: strict (fail) or lenient (skip and count them)")
+	flag.IntVar(&dataset.DownloadRetry.Attempts, "download-attempts", dataset.DownloadRetry.Attempts, "How many times to try downloading the dataset if it fails with a network error or 5xx response")
+	flag.DurationVar(&dataset.DownloadRetry.Backoff, "download-backoff", dataset.DownloadRetry.Backoff, "How long to wait before retrying a failed download, doubled (up to 30s) for each retry after that")
+	flag.IntVar(&dataset.MaxMissingShards, "max-missing-shards", dataset.MaxMissingShards, "How many shards of a sharded dataset (2023) may fail to download while still serving the rest of them; the gaps are listed at /api/coverage")
+}
+
+// datasetBase returns the path to the cached dataset (and its derived files) without a suffix.
+func datasetBase() string {
+	if source != dataset.Source2017 {
+		return filepath.Join(cacheDir, "source_"+source.Name)
+	}
+	return filepath.Join(cacheDir, "place_data_2017")
+}
+
+// datasetFile returns the path to the cached dataset.
+// New caches are written with zstd compression, but an existing gzip cache is used if present.
+func datasetFile() string {
+	base := datasetBase()
+	for _, suffix := range dataset.FileSuffixes {
+		if _, err := os.Stat(base + suffix); err == nil {
+			return base + suffix
+		}
+	}
+	return base + dataset.FileSuffixes[0]
+}
+
+func tileGridFile() string {
+	return datasetBase() + ".tiles.gob"
+}
+
+func chunkFile() string {
+	return datasetBase() + ".chunks"
+}
+
+// datasetVersion identifies the current contents of the cached dataset file:
+// by its checksum, which is the same wherever it is (e.g. once fetched from --cache-url),
+// or by its size and modification time if it doesn't have one.
+func datasetVersion() (string, error) {
+	info, err := dataset.ReadFileInfo(datasetFile())
+	if err != nil {
+		return "", err
+	}
+	if info.Checksum != nil {
+		return fmt.Sprintf("sha256:%x", info.Checksum), nil
+	}
+	fi, err := os.Stat(datasetFile())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d@%d", fi.Size(), fi.ModTime().UnixNano()), nil
+}
+
+// sharedURL returns the URL of the cache file in the shared cache.
+func sharedURL(file string) *url.URL {
+	u := *sharedCache
+	u.Path = path.Join("/", u.Path, filepath.Base(file))
+	return &u
+}
+
+// fetchShared fetches the cache file from the shared cache (if there is one),
+// reporting whether it was there.
+func fetchShared(ctx context.Context, file string) bool {
+	if sharedCache == nil {
+		return false
+	}
+	u := sharedURL(file)
+	if err := dataset.FetchObject(ctx, u, file); errors.Is(err, os.ErrNotExist) {
+		glog.Infof("%s is not in the shared cache yet", filepath.Base(file))
+		return false
+	} else if err != nil {
+		glog.Warningf("Failed to fetch from the shared cache: %s", err)
+		return false
+	}
+	glog.Infof("Fetched %s from the shared cache", u)
+	return true
+}
+
+// storeShared stores the cache file in the shared cache (if there is one) in the background,
+// for other servers to fetch.
+func storeShared(ctx context.Context, file string) {
+	if sharedCache == nil {
+		return
+	}
+	u := sharedURL(file)
+	go func() {
+		if err := dataset.StoreObject(ctx, file, u); err != nil {
+			glog.Warningf("Failed to store in the shared cache: %s", err)
+			return
+		}
+		glog.Infof("Stored %s in the shared cache", u)
+	}()
+}
+
+// loadTileGrid returns the flattened canvas for serving tiles.
+//
+// If reuse is true and the grid was previously saved for the current dataset file,
+// it is loaded directly without waiting for the records;
+// otherwise it is computed from the records and saved for next time.
+func loadTileGrid(ctx context.Context, records *gsync.Future[[]dataset.Record], reuse bool) ([][]uint8, error) {
+	if reuse {
+		if version, err := datasetVersion(); err == nil {
+			pixels, err := tiles.LoadGrid(tileGridFile(), version)
+			if (errors.Is(err, os.ErrNotExist) || errors.Is(err, tiles.ErrStaleGrid)) && fetchShared(ctx, tileGridFile()) {
+				pixels, err = tiles.LoadGrid(tileGridFile(), version)
+			}
+			if err == nil {
+				glog.Infof("Loaded cached tile data from %s", tileGridFile())
+				return pixels, nil
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				glog.Warningf("Ignoring cached tile data: %s", err)
+			}
+		}
+	}
+
+	recs, err := records.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pixels, err := tiles.Flatten(recs)
+	if err != nil {
+		return nil, err
+	}
+
+	if version, err := datasetVersion(); err != nil {
+		glog.Warningf("Not caching tile data: %s", err)
+	} else if err := tiles.SaveGrid(tileGridFile(), version, pixels); err != nil {
+		glog.Warningf("Failed to cache tile data: %s", err)
+	} else {
+		storeShared(ctx, tileGridFile())
+	}
+	return pixels, nil
+}
+
+var chunkMmap = serveFlags.Bool("chunk-mmap", false, "Map the pixel histories from the cache read-only, sharing their memory with other processes serving the same cache (instead of a --chunk-cache)")
+
+var chunkCache = serveFlags.Int("chunk-cache", 0, "How many chunks (256px squares) of pixel histories to keep in memory, loading the others from the cache as they're needed (0 for all of them)")
+
+// loadChunks returns the records stored by chunk, for looking up the history of pixels.
+//
+// If reuse is true and the chunks were previously saved for the current dataset file,
+// they are loaded directly without waiting for the records;
+// otherwise they are built from the records and saved for next time.
+// With --chunk-cache, only that many of them are kept in memory once they're saved,
+// and with --chunk-mmap they're mapped from where they're saved.
+// Processes sharing the cache directory take turns building them, so that only the first has to.
+func loadChunks(ctx context.Context, records *gsync.Future[[]dataset.Record], reuse bool) (*chunked.Dataset, error) {
+	if reuse {
+		if version, err := datasetVersion(); err == nil {
+			chunks, err := openChunks(version)
+			if (errors.Is(err, os.ErrNotExist) || errors.Is(err, chunked.ErrStale)) && fetchShared(ctx, chunkFile()) {
+				chunks, err = openChunks(version)
+			}
+			if err == nil {
+				glog.Infof("Loaded %d events by chunk from %s", chunks.TotalEvents(), chunkFile())
+				return chunks, nil
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				glog.Warningf("Ignoring cached chunks: %s", err)
+			}
+		}
+	}
+
+	recs, err := records.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if unlock, err := chunked.Lock(chunkFile()); err != nil {
+		glog.Warningf("Building chunks without a lock: %s", err)
+	} else {
+		defer unlock()
+		if version, err := datasetVersion(); reuse && err == nil {
+			if chunks, err := openChunks(version); err == nil {
+				glog.Infof("Loaded %d events by chunk from %s, built by another process", chunks.TotalEvents(), chunkFile())
+				return chunks, nil
+			}
+		}
+	}
+	chunks, err := newChunks(recs)
+	if err != nil {
+		return nil, err
+	}
+
+	if version, err := datasetVersion(); err != nil {
+		glog.Warningf("Not caching chunks: %s", err)
+	} else if err := chunks.WriteFile(chunkFile(), version); err != nil {
+		glog.Warningf("Failed to cache chunks: %s", err)
+	} else {
+		storeShared(ctx, chunkFile())
+		if *chunkCache > 0 || *chunkMmap {
+			if opened, err := openChunks(version); err != nil {
+				glog.Warningf("Keeping all chunks in memory: %s", err)
+			} else {
+				chunks = opened
+			}
+		}
+	}
+	return chunks, nil
+}
+
+// openChunks opens the cached chunks, which are mapped with --chunk-mmap,
+// or loaded as they're needed if there's a --chunk-cache.
+func openChunks(version string) (*chunked.Dataset, error) {
+	if *chunkMmap {
+		return chunked.Map(chunkFile(), version)
+	}
+	if *chunkCache > 0 {
+		return chunked.Open(chunkFile(), version, *chunkCache)
+	}
+	return chunked.Load(chunkFile(), version)
+}
+
+// newChunks stores the records (sorted by time, as loaded) by chunk of the canvas in use.
+func newChunks(records []dataset.Record) (*chunked.Dataset, error) {
+	return chunked.New(records, dataset.CanvasBounds())
+}
+
+// sourceProbeTTL is how long the results of probing the dataset sources are reused by /api/sources,
+// so that its clients can't have the server probe them on every request.
+const sourceProbeTTL = 5 * time.Minute
+
+// sourceProbes holds the results of the most recent probe of the dataset sources, if any (under the key "").
+var sourceProbes = gsync.Cache[string, []dataset.SourceProbe]{TTL: sourceProbeTTL}
+
+// chooseSource probes the dataset sources and returns the first healthy one.
+func chooseSource(ctx context.Context) (*url.URL, error) {
+	sources, err := datasetSources()
+	if err != nil {
+		return nil, err
+	}
+	probes := dataset.ProbeSources(ctx, sources)
+	sourceProbes.Put("", probes)
+
+	var chosen *url.URL
+	for i, probe := range probes {
+		if !probe.OK {
+			glog.Warningf("Source %s is unavailable: %s", probe.URL, probe.Error)
+			continue
+		}
+		glog.V(1).Infof("Source %s is available (%s, responded in %dms)",
+			probe.URL, progress.FormatBytes(probe.Size), probe.LatencyMillis)
+		if chosen == nil {
+			chosen = sources[i]
+			glog.Infof("Downloading from %s (expecting %s)", probe.URL, progress.FormatBytes(probe.Size))
+		}
+	}
+	if chosen == nil {
+		return nil, fmt.Errorf("none of the %d dataset sources are available", len(sources))
+	}
+	return chosen, nil
+}
+
+// downloadRecords downloads the dataset to datasetFile: shard by shard if the source is sharded,
+// or else from the first of its sources which is available.
+func downloadRecords(ctx context.Context, datasetFile string, bar *progress.Bar) ([]dataset.Record, error) {
+	if len(source.Shards) > 0 {
+		glog.Infof("Downloading %d shards of the %s dataset", len(source.Shards), source.Name)
+		recs, _, _, err := source.DownloadShards(ctx, datasetFile, parseMode, bar)
+		return recs, err
+	}
+	chosen, err := chooseSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	recs, _, err := source.Download(ctx, datasetFile, chosen, parseMode, bar)
+	return recs, err
+}
+
+// loadRecords loads the dataset from the cache, downloading it first if it isn't cached (or if forced).
+func loadRecords(ctx context.Context, bar *progress.Bar, forceDownload bool) ([]dataset.Record, error) {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+
+	datasetFile := datasetFile()
+	_, err := os.Stat(datasetFile)
+	if os.IsNotExist(err) && !forceDownload && fetchShared(ctx, datasetFile) {
+		_, err = os.Stat(datasetFile)
+	}
+	var records []dataset.Record
+	if os.IsNotExist(err) || forceDownload {
+		glog.Infof("No dataset found, downloading...")
+		recs, err := downloadRecords(ctx, datasetFile, bar)
+		if err != nil {
+			return nil, fmt.Errorf("downloading dataset: %w", err)
+		}
+		records = recs
+		if coverage, err := dataset.ReadCoverage(datasetFile); err == nil && coverage.Complete() {
+			storeShared(ctx, datasetFile) // other servers download the missing shards for themselves
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("checking cache: %w", err)
+	} else {
+		glog.Infof("Loading cached dataset (--download to re-download)...")
+		glog.Infof("  File: %s", datasetFile)
+		recs, err := dataset.Load(ctx, datasetFile)
+		if errors.Is(err, dataset.ErrCorrupt) {
+			return nil, fmt.Errorf("loading dataset: %w (--download to re-download)", err)
+		} else if err != nil {
+			return nil, fmt.Errorf("loading dataset: %w", err)
+		}
+		records = recs
+	}
+	return records, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// logLevel is the response of /admin/loglevel.
+type logLevel struct {
+	V       string `json:"v"`
+	VModule string `json:"vmodule"`
+}
+
+// logLevelHandler serves /admin/loglevel: GET reports the log verbosity, and POST ?v=&vmodule=
+// changes it (as the flags of the same names would) without restarting the server and losing
+// its caches. Only authorized requests can change it.
+func logLevelHandler(authorized func(*http.Request) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if !authorized(r) {
+				http.Error(w, "changing the log level requires a valid X-Admin-Key", http.StatusUnauthorized)
+				return
+			}
+			query := r.URL.Query()
+			if s := query.Get("v"); s != "" {
+				if v, err := strconv.Atoi(s); err != nil || v < 0 {
+					http.Error(w, fmt.Sprintf("v: must be a non-negative integer, got %q", s), http.StatusBadRequest)
+					return
+				}
+			}
+			for _, name := range []string{"v", "vmodule"} {
+				if !query.Has(name) {
+					continue
+				}
+				if err := flag.Set(name, query.Get(name)); err != nil {
+					http.Error(w, fmt.Sprintf("%s: %s", name, err), http.StatusBadRequest)
+					return
+				}
+				glog.Infof("Set --%s=%q (requested by %s)", name, query.Get(name), r.RemoteAddr)
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, logLevel{
+			V:       flag.Lookup("v").Value.String(),
+			VModule: flag.Lookup("vmodule").Value.String(),
+		})
+	}
+}
@@ -1,30 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"net"
-	"net/http"
-	_ "net/http/pprof"
 	"net/url"
 	"os"
-	"path/filepath"
-	"time"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/emersion/go-appdir"
 	"github.com/golang/glog"
 
 	"github.com/kylelemons/rplacemap/dataset"
-	"github.com/kylelemons/rplacemap/static"
-	"github.com/kylelemons/rplacemap/tiles"
-	"github.com/kylelemons/rplacemap/timelapse"
-)
-
-var (
-	download = flag.Bool("download", false, "Force re-download of r/place map data")
-	addr     = flag.String("http", "localhost:0", "HTTP serve address")
-
-	dev = flag.Bool("dev", false, "Don't use builtin assets")
 )
 
 var (
@@ -32,80 +26,212 @@ var (
 )
 
 var (
-	// Full 2017 dataset, CSV (~1GiB)
-	placeData2017 = &url.URL{
-		Scheme: "https",
-		Host:   "storage.googleapis.com",
-		Path:   "/justin_bassett/place_tiles",
-	}
+	mirrors      = flag.String("mirrors", "", "Comma-separated URLs of mirrors of the dataset CSV, tried in order if the primary source is unavailable; local files (paths or file:// URLs, optionally .gz) are tried first")
+	sourceCSV    = flag.String("source-csv", "", "URL or local path of a CSV of pixel events (e.g. exported from a private canvas, optionally .gz) to use instead of the 2017 dataset")
+	sourceConfig = flag.String("source-config", "", "JSON file describing the layout of the --source-csv (header, columns, timestamp_layout, palette, canvas_size), if it isn't that of the 2017 dataset")
+	year         = flag.Int("year", dataset.Year, "Year of r/place whose dataset is shown (2017 or 2023), or whose layout the --source-csv has")
+
+	gcsTokenFile = flag.String("gcs-token-file", "", "File holding an OAuth2 access token for gs:// and bq:// sources (default $GOOGLE_OAUTH_ACCESS_TOKEN)")
+	bqProject    = flag.String("bigquery-project", "", "Project billed for querying bq://project/dataset.table sources (default $GOOGLE_CLOUD_PROJECT, or the table's)")
+	s3Region     = flag.String("s3-region", "", "Region of the bucket of s3:// sources (default $AWS_REGION, or us-east-1); keys are read from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	s3Endpoint   = flag.String("s3-endpoint", "", "Endpoint of an S3-compatible store for s3:// sources (default $AWS_ENDPOINT_URL_S3, or AWS's)")
+	cacheURL     = flag.String("cache-url", "", "gs://bucket/prefix or s3://bucket/prefix of a cache shared by servers: the prepared dataset and tile data are fetched from it instead of being rebuilt, and stored in it once built")
 )
 
-func main() {
-	flag.Set("logtostderr", "true")
-	flag.Set("v", "2")
-	flag.Parse()
+// sharedCache is the parsed --cache-url, or nil if it isn't set.
+var sharedCache *url.URL
 
-	records := make(chan []dataset.Record, 1)
-	go func() {
-		records <- loadRecords()
-	}()
+// source is the dataset shown by the commands: the official dataset of the --year,
+// unless --source-csv or --source-config is set.
+var source = dataset.Source2017
 
-	serve(records)
-}
+// sourceName matches the names of sources other than 2017's, which appear in cache file names.
+var sourceName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
 
-func loadRecords() []dataset.Record {
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		glog.Fatalf("Failed to create cache directory: %s", err)
+// selectSource sets source (and registers it) according to the flags.
+func selectSource() error {
+	official, ok := dataset.LookupSource(strconv.Itoa(*year))
+	if !ok || official.Year != *year {
+		return fmt.Errorf("--year: no dataset for %d (want 2017 or 2023)", *year)
+	}
+	if *sourceCSV == "" && *sourceConfig == "" {
+		if official != source {
+			source = official
+			glog.Infof("Using the %d dataset", official.Year)
+		}
+		return nil
 	}
+	src := official.WithURLs()
+	src.Name = "csv"
+	if *sourceConfig != "" {
+		data, err := os.ReadFile(*sourceConfig)
+		if err != nil {
+			return fmt.Errorf("--source-config: %w", err)
+		}
+		src = new(dataset.Source)
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(src); err != nil {
+			return fmt.Errorf("--source-config: %w", err)
+		}
+	}
+	if *sourceCSV != "" {
+		src.URLs = []string{*sourceCSV}
+	}
+	if !sourceName.MatchString(src.Name) {
+		return fmt.Errorf("source name %q must be lowercase letters, digits, - and _ (up to 64)", src.Name)
+	}
+	if len(src.URLs) == 0 {
+		return fmt.Errorf("source %q has no URLs (set --source-csv)", src.Name)
+	}
+	if err := dataset.RegisterSource(src); err != nil {
+		return err
+	}
+	source = src
+	glog.Infof("Using source %q (%s)", src.Name, strings.Join(src.URLs, ", "))
+	return nil
+}
 
-	datasetFile := filepath.Join(cacheDir, "place_data_2017.gob.gz")
-	var records []dataset.Record
-	if _, err := os.Stat(datasetFile); os.IsNotExist(err) || *download {
-		glog.Infof("No dataset found, downloading...")
-		recs, err := dataset.Download(datasetFile, placeData2017)
+// configureObjectStore sets the credentials for gs://, s3://, and bq:// sources which are given by flags,
+// and the shared cache.
+func configureObjectStore() error {
+	if *gcsTokenFile != "" {
+		token, err := os.ReadFile(*gcsTokenFile)
 		if err != nil {
-			glog.Fatalf("Failed to download dataset: %s", err)
+			return fmt.Errorf("--gcs-token-file: %w", err)
 		}
-		records = recs
-	} else if err != nil {
-		glog.Fatalf("Failed to check cache: %s", err)
-	} else {
-		glog.Infof("Loading cached dataset (--download to re-download)...")
-		glog.Infof("  File: %s", datasetFile)
-		recs, err := dataset.Load(datasetFile)
+		dataset.ObjectStore.GCSToken = strings.TrimSpace(string(token))
+	}
+	if *bqProject != "" {
+		dataset.ObjectStore.BigQueryProject = *bqProject
+	}
+	if *s3Region != "" {
+		dataset.ObjectStore.S3Region = *s3Region
+	}
+	if *s3Endpoint != "" {
+		dataset.ObjectStore.S3Endpoint = *s3Endpoint
+	}
+	if *cacheURL != "" {
+		u, err := url.Parse(*cacheURL)
 		if err != nil {
-			glog.Fatalf("Failed to load dataset: %s", err)
+			return fmt.Errorf("--cache-url: %w", err)
+		}
+		if !dataset.IsObjectStore(u) || u.Host == "" {
+			return fmt.Errorf("--cache-url: %q is not a gs://bucket/prefix or s3://bucket/prefix URL", *cacheURL)
 		}
-		records = recs
+		sharedCache = u
 	}
-	return records
+	return nil
 }
 
-func serve(records chan []dataset.Record) {
-	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		select {
-		case recs := <-records:
-			records <- recs
-			fmt.Fprintf(w, "OK: %d records", len(records))
-		case <-time.After(1 * time.Second):
-			http.Error(w, "tiles not ready", http.StatusServiceUnavailable)
+// datasetSources returns the URLs from which the dataset can be downloaded, in order of preference.
+// Local mirrors are preferred to the source's own URLs.
+func datasetSources() ([]*url.URL, error) {
+	sources, err := source.ParsedURLs()
+	if err != nil {
+		return nil, err
+	}
+	if source != dataset.Source2017 {
+		return sources, nil // the mirrors are of the 2017 dataset
+	}
+	var local []*url.URL
+	for _, mirror := range strings.Split(*mirrors, ",") {
+		if mirror = strings.TrimSpace(mirror); mirror == "" {
+			continue
 		}
-	})
+		u, err := dataset.ParseSourceURL(mirror)
+		if err != nil {
+			return nil, fmt.Errorf("--mirrors: %w", err)
+		}
+		if dataset.IsLocal(u) {
+			local = append(local, u) // no need to download what is already on disk
+			continue
+		}
+		sources = append(sources, u)
+	}
+	return append(local, sources...), nil
+}
 
-	http.HandleFunc("/tiles/", tiles.Handler(records))
+// A command is a subcommand of the rplacemap binary.
+type command struct {
+	name  string
+	args  string // usage synopsis for the arguments after the flags
+	help  string
+	flags *flag.FlagSet
+	run   func(ctx context.Context, args []string) error
+}
 
-	renderTimelapse := timelapse.Handler(records)
-	http.HandleFunc("/render/timelapse.apng", renderTimelapse)
-	http.HandleFunc("/render/timelapse.gif", renderTimelapse)
+var commands = map[string]*command{}
 
-	http.Handle("/static/", static.Handler(*dev))
-	http.Handle("/", http.RedirectHandler("/static/index.html", http.StatusTemporaryRedirect))
+// register adds cmd to the given table of commands.
+func register(table map[string]*command, cmd *command) *command {
+	table[cmd.name] = cmd
+	return cmd
+}
 
-	lis, err := net.Listen("tcp", *addr)
-	if err != nil {
-		glog.Exitf("Failed to listen on %q: %s", *addr, err)
+// defaultCommand is run if no command is specified.
+const defaultCommand = "serve"
+
+func main() {
+	flag.Set("logtostderr", "true")
+	flag.Set("v", "2")
+	flag.Usage = usage
+	flag.Parse()
+	if err := configureObjectStore(); err != nil {
+		glog.Exitf("%s", err)
+	}
+	if err := selectSource(); err != nil {
+		glog.Exitf("%s", err)
+	}
+	source.Use()
+
+	name, args := defaultCommand, flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	cmd.parse(cmd.name, args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := cmd.run(ctx, cmd.flags.Args()); err != nil {
+		glog.Exitf("%s: %s", cmd.name, err)
+	}
+}
+
+// parse parses the command's flags from args, using path (e.g. "render timelapse") in its usage message.
+func (cmd *command) parse(path string, args []string) {
+	cmd.flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [global flags] %s [flags] %s\n\n%s\n\nFlags:\n",
+			os.Args[0], path, cmd.args, cmd.help)
+		cmd.flags.PrintDefaults()
+	}
+	cmd.flags.Parse(args)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [global flags] <command> [flags] [args]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands (default %q):\n", defaultCommand)
+
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		help := commands[name].help
+		if i := strings.IndexByte(help, '\n'); i >= 0 {
+			help = help[:i]
+		}
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, help)
 	}
-	glog.Infof("Serving HTTP on http://%s", lis.Addr())
 
-	glog.Exitf("HTTP Serve exited: %s", http.Serve(lis, nil))
+	fmt.Fprintf(os.Stderr, "\nGlobal flags:\n")
+	flag.PrintDefaults()
 }
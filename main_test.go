@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/kylelemons/rplacemap/dataset"
+)
+
+func TestSelectSource(t *testing.T) {
+	defer func(y int, s *dataset.Source) { *year, source = y, s }(*year, source)
+	tests := []struct {
+		year int
+		want *dataset.Source
+	}{
+		{dataset.Year, dataset.Source2017},
+		{2023, dataset.Source2023},
+		{2022, nil},
+	}
+	for _, test := range tests {
+		*year, source = test.year, dataset.Source2017
+		err := selectSource()
+		switch {
+		case test.want == nil && err == nil:
+			t.Errorf("--year=%d: selectSource succeeded, want an error", test.year)
+		case test.want != nil && err != nil:
+			t.Errorf("--year=%d: selectSource: %s", test.year, err)
+		case test.want != nil && source != test.want:
+			t.Errorf("--year=%d: selected source %q, want %q", test.year, source.Name, test.want.Name)
+		}
+	}
+}
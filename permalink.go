@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// permalinkVersion is the first byte of every permalink token,
+// so that the encoding can change without breaking old links.
+const permalinkVersion = 1
+
+// A viewState is the state of the map as captured by a permalink.
+type viewState struct {
+	X      int        `json:"x"`
+	Y      int        `json:"y"`
+	Zoom   int        `json:"zoom"`
+	Time   *time.Time `json:"t,omitempty"`
+	Layers []string   `json:"layers,omitempty"`
+}
+
+var errBadToken = errors.New("malformed permalink token")
+
+// encode returns a short, URL-safe token for the view.
+func (v viewState) encode() string {
+	var millis int64
+	if v.Time != nil {
+		millis = v.Time.UnixMilli()
+	}
+	buf := []byte{permalinkVersion}
+	buf = binary.AppendVarint(buf, int64(v.X))
+	buf = binary.AppendVarint(buf, int64(v.Y))
+	buf = binary.AppendUvarint(buf, uint64(v.Zoom))
+	buf = binary.AppendVarint(buf, millis)
+	buf = append(buf, strings.Join(v.Layers, ",")...)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeViewState(token string) (viewState, error) {
+	var v viewState
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) == 0 || buf[0] != permalinkVersion {
+		return v, errBadToken
+	}
+	buf = buf[1:]
+
+	varint := func() int64 {
+		n, size := binary.Varint(buf)
+		if size <= 0 {
+			err = errBadToken
+			return 0
+		}
+		buf = buf[size:]
+		return n
+	}
+	v.X = int(varint())
+	v.Y = int(varint())
+	if zoom, size := binary.Uvarint(buf); size > 0 {
+		v.Zoom, buf = int(zoom), buf[size:]
+	} else {
+		err = errBadToken
+	}
+	if millis := varint(); millis != 0 {
+		t := time.UnixMilli(millis).UTC()
+		v.Time = &t
+	}
+	if err != nil {
+		return viewState{}, err
+	}
+	if len(buf) > 0 {
+		v.Layers = strings.Split(string(buf), ",")
+	}
+	return v, nil
+}
+
+// parseViewState reads a view from the x, y, zoom, t, and layers query parameters.
+func parseViewState(query url.Values) (viewState, error) {
+	var v viewState
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"x", &v.X}, {"y", &v.Y}, {"zoom", &v.Zoom}} {
+		if s := query.Get(p.name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return v, fmt.Errorf("%s: %w", p.name, err)
+			}
+			*p.dst = n
+		}
+	}
+	if v.Zoom < 0 {
+		return v, fmt.Errorf("zoom must not be negative")
+	}
+	if s := query.Get("t"); s != "" {
+		var t timeFlag
+		if err := t.Set(s); err != nil {
+			return v, fmt.Errorf("t: %w", err)
+		}
+		v.Time = &t.Time
+	}
+	for _, layer := range strings.Split(query.Get("layers"), ",") {
+		if layer = strings.TrimSpace(layer); layer != "" {
+			v.Layers = append(v.Layers, layer)
+		}
+	}
+	return v, nil
+}
+
+// handlePermalink converts between view states and permalink tokens:
+// with a token parameter it returns the view it encodes, and otherwise
+// it returns the token for the view given by the other parameters.
+func handlePermalink(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var resp any
+	if token := query.Get("token"); token != "" {
+		v, err := decodeViewState(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		loc, err := requestLocation(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if v.Time != nil {
+			t := v.Time.In(loc)
+			v.Time = &t
+		}
+		resp = v
+	} else {
+		v, err := parseViewState(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp = struct {
+			Token string `json:"token"`
+		}{v.encode()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+// prerenderQuiet is how long interactive traffic must be idle before the next prerender starts.
+const prerenderQuiet = 1 * time.Second
+
+type prerenderJob struct {
+	name     string
+	params   map[string]string
+	artifact string // path at which the result is served
+	run      func(ctx context.Context) error
+}
+
+// prerenderJobs parses a comma-separated list of prerender targets.
+func prerenderJobs(spec string, tileGrid *gsync.Future[[][]uint8], lapse *timelapse.Encodings) ([]prerenderJob, error) {
+	var jobs []prerenderJob
+	for _, target := range strings.Split(spec, ",") {
+		target = strings.TrimSpace(target)
+		kind, format, _ := strings.Cut(target, ":")
+		switch {
+		case target == "":
+		case target == "tiles":
+			jobs = append(jobs, prerenderJob{target, nil, "/", func(ctx context.Context) error {
+				_, err := tileGrid.Wait(ctx)
+				return err
+			}})
+		case kind == "timelapse" && contains(timelapse.Formats, format):
+			params := map[string]string{
+				"format":   format,
+				"interval": timelapse.DefaultInterval.String(),
+			}
+			jobs = append(jobs, prerenderJob{target, params, "/render/timelapse." + format, func(ctx context.Context) error {
+				return lapse.Prerender(ctx, format)
+			}})
+		default:
+			return nil, fmt.Errorf("unknown prerender target %q (want tiles or timelapse:{%s})",
+				target, strings.Join(timelapse.Formats, ","))
+		}
+	}
+	return jobs, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// A prerenderer runs heavy renders in the background so they are ready before they are requested.
+//
+// Jobs run one at a time, in the order given, and each one waits to start until
+// interactive requests have been idle for prerenderQuiet, so that a prerender
+// doesn't compete with someone browsing the map.
+type prerenderer struct {
+	mu     sync.Mutex
+	active int       // interactive requests in flight
+	last   time.Time // when the last interactive request finished
+}
+
+// interactive wraps a handler whose requests should take priority over prerendering.
+func (p *prerenderer) interactive(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.active++
+		p.mu.Unlock()
+
+		defer func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.active--
+			p.last = time.Now()
+		}()
+		h(w, r)
+	}
+}
+
+// waitIdle waits until there have been no interactive requests for prerenderQuiet.
+func (p *prerenderer) waitIdle(ctx context.Context) error {
+	for {
+		p.mu.Lock()
+		wait := prerenderQuiet - time.Since(p.last)
+		if p.active > 0 {
+			wait = prerenderQuiet
+		}
+		p.mu.Unlock()
+
+		if wait <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// run runs the jobs once the records are loaded, notifying hooks as each one finishes.
+func (p *prerenderer) run(ctx context.Context, records *gsync.Future[[]dataset.Record], jobs []prerenderJob, hooks *webhooks) {
+	if len(jobs) == 0 {
+		return
+	}
+	if _, err := records.Wait(ctx); err != nil {
+		return // already logged by the loader
+	}
+	for _, job := range jobs {
+		if err := p.waitIdle(ctx); err != nil {
+			return
+		}
+		glog.Infof("Prerendering %s", job.name)
+		start := time.Now()
+		err := job.run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			glog.Warningf("Prerendering %s failed: %s", job.name, err)
+		} else {
+			glog.Infof("Prerendered %s in %s", job.name, time.Since(start).Truncate(time.Millisecond))
+		}
+		hooks.jobFinished(ctx, job.name, job.params, job.artifact, time.Since(start), err)
+	}
+}
@@ -0,0 +1,286 @@
+// Package progress tracks and reports the progress of long-running operations.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// A Bar tracks progress towards a (possibly not yet known) total.
+// It is safe for concurrent use.
+type Bar struct {
+	label  string
+	unit   Unit
+	start  time.Time
+	parent *Bar
+
+	progress, total int64 // accessed atomically
+	lastUpdate      int64 // UnixNano of the last observer notification, accessed atomically
+	nextSample      int64 // UnixNano of the next rate sample, accessed atomically
+	rates           rateHistogram
+
+	mu        sync.Mutex
+	observers map[int]func(Snapshot)
+	nextID    int
+}
+
+// UpdateInterval is the minimum time between calls to the observers of a Bar.
+const UpdateInterval = 250 * time.Millisecond
+
+func New(label string, unit Unit) *Bar {
+	b := &Bar{
+		label: label,
+		unit:  unit,
+		start: time.Now(),
+	}
+	b.rates.sample(b.start, 0)
+	b.nextSample = b.start.Add(SampleInterval).UnixNano()
+	return b
+}
+
+// SetTotal sets the expected total; a total of zero or less means the total is unknown.
+func (b *Bar) SetTotal(total int64) {
+	old := atomic.SwapInt64(&b.total, total)
+	b.update(false)
+	if b.parent != nil {
+		b.parent.addTotal(total - old)
+	}
+}
+
+func (b *Bar) addTotal(delta int64) {
+	atomic.AddInt64(&b.total, delta)
+	b.update(false)
+	if b.parent != nil {
+		b.parent.addTotal(delta)
+	}
+}
+
+// Add records n more units of progress.
+func (b *Bar) Add(n int64) {
+	progress := atomic.AddInt64(&b.progress, n)
+	b.update(false)
+	if now := time.Now(); now.UnixNano() >= atomic.LoadInt64(&b.nextSample) {
+		atomic.StoreInt64(&b.nextSample, now.Add(SampleInterval).UnixNano())
+		b.rates.sample(now, progress)
+	}
+	if b.parent != nil {
+		b.parent.Add(n)
+	}
+}
+
+// Reset sets the progress and total of the bar back to zero (e.g. to retry the operation),
+// taking them back out of its parent's.
+func (b *Bar) Reset() {
+	progress := atomic.SwapInt64(&b.progress, 0)
+	total := atomic.SwapInt64(&b.total, 0)
+	b.update(false)
+	if b.parent != nil {
+		b.parent.Add(-progress)
+		b.parent.addTotal(-total)
+	}
+}
+
+// Sub returns a new bar (e.g. for one of several sources) whose progress and total
+// also count towards b.
+func (b *Bar) Sub(label string) *Bar {
+	sub := New(label, b.unit)
+	sub.parent = b
+	return sub
+}
+
+// Rates returns statistics about the throughput of the bar so far.
+// Throughput is only sampled while progress is being made.
+func (b *Bar) Rates() RateStats {
+	return b.rates.stats(b.unit)
+}
+
+// Label returns the label of the bar.
+func (b *Bar) Label() string {
+	return b.label
+}
+
+// OnUpdate registers fn to be called with a snapshot of the bar when its progress changes.
+// Calls are rate-limited to one per UpdateInterval (across all observers) and are made
+// synchronously from whichever goroutine updated the bar, so fn should return quickly.
+//
+// The returned function unregisters fn.
+func (b *Bar) OnUpdate(fn func(Snapshot)) (remove func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.observers == nil {
+		b.observers = make(map[int]func(Snapshot))
+	}
+	id := b.nextID
+	b.nextID++
+	b.observers[id] = fn
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.observers, id)
+	}
+}
+
+func (b *Bar) update(force bool) {
+	now := time.Now().UnixNano()
+	if force {
+		atomic.StoreInt64(&b.lastUpdate, now)
+	} else if last := atomic.LoadInt64(&b.lastUpdate); now-last < int64(UpdateInterval) {
+		return
+	} else if !atomic.CompareAndSwapInt64(&b.lastUpdate, last, now) {
+		return // someone else is notifying
+	}
+
+	b.mu.Lock()
+	observers := make([]func(Snapshot), 0, len(b.observers))
+	for _, fn := range b.observers {
+		observers = append(observers, fn)
+	}
+	b.mu.Unlock()
+
+	if len(observers) == 0 {
+		return
+	}
+	snap := b.Snapshot()
+	for _, fn := range observers {
+		fn(snap)
+	}
+}
+
+// Progress returns the current progress.
+func (b *Bar) Progress() int64 {
+	return atomic.LoadInt64(&b.progress)
+}
+
+// A Snapshot is a point-in-time view of a Bar.
+type Snapshot struct {
+	Label    string  `json:"label,omitempty"`
+	Unit     Unit    `json:"unit"`
+	Progress int64   `json:"progress"`
+	Total    int64   `json:"total,omitempty"`
+	Percent  float64 `json:"percent"`
+
+	Rate    float64       `json:"rate"` // per second
+	Elapsed time.Duration `json:"-"`
+	ETA     time.Duration `json:"-"` // zero if unknown
+
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	ETASeconds     float64 `json:"eta_seconds,omitempty"`
+}
+
+func (b *Bar) Snapshot() Snapshot {
+	s := Snapshot{
+		Label:    b.label,
+		Unit:     b.unit,
+		Progress: atomic.LoadInt64(&b.progress),
+		Total:    atomic.LoadInt64(&b.total),
+		Elapsed:  time.Since(b.start),
+	}
+	if s.Total > 0 {
+		s.Percent = float64(s.Progress) * 100 / float64(s.Total)
+	}
+	if secs := s.Elapsed.Seconds(); secs > 0 {
+		s.Rate = float64(s.Progress) / secs
+	}
+	if s.Rate > 0 && s.Total > s.Progress {
+		s.ETA = time.Duration(float64(s.Total-s.Progress) / s.Rate * float64(time.Second))
+	}
+	s.ElapsedSeconds = s.Elapsed.Seconds()
+	s.ETASeconds = s.ETA.Seconds()
+	return s
+}
+
+const barWidth = 50
+
+var barFill = strings.Repeat("#", barWidth)
+
+func (s Snapshot) String() string {
+	percent := int(s.Percent)
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+	amount := s.Unit.Format(s.Progress)
+	if s.Total > 0 {
+		amount += "/" + s.Unit.Format(s.Total)
+	}
+	return fmt.Sprintf("%3d%% [% -*s] %s", percent, barWidth, barFill[:percent*barWidth/100], amount)
+}
+
+func (b *Bar) String() string {
+	return b.Snapshot().String()
+}
+
+// LogEvery logs the progress of the bar periodically until the returned function is called,
+// at which point the progress is logged one final time.
+func (b *Bar) LogEvery(interval time.Duration) (stop func()) {
+	return b.LogEveryV(0, interval)
+}
+
+// LogEveryV is like LogEvery, but only logs at the given verbosity.
+func (b *Bar) LogEveryV(level glog.Level, interval time.Duration) (stop func()) {
+	label := b.label
+	if label == "" {
+		label = "Progress"
+	}
+	print := func() {
+		glog.V(level).Infof("%s: %s", label, b)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				print()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+			print()
+			glog.V(level).Infof("%s: %s", label, b.Rates())
+			b.update(true)
+		})
+	}
+}
+
+// WrapWriter returns a writer that records the bytes written to w as progress on the bar.
+// If size is positive, it is used as the total.
+func (b *Bar) WrapWriter(w io.Writer, size int64) io.Writer {
+	if size > 0 {
+		b.SetTotal(size)
+	}
+	return &progressWriter{w, b}
+}
+
+type progressWriter struct {
+	w   io.Writer
+	bar *Bar
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.bar.Add(int64(n))
+	return n, err
+}
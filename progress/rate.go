@@ -0,0 +1,97 @@
+package progress
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// SampleInterval is how often a Bar samples its throughput for RateStats.
+const SampleInterval = 1 * time.Second
+
+// RateStats summarizes the throughput of a Bar, sampled every SampleInterval.
+type RateStats struct {
+	Unit    Unit    `json:"unit"`
+	Samples int     `json:"samples"`
+	Min     float64 `json:"min"`  // per second
+	Mean    float64 `json:"mean"` // per second
+	Max     float64 `json:"max"`  // per second
+
+	// Histogram[i] is the number of samples with a rate in [2^(i-1), 2^i) per second,
+	// except Histogram[0] which counts samples with no progress.
+	Histogram []int `json:"histogram"`
+}
+
+func (r RateStats) String() string {
+	if r.Samples == 0 {
+		return "no rate samples"
+	}
+	rate := func(v float64) string {
+		return r.Unit.Format(int64(math.Round(v))) + "/s"
+	}
+	return fmt.Sprintf("min/avg/max rate %s/%s/%s over %d samples", rate(r.Min), rate(r.Mean), rate(r.Max), r.Samples)
+}
+
+type rateHistogram struct {
+	mu           sync.Mutex
+	lastTime     time.Time
+	lastProgress int64
+
+	samples        int
+	min, max, sum  float64
+	buckets        [65]int
+	highestNonzero int
+}
+
+func (h *rateHistogram) sample(now time.Time, progress int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.lastTime.IsZero() {
+		h.lastTime, h.lastProgress = now, progress
+		return
+	}
+	dt := now.Sub(h.lastTime)
+	if dt < SampleInterval {
+		return // another goroutine beat us to it
+	}
+	rate := float64(progress-h.lastProgress) / dt.Seconds()
+	h.lastTime, h.lastProgress = now, progress
+
+	if h.samples == 0 || rate < h.min {
+		h.min = rate
+	}
+	if h.samples == 0 || rate > h.max {
+		h.max = rate
+	}
+	h.sum += rate
+	h.samples++
+
+	bucket := 0
+	if rate >= 1 {
+		bucket = bits.Len64(uint64(rate))
+	}
+	h.buckets[bucket]++
+	if bucket > h.highestNonzero {
+		h.highestNonzero = bucket
+	}
+}
+
+func (h *rateHistogram) stats(unit Unit) RateStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := RateStats{
+		Unit:    unit,
+		Samples: h.samples,
+		Min:     h.min,
+		Max:     h.max,
+	}
+	if h.samples > 0 {
+		r.Mean = h.sum / float64(h.samples)
+		r.Histogram = append([]int(nil), h.buckets[:h.highestNonzero+1]...)
+	}
+	return r
+}
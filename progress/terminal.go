@@ -0,0 +1,101 @@
+package progress
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Intervals used by Display.
+const (
+	RedrawInterval = 200 * time.Millisecond
+	LogInterval    = 3 * time.Second
+)
+
+// Display shows the progress of the bar until the returned function is called.
+//
+// If standard error is a terminal, the bar is redrawn in place every RedrawInterval;
+// otherwise, or if glog is also writing its logs there (which would land in the middle of the bar),
+// this falls back to logging it every LogInterval.
+// Only one bar should be displayed on a terminal at a time.
+func (b *Bar) Display() (stop func()) {
+	if !isTerminal(os.Stderr) || logsToStderr() {
+		return b.LogEvery(LogInterval)
+	}
+	return b.draw(os.Stderr, RedrawInterval)
+}
+
+// logsToStderr reports whether glog writes all of its logs (not just errors) to standard error,
+// as it does with --logtostderr or --alsologtostderr.
+func logsToStderr() bool {
+	for _, name := range []string{"logtostderr", "alsologtostderr"} {
+		if f := flag.Lookup(name); f != nil && f.Value.String() == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+const (
+	ansiReturn    = "\r"
+	ansiClearLine = "\x1b[K"
+)
+
+func (b *Bar) draw(w io.Writer, interval time.Duration) (stop func()) {
+	label := b.label
+	if label == "" {
+		label = "Progress"
+	}
+	redraw := func() {
+		s := b.Snapshot()
+		line := fmt.Sprintf("%s: %s", label, s)
+		if s.ETA > 0 {
+			line += fmt.Sprintf(" ETA %s", s.ETA.Truncate(time.Second))
+		}
+		fmt.Fprint(w, ansiReturn+ansiClearLine+line)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		redraw()
+		for {
+			select {
+			case <-ticker.C:
+				redraw()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+			redraw()
+			fmt.Fprintln(w)
+			glog.Infof("%s: %s", label, b.Rates())
+			b.update(true)
+		})
+	}
+}
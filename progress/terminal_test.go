@@ -0,0 +1,21 @@
+package progress
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestLogsToStderr(t *testing.T) {
+	if logsToStderr() {
+		t.Fatalf("logsToStderr = true by default, want false")
+	}
+	for _, name := range []string{"logtostderr", "alsologtostderr"} {
+		if err := flag.Set(name, "true"); err != nil {
+			t.Fatalf("setting --%s: %s", name, err)
+		}
+		if !logsToStderr() {
+			t.Errorf("logsToStderr = false with --%s, want true", name)
+		}
+		flag.Set(name, "false")
+	}
+}
@@ -0,0 +1,77 @@
+package progress
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// A Unit describes what a Bar is counting, which determines how amounts are displayed.
+type Unit int
+
+const (
+	Counter Unit = iota // displayed with thousands separators, e.g. 1,234,567
+	Bytes               // displayed with binary prefixes, e.g. 1.18MiB
+)
+
+func (u Unit) Format(n int64) string {
+	switch u {
+	case Bytes:
+		return FormatBytes(n)
+	default:
+		return FormatCount(n)
+	}
+}
+
+func (u Unit) MarshalText() ([]byte, error) {
+	switch u {
+	case Counter:
+		return []byte("count"), nil
+	case Bytes:
+		return []byte("bytes"), nil
+	default:
+		return nil, fmt.Errorf("unknown unit %d", int(u))
+	}
+}
+
+var byteUnits = []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+// FormatBytes formats n bytes using the largest binary prefix (up to TiB)
+// that keeps the value, rounded to two decimal places, at or above 1.
+func FormatBytes(n int64) string {
+	if n < 0 {
+		return "-" + formatBytes(uint64(-n)) // even for math.MinInt64, whose negation wraps to itself
+	}
+	return formatBytes(uint64(n))
+}
+
+func formatBytes(n uint64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	v := float64(n)
+	unit := 0
+	for math.Round(v*100)/100 >= 1024 && unit < len(byteUnits)-1 {
+		v /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.2f%s", v, byteUnits[unit])
+}
+
+// FormatCount formats n in decimal with commas separating groups of three digits.
+func FormatCount(n int64) string {
+	digits := strconv.FormatInt(n, 10)
+	sign := ""
+	if n < 0 {
+		sign, digits = "-", digits[1:]
+	}
+
+	out := make([]byte, 0, len(digits)+len(digits)/3)
+	for i := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			out = append(out, ',')
+		}
+		out = append(out, digits[i])
+	}
+	return sign + string(out)
+}
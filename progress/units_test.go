@@ -0,0 +1,55 @@
+package progress_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0B"},
+		{1, "1B"},
+		{1023, "1023B"},
+		{1024, "1.00KiB"},
+		{1536, "1.50KiB"},
+		{1<<20 - 1, "1.00MiB"}, // not 1024.00KiB
+		{1<<20 - 6, "1023.99KiB"},
+		{5 << 30, "5.00GiB"},
+		{1<<40 - 1, "1.00TiB"},
+		{1 << 50, "1024.00TiB"}, // TiB is the largest unit
+		{-1536, "-1.50KiB"},
+		{math.MaxInt64, "8388608.00TiB"},
+		{math.MinInt64, "-8388608.00TiB"},
+	}
+	for _, test := range tests {
+		if got := progress.FormatBytes(test.n); got != test.want {
+			t.Errorf("FormatBytes(%d) = %q, want %q", test.n, got, test.want)
+		}
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0"},
+		{999, "999"},
+		{1000, "1,000"},
+		{1234567, "1,234,567"},
+		{-1234, "-1,234"},
+		{-100, "-100"},
+		{math.MaxInt64, "9,223,372,036,854,775,807"},
+		{math.MinInt64, "-9,223,372,036,854,775,808"},
+	}
+	for _, test := range tests {
+		if got := progress.FormatCount(test.n); got != test.want {
+			t.Errorf("FormatCount(%d) = %q, want %q", test.n, got, test.want)
+		}
+	}
+}
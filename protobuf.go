@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Protobuf messages (https://protobuf.dev/programming-guides/encoding/) are encoded and decoded
+// by hand, since the gRPC API (see rplacemap.proto) only has a few small messages of scalars.
+
+// Wire types of protobuf fields.
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+// A pbMessage is an encoded protobuf message, to which fields are appended.
+// As in proto3, fields with their default (zero) values are left out.
+type pbMessage []byte
+
+func (m pbMessage) tag(field, wireType int) pbMessage {
+	return binary.AppendUvarint(m, uint64(field)<<3|uint64(wireType))
+}
+
+// int64 appends an int64, int32, or uint32 field (which are encoded alike, with negative numbers sign-extended).
+func (m pbMessage) int64(field int, v int64) pbMessage {
+	if v == 0 {
+		return m
+	}
+	return binary.AppendUvarint(m.tag(field, pbVarint), uint64(v))
+}
+
+func (m pbMessage) bytes(field int, b []byte) pbMessage {
+	if len(b) == 0 {
+		return m
+	}
+	m = binary.AppendUvarint(m.tag(field, pbBytes), uint64(len(b)))
+	return append(m, b...)
+}
+
+func (m pbMessage) string(field int, s string) pbMessage {
+	return m.bytes(field, []byte(s))
+}
+
+// packed appends a repeated int64 field, which proto3 packs.
+func (m pbMessage) packed(field int, vs []int64) pbMessage {
+	var values []byte
+	for _, v := range vs {
+		values = binary.AppendUvarint(values, uint64(v))
+	}
+	return m.bytes(field, values)
+}
+
+// decodeProtobuf calls field with each of the fields of an encoded message, in order:
+// with the value of varint and fixed-size fields, or the contents of length-delimited ones.
+// Groups, which proto3 doesn't have, are an error.
+func decodeProtobuf(msg []byte, field func(field, wireType int, v uint64, b []byte) error) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errors.New("protobuf: bad tag")
+		}
+		msg = msg[n:]
+		num, wireType := int(tag>>3), int(tag&7)
+		var (
+			v uint64
+			b []byte
+		)
+		switch wireType {
+		case pbVarint:
+			if v, n = binary.Uvarint(msg); n <= 0 {
+				return fmt.Errorf("protobuf: field %d: bad varint", num)
+			}
+			msg = msg[n:]
+		case pbFixed64:
+			if len(msg) < 8 {
+				return fmt.Errorf("protobuf: field %d: truncated", num)
+			}
+			v, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case pbFixed32:
+			if len(msg) < 4 {
+				return fmt.Errorf("protobuf: field %d: truncated", num)
+			}
+			v, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		case pbBytes:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return fmt.Errorf("protobuf: field %d: bad length", num)
+			}
+			b, msg = msg[n:n+int(size)], msg[n+int(size):]
+		default:
+			return fmt.Errorf("protobuf: field %d has unsupported wire type %d", num, wireType)
+		}
+		if err := field(num, wireType, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/static"
+)
+
+const (
+	// proxyCacheEntries limits how many upstream responses are cached in --upstream mode.
+	proxyCacheEntries = 4096
+
+	// maxProxiedBody is the largest upstream response which is cached (tiles are a few KiB);
+	// larger ones are streamed to each client instead, so the cache holds at most 1GiB.
+	maxProxiedBody = 256 << 10
+
+	// proxyTimeout bounds each upstream request, which may be waiting on a long render.
+	proxyTimeout = 5 * time.Minute
+)
+
+var upstreamTTL = serveFlags.Duration("upstream-ttl", 10*time.Minute, "How long responses from --upstream are cached")
+
+// proxiedPrefixes are the paths whose (GET) responses are cached from the upstream server,
+// except for event streams (e.g. /api/replay/live) and large responses, which are passed straight through.
+var proxiedPrefixes = []string{"/tiles/", "/render/", "/api/", "/analytics/", "/export/"}
+
+// proxiedHeaders are the response headers retained in the cache.
+var proxiedHeaders = []string{"Content-Type", "Content-Range", "Cache-Control", "ETag", "Last-Modified"}
+
+// forwardedHeaders are the request headers passed to the upstream server. Like the URL, they can change
+// its response (or whether the client may have it), so responses are cached by them as well.
+var forwardedHeaders = []string{"X-API-Key", "X-Admin-Key", "Range", "DPR", "Sec-CH-DPR"}
+
+// A cachedResponse is a complete response from the upstream server.
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// write writes the response to w. Successful responses support Range (if upstream ignored it)
+// and conditional requests, using the upstream ETag and Last-Modified headers.
+func (c *cachedResponse) write(w http.ResponseWriter, r *http.Request) {
+	for key, values := range c.header {
+		w.Header()[key] = values
+	}
+	if c.status == http.StatusOK {
+		modTime, _ := http.ParseTime(c.header.Get("Last-Modified"))
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(c.body))
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(c.body)))
+	w.WriteHeader(c.status)
+	w.Write(c.body)
+}
+
+// An upstreamError is an unsuccessful response from the upstream server,
+// which is passed along to the client but not cached.
+type upstreamError struct {
+	resp *cachedResponse
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream returned status %d", e.resp.status)
+}
+
+// errUncacheable is returned by fetchUpstream for an event stream or a body larger than maxProxiedBody,
+// which is instead proxied separately for each client.
+var errUncacheable = errors.New("upstream response is not cacheable")
+
+// isEventStream reports whether the header (of a request's Accept or a response's Content-Type)
+// is for a stream of server-sent events.
+func isEventStream(header string) bool {
+	return strings.Contains(header, "text/event-stream")
+}
+
+// serveProxy serves the map without a local dataset, proxying (and caching)
+// requests to the origin server instead.
+func serveProxy(ctx context.Context, origin *url.URL) error {
+	// The reverse proxy streams responses as they arrive (flushing event streams immediately),
+	// and cancels its upstream request when the client goes away.
+	proxy := httputil.NewSingleHostReverseProxy(origin)
+	var shared *redisClient
+	if *upstreamRedis != "" {
+		var err error
+		if shared, err = newRedisClient(*upstreamRedis); err != nil {
+			return fmt.Errorf("--upstream-redis: %w", err)
+		}
+	}
+	cached := cachingProxy(origin, proxy, shared)
+	for _, prefix := range proxiedPrefixes {
+		http.HandleFunc(prefix, cached)
+	}
+	http.Handle("/status", proxy)
+	http.Handle("/status/", proxy)
+
+	files, err := staticFiles()
+	if err != nil {
+		return err
+	}
+	http.Handle("/static/", static.FSHandler(files))
+	http.Handle("/", http.RedirectHandler("/static/index.html", http.StatusTemporaryRedirect))
+
+	return listenAndServe(ctx, func(net.Addr) {
+		glog.Infof("Proxying %s", origin)
+	})
+}
+
+// cachingProxy returns a handler which serves GET requests from a cache of the origin server's responses,
+// and passes other requests (and uncacheable responses) through to proxy.
+// If shared is non-nil, responses missing from the cache are looked up in (and stored in) Redis
+// before going to the origin server, so that the proxies using it share their responses.
+func cachingProxy(origin *url.URL, proxy http.Handler, shared *redisClient) http.HandlerFunc {
+	cache := &gsync.Cache[string, *cachedResponse]{
+		TTL:        *upstreamTTL,
+		MaxEntries: proxyCacheEntries,
+	}
+	// Concurrent requests for a response which isn't cached share one upstream request,
+	// which is canceled if all of their clients go away.
+	var fetches gsync.Group[string, *cachedResponse]
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || isEventStream(r.Header.Get("Accept")) {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		fields := []string{r.URL.RequestURI()}
+		for _, name := range forwardedHeaders {
+			fields = append(fields, r.Header.Get(name))
+		}
+		key := strings.Join(fields, "\n")
+		resp, ok := cache.Peek(key)
+		if !ok {
+			var err error
+			resp, err = fetches.Do(r.Context(), key, func(ctx context.Context) (*cachedResponse, error) {
+				if shared == nil {
+					return fetchUpstream(ctx, origin, r.URL, r.Header)
+				}
+				if resp, ok := shared.lookup(ctx, key); ok {
+					return resp, nil
+				}
+				resp, err := fetchUpstream(ctx, origin, r.URL, r.Header)
+				if err == nil {
+					shared.store(ctx, key, resp, *upstreamTTL)
+				}
+				return resp, err
+			})
+			var uerr *upstreamError
+			switch {
+			case errors.Is(err, errUncacheable):
+				proxy.ServeHTTP(w, r)
+				return
+			case errors.As(err, &uerr):
+				resp = uerr.resp
+			case err != nil:
+				http.Error(w, fmt.Sprintf("upstream: %s", err), http.StatusBadGateway)
+				return
+			default:
+				cache.Put(key, resp)
+			}
+		}
+		resp.write(w, r)
+	}
+}
+
+// fetchUpstream fetches the path and query of u from the origin server, with the forwardedHeaders of header,
+// unless the response turns out to be uncacheable (see errUncacheable).
+func fetchUpstream(ctx context.Context, origin, u *url.URL, header http.Header) (*cachedResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, proxyTimeout)
+	defer cancel()
+
+	target := origin.JoinPath(u.Path)
+	target.RawQuery = u.RawQuery
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range forwardedHeaders {
+		if v := header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if isEventStream(resp.Header.Get("Content-Type")) || resp.ContentLength > maxProxiedBody {
+		return nil, errUncacheable
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxProxiedBody+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", target.Path, err)
+	}
+	if len(body) > maxProxiedBody {
+		return nil, errUncacheable
+	}
+	cached := &cachedResponse{
+		status: resp.StatusCode,
+		header: make(http.Header),
+		body:   body,
+	}
+	for _, key := range proxiedHeaders {
+		if values := resp.Header.Values(key); len(values) > 0 {
+			cached.header[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent { // of the forwarded Range
+		return nil, &upstreamError{cached}
+	}
+	return cached, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCachingProxyHeaders(t *testing.T) {
+	var fetches atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if r.Header.Get("X-API-Key") != "secret" {
+			http.Error(w, "no key", http.StatusUnauthorized)
+			return
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			w.Header().Set("Content-Range", "bytes 0-1/4")
+			w.WriteHeader(http.StatusPartialContent)
+			fmt.Fprint(w, "ab")
+			return
+		}
+		fmt.Fprintf(w, "dpr=%s", r.Header.Get("Sec-CH-DPR"))
+	}))
+	defer upstream.Close()
+	origin, _ := url.Parse(upstream.URL)
+	handler := cachingProxy(origin, http.NotFoundHandler(), nil)
+
+	get := func(header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/things", nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	tests := []struct {
+		header  map[string]string
+		status  int
+		body    string
+		fetched int32 // upstream requests so far
+	}{
+		{map[string]string{"X-API-Key": "secret"}, http.StatusOK, "dpr=", 1},
+		{map[string]string{"X-API-Key": "secret"}, http.StatusOK, "dpr=", 1}, // cached
+		{nil, http.StatusUnauthorized, "no key\n", 2},                        // not served the keyed response
+		{map[string]string{"X-API-Key": "secret", "Sec-CH-DPR": "2"}, http.StatusOK, "dpr=2", 3},
+		{map[string]string{"X-API-Key": "secret", "Range": "bytes=0-1"}, http.StatusPartialContent, "ab", 4},
+		{map[string]string{"X-API-Key": "secret", "Range": "bytes=0-1"}, http.StatusPartialContent, "ab", 4},
+	}
+	for i, test := range tests {
+		w := get(test.header)
+		if w.Code != test.status || w.Body.String() != test.body {
+			t.Errorf("request %d (%v) = %d %q, want %d %q", i, test.header, w.Code, w.Body, test.status, test.body)
+		}
+		if got := fetches.Load(); got != test.fetched {
+			t.Errorf("after request %d (%v), upstream was fetched %d times, want %d", i, test.header, got, test.fetched)
+		}
+	}
+}
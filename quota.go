@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	renderConcurrency = serveFlags.Int("render-concurrency", 2, "How many parameterized renders (e.g. timelapse variants) each client can request at once (0 for no limit)")
+	renderQuota       = serveFlags.Int("render-quota", 200, "How many parameterized renders each client can request per (UTC) day (0 for no limit)")
+	apiKeysFile       = serveFlags.String("api-keys", "", "File of API keys (one per line), which clients can send as X-API-Key to be limited by key instead of by IP address")
+)
+
+// renderLimits limits how many parameterized renders each client requests, concurrently and per day,
+// so that one client can't queue up unbounded work. Clients are identified by API key, if they send
+// a valid one, or else by IP address.
+type renderLimits struct {
+	concurrency, quota int
+	keys               map[string]bool
+
+	mu     sync.Mutex
+	day    string // of the counts in used, which are reset each day
+	active map[string]int
+	used   map[string]int
+}
+
+// loadRenderLimits returns the limits set by the flags.
+func loadRenderLimits() (*renderLimits, error) {
+	l := &renderLimits{
+		concurrency: *renderConcurrency,
+		quota:       *renderQuota,
+		keys:        make(map[string]bool),
+		active:      make(map[string]int),
+		used:        make(map[string]int),
+	}
+	if *apiKeysFile == "" {
+		return l, nil
+	}
+	keys, err := readKeys(*apiKeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("--api-keys: %w", err)
+	}
+	l.keys = keys
+	return l, nil
+}
+
+// readKeys reads a file of keys, one per line, ignoring blank lines and #comments.
+func readKeys(file string) (map[string]bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := make(map[string]bool)
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		if key := strings.TrimSpace(lines.Text()); key != "" && !strings.HasPrefix(key, "#") {
+			keys[key] = true
+		}
+	}
+	return keys, lines.Err()
+}
+
+// wrap limits the requests to h, responding with 429 Too Many Requests (and Retry-After) to clients
+// which are over their limits.
+func (l *renderLimits) wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := l.client(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		done, retry, err := l.start(client)
+		if err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retry.Seconds())))))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer done()
+		h(w, r)
+	}
+}
+
+// wrapVariants is like wrap, but only limits requests for palette variants, which are rendered on demand
+// (unlike the default, which is rendered once for everyone).
+func (l *renderLimits) wrapVariants(h http.HandlerFunc) http.HandlerFunc {
+	limited := l.wrap(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if palette := r.FormValue("palette"); palette == "" || palette == "default" {
+			h(w, r)
+			return
+		}
+		limited(w, r)
+	}
+}
+
+// client identifies the client making the request.
+func (l *renderLimits) client(r *http.Request) (string, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		if !l.keys[key] {
+			return "", fmt.Errorf("unknown API key")
+		}
+		return "key:" + key, nil
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host, nil
+}
+
+// start counts a render by the client, returning a function to call when it is done,
+// or how long to wait before retrying if the client is over its limits.
+func (l *renderLimits) start(client string) (done func(), retry time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().UTC()
+	if day := now.Format(time.DateOnly); day != l.day {
+		l.day, l.used = day, make(map[string]int)
+	}
+	if l.quota > 0 && l.used[client] >= l.quota {
+		tomorrow := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return nil, tomorrow.Sub(now), fmt.Errorf("daily quota of %d renders exceeded", l.quota)
+	}
+	if l.concurrency > 0 && l.active[client] >= l.concurrency {
+		return nil, time.Second, fmt.Errorf("too many concurrent renders (limit %d)", l.concurrency)
+	}
+	l.used[client]++
+	l.active[client]++
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.active[client]--; l.active[client] == 0 {
+			delete(l.active, client)
+		}
+	}, 0, nil
+}
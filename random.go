@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/tiles"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+const (
+	// defaultMinActivity is the default number of placements needed for a region to be interesting.
+	defaultMinActivity = 1000
+
+	// randomZoom is the zoom suggested by /api/random, at which a region fills a tile.
+	randomZoom = 6
+)
+
+// regionActivity counts the placements in each contextRegionSize square region of the canvas,
+// and finds the time of the median placement in each.
+type regionActivity struct {
+	counts  [][]int64 // [row][column]
+	medians [][]int64 // [row][column], in milliseconds since the Unix epoch
+}
+
+// newRegionActivity summarizes the records, which must be sorted by time.
+func newRegionActivity(records []dataset.Record) *regionActivity {
+	bounds := timelapse.Bounds()
+	rows := (bounds.Dy() + contextRegionSize - 1) / contextRegionSize
+	cols := (bounds.Dx() + contextRegionSize - 1) / contextRegionSize
+	a := &regionActivity{counts: make([][]int64, rows), medians: make([][]int64, rows)}
+	for i := range a.counts {
+		a.counts[i] = make([]int64, cols)
+		a.medians[i] = make([]int64, cols)
+	}
+	for _, rec := range records {
+		a.counts[int(rec.Y)/contextRegionSize][int(rec.X)/contextRegionSize]++
+	}
+	seen := make([][]int64, rows)
+	for i := range seen {
+		seen[i] = make([]int64, cols)
+	}
+	for _, rec := range records {
+		row, col := int(rec.Y)/contextRegionSize, int(rec.X)/contextRegionSize
+		if seen[row][col] == a.counts[row][col]/2 {
+			a.medians[row][col] = rec.UnixMillis
+		}
+		seen[row][col]++
+	}
+	return a
+}
+
+// randomResponse is served by /api/random: somewhere worth looking at.
+type randomResponse struct {
+	X        int       `json:"x"` // canvas pixel at the center of the region
+	Y        int       `json:"y"`
+	Lat      float64   `json:"lat"`
+	Lng      float64   `json:"lng"`
+	Zoom     int       `json:"zoom"`
+	Time     time.Time `json:"t"`      // the middle of the region's activity
+	Bounds   [4]int    `json:"region"` // x0, y0, x1, y1
+	Activity int64     `json:"activity"`
+}
+
+// randomHandler serves /api/random?min_activity=, which picks a random region of the canvas with
+// at least that many placements, and suggests how to view it.
+func randomHandler(records *gsync.Future[[]dataset.Record]) http.HandlerFunc {
+	activity := gsync.Map(records, func(records []dataset.Record) (*regionActivity, error) {
+		return newRegionActivity(records), nil
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		minActivity := int64(defaultMinActivity)
+		if s := r.FormValue("min_activity"); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 0 {
+				http.Error(w, "min_activity must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			minActivity = n
+		}
+		loc, err := requestLocation(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a, err := activity.Wait(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+
+		var candidates []image.Point
+		for row, counts := range a.counts {
+			for col, count := range counts {
+				if count > 0 && count >= minActivity {
+					candidates = append(candidates, image.Pt(col, row))
+				}
+			}
+		}
+		if len(candidates) == 0 {
+			http.Error(w, fmt.Sprintf("no region has %d placements", minActivity), http.StatusNotFound)
+			return
+		}
+		pick := candidates[rand.Intn(len(candidates))]
+
+		region := image.Rect(0, 0, contextRegionSize, contextRegionSize).
+			Add(pick.Mul(contextRegionSize)).
+			Intersect(timelapse.Bounds())
+		resp := randomResponse{
+			X:        (region.Min.X + region.Max.X) / 2,
+			Y:        (region.Min.Y + region.Max.Y) / 2,
+			Zoom:     randomZoom,
+			Bounds:   [4]int{region.Min.X, region.Min.Y, region.Max.X, region.Max.Y},
+			Activity: a.counts[pick.Y][pick.X],
+		}
+		resp.Lat, resp.Lng = tiles.PixelToLatLng(image.Pt(resp.X, resp.Y))
+		resp.Time = time.UnixMilli(a.medians[pick.Y][pick.X]).In(loc)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
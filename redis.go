@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// redisTimeout bounds each Redis command, which should take a millisecond,
+	// so that a slow Redis can't hold up requests which could go upstream instead.
+	redisTimeout = 2 * time.Second
+
+	// redisIdleConns limits how many connections to Redis are kept open between commands.
+	redisIdleConns = 16
+
+	// redisKeyPrefix namespaces the keys of cached responses in a Redis which may be shared with other uses.
+	redisKeyPrefix = "rplacemap:upstream:"
+)
+
+var upstreamRedis = serveFlags.String("upstream-redis", "", "redis://[:password@]host:port[/db] of a Redis server in which responses from --upstream are cached (for --upstream-ttl), shared by all proxies using it and across restarts")
+
+// A redisClient runs commands on a Redis server, speaking its protocol (RESP) directly.
+// It only supports the few commands which the proxy needs.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+// A redisConn is a connection to Redis, with its replies buffered.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// newRedisClient returns a client for the server given by a redis:// URL.
+// It doesn't connect until the first command.
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not a redis://host:port URL", rawURL)
+	}
+	c := &redisClient{
+		addr: u.Host,
+		idle: make(chan *redisConn, redisIdleConns),
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+			return nil, fmt.Errorf("database %q is not a number", db)
+		}
+	}
+	return c, nil
+}
+
+// A redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// get returns the value of key, or nil if it isn't set.
+func (c *redisClient) get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := c.do(ctx, "GET", []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	value, ok := reply.([]byte)
+	if !ok && reply != nil {
+		return nil, fmt.Errorf("redis: GET replied %T", reply)
+	}
+	return value, nil
+}
+
+// set sets the value of key, which expires after ttl (if positive).
+func (c *redisClient) set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := [][]byte{[]byte(key), value}
+	if ttl > 0 {
+		args = append(args, []byte("PX"), []byte(strconv.FormatInt(ttl.Milliseconds(), 10)))
+	}
+	_, err := c.do(ctx, "SET", args...)
+	return err
+}
+
+// do runs a command, returning its reply: nil, a string (status), an int64, or a []byte (bulk string).
+func (c *redisClient) do(ctx context.Context, cmd string, args ...[]byte) (any, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.roundTrip(ctx, cmd, args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		conn.Close() // the connection is in an unknown state
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// conn returns an idle connection, or else a new one (authenticated, with the database selected).
+func (c *redisClient) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	var d net.Dialer
+	dialCtx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	nc, err := d.DialContext(dialCtx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	conn := &redisConn{nc, bufio.NewReader(nc)}
+	if c.password != "" {
+		if _, err := conn.roundTrip(ctx, "AUTH", []byte(c.password)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.roundTrip(ctx, "SELECT", []byte(strconv.Itoa(c.db))); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// roundTrip sends a command and reads its reply.
+func (conn *redisConn) roundTrip(ctx context.Context, cmd string, args ...[]byte) (any, error) {
+	deadline := time.Now().Add(redisTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(cmd), cmd)
+	for _, arg := range args {
+		fmt.Fprintf(&req, "$%d\r\n", len(arg))
+		req.Write(arg)
+		req.WriteString("\r\n")
+	}
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	return readReply(conn.r)
+}
+
+// maxRedisValue limits the bulk strings read from Redis, which are at most a cached response.
+const maxRedisValue = 2 * maxProxiedBody
+
+// readReply reads a RESP reply.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	if !strings.HasSuffix(line, "\r\n") || len(line) < 3 {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		n, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed integer %q", rest)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < -1 || n > maxRedisValue {
+			return nil, fmt.Errorf("redis: bad bulk string length %q", rest)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		value := make([]byte, n+2)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		return value[:n], nil
+	default:
+		return nil, fmt.Errorf("redis: unsupported reply %q", line)
+	}
+}
+
+// redisKey returns the Redis key of a response cached by the proxy under key,
+// which is hashed since it contains the client's forwarded headers (e.g. API keys).
+func redisKey(key string) string {
+	return fmt.Sprintf("%s%x", redisKeyPrefix, sha256.Sum256([]byte(key)))
+}
+
+// lookup returns the response which a proxy cached in Redis under key, if there is one.
+// Since the upstream server can stand in for Redis, errors are only logged.
+func (c *redisClient) lookup(ctx context.Context, key string) (*cachedResponse, bool) {
+	data, err := c.get(ctx, redisKey(key))
+	if err != nil {
+		glog.Warningf("Failed to look up a cached response: %s", err)
+		return nil, false
+	}
+	if data == nil {
+		return nil, false
+	}
+	resp := new(cachedResponse)
+	if err := resp.UnmarshalBinary(data); err != nil {
+		glog.Warningf("Ignoring a corrupt cached response: %s", err)
+		return nil, false
+	}
+	return resp, true
+}
+
+// store caches the response in Redis under key, for ttl.
+func (c *redisClient) store(ctx context.Context, key string, resp *cachedResponse, ttl time.Duration) {
+	data, err := resp.MarshalBinary()
+	if err == nil {
+		err = c.set(ctx, redisKey(key), data, ttl)
+	}
+	if err != nil {
+		glog.Warningf("Failed to cache a response: %s", err)
+	}
+}
+
+// storedResponse is the form of a cachedResponse stored in Redis.
+type storedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+func (c *cachedResponse) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(storedResponse{c.status, c.header, c.body})
+	return buf.Bytes(), err
+}
+
+func (c *cachedResponse) UnmarshalBinary(data []byte) error {
+	var s storedResponse
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+		return err
+	}
+	c.status, c.header, c.body = s.Status, s.Header, s.Body
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeRedis is a Redis server which supports the commands the proxy uses, storing values in memory.
+type fakeRedis struct {
+	lis      net.Listener
+	password string
+
+	mu     sync.Mutex
+	values map[string]string
+	cmds   []string // names of the commands run, in order
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{lis: lis, password: password, values: make(map[string]string)}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) url() string {
+	if f.password != "" {
+		return "redis://:" + f.password + "@" + f.lis.Addr().String() + "/2"
+	}
+	return "redis://" + f.lis.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.cmds = append(f.cmds, args[0])
+		switch {
+		case args[0] == "AUTH":
+			authed = args[1] == f.password
+			if authed {
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+			}
+		case !authed:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case args[0] == "SELECT":
+			fmt.Fprint(conn, "+OK\r\n")
+		case args[0] == "GET":
+			if v, ok := f.values[args[1]]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		case args[0] == "SET" && len(args) == 5 && args[3] == "PX":
+			f.values[args[1]] = args[2]
+			fmt.Fprint(conn, "+OK\r\n")
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command %q\r\n", args)
+		}
+		f.mu.Unlock()
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("bad argument %q", line)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func TestCachingProxyRedis(t *testing.T) {
+	var fetches atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprintf(w, "tile %s", r.URL.Path)
+	}))
+	defer upstream.Close()
+	origin, _ := url.Parse(upstream.URL)
+
+	redis := newFakeRedis(t, "hunter2")
+	// Two proxies share Redis, but not their own caches.
+	var proxies []http.HandlerFunc
+	for i := 0; i < 2; i++ {
+		shared, err := newRedisClient(redis.url())
+		if err != nil {
+			t.Fatalf("newRedisClient: %s", err)
+		}
+		proxies = append(proxies, cachingProxy(origin, http.NotFoundHandler(), shared))
+	}
+	for i, proxy := range proxies {
+		w := httptest.NewRecorder()
+		proxy(w, httptest.NewRequest(http.MethodGet, "/tiles/1.png", nil))
+		if got, want := w.Body.String(), "tile /tiles/1.png"; w.Code != http.StatusOK || got != want {
+			t.Errorf("proxy %d: GET = %d %q, want 200 %q", i, w.Code, got, want)
+		}
+		if got, want := w.Header().Get("Content-Type"), "image/png"; got != want {
+			t.Errorf("proxy %d: Content-Type = %q, want %q", i, got, want)
+		}
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("upstream was fetched %d times, want once (for the first proxy)", got)
+	}
+
+	redis.mu.Lock()
+	defer redis.mu.Unlock()
+	if got, want := strings.Join(redis.cmds, " "), "AUTH SELECT GET SET AUTH SELECT GET"; got != want {
+		t.Errorf("Redis ran %q, want %q", got, want)
+	}
+	for key := range redis.values {
+		if !strings.HasPrefix(key, redisKeyPrefix) || strings.Contains(key, "/tiles/") {
+			t.Errorf("Redis key %q isn't a hash under %q", key, redisKeyPrefix)
+		}
+	}
+}
+
+func TestCachingProxyRedisDown(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+	origin, _ := url.Parse(upstream.URL)
+
+	redis := newFakeRedis(t, "hunter2")
+	shared, err := newRedisClient(strings.Replace(redis.url(), "hunter2", "wrong", 1))
+	if err != nil {
+		t.Fatalf("newRedisClient: %s", err)
+	}
+	w := httptest.NewRecorder()
+	cachingProxy(origin, http.NotFoundHandler(), shared)(w, httptest.NewRequest(http.MethodGet, "/api/x", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("GET with Redis failing = %d %q, want 200 %q from upstream", w.Code, w.Body, "ok")
+	}
+}
+
+func TestNewRedisClient(t *testing.T) {
+	tests := []struct {
+		url      string
+		addr     string
+		password string
+		db       int
+		ok       bool
+	}{
+		{"redis://cache:6380", "cache:6380", "", 0, true},
+		{"redis://cache", "cache:6379", "", 0, true},
+		{"redis://:pw@cache/3", "cache:6379", "pw", 3, true},
+		{"http://cache:6379", "", "", 0, false},
+		{"redis://cache/db", "", "", 0, false},
+		{"cache:6379", "", "", 0, false},
+	}
+	for _, test := range tests {
+		c, err := newRedisClient(test.url)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("newRedisClient(%q) succeeded, want an error", test.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newRedisClient(%q): %s", test.url, err)
+			continue
+		}
+		if c.addr != test.addr || c.password != test.password || c.db != test.db {
+			t.Errorf("newRedisClient(%q) = %s, %q, db %d; want %s, %q, db %d",
+				test.url, c.addr, c.password, c.db, test.addr, test.password, test.db)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/progress"
+	"github.com/kylelemons/rplacemap/tiles"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+var renderFlags = flag.NewFlagSet("render", flag.ExitOnError)
+
+var _ = register(commands, &command{
+	name:  "render",
+	args:  "<what> [flags]",
+	help:  "Render images from the cached dataset to files.\n\nAvailable renders:\n  snapshot   the canvas at a point in time\n  tile       a single map tile\n  timelapse  animated timelapse of the whole canvas",
+	flags: renderFlags,
+	run:   runRender,
+})
+
+// renders are the subcommands of the render command.
+var renders = map[string]*command{}
+
+func runRender(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		renderFlags.Usage()
+		return fmt.Errorf("no render specified")
+	}
+	name, args := args[0], args[1:]
+	sub, ok := renders[name]
+	if !ok {
+		return fmt.Errorf("unknown render %q", name)
+	}
+	sub.parse("render "+sub.name, args)
+	return sub.run(ctx, sub.flags.Args())
+}
+
+var (
+	renderTimelapseFlags    = flag.NewFlagSet("render timelapse", flag.ExitOnError)
+	renderTimelapseOut      = renderTimelapseFlags.String("out", "timelapse.gif", "Output file")
+	renderTimelapseFormat   = renderTimelapseFlags.String("format", "", "Output format: gif, apng, or mp4 (requires ffmpeg) (default: from --out)")
+	renderTimelapseInterval = renderTimelapseFlags.Duration("interval", timelapse.DefaultInterval, "Amount of time aggregated into each frame")
+)
+
+var _ = register(renders, &command{
+	name:  "timelapse",
+	help:  "Render an animated timelapse of the whole canvas.",
+	flags: renderTimelapseFlags,
+	run:   runRenderTimelapse,
+})
+
+// timelapseEncoders are the supported timelapse formats.
+var timelapseEncoders = map[string]func(io.Writer, []*image.Paletted) error{
+	"gif":  timelapse.EncodeGIF,
+	"apng": timelapse.EncodeAPNG,
+	"mp4":  timelapse.EncodeMP4,
+}
+
+func runRenderTimelapse(ctx context.Context, args []string) error {
+	format := *renderTimelapseFormat
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(*renderTimelapseOut), ".")
+	}
+	encode, ok := timelapseEncoders[format]
+	if !ok {
+		return fmt.Errorf("unsupported timelapse format %q", format)
+	}
+	if *renderTimelapseInterval <= 0 {
+		return fmt.Errorf("--interval must be positive")
+	}
+
+	records, err := loadCachedRecords(ctx)
+	if err != nil {
+		return err
+	}
+
+	rendering := progress.New("Rendering frames", progress.Counter)
+	stopProgress := rendering.Display()
+	frames := timelapse.RenderFrames(records, *renderTimelapseInterval, rendering)
+	stopProgress()
+
+	encoding := progress.New(fmt.Sprintf("Encoding %s", format), progress.Bytes)
+	stopProgress = encoding.Display()
+	defer stopProgress()
+	if err := writeFile(*renderTimelapseOut, func(w io.Writer) error {
+		return encode(encoding.WrapWriter(w, 0), frames)
+	}); err != nil {
+		return err
+	}
+	stopProgress()
+
+	glog.Infof("Wrote %d-frame timelapse to %s", len(frames), *renderTimelapseOut)
+	return nil
+}
+
+var (
+	renderSnapshotFlags  = flag.NewFlagSet("render snapshot", flag.ExitOnError)
+	renderSnapshotOut    = renderSnapshotFlags.String("out", "canvas.png", "Output PNG file")
+	renderSnapshotTime   timeFlag
+	renderSnapshotRegion regionFlag
+)
+
+func init() {
+	renderSnapshotFlags.Var(&renderSnapshotTime, "t", "Time (UTC) of the snapshot, e.g. \"2017-04-03 12:00\" (default: the end)")
+	renderSnapshotFlags.Var(&renderSnapshotRegion, "region", "Region of the canvas to render as x0,y0,x1,y1 (default: everything)")
+}
+
+var _ = register(renders, &command{
+	name:  "snapshot",
+	help:  "Render the state of the canvas at a point in time to a PNG.",
+	flags: renderSnapshotFlags,
+	run:   runRenderSnapshot,
+})
+
+func runRenderSnapshot(ctx context.Context, args []string) error {
+	records, err := loadCachedRecords(ctx)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("dataset is empty")
+	}
+
+	at := records[len(records)-1].UnixMillis
+	if t := renderSnapshotTime.Time; !t.IsZero() {
+		at = t.UnixMilli()
+	}
+	bounds := timelapse.Bounds()
+	if r := renderSnapshotRegion.Rectangle; !r.Empty() {
+		bounds = r.Intersect(bounds)
+		if bounds.Empty() {
+			return fmt.Errorf("region %v is outside the canvas", r)
+		}
+	}
+
+	img := dataset.Snapshot(records, at, bounds)
+	if err := writeFile(*renderSnapshotOut, func(w io.Writer) error {
+		return png.Encode(w, img)
+	}); err != nil {
+		return err
+	}
+	glog.Infof("Wrote %v snapshot as of %s to %s",
+		bounds, time.UnixMilli(at).UTC().Format(time.RFC3339), *renderSnapshotOut)
+	return nil
+}
+
+var (
+	renderTileFlags = flag.NewFlagSet("render tile", flag.ExitOnError)
+	renderTileX     = renderTileFlags.Int("x", 0, "Tile column")
+	renderTileY     = renderTileFlags.Int("y", 0, "Tile row")
+	renderTileZ     = renderTileFlags.Int("z", 0, "Zoom level (0-10)")
+	renderTileSize  = renderTileFlags.Int("size", tiles.DefaultTileSize, "Width and height of the tile in pixels (1-1024)")
+	renderTileOut   = renderTileFlags.String("out", "tile.png", "Output PNG file")
+	renderTileTime  timeFlag
+)
+
+func init() {
+	renderTileFlags.Var(&renderTileTime, "t", "Time (UTC) of the canvas to render, e.g. \"2017-04-03 12:00\" (default: the end)")
+}
+
+var _ = register(renders, &command{
+	name:  "tile",
+	help:  "Render a single map tile to a PNG, as it would be served.",
+	flags: renderTileFlags,
+	run:   runRenderTile,
+})
+
+func runRenderTile(ctx context.Context, args []string) error {
+	if *renderTileZ < 0 || *renderTileZ > tiles.MaxZoom {
+		return fmt.Errorf("--z=%d out of range (0-%d)", *renderTileZ, tiles.MaxZoom)
+	}
+	if *renderTileSize <= 0 || *renderTileSize > tiles.MaxTileSize {
+		return fmt.Errorf("--size=%d out of range (1-%d)", *renderTileSize, tiles.MaxTileSize)
+	}
+
+	records, err := loadCachedRecords(ctx)
+	if err != nil {
+		return err
+	}
+	if t := renderTileTime.Time; !t.IsZero() {
+		end := sort.Search(len(records), func(i int) bool {
+			return records[i].UnixMillis > t.UnixMilli()
+		})
+		records = records[:end]
+	}
+	pixels, err := tiles.Flatten(records)
+	if err != nil {
+		return err
+	}
+
+	img := tiles.Tile(pixels, *renderTileX, *renderTileY, *renderTileZ, *renderTileSize, *renderTileSize)
+	if err := writeFile(*renderTileOut, func(w io.Writer) error {
+		return png.Encode(w, img)
+	}); err != nil {
+		return err
+	}
+	glog.Infof("Wrote tile %d_%d_z%d to %s", *renderTileX, *renderTileY, *renderTileZ, *renderTileOut)
+	return nil
+}
+
+// loadCachedRecords loads the cached dataset, downloading it if necessary.
+func loadCachedRecords(ctx context.Context) ([]dataset.Record, error) {
+	return loadRecords(ctx, progress.New("Download", progress.Bytes), false)
+}
+
+// writeFile creates filename and writes to it using write, removing it on failure.
+func writeFile(filename string, write func(io.Writer) error) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("creating output: %w", err) // contains filename
+	}
+	buf := bufio.NewWriter(f)
+	err = write(buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(filename)
+		return fmt.Errorf("writing %q: %w", filename, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing output: %w", err) // contains filename
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+const (
+	maxReplaySpeed  = 3600 // an hour per second
+	replayKeepalive = 15 * time.Second
+)
+
+// parseReplaySpeed parses how many times faster than their original pace events are replayed, e.g. "60x".
+func parseReplaySpeed(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil || v <= 0 || v > maxReplaySpeed {
+		return 0, fmt.Errorf("speed: want e.g. 1x, 0.5x, or up to %dx, got %q", maxReplaySpeed, s)
+	}
+	return v, nil
+}
+
+// replayStart returns the index of the first record to replay and the time relative to which the replay is paced:
+// the event after the one whose resume token is given, or else the first event at or after start (if it's set),
+// or else the first event.
+func replayStart(recs []dataset.Record, start time.Time, resume string) (next int, base int64, err error) {
+	switch {
+	case resume != "":
+		last, err := strconv.Atoi(resume)
+		if err != nil || last < 0 || last >= len(recs) {
+			return 0, 0, fmt.Errorf("resume: unknown token %q", resume)
+		}
+		return last + 1, recs[last].UnixMillis, nil
+	case !start.IsZero():
+		base = start.UnixMilli()
+		return sort.Search(len(recs), func(i int) bool { return recs[i].UnixMillis >= base }), base, nil
+	}
+	return 0, recs[0].UnixMillis, nil
+}
+
+// A replayStream is where paceReplay sends the events.
+type replayStream interface {
+	send(i int) error // the i'th record, which is due
+	flush() error     // before waiting for the next event
+	keepalive() error // after waiting replayKeepalive without an event
+}
+
+// paceReplay sends the records from next on to the stream at their original pace (or speed times faster),
+// relative to base, until it runs out of them, the stream fails, or ctx is done.
+func paceReplay(ctx context.Context, recs []dataset.Record, next int, base int64, speed float64, stream replayStream) error {
+	began := time.Now()
+	for ; next < len(recs); next++ {
+		offset := time.Duration(recs[next].UnixMillis-base) * time.Millisecond
+		due := began.Add(time.Duration(float64(offset) / speed))
+		for {
+			wait := time.Until(due)
+			if wait <= 0 {
+				break
+			}
+			if err := stream.flush(); err != nil {
+				return err
+			}
+			select {
+			case <-time.After(min(wait, replayKeepalive)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if wait > replayKeepalive {
+				if err := stream.keepalive(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := stream.send(next); err != nil {
+			return err
+		}
+	}
+	return stream.flush()
+}
+
+// replayHandler serves /api/replay/live?start=&speed=, which streams the events as server-sent events
+// at their original pace (or speed times faster), starting from the given time (default: the beginning).
+//
+// Each event is in the JSON form of `rplacemap export --format=ndjson`, so the stream can also be
+// followed by another server with --live. Its id is a resume token: a client reconnecting with it as
+// Last-Event-ID (or the resume parameter) continues, at the same pace, from the event after it.
+func replayHandler(records *gsync.Future[[]dataset.Record]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		speed := 1.0
+		if s := r.FormValue("speed"); s != "" {
+			v, err := parseReplaySpeed(s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			speed = v
+		}
+		var start timeFlag
+		if s := r.FormValue("start"); s != "" {
+			if err := start.Set(s); err != nil {
+				http.Error(w, fmt.Sprintf("start: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+		resume := r.Header.Get("Last-Event-ID")
+		if s := r.FormValue("resume"); s != "" {
+			resume = s
+		}
+
+		recs, err := records.Wait(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		if len(recs) == 0 {
+			http.Error(w, "no events to replay", http.StatusNotFound)
+			return
+		}
+		next, base, err := replayStart(recs, start.Time, resume)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprintf(w, "retry: %d\n\n", time.Second.Milliseconds())
+		flusher.Flush()
+
+		if paceReplay(r.Context(), recs, next, base, speed, &sseReplay{w, flusher, recs}) != nil {
+			return
+		}
+		fmt.Fprint(w, ": end of replay\n\n")
+		flusher.Flush()
+	}
+}
+
+// sseReplay is a replayStream of server-sent events, with the index of each event as its id.
+type sseReplay struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	recs    []dataset.Record
+}
+
+func (s *sseReplay) send(i int) error {
+	data, _ := json.Marshal(newJSONEvent(s.recs[i]))
+	_, err := fmt.Fprintf(s.w, "id: %d\ndata: %s\n\n", i, data)
+	return err
+}
+
+func (s *sseReplay) flush() error {
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *sseReplay) keepalive() error {
+	_, err := fmt.Fprint(s.w, ": keepalive\n\n")
+	return err
+}
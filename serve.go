@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/analytics"
+	"github.com/kylelemons/rplacemap/atlas"
+	"github.com/kylelemons/rplacemap/chunked"
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/live"
+	"github.com/kylelemons/rplacemap/progress"
+	"github.com/kylelemons/rplacemap/static"
+	"github.com/kylelemons/rplacemap/tiles"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+var (
+	serveFlags = flag.NewFlagSet("serve", flag.ExitOnError)
+	download   = serveFlags.Bool("download", false, "Force re-download of r/place map data")
+	addr       = serveFlags.String("http", "localhost:0", "HTTP serve address")
+	liveFeed   = serveFlags.String("live", "", "URL of a live feed of pixel events (server-sent events or NDJSON) to apply to the map as they arrive")
+	prerender  = serveFlags.String("prerender", "tiles", "Comma-separated renders to start in the background once the dataset is loaded (tiles, timelapse:apng, timelapse:gif)")
+	webhook    = serveFlags.String("webhook", "", "Comma-separated URLs to POST a JSON notification to when each prerender finishes")
+	upstream   = serveFlags.String("upstream", "", "URL of another rplacemap server to proxy (and cache) instead of loading the dataset locally")
+	publicURL  = serveFlags.String("public-url", "", "Base URL at which others can reach this server, for links in notifications (default: the serving address)")
+
+	dev           = serveFlags.Bool("dev", false, "Serve the frontend assets from --static-dir instead of the builtin ones")
+	staticDir     = serveFlags.String("static-dir", "static", "Directory of frontend assets to serve with --dev")
+	assetsOverlay = serveFlags.String("assets-overlay", "", "Directory of files (e.g. index.html, favicon.ico) to serve instead of the builtin assets of the same name")
+)
+
+var _ = register(commands, &command{
+	name:  "serve",
+	help:  "Serve the interactive map over HTTP.",
+	flags: serveFlags,
+	run:   runServe,
+})
+
+func runServe(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", args)
+	}
+	if *upstream != "" {
+		origin, err := url.Parse(*upstream)
+		if err != nil {
+			return fmt.Errorf("--upstream: %w", err)
+		}
+		return serveProxy(ctx, origin)
+	}
+
+	records := gsync.NewFuture[[]dataset.Record]()
+	loading := progress.New("Download", progress.Bytes)
+	go records.ProvideFunc(ctx, func(ctx context.Context) ([]dataset.Record, error) {
+		recs, err := loadRecords(ctx, loading, *download)
+		if err != nil {
+			glog.Errorf("Failed to load dataset: %s", err)
+		}
+		return recs, err
+	})
+
+	return serve(ctx, records, loading)
+}
+
+func serve(ctx context.Context, records *gsync.Future[[]dataset.Record], loading *progress.Bar) error {
+	coalesced := new(coalescer) // for the expensive handlers
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
+		defer cancel()
+
+		recs, err := records.Wait(ctx)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("tiles not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "OK: %d records", len(recs))
+	})
+	http.HandleFunc("/status/progress", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") == "text/event-stream" {
+			streamProgress(w, r, loading)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(loading.Snapshot())
+	})
+
+	http.HandleFunc("/api/sources", handleSources)
+	http.HandleFunc("/api/coverage", coverageHandler(records, datasetFile()))
+
+	http.HandleFunc("/api/permalink", handlePermalink)
+	http.HandleFunc("/api/palette", handlePalette)
+	http.HandleFunc("/api/canvas", canvasHandler(records))
+	http.HandleFunc("/api/coords", handleCoords)
+	var (
+		atl     *atlas.Atlas
+		atlases *atlasAPI
+	)
+	if *atlasSource != "" {
+		var err error
+		if atl, err = atlas.Load(ctx, *atlasSource); err != nil {
+			return fmt.Errorf("--atlas: %w", err)
+		}
+		glog.Infof("Loaded %d atlas entries", len(atl.Entries))
+		atlases = newAtlasAPI(atl, records)
+		http.HandleFunc("/api/atlas", atlases.handleAt)
+		http.HandleFunc("/api/atlas/", coalesced.wrap(atlases.handle))
+	}
+	chunks := gsync.Lazy(func(ctx context.Context) (*chunked.Dataset, error) {
+		return loadChunks(ctx, records, !*download)
+	})
+	contexts := newPixelContexts(chunks, atl)
+	http.HandleFunc("/api/context", coalesced.wrap(contextHandler(contexts)))
+	http.HandleFunc("/api/random", randomHandler(records))
+	http.HandleFunc("/api/users/search", userSearchHandler(records))
+	http.HandleFunc("/api/replay/live", replayHandler(records))
+	http.HandleFunc("/ws/session", newSessions(records, contexts).handle)
+	http.HandleFunc("/api/stats/dominance", coalesced.wrap(dominanceHandler(records)))
+	if *sqlDB != "" {
+		handler, err := sqlHandler(*sqlDB)
+		if err != nil {
+			return fmt.Errorf("--sql-db: %w", err)
+		}
+		http.HandleFunc("/api/sql", coalesced.wrap(handler))
+	}
+
+	tileGrid := gsync.Lazy(func(ctx context.Context) ([][]uint8, error) {
+		return loadTileGrid(ctx, records, !*download)
+	})
+	lapse := timelapse.NewEncodings(records)
+	jobs, err := prerenderJobs(*prerender, tileGrid, lapse)
+	if err != nil {
+		return fmt.Errorf("--prerender: %w", err)
+	}
+	prerenderer := new(prerenderer)
+	signer, err := loadSigner()
+	if err != nil {
+		return err
+	}
+	hooks, err := parseWebhooks(*webhook)
+	if err != nil {
+		return fmt.Errorf("--webhook: %w", err)
+	}
+	hooks.signer = signer
+	if *publicURL != "" {
+		if hooks.base, err = url.Parse(*publicURL); err != nil {
+			return fmt.Errorf("--public-url: %w", err)
+		}
+	}
+
+	tileHandler := tiles.GridHandler(tileGrid)
+	view := new(liveView)
+	if *liveFeed != "" {
+		feed, err := url.Parse(*liveFeed)
+		if err != nil {
+			return fmt.Errorf("--live: %w", err)
+		}
+		if *liveRefresh <= 0 {
+			return fmt.Errorf("--live-refresh must be positive")
+		}
+		view.data = live.NewDataset(records)
+		events := make(chan dataset.Record, 1024)
+		updates := make(chan dataset.Record, 1024)
+		go live.Follow(ctx, feed, events)
+		go func() {
+			for rec := range events {
+				view.data.Append(rec)
+				updates <- rec
+			}
+		}()
+		go view.run(ctx, *liveRefresh)
+		tileHandler = tiles.LiveGridHandler(tileGrid, updates)
+	}
+	http.HandleFunc("/tiles/", coalesced.wrap(prerenderer.interactive(tileHandler)))
+
+	limits, err := loadRenderLimits()
+	if err != nil {
+		return err
+	}
+	if err := listenGRPC(ctx, newGRPCAPI(records, contexts, limits)); err != nil {
+		return err
+	}
+	renderTimelapse := signer.require(limits.wrapVariants(view.handler(records, func(snapshot *gsync.Future[[]dataset.Record]) http.Handler {
+		if snapshot == records {
+			return lapse.Handler() // which is prerendered, until there are live events
+		}
+		return timelapse.NewEncodings(snapshot).Handler()
+	})))
+	http.HandleFunc("/render/timelapse.apng", renderTimelapse)
+	http.HandleFunc("/render/timelapse.gif", renderTimelapse)
+
+	if *keyframeInterval <= 0 {
+		return fmt.Errorf("--keyframes must be positive")
+	}
+	keyframes := newKeyframes(records, chunks, *keyframeInterval, signer)
+	http.HandleFunc("/api/keyframes", keyframes.list)
+	http.HandleFunc("/render/keyframe/", signer.require(keyframes.render))
+	uploadDir := *datasetsDir
+	if uploadDir == "" {
+		uploadDir = filepath.Join(cacheDir, "datasets")
+	}
+	admin, err := loadAdminKeys()
+	if err != nil {
+		return err
+	}
+	datasets, err := loadDatasets(uploadDir, admin.authorized)
+	if err != nil {
+		return fmt.Errorf("--datasets-dir: %w", err)
+	}
+	http.HandleFunc("/admin/loglevel", logLevelHandler(admin.authorized))
+	http.HandleFunc("/debug/pprof/", profileHandler(admin.authorized))
+	http.HandleFunc("/api/datasets", datasets.handle)
+	http.HandleFunc("/datasets/", coalesced.wrap(datasets.serve))
+
+	jobDir := *jobsDir
+	if jobDir == "" {
+		jobDir = filepath.Join(cacheDir, "jobs")
+	}
+	renderJobs, err := loadJobs(jobDir, records, signer, hooks, limits.client)
+	if err != nil {
+		return fmt.Errorf("--jobs-dir: %w", err)
+	}
+	http.HandleFunc("/api/jobs/render", limits.wrap(renderJobs.submit))
+	http.HandleFunc("/export/events.arrow", limits.wrap(arrowExportHandler(records)))
+	http.HandleFunc("/api/jobs/", renderJobs.handle)
+	http.HandleFunc("/render/jobs/", signer.require(renderJobs.download))
+	if atlases != nil {
+		http.HandleFunc("/render/atlas/", signer.require(limits.wrap(atlases.renderTimelapse)))
+	}
+
+	http.HandleFunc("/analytics/", coalesced.wrap(view.handler(records, func(snapshot *gsync.Future[[]dataset.Record]) http.Handler {
+		return analytics.Handler(snapshot)
+	})))
+
+	files, err := staticFiles()
+	if err != nil {
+		return err
+	}
+	assets := static.FSHandler(files)
+	http.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-CH", tiles.AcceptCH) // so that the tiles are requested for the display's density
+		assets.ServeHTTP(w, r)
+	})
+	http.Handle("/", http.RedirectHandler("/static/index.html", http.StatusTemporaryRedirect))
+
+	return listenAndServe(ctx, func(addr net.Addr) {
+		if hooks.base == nil {
+			hooks.base = &url.URL{Scheme: "http", Host: addr.String(), Path: "/"}
+		}
+		go prerenderer.run(ctx, records, jobs, hooks)
+		renderJobs.run(ctx, *jobWorkers)
+	})
+}
+
+// staticFiles returns the frontend assets, including any --assets-overlay.
+func staticFiles() (fs.FS, error) {
+	files := static.Files(false)
+	if *dev {
+		if err := static.CheckDir(*staticDir); err != nil {
+			return nil, fmt.Errorf("--static-dir: %w", err)
+		}
+		files = static.Dir(*staticDir)
+	}
+	if *assetsOverlay != "" {
+		files = static.Overlay(os.DirFS(*assetsOverlay), files)
+	}
+	return files, nil
+}
+
+// listenAndServe serves the default mux on --http until ctx is canceled,
+// calling started once it is listening.
+func listenAndServe(ctx context.Context, started func(net.Addr)) error {
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return fmt.Errorf("listening on %q: %w", *addr, err)
+	}
+	glog.Infof("Serving HTTP on http://%s", lis.Addr())
+	started(lis.Addr())
+
+	srv := new(http.Server)
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+
+		<-ctx.Done()
+		glog.Infof("Shutting down...")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			glog.Errorf("HTTP Shutdown: %s", err)
+		}
+	}()
+
+	if err := srv.Serve(lis); err != http.ErrServerClosed {
+		return fmt.Errorf("HTTP Serve exited: %w", err)
+	}
+	<-shutdown
+	return nil
+}
+
+// handleSources serves the results of the most recent probe of the dataset sources (probing them again
+// if it is older than sourceProbeTTL), without the paths of local files or the details of errors,
+// which are only logged.
+func handleSources(w http.ResponseWriter, r *http.Request) {
+	probes, err := sourceProbes.Get(r.Context(), "", func(ctx context.Context) ([]dataset.SourceProbe, error) {
+		sources, err := datasetSources()
+		if err != nil {
+			return nil, err
+		}
+		probes := dataset.ProbeSources(ctx, sources)
+		for _, probe := range probes {
+			if !probe.OK {
+				glog.V(1).Infof("Source %s is unavailable: %s", probe.URL, probe.Error)
+			}
+		}
+		return probes, nil
+	})
+	if err != nil {
+		glog.Errorf("Probing sources: %s", err)
+		http.Error(w, "probing sources failed", http.StatusInternalServerError)
+		return
+	}
+	public := make([]dataset.SourceProbe, len(probes))
+	for i, probe := range probes {
+		if u, err := url.Parse(probe.URL); err != nil || dataset.IsLocal(u) {
+			probe.URL = "(local file)"
+		}
+		if probe.Error != "" && probe.Status == "" {
+			// Without a response, the error is from the OS or the network (e.g. with the path of a local file).
+			probe.Error = "unavailable (see the server log)"
+		}
+		public[i] = probe
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(public)
+}
+
+// coverageHandler serves /api/coverage, which shards of the dataset (in datasetFile) are missing once it's loaded,
+// if --max-missing-shards let it load without them. Like /api/sources, it leaves out the paths of local files
+// and the errors, which were logged.
+func coverageHandler(records *gsync.Future[[]dataset.Record], datasetFile string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := records.Wait(r.Context()); err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		coverage, err := dataset.ReadCoverage(datasetFile)
+		if err != nil {
+			glog.Errorf("Reading coverage: %s", err)
+			http.Error(w, "reading coverage failed", http.StatusInternalServerError)
+			return
+		}
+		for i, missing := range coverage.Missing {
+			if u, err := dataset.ParseSourceURL(missing.URL); err != nil || dataset.IsLocal(u) {
+				missing.URL = "(local file)"
+			}
+			missing.Error = ""
+			coverage.Missing[i] = missing
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Complete bool `json:"complete"`
+			dataset.Coverage
+		}{coverage.Complete(), coverage})
+	}
+}
+
+// paletteEntry is the JSON form of a color served by /api/palette.
+type paletteEntry struct {
+	Index int    `json:"index"`
+	Hex   string `json:"hex"`
+	Name  string `json:"name"`
+}
+
+// handlePalette serves the palette of the year given by the year parameter (default: the dataset's),
+// or one of its variants given by the palette parameter.
+func handlePalette(w http.ResponseWriter, r *http.Request) {
+	palette, name := dataset.Palette, dataset.ColorName // the dataset's
+	if s := r.FormValue("year"); s != "" {
+		y, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("year: %s", err), http.StatusBadRequest)
+			return
+		}
+		if y != *year {
+			p, names, ok := dataset.YearPalette(y)
+			if !ok {
+				http.Error(w, fmt.Sprintf("no palette for %d", y), http.StatusNotFound)
+				return
+			}
+			palette, name = p, func(i uint8) string { return names[i] }
+		}
+	}
+
+	palette, err := dataset.PaletteVariantOf(palette, r.FormValue("palette"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries := make([]paletteEntry, len(palette))
+	for i, c := range palette {
+		r, g, b, _ := c.RGBA()
+		entries[i] = paletteEntry{i, fmt.Sprintf("#%02X%02X%02X", r>>8, g>>8, b>>8), name(uint8(i))}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// streamProgress sends progress snapshots as server-sent events until the client goes away.
+func streamProgress(w http.ResponseWriter, r *http.Request, bar *progress.Bar) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	updates := make(chan progress.Snapshot, 1)
+	remove := bar.OnUpdate(func(s progress.Snapshot) {
+		select {
+		case updates <- s:
+		default: // drop updates the client hasn't caught up to
+		}
+	})
+	defer remove()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	send := func(s progress.Snapshot) {
+		data, _ := json.Marshal(s)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+
+	send(bar.Snapshot())
+	for {
+		select {
+		case s := <-updates:
+			send(s)
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/dataset/datasettest"
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+func TestHandlePaletteYears(t *testing.T) {
+	tests := []struct {
+		query  string
+		colors int
+		first  string // name of color 0
+		last   string // hex of the last color
+	}{
+		{"", 16, dataset.PaletteNames[2017][0], "#820080"},
+		{"?year=2017", 16, dataset.PaletteNames[2017][0], "#820080"},
+		{"?year=2023", 32, dataset.PaletteNames[2023][0], "#FFB470"},
+		{"?year=2017&palette=highcontrast", 16, dataset.PaletteNames[2017][0], "#800080"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handlePalette(w, httptest.NewRequest(http.MethodGet, "/api/palette"+test.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", test.query, w.Code, w.Body)
+		}
+		var entries []paletteEntry
+		if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+			t.Fatalf("GET %s: %s", test.query, err)
+		}
+		if len(entries) != test.colors {
+			t.Fatalf("GET %s returned %d colors, want %d", test.query, len(entries), test.colors)
+		}
+		if got := entries[0].Name; got != test.first {
+			t.Errorf("GET %s: color 0 is named %q, want %q", test.query, got, test.first)
+		}
+		if got := entries[len(entries)-1].Hex; got != test.last {
+			t.Errorf("GET %s: last color is %s, want %s", test.query, got, test.last)
+		}
+	}
+
+	for query, want := range map[string]int{
+		"?year=2022":                      http.StatusNotFound,
+		"?year=twenty":                    http.StatusBadRequest,
+		"?year=2023&palette=highcontrast": http.StatusBadRequest, // the variants are of the 2017 palette
+	} {
+		w := httptest.NewRecorder()
+		handlePalette(w, httptest.NewRequest(http.MethodGet, "/api/palette"+query, nil))
+		if w.Code != want {
+			t.Errorf("GET %s = %d, want %d", query, w.Code, want)
+		}
+	}
+}
+
+func TestCoverageHandler(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "sharded"+dataset.FileSuffixes[0])
+	records := gsync.NewFuture[[]dataset.Record]()
+	records.Provide(datasettest.Records(datasettest.Options{Events: 10}))
+	handler := coverageHandler(records, file)
+
+	get := func() (got struct {
+		Complete bool                   `json:"complete"`
+		Shards   int                    `json:"shards"`
+		Missing  []dataset.MissingShard `json:"missing"`
+	}) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/api/coverage", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET = %d: %s", w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decoding %q: %s", w.Body, err)
+		}
+		return got
+	}
+
+	if got := get(); !got.Complete || len(got.Missing) != 0 {
+		t.Errorf("GET without a coverage file = %+v, want it complete", got)
+	}
+
+	coverage := `{"shards": 3, "missing": [
+		{"index": 0, "url": "/data/shard0.csv", "error": "open /data/shard0.csv: permission denied"},
+		{"index": 2, "url": "https://example.com/shard2.csv", "error": "503 Service Unavailable"}
+	]}`
+	if err := os.WriteFile(dataset.CoverageFile(file), []byte(coverage), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got := get()
+	want := []dataset.MissingShard{
+		{Index: 0, URL: "(local file)"},
+		{Index: 2, URL: "https://example.com/shard2.csv"},
+	}
+	if got.Complete || got.Shards != 3 || !reflect.DeepEqual(got.Missing, want) {
+		t.Errorf("GET = %+v, want 3 shards missing %+v", got, want)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/tiles"
+)
+
+const (
+	// maxSessions limits how many /ws/session connections are open at once,
+	// since each may hold a copy of the canvas for its tiles.
+	maxSessions = 64
+
+	// maxSessionReplays limits how many replays each session may have running at once.
+	maxSessionReplays = 4
+)
+
+// A sessionRequest is a message from a /ws/session client. Each has an ID, chosen by the client,
+// with which the server's responses to it are tagged:
+//
+//	{"id": 1, "type": "tile", "x": 0, "y": 0, "z": 2, "at": "2017-04-01T12:00:00Z"}
+//	    renders the DefaultTileSize (or size) tile of the canvas as it was at the time (default: the end),
+//	    as /tiles/{x}_{y}_z{z}_{size}x{size}.png does, with the dpr and palette if given.
+//	    It's sent as a binary message: the request ID (a big-endian uint32) followed by the PNG.
+//	{"id": 2, "type": "pixel", "x": 500, "y": 500, "tz": "Europe/Berlin"}
+//	    looks up a pixel as /api/context does, responding with {"id": 2, "type": "pixel", "pixel": {...}}.
+//	{"id": 3, "type": "replay", "start": "2017-04-01T12:00:00Z", "speed": "60x"}
+//	    replays the events as /api/replay/live does (also taking resume), with each as
+//	    {"id": 3, "type": "event", "resume": "123", "event": {...}}, and then {"id": 3, "type": "end"}.
+//	{"id": 3, "type": "cancel"}
+//	    stops the replay with the ID, which then ends.
+//
+// A request which fails is answered with {"id": n, "type": "error", "error": "..."}.
+type sessionRequest struct {
+	ID   uint32 `json:"id"`
+	Type string `json:"type"`
+
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	Z       int    `json:"z"`
+	Size    int    `json:"size"`
+	DPR     int    `json:"dpr"`
+	Palette string `json:"palette"`
+	At      string `json:"at"`
+
+	TZ string `json:"tz"`
+
+	Start  string `json:"start"`
+	Speed  string `json:"speed"`
+	Resume string `json:"resume"`
+}
+
+// A sessionResponse is a (text) message to a /ws/session client.
+type sessionResponse struct {
+	ID     uint32        `json:"id"`
+	Type   string        `json:"type"`
+	Pixel  *pixelContext `json:"pixel,omitempty"`
+	Resume string        `json:"resume,omitempty"`
+	Event  *jsonEvent    `json:"event,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// sessions serves /ws/session, a WebSocket over which the frontend requests tiles at times, pixel details,
+// and replays while it's scrubbing through time, without the overhead of a request for each of them.
+type sessions struct {
+	records  *gsync.Future[[]dataset.Record]
+	contexts *pixelContexts
+	slots    chan struct{}
+}
+
+func newSessions(records *gsync.Future[[]dataset.Record], contexts *pixelContexts) *sessions {
+	return &sessions{
+		records:  records,
+		contexts: contexts,
+		slots:    make(chan struct{}, maxSessions),
+	}
+}
+
+func (s *sessions) handle(w http.ResponseWriter, r *http.Request) {
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	default:
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+		return
+	}
+	conn, err := acceptWebSocket(w, r)
+	if err != nil {
+		glog.V(1).Infof("Session from %s: %s", r.RemoteAddr, err)
+		return
+	}
+	sess := &session{sessions: s, conn: conn, replays: make(map[uint32]context.CancelFunc)}
+	err = sess.run(r.Context())
+	conn.Close(wsNormalClosure, "")
+	glog.V(1).Infof("Session from %s ended: %s", r.RemoteAddr, err)
+}
+
+// A session is a client's connection to /ws/session.
+type session struct {
+	*sessions
+	conn   *wsConn
+	canvas *tiles.Canvas // for tiles, once one is requested
+
+	mu      sync.Mutex
+	replays map[uint32]context.CancelFunc // by request ID
+}
+
+// run handles the client's requests until it goes away, returning why.
+// Tiles and pixels are handled in turn, but replays run in the background.
+func (s *session) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var replays sync.WaitGroup
+	defer replays.Wait()
+	defer cancel()
+
+	for {
+		opcode, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if opcode != wsText {
+			s.conn.Close(wsUnsupportedData, "requests are JSON text messages")
+			return fmt.Errorf("binary message")
+		}
+		var req sessionRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			err = s.send(sessionResponse{Type: "error", Error: fmt.Sprintf("bad request: %s", err)})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		switch req.Type {
+		case "tile":
+			err = s.tile(ctx, req)
+		case "pixel":
+			err = s.pixel(ctx, req)
+		case "replay":
+			err = s.replay(ctx, req, &replays)
+		case "cancel":
+			s.mu.Lock()
+			if stop, ok := s.replays[req.ID]; ok {
+				stop()
+			}
+			s.mu.Unlock()
+		default:
+			err = fmt.Errorf("unknown request type %q", req.Type)
+		}
+		if err != nil {
+			if err := s.send(sessionResponse{ID: req.ID, Type: "error", Error: err.Error()}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// send sends a response to the client.
+func (s *session) send(resp sessionResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(wsText, data)
+}
+
+func (s *session) tile(ctx context.Context, req sessionRequest) error {
+	size, dpr := req.Size, req.DPR
+	if size == 0 {
+		size = tiles.DefaultTileSize
+	}
+	if dpr == 0 {
+		dpr = 1
+	}
+	palette, err := dataset.PaletteVariant(req.Palette)
+	if err != nil {
+		return err
+	}
+	at := int64(math.MaxInt64)
+	if req.At != "" {
+		var t timeFlag
+		if err := t.Set(req.At); err != nil {
+			return fmt.Errorf("at: %s", err)
+		}
+		at = t.UnixMilli()
+	}
+	recs, err := s.records.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("not ready: %s", err)
+	}
+	if s.canvas == nil {
+		s.canvas = tiles.NewCanvas(recs)
+	}
+	s.canvas.MoveTo(at)
+	img, err := s.canvas.Tile(req.X, req.Y, req.Z, size, dpr, palette)
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(binary.BigEndian.AppendUint32(nil, req.ID))
+	if err := png.Encode(buf, img); err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(wsBinary, buf.Bytes())
+}
+
+func (s *session) pixel(ctx context.Context, req sessionRequest) error {
+	if err := checkPixel(req.X, req.Y); err != nil {
+		return err
+	}
+	loc := time.UTC
+	if req.TZ != "" {
+		var err error
+		if loc, err = time.LoadLocation(req.TZ); err != nil {
+			return fmt.Errorf("tz: unknown time zone %q", req.TZ)
+		}
+	}
+	pixel, err := s.contexts.lookup(ctx, req.X, req.Y, loc)
+	if err != nil {
+		return fmt.Errorf("not ready: %s", err)
+	}
+	return s.send(sessionResponse{ID: req.ID, Type: "pixel", Pixel: pixel})
+}
+
+// replay starts replaying the events in the background, until they run out or it's canceled.
+func (s *session) replay(ctx context.Context, req sessionRequest, replays *sync.WaitGroup) error {
+	speed := 1.0
+	if req.Speed != "" {
+		v, err := parseReplaySpeed(req.Speed)
+		if err != nil {
+			return err
+		}
+		speed = v
+	}
+	var start timeFlag
+	if req.Start != "" {
+		if err := start.Set(req.Start); err != nil {
+			return fmt.Errorf("start: %s", err)
+		}
+	}
+	recs, err := s.records.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("not ready: %s", err)
+	}
+	if len(recs) == 0 {
+		return fmt.Errorf("no events to replay")
+	}
+	next, base, err := replayStart(recs, start.Time, req.Resume)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.replays[req.ID]; ok {
+		return fmt.Errorf("replay %d is already running", req.ID)
+	}
+	if len(s.replays) >= maxSessionReplays {
+		return fmt.Errorf("at most %d replays can run at once", maxSessionReplays)
+	}
+	ctx, stop := context.WithCancel(ctx)
+	s.replays[req.ID] = stop
+	replays.Add(1)
+	go func() {
+		defer replays.Done()
+		err := paceReplay(ctx, recs, next, base, speed, &wsReplay{s, req.ID, recs})
+		s.mu.Lock()
+		delete(s.replays, req.ID)
+		s.mu.Unlock()
+		stop()
+		if err == nil || errors.Is(err, context.Canceled) {
+			s.send(sessionResponse{ID: req.ID, Type: "end"})
+		}
+	}()
+	return nil
+}
+
+// wsReplay is a replayStream of a session's replay.
+type wsReplay struct {
+	session *session
+	id      uint32
+	recs    []dataset.Record
+}
+
+func (r *wsReplay) send(i int) error {
+	event := newJSONEvent(r.recs[i])
+	return r.session.send(sessionResponse{ID: r.id, Type: "event", Resume: fmt.Sprint(i), Event: &event})
+}
+
+func (r *wsReplay) flush() error {
+	return nil // each event is sent as it's due
+}
+
+func (r *wsReplay) keepalive() error {
+	return r.session.conn.write(wsPing, nil)
+}
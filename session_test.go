@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/dataset/datasettest"
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+// wsClient is the client's end of a WebSocket connection, enough to test the server's.
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, serverURL, path string) *wsClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	// The key and accept key are the example of RFC 6455.
+	req, _ := http.NewRequest(http.MethodGet, serverURL+path, nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatalf("reading handshake: %s", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake = %s, want %d", resp.Status, http.StatusSwitchingProtocols)
+	}
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("Sec-WebSocket-Accept = %q, want %q", got, want)
+	}
+	return &wsClient{t, conn, r}
+}
+
+// writeFrame writes a masked frame.
+func (c *wsClient) writeFrame(fin bool, opcode int, payload []byte) {
+	c.t.Helper()
+	head := byte(opcode)
+	if fin {
+		head |= 0x80
+	}
+	frame := []byte{head}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	default:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatalf("writing frame: %s", err)
+	}
+}
+
+func (c *wsClient) request(req string) {
+	c.t.Helper()
+	c.writeFrame(true, wsText, []byte(req))
+}
+
+// readFrame reads an (unmasked, unfragmented) frame.
+func (c *wsClient) readFrame() (opcode int, payload []byte) {
+	c.t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		c.t.Fatalf("reading frame: %s", err)
+	}
+	if head[0]&0x80 == 0 || head[1]&0x80 != 0 {
+		c.t.Fatalf("frame header %x: want a final, unmasked frame", head)
+	}
+	size := int(head[1])
+	switch size {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.r, ext[:])
+		size = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.r, ext[:])
+		size = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		c.t.Fatalf("reading frame: %s", err)
+	}
+	return int(head[0] & 0x0F), payload
+}
+
+// response reads the next text message, skipping pings.
+func (c *wsClient) response() (resp sessionResponse) {
+	c.t.Helper()
+	for {
+		opcode, payload := c.readFrame()
+		if opcode == wsPing {
+			continue
+		}
+		if opcode != wsText {
+			c.t.Fatalf("message with opcode %#x, want text", opcode)
+		}
+		if err := json.Unmarshal(payload, &resp); err != nil {
+			c.t.Fatalf("decoding %q: %s", payload, err)
+		}
+		return resp
+	}
+}
+
+// roundTrip sends a request and reads its response.
+func (c *wsClient) roundTrip(req string) sessionResponse {
+	c.t.Helper()
+	c.request(req)
+	return c.response()
+}
+
+func TestSession(t *testing.T) {
+	records := gsync.NewFuture[[]dataset.Record]()
+	records.Provide(datasettest.Build(t, datasettest.Tiny()).Records)
+	server := httptest.NewServer(http.HandlerFunc(newSessions(records, newPixelContexts(gsync.Map(records, newChunks), nil)).handle))
+	defer server.Close()
+	c := dialWebSocket(t, server.URL, "/ws/session")
+	start := datasettest.TinyStart
+
+	// Alice painted (1,1) twice, so the tile shows her first color before her second.
+	for _, test := range []struct {
+		id    uint32
+		at    time.Time
+		color uint8
+	}{
+		{1, start.Add(30 * time.Second), 1},
+		{2, start.Add(time.Minute), 3},
+		{3, start.Add(-time.Second), 0},
+	} {
+		c.request(fmt.Sprintf(`{"id": %d, "type": "tile", "z": 2, "at": %q}`, test.id, test.at.Format(time.RFC3339)))
+		opcode, payload := c.readFrame()
+		if opcode != wsBinary || len(payload) < 4 {
+			t.Fatalf("tile %d: message with opcode %#x and %d bytes, want a binary PNG", test.id, opcode, len(payload))
+		}
+		if id := binary.BigEndian.Uint32(payload); id != test.id {
+			t.Errorf("tile has ID %d, want %d", id, test.id)
+		}
+		img, err := png.Decode(bytes.NewReader(payload[4:]))
+		if err != nil {
+			t.Fatalf("tile %d: %s", test.id, err)
+		}
+		r, g, b, _ := img.At(1, 1).RGBA()
+		wr, wg, wb, _ := dataset.Palette[test.color].RGBA()
+		if r != wr || g != wg || b != wb {
+			t.Errorf("tile %d at %s: (1,1) = %v, want color %d", test.id, test.at.Format(time.TimeOnly), img.At(1, 1), test.color)
+		}
+	}
+
+	c.request(`{"id": 4, "type": "pixel", "x": 1, "y": 1}`)
+	if resp := c.response(); resp.ID != 4 || resp.Type != "pixel" || resp.Pixel == nil || len(resp.Pixel.History) != 2 {
+		t.Errorf("pixel = %+v, want the 2 events at (1,1)", resp)
+	}
+
+	// The replay is fast enough to see all four events, and is followed by its end.
+	c.request(`{"id": 5, "type": "replay", "speed": "3600x"}`)
+	for i := 0; i < 4; i++ {
+		resp := c.response()
+		if resp.ID != 5 || resp.Type != "event" || resp.Event == nil || resp.Resume != fmt.Sprint(i) {
+			t.Fatalf("replay message %d = %+v, want event %d", i, resp, i)
+		}
+	}
+	if resp := c.response(); resp.ID != 5 || resp.Type != "end" {
+		t.Errorf("after the events, replay sent %+v, want its end", resp)
+	}
+
+	// A slow replay is canceled.
+	c.request(`{"id": 6, "type": "replay", "speed": "0.001x", "resume": "0"}`)
+	c.request(`{"id": 6, "type": "cancel"}`)
+	if resp := c.response(); resp.ID != 6 || resp.Type != "end" {
+		t.Errorf("canceled replay sent %+v, want its end", resp)
+	}
+
+	for _, req := range []string{
+		`{"id": 7, "type": "tile", "z": 99}`,
+		`{"id": 7, "type": "pixel", "x": -1, "y": 0}`,
+		`{"id": 7, "type": "replay", "speed": "fast"}`,
+		`{"id": 7, "type": "dance"}`,
+		`{"id": 7`,
+	} {
+		if resp := c.roundTrip(req); resp.Type != "error" || resp.Error == "" {
+			t.Errorf("%s: response %+v, want an error", req, resp)
+		}
+	}
+
+	// Requests may be fragmented, with pings between the fragments.
+	c.writeFrame(false, wsText, []byte(`{"id": 8, "type":`))
+	c.writeFrame(true, wsPing, []byte("hi"))
+	c.writeFrame(true, wsContinuation, []byte(` "pixel", "x": 6, "y": 2}`))
+	if opcode, payload := c.readFrame(); opcode != wsPong || string(payload) != "hi" {
+		t.Errorf("ping answered with opcode %#x %q, want a pong", opcode, payload)
+	}
+	if resp := c.response(); resp.ID != 8 || resp.Pixel == nil || len(resp.Pixel.History) != 1 {
+		t.Errorf("fragmented pixel request = %+v, want the event at (6,2)", resp)
+	}
+
+	c.writeFrame(true, wsClose, binary.BigEndian.AppendUint16(nil, wsNormalClosure))
+	if opcode, payload := c.readFrame(); opcode != wsClose || binary.BigEndian.Uint16(payload) != wsNormalClosure {
+		t.Errorf("close answered with opcode %#x %x, want a normal close", opcode, payload)
+	}
+}
+
+func TestSessionNotWebSocket(t *testing.T) {
+	records := gsync.NewFuture[[]dataset.Record]()
+	handler := newSessions(records, newPixelContexts(gsync.Map(records, newChunks), nil)).handle
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/ws/session", nil))
+	if w.Code != http.StatusUpgradeRequired {
+		t.Errorf("GET without upgrading = %d, want %d", w.Code, http.StatusUpgradeRequired)
+	}
+}
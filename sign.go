@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var signKeyFile = flag.String("sign-key-file", "", "File containing a secret key; if set, the server only serves /render/ URLs signed with it (see the sign command)")
+
+// signedPrefix is the path prefix of the (expensive) URLs which require a signature.
+const signedPrefix = "/render/"
+
+// A urlSigner signs URLs with an HMAC and an expiry, so that links to them can be handed out
+// without allowing access to arbitrary URLs.
+//
+// The signature covers the path and all query parameters (including "expires") except "sig" itself.
+type urlSigner struct {
+	key []byte
+}
+
+// loadSigner returns the signer for --sign-key-file, or nil if it isn't set.
+func loadSigner() (*urlSigner, error) {
+	if *signKeyFile == "" {
+		return nil, nil
+	}
+	key, err := os.ReadFile(*signKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("--sign-key-file: %w", err)
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < 16 {
+		return nil, fmt.Errorf("--sign-key-file: key must be at least 16 bytes")
+	}
+	return &urlSigner{key: key}, nil
+}
+
+func (s *urlSigner) mac(path string, query url.Values) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(path))
+	h.Write([]byte{'?'})
+	h.Write([]byte(query.Encode()))
+	return h.Sum(nil)
+}
+
+// sign returns a copy of u which is valid until expires.
+func (s *urlSigner) sign(u *url.URL, expires time.Time) *url.URL {
+	signed := *u
+	query := u.Query()
+	query.Del("sig")
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", hex.EncodeToString(s.mac(u.Path, query)))
+	signed.RawQuery = query.Encode()
+	return &signed
+}
+
+var (
+	errUnsigned = errors.New("URL is not signed")
+	errExpired  = errors.New("signed URL has expired")
+	errBadSig   = errors.New("URL signature is invalid")
+)
+
+// verify checks the signature of u.
+func (s *urlSigner) verify(u *url.URL, now time.Time) error {
+	query := u.Query()
+	sig, err := hex.DecodeString(query.Get("sig"))
+	if err != nil || len(sig) == 0 {
+		return errUnsigned
+	}
+	query.Del("sig")
+	if !hmac.Equal(sig, s.mac(u.Path, query)) {
+		return errBadSig
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || now.Unix() > expires {
+		return errExpired
+	}
+	return nil
+}
+
+// require wraps a handler so that it only serves signed URLs.
+// If s is nil, the handler is returned as-is.
+func (s *urlSigner) require(h http.HandlerFunc) http.HandlerFunc {
+	if s == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.verify(r.URL, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+var (
+	signFlags = flag.NewFlagSet("sign", flag.ExitOnError)
+	signTTL   = signFlags.Duration("ttl", 7*24*time.Hour, "How long the signed URLs remain valid")
+	signBase  = signFlags.String("base", "", "Base URL of the server, e.g. https://place.example.com (default: print paths)")
+)
+
+var _ = register(commands, &command{
+	name:  "sign",
+	args:  "path...",
+	help:  "Print signed, expiring URLs for a server run with --sign-key-file, e.g. /render/timelapse.gif.",
+	flags: signFlags,
+	run:   runSign,
+})
+
+func runSign(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no paths specified")
+	}
+	signer, err := loadSigner()
+	if err != nil {
+		return err
+	}
+	if signer == nil {
+		return fmt.Errorf("--sign-key-file is required")
+	}
+	base, err := url.Parse(*signBase)
+	if err != nil {
+		return fmt.Errorf("--base: %w", err)
+	}
+
+	expires := time.Now().Add(*signTTL)
+	for _, arg := range args {
+		u, err := url.Parse(arg)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(u.Path, "/") {
+			u.Path = "/" + u.Path
+		}
+		fmt.Println(base.ResolveReference(signer.sign(u, expires)))
+	}
+	return nil
+}
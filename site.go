@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/progress"
+	"github.com/kylelemons/rplacemap/static"
+	"github.com/kylelemons/rplacemap/tiles"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+var (
+	exportSiteFlags     = flag.NewFlagSet("export site", flag.ExitOnError)
+	exportSiteOut       = exportSiteFlags.String("out", "site", "Output directory")
+	exportSiteMaxZoom   = exportSiteFlags.Int("max-zoom", 5, "Deepest zoom level to pre-render tiles for (each level has 4x the tiles of the last)")
+	exportSiteKeyframes = exportSiteFlags.Duration("keyframes", 6*time.Hour, "Interval between snapshots of the canvas (0 for none)")
+	exportSiteTimelapse = exportSiteFlags.String("timelapse", "gif", "Timelapse format to include (gif or apng), or empty for none")
+)
+
+var _ = register(exports, &command{
+	name: "site",
+	help: "Export a static copy of the map (frontend, pre-rendered tiles, snapshots, and metadata)\n" +
+		"that can be hosted without the server, e.g. on GitHub Pages or S3.",
+	flags: exportSiteFlags,
+	run:   runExportSite,
+})
+
+// siteMetadata is written to site.json in the exported site.
+type siteMetadata struct {
+	Records   int64          `json:"records"`
+	Users     int            `json:"users"`
+	First     time.Time      `json:"first"`
+	Last      time.Time      `json:"last"`
+	TileSize  int            `json:"tile_size"`
+	MaxZoom   int            `json:"max_zoom"`
+	Snapshots []siteSnapshot `json:"snapshots"`
+	Timelapse string         `json:"timelapse,omitempty"`
+}
+
+type siteSnapshot struct {
+	Time time.Time `json:"time"`
+	Path string    `json:"path"`
+}
+
+// siteIndex is the entry point of the exported site.
+// It uses the same frontend as the server, pointed at the pre-rendered tiles by relative paths
+// so that the site can be hosted under any prefix.
+var siteIndex = template.Must(template.New("index.html").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>r/place (2017)</title>
+    <link rel="stylesheet" href="static/style.css">
+    <link rel="stylesheet" href="https://unpkg.com/leaflet@1.7.1/dist/leaflet.css"
+          integrity="sha512-xodZBNTC5n17Xt2atTPuE1HxjVMSvLVW9ocqUKLsCC5CXdbqCmblAshOMAS6/keqq/sMZMZ19scR4PsZChSR7A=="
+          crossorigin=""/>
+    <script src="https://unpkg.com/leaflet@1.7.1/dist/leaflet.js"
+            integrity="sha512-XQoYMqMTK8LvdxXYG3nZ448hOEQiglfqkJs1NOQV44cWnUrBc8PkAOcXy20w0vlaXaVUearIOBhiXZ5V3ynxwA=="
+            crossorigin=""></script>
+    <script>window.rplacemapSite = {tileRoot: "tiles/", maxNativeZoom: {{.MaxZoom}}};</script>
+</head>
+<body>
+    <div id="map"></div>
+    <script src="static/init.js"></script>
+    {{with .Timelapse}}<a href="{{.}}">Timelapse</a><br/>{{end}}
+    {{range .Snapshots}}<a href="{{.Path}}">{{.Time.Format "2006-01-02 15:04"}}</a>
+    {{end}}
+</body>
+</html>
+`))
+
+func runExportSite(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", args)
+	}
+	if *exportSiteMaxZoom < 0 || *exportSiteMaxZoom > tiles.MaxZoom {
+		return fmt.Errorf("--max-zoom must be between 0 and %d", tiles.MaxZoom)
+	}
+	encode, ok := timelapseEncoders[*exportSiteTimelapse]
+	if *exportSiteTimelapse != "" && (!ok || *exportSiteTimelapse == "mp4") {
+		return fmt.Errorf("unsupported timelapse format %q", *exportSiteTimelapse)
+	}
+
+	records, err := loadCachedRecords(ctx)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("dataset is empty")
+	}
+	out := *exportSiteOut
+
+	sum := newSummary()
+	for _, rec := range records {
+		sum.add(rec)
+	}
+	meta := siteMetadata{
+		Records:  sum.records,
+		Users:    len(sum.users),
+		First:    time.UnixMilli(sum.first).UTC(),
+		Last:     time.UnixMilli(sum.last).UTC(),
+		TileSize: tiles.DefaultTileSize,
+		MaxZoom:  *exportSiteMaxZoom,
+	}
+
+	// Frontend
+	if err := copyAssets(filepath.Join(out, "static"), static.Files(false)); err != nil {
+		return err
+	}
+
+	// Tiles
+	pixels, err := tiles.Flatten(records)
+	if err != nil {
+		return err
+	}
+	if err := exportTiles(ctx, filepath.Join(out, "tiles"), pixels, *exportSiteMaxZoom); err != nil {
+		return err
+	}
+
+	// Snapshots
+	if interval := *exportSiteKeyframes; interval > 0 {
+		bounds := timelapse.Bounds()
+		for _, t := range keyframeTimes(meta.First, meta.Last, interval) {
+			meta.Snapshots = append(meta.Snapshots, siteSnapshot{Time: t})
+		}
+		for i, snap := range meta.Snapshots {
+			path := "snapshots/" + snap.Time.Format("20060102T150405") + ".png"
+			img := dataset.Snapshot(records, snap.Time.UnixMilli(), bounds)
+			if err := writeSiteFile(out, path, func(w io.Writer) error {
+				return png.Encode(w, img)
+			}); err != nil {
+				return err
+			}
+			meta.Snapshots[i].Path = path
+		}
+	}
+
+	// Timelapse
+	if *exportSiteTimelapse != "" {
+		bar := progress.New("Timelapse", progress.Counter)
+		stopProgress := bar.Display()
+		frames := timelapse.RenderFrames(records, timelapse.DefaultInterval, bar)
+		stopProgress()
+		meta.Timelapse = "render/timelapse." + *exportSiteTimelapse
+		if err := writeSiteFile(out, meta.Timelapse, func(w io.Writer) error {
+			return encode(w, frames)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Metadata and entry point
+	if err := writeSiteFile(out, "site.json", func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(meta)
+	}); err != nil {
+		return err
+	}
+	if err := writeSiteFile(out, "index.html", func(w io.Writer) error {
+		return siteIndex.Execute(w, meta)
+	}); err != nil {
+		return err
+	}
+
+	glog.Infof("Exported static site to %s", out)
+	return nil
+}
+
+// writeSiteFile writes the file at the slash-separated path within the site directory.
+func writeSiteFile(dir, path string, write func(io.Writer) error) error {
+	filename := filepath.Join(dir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("creating output directory: %w", err)
+	}
+	return writeFile(filename, write)
+}
+
+// copyAssets copies the frontend assets in fsys into dir.
+// The server's index.html is skipped, since the site has its own entry point.
+func copyAssets(dir string, fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) == ".go" || path == "index.html" {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		return writeSiteFile(dir, path, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+	})
+}
+
+// exportTiles renders every tile for zoom levels 0 through maxZoom into dir,
+// named as the server would serve them.
+func exportTiles(ctx context.Context, dir string, pixels [][]uint8, maxZoom int) error {
+	var total int64
+	for z := 0; z <= maxZoom; z++ {
+		total += 1 << (2 * z)
+	}
+	bar := progress.New("Tiles", progress.Counter)
+	bar.SetTotal(total)
+	stopProgress := bar.Display()
+	defer stopProgress()
+
+	pool := gsync.NewPool(ctx, 0)
+	for z := 0; z <= maxZoom; z++ {
+		for y := 0; y < 1<<z; y++ {
+			for x := 0; x < 1<<z; x++ {
+				size := tiles.DefaultTileSize
+				path := fmt.Sprintf("%d_%d_z%d_%dx%d.png", x, y, z, size, size)
+				if !pool.GoID(path, func(context.Context) error {
+					defer bar.Add(1)
+					img := tiles.Tile(pixels, x, y, z, size, size)
+					return writeSiteFile(dir, path, func(w io.Writer) error {
+						return png.Encode(w, img)
+					})
+				}) {
+					return pool.Wait()
+				}
+			}
+		}
+	}
+	return pool.Wait()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+var (
+	exportSQLiteFlags = flag.NewFlagSet("export sqlite", flag.ExitOnError)
+	exportSQLiteOut   = exportSQLiteFlags.String("out", "place.db", "Output database file (replaced if it exists)")
+)
+
+var _ = register(exports, &command{
+	name: "sqlite",
+	help: "Export the cached dataset as an indexed SQLite database (events, users, and palette tables),\n" +
+		"e.g. for exploring with Datasette. Requires the sqlite3 command line tool.",
+	flags: exportSQLiteFlags,
+	run:   runExportSQLite,
+})
+
+const sqliteSchema = `
+PRAGMA journal_mode = OFF;
+PRAGMA synchronous = OFF;
+CREATE TABLE palette (
+	color INTEGER PRIMARY KEY,
+	hex   TEXT NOT NULL,
+	name  TEXT NOT NULL
+);
+CREATE TABLE users (
+	id   INTEGER PRIMARY KEY,
+	hash TEXT NOT NULL UNIQUE
+);
+CREATE TABLE events (
+	ts          TEXT NOT NULL,
+	unix_millis INTEGER NOT NULL,
+	user_id     INTEGER NOT NULL REFERENCES users(id),
+	x           INTEGER NOT NULL,
+	y           INTEGER NOT NULL,
+	color       INTEGER NOT NULL REFERENCES palette(color)
+);
+`
+
+// sqliteIndexes are created after the data is inserted, which is much faster than maintaining them.
+const sqliteIndexes = `
+CREATE INDEX events_by_time ON events (unix_millis);
+CREATE INDEX events_by_pixel ON events (x, y, unix_millis);
+CREATE INDEX events_by_user ON events (user_id, unix_millis);
+CREATE INDEX events_by_color ON events (color);
+`
+
+// sqliteBatch is the number of rows in each INSERT statement.
+const sqliteBatch = 500
+
+func runExportSQLite(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", args)
+	}
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		return fmt.Errorf("SQLite export requires sqlite3: %w", err)
+	}
+	if err := ensureDataset(ctx); err != nil {
+		return err
+	}
+
+	out := *exportSQLiteOut
+	if err := os.Remove(out); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("replacing output: %w", err) // contains filename
+	}
+
+	start := time.Now()
+	stderr := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, sqlite3, "-batch", "-bail", out)
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("sqlite3 stdin: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting sqlite3: %w", err)
+	}
+
+	exported, err := writeSQLite(ctx, stdin)
+	if err != nil {
+		stdin.Close()
+		cmd.Wait()
+		os.Remove(out)
+		return fmt.Errorf("writing to sqlite3: %w: %s", err, stderr)
+	}
+	if err := stdin.Close(); err != nil {
+		return fmt.Errorf("closing sqlite3 input: %w", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		os.Remove(out)
+		return fmt.Errorf("sqlite3: %w: %s", err, stderr)
+	}
+	glog.Infof("Exported %s events to %s in %s",
+		progress.FormatCount(exported), out, time.Since(start).Truncate(time.Second))
+	return nil
+}
+
+// writeSQLite writes the SQL statements that build the database to w.
+func writeSQLite(ctx context.Context, w io.Writer) (exported int64, err error) {
+	buf := bufio.NewWriterSize(w, 1<<16)
+	buf.WriteString(sqliteSchema)
+
+	buf.WriteString("BEGIN;\n")
+	writeSQLitePalette(buf)
+
+	users := make(map[[16]byte]int)
+	var (
+		rows  []byte   // the pending multi-row INSERT
+		hash  [24]byte // base64 of a 16-byte hash
+		batch int
+	)
+	flush := func() error {
+		if batch == 0 {
+			return nil
+		}
+		rows = append(rows, ";\n"...)
+		_, err := buf.Write(rows)
+		rows, batch = rows[:0], 0
+		return err
+	}
+	if err := dataset.Scan(ctx, datasetFile(), func(rec dataset.Record) error {
+		id, ok := users[rec.UserHash]
+		if !ok {
+			id = len(users) + 1
+			users[rec.UserHash] = id
+			base64.StdEncoding.Encode(hash[:], rec.UserHash[:])
+			fmt.Fprintf(buf, "INSERT INTO users VALUES (%d, '%s');\n", id, hash[:])
+		}
+
+		if batch == 0 {
+			rows = append(rows, "INSERT INTO events VALUES\n("...)
+		} else {
+			rows = append(rows, ",\n("...)
+		}
+		rows = append(rows, '\'')
+		rows = rec.Time().AppendFormat(rows, "2006-01-02 15:04:05.000")
+		rows = append(rows, "',"...)
+		rows = strconv.AppendInt(rows, rec.UnixMillis, 10)
+		rows = append(rows, ',')
+		rows = strconv.AppendInt(rows, int64(id), 10)
+		rows = append(rows, ',')
+		rows = strconv.AppendInt(rows, int64(rec.X), 10)
+		rows = append(rows, ',')
+		rows = strconv.AppendInt(rows, int64(rec.Y), 10)
+		rows = append(rows, ',')
+		rows = strconv.AppendUint(rows, uint64(rec.Color), 10)
+		rows = append(rows, ')')
+		exported++
+		if batch++; batch == sqliteBatch {
+			return flush()
+		}
+		return nil
+	}); err != nil {
+		return exported, err
+	}
+	if err := flush(); err != nil {
+		return exported, err
+	}
+	buf.WriteString("COMMIT;\n")
+	buf.WriteString(sqliteIndexes)
+	buf.WriteString("ANALYZE;\n")
+	return exported, buf.Flush()
+}
+
+// writeSQLitePalette writes the statements that fill in the palette table to w.
+// The color names can come from a --source-config, so they are quoted as SQL strings.
+func writeSQLitePalette(w io.Writer) {
+	for i := range dataset.Palette {
+		fmt.Fprintf(w, "INSERT INTO palette VALUES (%d, %s, %s);\n",
+			i, sqlQuote(dataset.ColorHex(uint8(i))), sqlQuote(dataset.ColorName(uint8(i))))
+	}
+}
+
+// sqlQuote returns s as an SQL string literal.
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/rplacemap/dataset"
+)
+
+func TestSQLQuote(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", "''"},
+		{"White", "'White'"},
+		{"Reddit's Orange", "'Reddit''s Orange'"},
+		{"'); DROP TABLE events; --", "'''); DROP TABLE events; --'"},
+	}
+	for _, test := range tests {
+		if got := sqlQuote(test.in); got != test.want {
+			t.Errorf("sqlQuote(%q) = %s, want %s", test.in, got, test.want)
+		}
+	}
+}
+
+func TestWriteSQLitePalette(t *testing.T) {
+	src := &dataset.Source{
+		Name:       "quoted-names",
+		Columns:    []string{"ts", "user", "x", "y", "color"},
+		Palette:    []string{"#FFFFFF", "#FF4500"},
+		ColorNames: []string{"White", "Reddit's Orange"},
+	}
+	if err := dataset.RegisterSource(src); err != nil {
+		t.Fatalf("RegisterSource: %s", err)
+	}
+	src.Use()
+	defer dataset.Source2017.Use()
+
+	var buf bytes.Buffer
+	buf.WriteString(sqliteSchema)
+	writeSQLitePalette(&buf)
+	if !strings.Contains(buf.String(), `(1, '#FF4500', 'Reddit''s Orange');`) {
+		t.Errorf("writeSQLitePalette wrote:\n%s\nwant the name quoted", buf.String())
+	}
+
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skipf("checking the statements requires sqlite3: %s", err)
+	}
+	buf.WriteString("SELECT name FROM palette WHERE color = 1;\n")
+	cmd := exec.Command(sqlite3, "-batch", "-bail", filepath.Join(t.TempDir(), "palette.db"))
+	cmd.Stdin = &buf
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("sqlite3: %s: %s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n") // after the output of the PRAGMAs
+	if got, want := lines[len(lines)-1], "Reddit's Orange"; got != want {
+		t.Errorf("palette name = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sqlDB = serveFlags.String("sql-db", "", "Database built by `export sqlite` to serve read-only queries against at /api/sql (requires sqlite3)")
+
+const (
+	// sqlMaxRows is the default (and maximum) number of rows returned by /api/sql.
+	sqlMaxRows = 1000
+
+	// sqlTimeout bounds how long each query may run.
+	sqlTimeout = 10 * time.Second
+
+	// sqlMaxOutput bounds the size of each query's results.
+	sqlMaxOutput = 8 << 20
+
+	// sqlConcurrency limits how many queries run at once.
+	sqlConcurrency = 4
+)
+
+var errTooMuchOutput = errors.New("query results are too large")
+
+// sqlHandler serves read-only SQL queries (in the q parameter) against the database,
+// using the sqlite3 command line tool in its read-only and safe modes.
+// The results are a JSON array of rows, each an object keyed by column name.
+func sqlHandler(db string) (http.HandlerFunc, error) {
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		return nil, fmt.Errorf("serving SQL requires sqlite3: %w", err)
+	}
+	if _, err := os.Stat(db); err != nil {
+		return nil, err
+	}
+
+	slots := make(chan struct{}, sqlConcurrency)
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := strings.TrimRight(strings.TrimSpace(r.FormValue("q")), "; \t\n")
+		switch {
+		case query == "":
+			http.Error(w, "missing query (q)", http.StatusBadRequest)
+			return
+		case strings.HasPrefix(query, "."):
+			http.Error(w, "only SQL queries are supported", http.StatusBadRequest)
+			return
+		case strings.Contains(query, ";"):
+			http.Error(w, "only a single statement is supported", http.StatusBadRequest)
+			return
+		case strings.Contains(query, "--") || strings.Contains(query, "/*"):
+			// A comment could hide the rest of the wrapping query (and so its LIMIT) from sqlite3.
+			http.Error(w, "comments are not supported", http.StatusBadRequest)
+			return
+		}
+		limit := sqlMaxRows
+		if s := r.FormValue("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 || n > sqlMaxRows {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", sqlMaxRows), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-r.Context().Done():
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), sqlTimeout)
+		defer cancel()
+		rows, err := runSQL(ctx, sqlite3, db, fmt.Sprintf("SELECT * FROM (\n%s\n) LIMIT %d", query, limit))
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			http.Error(w, fmt.Sprintf("query exceeded %s", sqlTimeout), http.StatusRequestTimeout)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(rows)
+	}, nil
+}
+
+// runSQL runs the query and returns its results as a JSON array.
+func runSQL(ctx context.Context, sqlite3, db, query string) (json.RawMessage, error) {
+	cmd := exec.CommandContext(ctx, sqlite3, "-readonly", "-safe", "-bail", "-json", db, query)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	out, err := io.ReadAll(io.LimitReader(stdout, sqlMaxOutput+1))
+	if err == nil && len(out) > sqlMaxOutput {
+		err = errTooMuchOutput
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	if err := cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+
+	if out = bytes.TrimSpace(out); len(out) == 0 {
+		out = []byte("[]") // no rows
+	}
+	return out, nil
+}
@@ -0,0 +1,134 @@
+package static
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hashLength is the number of hex digits of the content hash in hashed asset names.
+const hashLength = 10
+
+// ImmutableCacheControl is sent with content-hashed assets, which never change.
+const ImmutableCacheControl = "public, max-age=31536000, immutable"
+
+var (
+	// hashedName matches a content-hashed asset name, e.g. "init.0123456789.js".
+	hashedName = regexp.MustCompile(`^(.*)\.([0-9a-f]{10})(\.[^./]+)$`)
+
+	// assetRef matches a quoted reference to an asset within an HTML page.
+	assetRef = regexp.MustCompile(`(["'])/static/([^"'?#]+)(["'])`)
+)
+
+// hashedHandler serves assets, with those referenced by HTML pages also available
+// under content-hashed names that can be cached indefinitely.
+type hashedHandler struct {
+	fsys  fs.FS
+	files http.Handler
+
+	mu     sync.Mutex
+	hashes map[string]assetHash // by name
+}
+
+type assetHash struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+// hash returns the content hash of the named file, or "" if it can't be read.
+func (h *hashedHandler) hash(name string) string {
+	info, err := fs.Stat(h.fsys, name)
+	if err != nil || info.IsDir() {
+		return ""
+	}
+
+	h.mu.Lock()
+	cached, ok := h.hashes[name]
+	h.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.hash
+	}
+
+	data, err := fs.ReadFile(h.fsys, name)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	cached = assetHash{info.ModTime(), info.Size(), hex.EncodeToString(sum[:])[:hashLength]}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.hashes == nil {
+		h.hashes = make(map[string]assetHash)
+	}
+	h.hashes[name] = cached
+	return cached.hash
+}
+
+// hashedName returns the content-hashed name of the named asset, e.g. "init.0123456789.js".
+func (h *hashedHandler) hashedName(name string) (string, bool) {
+	hash := h.hash(name)
+	if hash == "" {
+		return "", false
+	}
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext, true
+}
+
+func (h *hashedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+
+	if m := hashedName.FindStringSubmatch(name); m != nil {
+		original := m[1] + m[3]
+		if h.hash(original) != m[2] {
+			http.NotFound(w, r) // a stale or bogus hash
+			return
+		}
+		w.Header().Set("Cache-Control", ImmutableCacheControl)
+		http.ServeFileFS(w, r, h.fsys, original)
+		return
+	}
+
+	if path.Ext(name) == ".html" {
+		if info, err := fs.Stat(h.fsys, name); err == nil && !info.IsDir() {
+			h.serveHTML(w, r, name, info.ModTime())
+			return
+		}
+	}
+	h.files.ServeHTTP(w, r)
+}
+
+// serveHTML serves the named page with its asset references replaced by their content-hashed names.
+func (h *hashedHandler) serveHTML(w http.ResponseWriter, r *http.Request, name string, modTime time.Time) {
+	page, err := fs.ReadFile(h.fsys, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page = assetRef.ReplaceAllFunc(page, func(ref []byte) []byte {
+		m := assetRef.FindSubmatch(ref)
+		asset := string(m[2])
+		if path.Ext(asset) == ".html" {
+			return ref
+		}
+		hashed, ok := h.hashedName(asset)
+		if !ok {
+			return ref
+		}
+		return []byte(string(m[1]) + "/static/" + hashed + string(m[3]))
+	})
+
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, name, modTime, bytes.NewReader(page))
+}
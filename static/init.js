@@ -1,12 +1,35 @@
+// A static export of the site (see `rplacemap export site`) sets rplacemapSite
+// to point at its pre-rendered tiles; otherwise they come from the server,
+// which describes the canvas at /api/canvas.
+const site = window.rplacemapSite || {};
+
 const map = L.map('map').setView([0,0], 0);
 
-L.tileLayer('/tiles/{x}_{y}_z{z}_{tileSize}x{tileSize}.png', {
-    maxZoom: 10,
-    tileSize: 256,
-    zoomOffset: 0,
-    // bounds: L.latLngBounds(
-    //   L.latLng(-1001, -1001),
-    //   L.latLng(1001, 1001),
-    // ),
-    //noWrap: true,
-}).addTo(map);
+const canvas = site.tileRoot
+    ? Promise.resolve({})
+    : fetch('/api/canvas').then(resp => resp.ok ? resp.json() : {}).catch(() => ({}));
+
+canvas.then(canvas => {
+    const tileSize = canvas.tile_size || 256;
+    // The server renders tiles at the display's density, so they stay crisp on high-DPI screens.
+    const dpr = Math.round(window.devicePixelRatio || 1);
+    const params = new URLSearchParams();
+    if (!site.tileRoot && dpr > 1) params.set('dpr', dpr);
+    // An uploaded dataset (see /api/datasets) is shown with ?dataset=<name>&key=<key>.
+    const page = new URLSearchParams(window.location.search);
+    const dataset = page.get('dataset');
+    if (!site.tileRoot && dataset) params.set('key', page.get('key') || '');
+    const query = params.toString() ? '?' + params : '';
+    const tileRoot = site.tileRoot || (dataset ? '/datasets/' + encodeURIComponent(dataset) + '/tiles/' : '/tiles/');
+    L.tileLayer(tileRoot + '{x}_{y}_z{z}_{tileSize}x{tileSize}.png' + query, {
+        maxZoom: canvas.max_zoom || 10,
+        maxNativeZoom: site.maxNativeZoom,
+        tileSize: tileSize,
+        zoomOffset: 0,
+        // bounds: L.latLngBounds(
+        //   L.latLng(-1001, -1001),
+        //   L.latLng(1001, 1001),
+        // ),
+        //noWrap: true,
+    }).addTo(map);
+});
@@ -0,0 +1,82 @@
+package static
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+)
+
+// Overlay returns a filesystem in which the files of upper shadow those of lower,
+// e.g. to customize some of the builtin assets.
+// Directories present in both are merged.
+func Overlay(upper, lower fs.FS) fs.FS {
+	return overlay{upper, lower}
+}
+
+type overlay struct {
+	upper, lower fs.FS
+}
+
+func (o overlay) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.lower.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil || !info.IsDir() {
+		return f, err
+	}
+	if lower, err := fs.Stat(o.lower, name); err != nil || !lower.IsDir() {
+		return f, nil
+	}
+	return &overlayDir{File: f, fsys: o, name: name}, nil
+}
+
+// overlayDir is a directory present in both layers of an overlay.
+type overlayDir struct {
+	fs.File
+	fsys    overlay
+	name    string
+	entries []fs.DirEntry // remaining, once read
+	read    bool
+}
+
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		d.read = true
+		seen := make(map[string]bool)
+		for _, layer := range []fs.FS{d.fsys.upper, d.fsys.lower} {
+			entries, err := fs.ReadDir(layer, d.name)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if !seen[e.Name()] {
+					seen[e.Name()] = true
+					d.entries = append(d.entries, e)
+				}
+			}
+		}
+		sort.Slice(d.entries, func(i, j int) bool {
+			return d.entries[i].Name() < d.entries[j].Name()
+		})
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
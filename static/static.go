@@ -1,10 +1,14 @@
+// Package static holds the frontend assets of the map.
 package static
 
 import (
 	"embed"
+	"errors"
+	"fmt"
 	"io/fs"
 	"net/http"
 	"os"
+	"path/filepath"
 
 	"github.com/golang/glog"
 )
@@ -12,13 +16,58 @@ import (
 //go:embed *
 var fromBuiltin embed.FS
 
-var fromFilesystem = os.DirFS("./static")
-
-func Handler(dev bool) http.Handler {
-	var files fs.FS = fromBuiltin
+// Files returns the frontend assets, from the ./static directory instead of the binary if dev is set.
+func Files(dev bool) fs.FS {
 	if dev {
-		glog.V(1).Infof("Using assets from filesystem")
-		files = fromFilesystem
+		return Dir("./static")
 	}
-	return http.StripPrefix("/static", http.FileServer(http.FS(files)))
+	return fromBuiltin
+}
+
+// Dir returns the frontend assets from dir instead of the binary, e.g. to work on them without rebuilding.
+//
+// Requests for builtin assets that are missing from dir are logged,
+// since that usually means that dir is not the right directory.
+func Dir(dir string) fs.FS {
+	glog.V(1).Infof("Using assets from %s", dir)
+	return devDir{dir, os.DirFS(dir)}
+}
+
+// CheckDir returns an error if dir does not look like a directory of frontend assets.
+func CheckDir(dir string) error {
+	if _, err := fs.Stat(os.DirFS(dir), "index.html"); err != nil {
+		abs, _ := filepath.Abs(dir)
+		return fmt.Errorf("%s does not contain the frontend assets (it has no index.html): %w", abs, err)
+	}
+	return nil
+}
+
+type devDir struct {
+	dir string
+	fs.FS
+}
+
+func (d devDir) Open(name string) (fs.File, error) {
+	f, err := d.FS.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, builtin := fs.Stat(fromBuiltin, name); builtin == nil {
+			glog.Warningf("Builtin asset %q is missing from %s; is it the static directory of the source tree?", name, d.dir)
+		}
+	}
+	return f, err
+}
+
+func Handler(dev bool) http.Handler {
+	return FSHandler(Files(dev))
+}
+
+// FSHandler serves the assets in fsys under /static/.
+//
+// Assets referenced from HTML pages as "/static/name.ext" are rewritten to content-hashed
+// names such as "/static/name.0123456789.ext", which are served with ImmutableCacheControl.
+func FSHandler(fsys fs.FS) http.Handler {
+	return http.StripPrefix("/static", &hashedHandler{
+		fsys:  fsys,
+		files: http.FileServer(http.FS(fsys)),
+	})
 }
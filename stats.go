@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+var statsFlags = flag.NewFlagSet("stats", flag.ExitOnError)
+
+var _ = register(commands, &command{
+	name:  "stats",
+	help:  "Print summary statistics about the cached dataset.",
+	flags: statsFlags,
+	run:   runStats,
+})
+
+func runStats(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", args)
+	}
+
+	records, err := loadCachedRecords(ctx)
+	if err != nil {
+		return err
+	}
+
+	sum := newSummary()
+	for _, rec := range records {
+		sum.add(rec)
+	}
+	if sum.records == 0 {
+		return fmt.Errorf("dataset is empty")
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	sum.print(tw)
+	return tw.Flush()
+}
+
+// A summary accumulates statistics about a stream of records.
+type summary struct {
+	records     int64
+	users       map[[16]byte]bool
+	colors      [16]int64
+	first, last int64 // UnixMillis
+	bounds      image.Rectangle
+}
+
+func newSummary() *summary {
+	return &summary{
+		users: make(map[[16]byte]bool),
+	}
+}
+
+func (s *summary) add(rec dataset.Record) {
+	if s.records == 0 || rec.UnixMillis < s.first {
+		s.first = rec.UnixMillis
+	}
+	if s.records == 0 || rec.UnixMillis > s.last {
+		s.last = rec.UnixMillis
+	}
+	pixel := image.Rect(int(rec.X), int(rec.Y), int(rec.X)+1, int(rec.Y)+1)
+	if s.records == 0 {
+		s.bounds = pixel
+	} else {
+		s.bounds = s.bounds.Union(pixel)
+	}
+
+	s.records++
+	s.users[rec.UserHash] = true
+	if int(rec.Color) < len(s.colors) {
+		s.colors[rec.Color]++
+	}
+}
+
+// print writes the summary to a tabwriter.
+func (s *summary) print(w io.Writer) {
+	first := time.UnixMilli(s.first).UTC()
+	last := time.UnixMilli(s.last).UTC()
+
+	fmt.Fprintf(w, "Records:\t%s\n", progress.FormatCount(s.records))
+	fmt.Fprintf(w, "Users:\t%s\n", progress.FormatCount(int64(len(s.users))))
+	fmt.Fprintf(w, "Canvas:\t%dx%d (pixels %v)\n", s.bounds.Dx(), s.bounds.Dy(), s.bounds)
+	fmt.Fprintf(w, "First:\t%s\n", first.Format(time.RFC3339))
+	fmt.Fprintf(w, "Last:\t%s\n", last.Format(time.RFC3339))
+	fmt.Fprintf(w, "Duration:\t%s\n", last.Sub(first))
+	fmt.Fprintf(w, "Placements by color:\t\n")
+	for i, count := range s.colors {
+		fmt.Fprintf(w, "  %2d %s %-11s\t%s\n", i, dataset.ColorHex(uint8(i)), dataset.ColorName(uint8(i)), progress.FormatCount(count))
+	}
+}
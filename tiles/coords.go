@@ -0,0 +1,47 @@
+package tiles
+
+import (
+	"image"
+	"math"
+)
+
+// The map uses Leaflet's default (Web Mercator) projection, in which zoom level 0 is
+// a single DefaultTileSize tile spanning the whole world, and tile pixels cover
+// GlobalScale canvas pixels at zoom 0 (halving with each zoom level), wrapping around
+// every CanvasSize canvas pixels. The world of a larger canvas is larger (see WorldSize),
+// and its tile pixels cover proportionally more canvas pixels.
+
+// LatLngToPixel returns the canvas pixel at the given map coordinates.
+// The result is wrapped into the canvas horizontally, but is outside of it
+// vertically beyond the latitude limits of the projection.
+func LatLngToPixel(lat, lng float64) image.Point {
+	x := (lng + 180) / 360
+	sin := math.Sin(lat * math.Pi / 180)
+	y := 0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)
+
+	size := WorldSize()
+	px := int(math.Floor(x * float64(size)))
+	py := int(math.Floor(y * float64(size)))
+	return image.Pt(((px%size)+size)%size, py)
+}
+
+// PixelToLatLng returns the map coordinates of the center of the canvas pixel.
+func PixelToLatLng(p image.Point) (lat, lng float64) {
+	size := float64(WorldSize())
+	x := (float64(p.X) + 0.5) / size
+	y := (float64(p.Y) + 0.5) / size
+
+	lng = x*360 - 180
+	lat = (2*math.Atan(math.Exp(math.Pi*(1-2*y))) - math.Pi/2) * 180 / math.Pi
+	return lat, lng
+}
+
+// PixelToTile returns the size×size tile at zoom level z which covers the canvas pixel,
+// and the position within the tile of the (first) tile pixel covering it.
+func PixelToTile(p image.Point, z, size int) (tile, offset image.Point) {
+	// Tile pixel t shows canvas pixel t*scale>>z, as in window.At.
+	scale := WorldSize() / DefaultTileSize
+	world := image.Pt(p.X<<z/scale, p.Y<<z/scale)
+	tile = image.Pt(world.X/size, world.Y/size)
+	return tile, world.Sub(tile.Mul(size))
+}
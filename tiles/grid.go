@@ -0,0 +1,69 @@
+package tiles
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrStaleGrid is returned by LoadGrid if the cached grid was computed from a different dataset.
+var ErrStaleGrid = errors.New("cached tile grid is stale")
+
+// gridFile is the on-disk form of a flattened canvas.
+type gridFile struct {
+	Version string // identifies the dataset the grid was computed from
+	Pixels  [][]uint8
+}
+
+// SaveGrid writes a flattened canvas to filename, tagged with the version of the dataset it came from.
+func SaveGrid(filename, version string, pixels [][]uint8) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("creating grid file: %w", err) // contains filename
+	}
+	defer os.Remove(tmp) // no-op after rename
+	defer f.Close()      // double close OK
+
+	buf := bufio.NewWriter(f)
+	if err := gob.NewEncoder(buf).Encode(gridFile{version, pixels}); err != nil {
+		return fmt.Errorf("encoding grid: %w", err)
+	}
+	if err := buf.Flush(); err != nil {
+		return fmt.Errorf("flushing grid to %q: %w", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing grid file: %w", err) // contains filename
+	}
+	return os.Rename(tmp, filename)
+}
+
+// LoadGrid reads a flattened canvas written by SaveGrid,
+// returning ErrStaleGrid if it was not computed from the given version of the dataset.
+func LoadGrid(filename, version string) ([][]uint8, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("opening grid file: %w", err) // contains filename
+	}
+	defer f.Close() // no data to flush
+
+	var grid gridFile
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&grid); err != nil {
+		return nil, fmt.Errorf("decoding grid from %q: %w", filename, err)
+	}
+	if grid.Version != version {
+		return nil, fmt.Errorf("%q has version %q, want %q: %w", filename, grid.Version, version, ErrStaleGrid)
+	}
+	size := WorldSize()
+	if len(grid.Pixels) != size {
+		return nil, fmt.Errorf("%q has %d rows, want %d", filename, len(grid.Pixels), size)
+	}
+	for i, row := range grid.Pixels {
+		if len(row) != size {
+			return nil, fmt.Errorf("%q row %d has %d columns, want %d", filename, i, len(row), size)
+		}
+	}
+	return grid.Pixels, nil
+}
@@ -1,3 +1,4 @@
+// Package tiles renders and serves map tiles of the final state of the canvas (or of it at some time, see Canvas).
 package tiles
 
 import (
@@ -6,36 +7,70 @@ import (
 	"image"
 	"image/color"
 	"image/png"
+	"math"
 	"net/http"
 	"regexp"
+	"strconv"
+	"sync"
 
 	"github.com/golang/glog"
 
 	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
 )
 
+// CanvasSize is the width and height of the map's world for the 2017 canvas, and the smallest for any canvas:
+// zoom level 0 is a DefaultTileSize tile covering it, so each tile pixel covers GlobalScale canvas pixels.
+// Larger canvases have larger worlds (see GridSize).
 const CanvasSize = 1024
 
+// GridSize returns the width and height of the flattened canvas (and of the map's world) for a width×height
+// canvas: CanvasSize, doubled until it covers the canvas.
+func GridSize(width, height int) int {
+	size := CanvasSize
+	for size < width || size < height {
+		size *= 2
+	}
+	return size
+}
+
+// WorldSize returns the GridSize of the canvas in use (see dataset.CanvasBounds).
+func WorldSize() int {
+	b := dataset.CanvasBounds()
+	return GridSize(b.Dx(), b.Dy())
+}
+
 type tileData struct {
-	ready  chan struct{}
-	pixels [][]uint8
+	pixels *gsync.Future[[][]uint8]
+
+	mu sync.RWMutex // guards the contents of pixels, if they are being updated
 }
 
-func (d *tileData) init(records []dataset.Record) {
-	defer close(d.ready)
+// Flatten computes the final state of each pixel of the canvas in use, which is what tiles display.
+// The flattened canvas is WorldSize square.
+func Flatten(records []dataset.Record) ([][]uint8, error) {
+	pixels, err := flatten(records, WorldSize())
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("Tile data ready")
+	return pixels, nil
+}
 
-	pixels := make([][]uint8, CanvasSize)
+// flatten flattens the records onto a size×size grid.
+func flatten(records []dataset.Record, size int) ([][]uint8, error) {
+	pixels := make([][]uint8, size)
 	for r := range pixels {
-		pixels[r] = make([]uint8, CanvasSize)
+		pixels[r] = make([]uint8, size)
 	}
 
 	for _, rec := range records {
+		if rec.X < 0 || int(rec.X) >= size || rec.Y < 0 || int(rec.Y) >= size {
+			return nil, fmt.Errorf("pixel (%d,%d) is outside the %dpx canvas", rec.X, rec.Y, size)
+		}
 		pixels[int(rec.Y)][int(rec.X)] = rec.Color
 	}
-
-	d.pixels = pixels
-
-	glog.Infof("Tile data ready")
+	return pixels, nil
 }
 
 type window struct {
@@ -43,6 +78,7 @@ type window struct {
 	TileX, TileY          int
 	TileWidth, TileHeight int
 	PixelScale            int
+	Palette               color.Palette
 }
 
 func (w window) ColorModel() color.Model {
@@ -64,25 +100,52 @@ func clamp(v, max int) int {
 	return v
 }
 
-const GlobalScale = 4
+// GlobalScale is how many canvas pixels each tile pixel covers at zoom level 0 in the CanvasSize world.
+// Larger worlds (see GridSize) scale up with their size.
+const GlobalScale = CanvasSize / DefaultTileSize
 
 func (w window) At(x, y int) color.Color {
-	pX := x * GlobalScale / w.PixelScale
-	pY := y * GlobalScale / w.PixelScale
+	size := len(w.PixelData)
+	scale := size / DefaultTileSize
+	pX := x * scale / w.PixelScale
+	pY := y * scale / w.PixelScale
 
-	idx := w.PixelData[pY%CanvasSize][pX%CanvasSize]
-	return dataset.Palette[idx]
+	idx := w.PixelData[pY%size][pX%size]
+	return w.Palette[idx]
 }
 
 var _ image.Image = new(window)
 
 var tilePath = regexp.MustCompile(`^/tiles/(\d+)_(\d+)_z(\d+)_(\d+)x(\d+).png$`)
 
+// xyzPath matches the standard {z}/{x}/{y} tile scheme used by GIS tools,
+// with y counting down from the top (xyz) or up from the bottom (tms).
+var xyzPath = regexp.MustCompile(`^/tiles/(xyz|tms)/(\d+)/(\d+)/(\d+)\.png$`)
+
+// MaxZoom is the deepest zoom level served in the xyz and tms schemes,
+// at which each canvas pixel is 256 tile pixels wide.
+const MaxZoom = 10
+
 func (d *tileData) Handle(rw http.ResponseWriter, r *http.Request) {
-	select {
-	case <-d.ready:
-	case <-r.Context().Done():
-		http.Error(rw, "not ready", http.StatusServiceUnavailable)
+	palette, err := dataset.PaletteVariant(r.FormValue("palette"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dpr, err := requestDPR(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.Header().Add("Vary", "Sec-CH-DPR, DPR") // which browsers send once asked to by the page (see AcceptCH)
+	pixels, err := d.pixels.Wait(r.Context())
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	if m := xyzPath.FindStringSubmatch(r.URL.Path); m != nil {
+		d.handleXYZ(rw, r, pixels, palette, dpr, m)
 		return
 	}
 
@@ -109,33 +172,267 @@ func (d *tileData) Handle(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	// The zoom and size come straight from the URL, so they're limited before anything is allocated for them.
+	if err := checkTile(z, w, h, dpr); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	d.writePNG(rw, ScaledTile(pixels, x, y, z, w, h, dpr, palette))
+}
+
+// handleXYZ serves DefaultTileSize tiles in the xyz or tms scheme.
+// Zoom level 0 is a single tile covering the whole canvas, and each level doubles the tiles in each direction.
+// Unlike the map's own tiles, these don't wrap around: tiles outside the canvas are not found.
+func (d *tileData) handleXYZ(rw http.ResponseWriter, r *http.Request, pixels [][]uint8, palette color.Palette, dpr int, m []string) {
+	glog.V(1).Infof("Serving %q", r.URL.Path)
+
+	var z, x, y int
+	for _, parse := range []struct {
+		ptr *int
+		str string
+	}{
+		{&z, m[2]},
+		{&x, m[3]},
+		{&y, m[4]},
+	} {
+		if _, err := fmt.Sscan(parse.str, parse.ptr); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if z > MaxZoom {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	}
+	if n := 1 << z; x >= n || y >= n {
+		http.Error(rw, "not found", http.StatusNotFound)
+		return
+	}
+	if m[1] == "tms" {
+		y = 1<<z - 1 - y
+	}
+
+	d.writePNG(rw, ScaledTile(pixels, x, y, z, DefaultTileSize, DefaultTileSize, dpr, palette))
+}
 
-	win := &window{
-		PixelData:  d.pixels,
+// DefaultTileSize is the width and height of the tiles requested by the map.
+const DefaultTileSize = 256
+
+// Tile returns the w×h tile at (x, y) for zoom level z of the flattened canvas,
+// as served at /tiles/{x}_{y}_z{z}_{w}x{h}.png.
+func Tile(pixels [][]uint8, x, y, z, w, h int) image.Image {
+	return TileWithPalette(pixels, x, y, z, w, h, dataset.Palette)
+}
+
+// TileWithPalette is like Tile, but draws with the given palette (e.g. one of dataset.PaletteVariants),
+// as served with the palette parameter.
+func TileWithPalette(pixels [][]uint8, x, y, z, w, h int, palette color.Palette) image.Image {
+	return ScaledTile(pixels, x, y, z, w, h, 1, palette)
+}
+
+// ScaledTile is like TileWithPalette, but rendered at dpr times the density for high-DPI displays:
+// the image is dpr*w × dpr*h, covering the same part of the canvas.
+func ScaledTile(pixels [][]uint8, x, y, z, w, h, dpr int, palette color.Palette) image.Image {
+	return &window{
+		PixelData:  pixels,
 		TileX:      x,
 		TileY:      y,
-		TileWidth:  w,
-		TileHeight: h,
-		PixelScale: 1 << z,
+		TileWidth:  w * dpr,
+		TileHeight: h * dpr,
+		PixelScale: (1 << z) * dpr,
+		Palette:    palette,
+	}
+}
+
+// TileCoords identifies a tile, as in /tiles/{X}_{Y}_z{Z}_{w}x{h}.png.
+type TileCoords struct {
+	X, Y, Z int
+}
+
+// TileOptions configures RenderTile.
+type TileOptions struct {
+	Size    int           // width and height (default: DefaultTileSize), up to MaxTileSize
+	DPR     int           // device pixel ratio (default: 1), up to MaxDPR
+	Palette color.Palette // default: the dataset's
+}
+
+// MaxTileSize is the largest width or height of a tile (before it is scaled by the device pixel ratio).
+const MaxTileSize = 1024
+
+// checkTile returns an error unless a w×h tile at zoom level z can be rendered at the device pixel ratio.
+func checkTile(z, w, h, dpr int) error {
+	switch {
+	case z < 0 || z > MaxZoom:
+		return fmt.Errorf("zoom level %d out of range (0-%d)", z, MaxZoom)
+	case w <= 0 || w > MaxTileSize || h <= 0 || h > MaxTileSize:
+		return fmt.Errorf("tile size %dx%d out of range (1-%d)", w, h, MaxTileSize)
+	case dpr < 1 || dpr > MaxDPR:
+		return fmt.Errorf("device pixel ratio %d out of range (1-%d)", dpr, MaxDPR)
+	}
+	return nil
+}
+
+// RenderTile renders a tile of the final state of the dataset, drawn with its palette, as ScaledTile would for the
+// flattened canvas. It has no side effects, so the same dataset, coordinates, and options always
+// render the same image (e.g. for comparing against golden images).
+//
+// The zoom level must be at most MaxZoom, the size at most MaxTileSize, and the DPR at most MaxDPR.
+func RenderTile(ds *dataset.Dataset, coords TileCoords, opts TileOptions) (image.Image, error) {
+	if opts.Size == 0 {
+		opts.Size = DefaultTileSize
+	}
+	if opts.DPR == 0 {
+		opts.DPR = 1
+	}
+	if err := checkTile(coords.Z, opts.Size, opts.Size, opts.DPR); err != nil {
+		return nil, err
+	}
+	if opts.Palette == nil {
+		opts.Palette = ds.Palette
+	}
+	if opts.Palette == nil {
+		opts.Palette = dataset.Palette
+	}
+	b := ds.Bounds()
+	pixels, err := flatten(ds.Records, GridSize(b.Dx(), b.Dy()))
+	if err != nil {
+		return nil, err
+	}
+	return ScaledTile(pixels, coords.X, coords.Y, coords.Z, opts.Size, opts.Size, opts.DPR, opts.Palette), nil
+}
+
+// A Canvas is the flattened canvas (as tiles display it) at some point in its history,
+// which can be moved to other times to render tiles of the canvas as it was then.
+// It's WorldSize square, like the canvas served by GridHandler, and isn't safe for concurrent use.
+type Canvas struct {
+	records []dataset.Record // sorted by time
+	pixels  [][]uint8
+	next    int   // index of the first record which isn't applied
+	at      int64 // UnixMillis which the canvas is at
+}
+
+// NewCanvas returns the canvas of the records (sorted by time) as it was before the first of them.
+func NewCanvas(records []dataset.Record) *Canvas {
+	c := &Canvas{records: records}
+	c.reset()
+	return c
+}
+
+func (c *Canvas) reset() {
+	size := WorldSize()
+	c.pixels = make([][]uint8, size)
+	for r := range c.pixels {
+		c.pixels[r] = make([]uint8, size)
+	}
+	c.next, c.at = 0, math.MinInt64
+}
+
+// MoveTo moves the canvas to the given time (in UnixMillis), after the records up to and including it.
+// Moving forward only applies the records in between, but moving back starts over from the beginning.
+func (c *Canvas) MoveTo(unixMillis int64) {
+	if unixMillis < c.at {
+		c.reset()
+	}
+	c.at = unixMillis
+	size := len(c.pixels)
+	for ; c.next < len(c.records) && c.records[c.next].UnixMillis <= unixMillis; c.next++ {
+		rec := c.records[c.next]
+		if x, y := int(rec.X), int(rec.Y); x >= 0 && x < size && y >= 0 && y < size {
+			c.pixels[y][x] = rec.Color
+		}
 	}
-	writePNG(rw, win)
 }
 
-func Handler(records chan []dataset.Record) http.HandlerFunc {
+// Tile renders a tile of the canvas, as ScaledTile would (after checking the zoom, size, and DPR, as the tiles handler does).
+// The image refers to the canvas, so it must be drawn (e.g. encoded) before the canvas is moved.
+func (c *Canvas) Tile(x, y, z, size, dpr int, palette color.Palette) (image.Image, error) {
+	if err := checkTile(z, size, size, dpr); err != nil {
+		return nil, err
+	}
+	return ScaledTile(c.pixels, x, y, z, size, size, dpr, palette), nil
+}
+
+// MaxDPR is the highest device pixel ratio at which tiles are rendered.
+const MaxDPR = 4
+
+// AcceptCH is the Accept-CH header with which pages ask browsers to send the client hints
+// that tiles are rendered for, with their requests for tiles.
+const AcceptCH = "Sec-CH-DPR, DPR"
+
+// requestDPR returns the device pixel ratio requested by the dpr parameter or,
+// failing that, the Sec-CH-DPR (or older DPR) client hint, rounded and limited to 1-MaxDPR.
+// Invalid hints are ignored, but an invalid parameter is an error.
+func requestDPR(r *http.Request) (int, error) {
+	if s := r.FormValue("dpr"); s != "" {
+		dpr, ok := parseDPR(s)
+		if !ok {
+			return 0, fmt.Errorf("dpr: %q is not a positive number", s)
+		}
+		return dpr, nil
+	}
+	for _, hint := range []string{"Sec-CH-DPR", "DPR"} {
+		if dpr, ok := parseDPR(r.Header.Get(hint)); ok {
+			return dpr, nil
+		}
+	}
+	return 1, nil
+}
+
+func parseDPR(s string) (int, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(f > 0) {
+		return 0, false
+	}
+	return int(math.Round(min(max(f, 1), MaxDPR))), true
+}
+
+// Handler serves tiles of the final state of the canvas, as computed by Flatten.
+func Handler(records *gsync.Future[[]dataset.Record]) http.HandlerFunc {
+	return GridHandler(gsync.Map(records, Flatten))
+}
+
+// GridHandler serves tiles from an already flattened canvas.
+func GridHandler(pixels *gsync.Future[[][]uint8]) http.HandlerFunc {
+	data := &tileData{
+		pixels: pixels,
+	}
+	return data.Handle
+}
+
+// LiveGridHandler is like GridHandler, but also applies the updates to the canvas as they arrive,
+// until the updates channel is closed.
+func LiveGridHandler(pixels *gsync.Future[[][]uint8], updates <-chan dataset.Record) http.HandlerFunc {
 	data := &tileData{
-		ready: make(chan struct{}),
+		pixels: pixels,
 	}
-	go func() {
-		recs := <-records
-		data.init(recs)
-		records <- recs
-	}()
+	go data.apply(updates)
 	return data.Handle
 }
 
-func writePNG(w http.ResponseWriter, img *window) {
+func (d *tileData) apply(updates <-chan dataset.Record) {
+	pixels, err := d.pixels.Get()
+	if err != nil {
+		return
+	}
+	for rec := range updates {
+		x, y := int(rec.X), int(rec.Y)
+		if x < 0 || x >= len(pixels) || y < 0 || y >= len(pixels) || int(rec.Color) >= len(dataset.Palette) {
+			glog.V(2).Infof("Ignoring update out of range: %+v", rec)
+			continue
+		}
+		d.mu.Lock()
+		pixels[y][x] = rec.Color
+		d.mu.Unlock()
+	}
+}
+
+func (d *tileData) writePNG(w http.ResponseWriter, img image.Image) {
 	buf := new(bytes.Buffer)
-	if err := png.Encode(buf, img); err != nil {
+	d.mu.RLock()
+	err := png.Encode(buf, img)
+	d.mu.RUnlock()
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -0,0 +1,192 @@
+package tiles_test
+
+import (
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/dataset/datasettest"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/tiles"
+)
+
+// tiny returns the Tiny dataset on a canvas as large as 2017's, with an event in tile (2,3) at z4.
+func tiny(t *testing.T) *dataset.Dataset {
+	t.Helper()
+	b := datasettest.Tiny()
+	b.SetCanvasSize(1000)
+	b.AddEvent(datasettest.TinyStart.Add(time.Hour), "carol", 9, 12, 1)
+	return datasettest.Build(t, b)
+}
+
+func TestRenderTile(t *testing.T) {
+	ds := tiny(t)
+	tests := []struct {
+		name   string
+		coords tiles.TileCoords
+		opts   tiles.TileOptions
+	}{
+		{"z2", tiles.TileCoords{Z: 2}, tiles.TileOptions{Size: 16}},
+		{"z3", tiles.TileCoords{Z: 3}, tiles.TileOptions{Size: 16}},
+		{"z4-offset", tiles.TileCoords{X: 2, Y: 3, Z: 4}, tiles.TileOptions{Size: 16}},
+		{"z3-dpr2", tiles.TileCoords{Z: 3}, tiles.TileOptions{Size: 16, DPR: 2}},
+		{"z3-palette", tiles.TileCoords{Z: 3}, tiles.TileOptions{Size: 16, Palette: color.Palette{
+			color.Black, color.White, color.Gray{0x40}, color.Gray{0xC0},
+		}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			img, err := tiles.RenderTile(ds, test.coords, test.opts)
+			if err != nil {
+				t.Fatalf("RenderTile: %s", err)
+			}
+			datasettest.CheckGolden(t, "tile-"+test.name, img)
+		})
+	}
+}
+
+func TestRenderTileErrors(t *testing.T) {
+	ds := tiny(t)
+	tests := []struct {
+		name   string
+		coords tiles.TileCoords
+		opts   tiles.TileOptions
+	}{
+		{"negative zoom", tiles.TileCoords{Z: -1}, tiles.TileOptions{}},
+		{"past max zoom", tiles.TileCoords{Z: tiles.MaxZoom + 1}, tiles.TileOptions{}},
+		{"zoom 63", tiles.TileCoords{Z: 63}, tiles.TileOptions{}},
+		{"zoom 64", tiles.TileCoords{Z: 64}, tiles.TileOptions{}},
+		{"negative size", tiles.TileCoords{}, tiles.TileOptions{Size: -16}},
+		{"huge size", tiles.TileCoords{}, tiles.TileOptions{Size: tiles.MaxTileSize + 1}},
+		{"negative dpr", tiles.TileCoords{}, tiles.TileOptions{DPR: -1}},
+		{"huge dpr", tiles.TileCoords{}, tiles.TileOptions{DPR: tiles.MaxDPR + 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := tiles.RenderTile(ds, test.coords, test.opts); err == nil {
+				t.Errorf("RenderTile(%+v, %+v) succeeded, want an error", test.coords, test.opts)
+			}
+		})
+	}
+}
+
+func TestGridSize(t *testing.T) {
+	tests := []struct {
+		width, height int
+		want          int
+	}{
+		{1000, 1000, tiles.CanvasSize},
+		{1001, 1001, tiles.CanvasSize},
+		{8, 8, tiles.CanvasSize},
+		{3000, 2000, 4096},
+		{1024, 1025, 2048},
+	}
+	for _, test := range tests {
+		if got := tiles.GridSize(test.width, test.height); got != test.want {
+			t.Errorf("GridSize(%d, %d) = %d, want %d", test.width, test.height, got, test.want)
+		}
+	}
+}
+
+// TestRenderTileRectangle checks that the whole of a canvas larger than CanvasSize (like 2023's) is in the zoom 0 tile.
+func TestRenderTileRectangle(t *testing.T) {
+	var b dataset.Builder
+	b.SetCanvasBounds(3000, 2000)
+	palette := datasettest.FourColors
+	b.SetPalette(palette)
+	b.AddEvent(datasettest.TinyStart, "alice", 2992, 1984, 1) // near the corner, and sampled by a tile pixel
+	img, err := tiles.RenderTile(datasettest.Build(t, &b), tiles.TileCoords{}, tiles.TileOptions{})
+	if err != nil {
+		t.Fatalf("RenderTile: %s", err)
+	}
+	// Each tile pixel covers 4096/256 = 16 canvas pixels.
+	if got, want := img.At(2992/16, 1984/16), palette[1]; got != want {
+		t.Errorf("tile pixel covering (2992,1984) = %v, want %v", got, want)
+	}
+	if got, want := img.At(2992/16-1, 1984/16), palette[0]; got != want {
+		t.Errorf("tile pixel left of (2992,1984) = %v, want %v", got, want)
+	}
+}
+
+func TestGridHandlerLimits(t *testing.T) {
+	pixels, err := tiles.Flatten(tiny(t).Records)
+	if err != nil {
+		t.Fatalf("Flatten: %s", err)
+	}
+	future := gsync.NewFuture[[][]uint8]()
+	future.Provide(pixels)
+	handler := tiles.GridHandler(future)
+	tests := []struct {
+		path string
+		dpr  string
+		want int
+	}{
+		{"/tiles/0_0_z2_16x16.png", "", http.StatusOK},
+		{"/tiles/0_0_z2_16x16.png", "4", http.StatusOK},
+		{"/tiles/0_0_z63_16x16.png", "", http.StatusBadRequest},
+		{"/tiles/0_0_z64_16x16.png", "", http.StatusBadRequest},
+		{"/tiles/0_0_z2_100000x16.png", "", http.StatusBadRequest},
+		{"/tiles/0_0_z2_16x0.png", "", http.StatusBadRequest},
+		{"/tiles/0_0_z99999999999999999999_16x16.png", "", http.StatusBadRequest},
+		{"/tiles/xyz/11/0/0.png", "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.dpr != "" {
+			r.Header.Set("Sec-CH-DPR", test.dpr)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if got := w.Code; got != test.want {
+			t.Errorf("GET %s (DPR %q) = %d, want %d: %s", test.path, test.dpr, got, test.want, w.Body)
+		}
+	}
+}
+
+func BenchmarkRenderTile(b *testing.B) {
+	ds := &dataset.Dataset{
+		Records: datasettest.Records(datasettest.Options{Size: 1000, Users: 10000, Events: 100000}),
+		Size:    1000,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tiles.RenderTile(ds, tiles.TileCoords{X: 1, Y: 1, Z: 2}, tiles.TileOptions{}); err != nil {
+			b.Fatalf("RenderTile: %s", err)
+		}
+	}
+}
+
+func TestCanvas(t *testing.T) {
+	ds := tiny(t)
+	canvas := tiles.NewCanvas(ds.Records)
+	tests := []struct {
+		after time.Duration // TinyStart
+		want  map[[2]int]uint8
+	}{
+		{-time.Second, map[[2]int]uint8{{1, 1}: 0, {6, 2}: 0, {3, 7}: 0}},
+		{45 * time.Second, map[[2]int]uint8{{1, 1}: 1, {6, 2}: 2, {3, 7}: 0}},
+		{time.Minute, map[[2]int]uint8{{1, 1}: 3, {6, 2}: 2, {3, 7}: 0}},
+		{3 * time.Minute, map[[2]int]uint8{{1, 1}: 3, {6, 2}: 2, {3, 7}: 2}},
+		{10 * time.Second, map[[2]int]uint8{{1, 1}: 1, {6, 2}: 0, {3, 7}: 0}}, // back again
+	}
+	for _, test := range tests {
+		canvas.MoveTo(datasettest.TinyStart.Add(test.after).UnixMilli())
+		// At z2, each pixel of a tile is a pixel of the canvas.
+		img, err := canvas.Tile(0, 0, 2, tiles.DefaultTileSize, 1, datasettest.FourColors)
+		if err != nil {
+			t.Fatalf("Tile: %s", err)
+		}
+		for p, c := range test.want {
+			if got, want := img.At(p[0], p[1]), datasettest.FourColors[c]; got != want {
+				t.Errorf("at TinyStart%+v, (%d,%d) = %v, want color %d", test.after, p[0], p[1], got, c)
+			}
+		}
+	}
+	if _, err := canvas.Tile(0, 0, tiles.MaxZoom+1, tiles.DefaultTileSize, 1, nil); err == nil {
+		t.Errorf("Tile at z%d succeeded, want an error", tiles.MaxZoom+1)
+	}
+}
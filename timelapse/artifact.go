@@ -0,0 +1,45 @@
+package timelapse
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// An Artifact is an encoded render held in memory.
+//
+// It is served with http.ServeContent, so clients can resume an interrupted download
+// or seek within it with Range (and If-Range) requests.
+type Artifact struct {
+	Type    string // MIME type
+	Data    []byte
+	ModTime time.Time // when it was encoded
+	ETag    string
+}
+
+// NewArtifact returns an artifact with the encoded data, last modified now.
+func NewArtifact(ctype string, data []byte) *Artifact {
+	sum := sha256.Sum256(data)
+	return &Artifact{
+		Type:    ctype,
+		Data:    data,
+		ModTime: time.Now(),
+		ETag:    fmt.Sprintf(`"%x"`, sum[:12]),
+	}
+}
+
+// ServeHTTP serves the artifact, or the part of it which was requested.
+func (a *Artifact) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	w.Header().Set("Content-Type", a.Type)
+	w.Header().Set("ETag", a.ETag)
+	http.ServeContent(w, r, "", a.ModTime, bytes.NewReader(a.Data))
+
+	glog.Infof("Served %.2fMiB %q image (range %q) in %s",
+		float64(len(a.Data))/(1<<20), a.Type, r.Header.Get("Range"), time.Since(start).Truncate(time.Millisecond))
+}
@@ -0,0 +1,56 @@
+package timelapse
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os/exec"
+)
+
+// EncodeMP4 encodes the frames as an H.264 MP4 at 30fps using ffmpeg,
+// which must be installed and on the PATH.
+func EncodeMP4(w io.Writer, frames []*image.Paletted) error {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return fmt.Errorf("MP4 encoding requires ffmpeg: %w", err)
+	}
+
+	stderr := new(bytes.Buffer)
+	cmd := exec.Command(ffmpeg,
+		"-hide_banner", "-loglevel", "error",
+		"-f", "image2pipe", "-framerate", "30", "-i", "pipe:0",
+		"-c:v", "libx264", "-pix_fmt", "yuv420p",
+		// H.264 requires even dimensions
+		"-vf", "pad=ceil(iw/2)*2:ceil(ih/2)*2",
+		// MP4 normally requires seeking back to write the index; fragment it so it can be streamed
+		"-movflags", "frag_keyframe+empty_moov",
+		"-f", "mp4", "pipe:1",
+	)
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("ffmpeg stdin: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting ffmpeg: %w", err)
+	}
+
+	enc := &png.Encoder{CompressionLevel: png.BestSpeed}
+	for i, frame := range frames {
+		if err := enc.Encode(stdin, frame); err != nil {
+			stdin.Close()
+			cmd.Wait()
+			return fmt.Errorf("writing frame %d to ffmpeg: %w: %s", i, err, stderr)
+		}
+	}
+	if err := stdin.Close(); err != nil {
+		return fmt.Errorf("closing ffmpeg input: %w", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg: %w: %s", err, stderr)
+	}
+	return nil
+}
@@ -1,124 +1,358 @@
+// Package timelapse renders the history of the canvas as an animation.
 package timelapse
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"image"
 	"image/color"
 	"image/gif"
+	"io"
 	"net/http"
+	"runtime"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/kettek/apng"
 
 	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+	"github.com/kylelemons/rplacemap/progress"
 )
 
+// Dimension is the smallest width and height of the served timelapse, which is that of the 2017 canvas
+// (with a row and column to spare).
 const Dimension = 1001
 
-func Handler(future chan []dataset.Record) http.HandlerFunc {
-	var frames []*image.Paletted
-	ready := make(chan struct{})
+// Bounds returns the bounds of the frames of the served timelapse: at least Dimension square,
+// and covering all of the canvas in use (see dataset.CanvasBounds).
+func Bounds() image.Rectangle {
+	canvas := dataset.CanvasBounds()
+	return image.Rect(0, 0, max(canvas.Dx(), Dimension), max(canvas.Dy(), Dimension))
+}
 
-	go func() {
-		defer close(ready)
+// DefaultInterval is the amount of time aggregated into each frame of the served timelapse.
+const DefaultInterval = 10 * time.Minute
+
+// Formats lists the formats in which the served timelapse is available, by file extension.
+var Formats = []string{"apng", "gif"}
+
+// Encodings holds the served timelapse in each of the Formats.
+// Each is rendered and encoded the first time it is requested (or prerendered).
+//
+// The timelapse is also available with each of the dataset.PaletteVariants,
+// which are encoded on demand and cached separately.
+type Encodings struct {
+	rendered *gsync.Future[[]*image.Paletted]
+	formats  map[string]*gsync.Future[*Artifact]
+	variants gsync.Cache[string, *Artifact] // by format and palette
+}
 
-		records := <-future
-		future <- records
+// encoders encode the timelapse in each of the Formats.
+var encoders = map[string]func(io.Writer, []*image.Paletted) error{
+	"apng": EncodeAPNG,
+	"gif":  EncodeGIF,
+}
 
-		frames = renderFrames(records, 10*time.Minute)
-	}()
+// contentTypes are the MIME types of the Formats.
+var contentTypes = map[string]string{
+	"apng": "image/apng",
+	"gif":  "image/gif",
+}
 
-	var (
-		gifOnce sync.Once
-		gifData = new(bytes.Buffer)
+func NewEncodings(future *gsync.Future[[]dataset.Record]) *Encodings {
+	e := &Encodings{
+		rendered: gsync.Map(future, func(records []dataset.Record) ([]*image.Paletted, error) {
+			return RenderFrames(records, DefaultInterval, progress.New("Timelapse", progress.Counter)), nil
+		}),
+		formats: make(map[string]*gsync.Future[*Artifact]),
+		variants: gsync.Cache[string, *Artifact]{
+			MaxEntries: len(dataset.PaletteVariants) * len(Formats), // every variant in every format
+		},
+	}
+	for _, format := range Formats {
+		e.formats[format] = gsync.Lazy(func(ctx context.Context) (*Artifact, error) {
+			return e.encode(ctx, format, dataset.Palette)
+		})
+	}
+	return e
+}
 
-		apngOnce sync.Once
-		apngData = new(bytes.Buffer)
-	)
+// encode encodes the rendered frames in the format, drawn with the palette.
+func (e *Encodings) encode(ctx context.Context, format string, palette color.Palette) (*Artifact, error) {
+	frames, err := e.rendered.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	frames = WithPalette(frames, palette)
+	label := strings.ToUpper(format)
+	glog.Infof("Rendering %d-frame %s", len(frames), label)
+	start := time.Now()
+	buf := new(bytes.Buffer)
+	if err := encoders[format](buf, frames); err != nil {
+		glog.Errorf("Failed to encode %s: %s", label, err)
+		return nil, fmt.Errorf("encoding %s: %w", label, err)
+	}
+	glog.Infof("Rendered %d %s frames (%.2fMiB) in %s",
+		len(frames), label, float64(buf.Len())/(1<<20), time.Since(start).Truncate(time.Millisecond))
+	return NewArtifact(contentTypes[format], buf.Bytes()), nil
+}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		select {
-		case <-ready:
-		case <-r.Context().Done():
-			http.Error(w, "not ready", http.StatusServiceUnavailable)
-			return
-		}
+// WithPalette returns copies of the frames (sharing their pixels) which are drawn with the palette instead.
+func WithPalette(frames []*image.Paletted, palette color.Palette) []*image.Paletted {
+	recolored := make([]*image.Paletted, len(frames))
+	for i, frame := range frames {
+		f := *frame
+		f.Palette = palette
+		recolored[i] = &f
+	}
+	return recolored
+}
 
+// Prerender renders and encodes the timelapse in the given format, if it hasn't been already,
+// and waits for it to complete.
+func (e *Encodings) Prerender(ctx context.Context, format string) error {
+	data, ok := e.formats[format]
+	if !ok {
+		return fmt.Errorf("unknown timelapse format %q (want one of %q)", format, Formats)
+	}
+	_, err := data.Wait(ctx)
+	return err
+}
+
+// Handler serves the timelapse in the format indicated by the request's file extension.
+func (e *Encodings) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var format string
 		switch {
 		case strings.HasSuffix(r.URL.Path, ".apng"):
-			apngOnce.Do(func() {
-				glog.Infof("Rendering %d-frame APNG", len(frames))
-				writeAPNG(apngData, frames)
-			})
-			writeBuffer(w, "image/apng", apngData)
+			format = "apng"
 		case strings.HasSuffix(r.URL.Path, ".gif"):
-			gifOnce.Do(func() {
-				glog.Infof("Rendering %d-frame GIF", len(frames))
-				writeGIF(gifData, frames)
+			format = "gif"
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		name := r.FormValue("palette")
+		palette, err := dataset.PaletteVariant(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var artifact *Artifact
+		if name == "" || name == "default" {
+			artifact, err = e.formats[format].Wait(r.Context())
+		} else {
+			artifact, err = e.variants.Get(r.Context(), format+"/"+name, func(ctx context.Context) (*Artifact, error) {
+				return e.encode(ctx, format, palette)
 			})
-			writeBuffer(w, "image/gif", gifData)
 		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		artifact.ServeHTTP(w, r)
 	}
 }
 
-func writeBuffer(w http.ResponseWriter, ctype string, buf *bytes.Buffer) {
-	start := time.Now()
+func Handler(future *gsync.Future[[]dataset.Record]) http.HandlerFunc {
+	return NewEncodings(future).Handler()
+}
+
+// trailerFrames is how many times the final frame of a timelapse is repeated, to freeze on it for a little.
+const trailerFrames = 100
 
-	w.Header().Set("Content-Type", ctype)
-	w.Header().Set("Content-Length", fmt.Sprint(buf.Len()))
+// Options configures Render.
+type Options struct {
+	Interval time.Duration // of events in each frame (default: DefaultInterval)
+	Palette  color.Palette // default: the dataset's
+}
 
-	w.Write(buf.Bytes())
-	glog.Infof("Wrote %.2fMiB %q image in %s",
-		float64(buf.Len())/(1<<20), ctype, time.Since(start).Truncate(time.Millisecond))
+// Render renders the frames of a timelapse of the dataset, the size of its canvas and drawn with its palette, as RenderFrames
+// would for the full canvas. It has no side effects, so the same dataset and options always render
+// the same frames (e.g. for comparing against golden images).
+func Render(ds *dataset.Dataset, opts Options) []*image.Paletted {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	bounds := ds.Bounds()
+	if bounds.Empty() {
+		bounds = Bounds()
+	}
+	if opts.Palette == nil {
+		opts.Palette = ds.Palette
+	}
+	frames := renderFrames(ds.Records, bounds.Dx(), bounds.Dy(), opts.Interval, nil)
+	if opts.Palette != nil {
+		frames = WithPalette(frames, opts.Palette)
+	}
+	return frames
 }
 
-func renderFrames(records []dataset.Record, frameAggregation time.Duration) (frames []*image.Paletted) {
+// RenderFrames renders one frame of the served timelapse's Bounds for each frameAggregation worth of records,
+// followed by a short freeze on the final frame.
+// The records processed are reported to bar.
+func RenderFrames(records []dataset.Record, frameAggregation time.Duration, bar *progress.Bar) []*image.Paletted {
 	start := time.Now()
-	defer func() {
-		glog.Infof("Timelapse complete: rendered %d frames in %s",
-			len(frames), time.Since(start).Truncate(time.Millisecond))
-	}()
-
-	pixels := make([]uint8, Dimension*Dimension)
-
-	pending := records
-	for len(pending) > 0 {
-		endDeltaMillis := pending[0].UnixMillis + frameAggregation.Milliseconds()
-		for len(pending) > 0 {
-			current := pending[0]
-			if current.UnixMillis >= endDeltaMillis {
-				break
-			}
-			pending = pending[1:]
+	bounds := Bounds()
+	frames := renderFrames(records, bounds.Dx(), bounds.Dy(), frameAggregation, bar)
+	glog.Infof("Timelapse complete: rendered %d frames in %s",
+		len(frames), time.Since(start).Truncate(time.Millisecond))
+	return frames
+}
+
+// renderFrames renders the frames of a width×height canvas, reporting progress to bar (if it isn't nil).
+// Records outside the canvas are ignored.
+//
+// Within each frame, horizontal bands of the canvas are advanced in parallel,
+// each from its own queue of pending records.
+func renderFrames(records []dataset.Record, width, height int, frameAggregation time.Duration, bar *progress.Bar) (frames []*image.Paletted) {
+	if bar != nil {
+		bar.SetTotal(int64(len(records)))
+	}
 
-			pixels[int(current.Y)*Dimension+int(current.X)] = current.Color
+	pixels := make([]uint8, width*height)
+	bands := bandQueues(records, width, height, runtime.GOMAXPROCS(0))
+
+	for {
+		// Each frame starts with the earliest record still pending in any band.
+		var (
+			startMillis int64
+			ok          bool
+		)
+		for _, queue := range bands {
+			if len(queue) > 0 && (!ok || records[queue[0]].UnixMillis < startMillis) {
+				startMillis, ok = records[queue[0]].UnixMillis, true
+			}
+		}
+		if !ok {
+			break
 		}
+		endDeltaMillis := startMillis + frameAggregation.Milliseconds()
+
+		pool := gsync.NewPool(context.Background(), len(bands))
+		for i := range bands {
+			i := i
+			pool.Go(func(context.Context) error {
+				pending := bands[i]
+				for len(pending) > 0 {
+					current := records[pending[0]]
+					if current.UnixMillis >= endDeltaMillis {
+						break
+					}
+					pending = pending[1:]
+
+					pixels[int(current.Y)*width+int(current.X)] = current.Color
+				}
+				if bar != nil {
+					bar.Add(int64(len(bands[i]) - len(pending)))
+				}
+				bands[i] = pending
+				return nil
+			})
+		}
+		pool.Wait()
 
 		// Create the frame
 		frames = append(frames, &image.Paletted{
 			Pix:     pixels,
-			Stride:  Dimension,
-			Rect:    image.Rect(0, 0, Dimension, Dimension),
+			Stride:  width,
+			Rect:    image.Rect(0, 0, width, height),
 			Palette: dataset.Palette,
 		})
 
 		// Clone for the next frame
 		pixels = append([]uint8(nil), pixels...)
 	}
+	if len(frames) == 0 {
+		frames = append(frames, &image.Paletted{
+			Pix:     pixels,
+			Stride:  width,
+			Rect:    image.Rect(0, 0, width, height),
+			Palette: dataset.Palette,
+		})
+	}
 
 	// Freeze at the end for a little.
-	const TrailerFrames = 100
 	last := frames[len(frames)-1]
-	for i := 0; i < TrailerFrames; i++ {
+	for i := 0; i < trailerFrames; i++ {
 		frames = append(frames, last)
 	}
 	return frames
 }
 
+// bandQueues splits the width×height canvas into n horizontal bands of rows and returns
+// the indices of the records within each band, in their original order.
+// Since each band only writes its own rows, bands can be advanced concurrently.
+func bandQueues(records []dataset.Record, width, height, n int) [][]int32 {
+	rows := (height + n - 1) / n
+	bands := make([][]int32, n)
+	for i, rec := range records {
+		if rec.X < 0 || int(rec.X) >= width || rec.Y < 0 || int(rec.Y) >= height {
+			continue
+		}
+		band := int(rec.Y) / rows
+		bands[band] = append(bands[band], int32(i))
+	}
+	return bands
+}
+
+// RenderRegion renders a timelapse of the part of the canvas within bounds, like RenderFrames,
+// starting from the first record within it. Pixels for which include returns false are transparent.
+// The frames are the size of bounds, with bounds.Min at their origin.
+// The records must be sorted by time.
+func RenderRegion(records []dataset.Record, frameAggregation time.Duration, bounds image.Rectangle, include func(image.Point) bool) []*image.Paletted {
+	palette := append(color.Palette{}, dataset.Palette...)
+	transparent := uint8(len(palette))
+	palette = append(palette, color.Transparent)
+
+	current := image.NewPaletted(image.Rectangle{Max: bounds.Size()}, palette)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if !include(image.Pt(x, y)) {
+				current.SetColorIndex(x-bounds.Min.X, y-bounds.Min.Y, transparent)
+			}
+		}
+	}
+
+	var frames []*image.Paletted
+	var (
+		started bool
+		end     int64
+	)
+	for _, rec := range records {
+		p := image.Pt(int(rec.X), int(rec.Y))
+		if !p.In(bounds) || !include(p) {
+			continue
+		}
+		// As in RenderFrames, each frame starts with the next record, so idle periods are skipped.
+		if started && rec.UnixMillis >= end {
+			frames = append(frames, clonePaletted(current))
+		}
+		if !started || rec.UnixMillis >= end {
+			started, end = true, rec.UnixMillis+frameAggregation.Milliseconds()
+		}
+		current.SetColorIndex(p.X-bounds.Min.X, p.Y-bounds.Min.Y, rec.Color)
+	}
+	frames = append(frames, current)
+
+	// Freeze at the end for a little.
+	for i := 0; i < trailerFrames; i++ {
+		frames = append(frames, current)
+	}
+	return frames
+}
+
+func clonePaletted(img *image.Paletted) *image.Paletted {
+	clone := *img
+	clone.Pix = append([]uint8(nil), img.Pix...)
+	return &clone
+}
+
 type frame struct {
 	PixelData [][]uint8
 }
@@ -130,14 +364,14 @@ func (w frame) ColorModel() color.Model {
 }
 
 func (w frame) Bounds() image.Rectangle {
-	return image.Rect(0, 0, Dimension, Dimension)
+	return image.Rect(0, 0, len(w.PixelData[0]), len(w.PixelData))
 }
 
 func (w frame) At(x, y int) color.Color {
 	return dataset.Palette[w.PixelData[y][x]]
 }
 
-func writeAPNG(buf *bytes.Buffer, frames []*image.Paletted) {
+func EncodeAPNG(w io.Writer, frames []*image.Paletted) error {
 	apngFrames := make([]apng.Frame, len(frames))
 	for i := range apngFrames {
 		apngFrames[i] = apng.Frame{
@@ -152,15 +386,10 @@ func writeAPNG(buf *bytes.Buffer, frames []*image.Paletted) {
 		LoopCount: 0,
 	}
 
-	start := time.Now()
-	if err := apng.Encode(buf, img); err != nil {
-		glog.Fatalf("Failed to encode APNG: %s", err)
-	}
-	glog.Infof("Rendered %d APNG frames (%.2fMiB) in %s",
-		len(frames), float64(buf.Len())/(1<<20), time.Since(start).Truncate(time.Millisecond))
+	return apng.Encode(w, img)
 }
 
-func writeGIF(buf *bytes.Buffer, frames []*image.Paletted) {
+func EncodeGIF(w io.Writer, frames []*image.Paletted) error {
 	delays := make([]int, len(frames))
 	for i := range delays {
 		delays[i] = 3
@@ -170,17 +399,11 @@ func writeGIF(buf *bytes.Buffer, frames []*image.Paletted) {
 		Image: frames,
 		Delay: delays,
 		Config: image.Config{
-			Width:      Dimension,
-			Height:     Dimension,
-			ColorModel: dataset.Palette,
+			Width:      frames[0].Rect.Dx(),
+			Height:     frames[0].Rect.Dy(),
+			ColorModel: frames[0].Palette,
 		},
 	}
 
-	start := time.Now()
-	if err := gif.EncodeAll(buf, img); err != nil {
-		glog.Fatalf("Failed to encode GIF: %s", err)
-		return
-	}
-	glog.Infof("Rendered %d GIF frames (%.2fMiB) in %s",
-		len(frames), float64(buf.Len())/(1<<20), time.Since(start).Truncate(time.Millisecond))
+	return gif.EncodeAll(w, img)
 }
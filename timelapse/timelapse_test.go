@@ -0,0 +1,71 @@
+package timelapse_test
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/dataset/datasettest"
+	"github.com/kylelemons/rplacemap/timelapse"
+)
+
+func TestRender(t *testing.T) {
+	ds := datasettest.Build(t, datasettest.Tiny())
+	tests := []struct {
+		name   string
+		opts   timelapse.Options
+		frames int // before the trailer
+	}{
+		{"minute", timelapse.Options{Interval: time.Minute}, 3},
+		{"hour", timelapse.Options{Interval: time.Hour}, 1},
+		{"palette", timelapse.Options{Interval: time.Minute, Palette: color.Palette{
+			color.Black, color.White, color.Gray{0x40}, color.Gray{0xC0},
+		}}, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frames := timelapse.Render(ds, test.opts)
+			if got, want := len(frames), test.frames+100; got != want {
+				t.Fatalf("Render returned %d frames, want %d (including the trailer)", got, want)
+			}
+			for i, frame := range frames[:test.frames] {
+				datasettest.CheckGolden(t, fmt.Sprintf("render-%s-%d", test.name, i), frame)
+			}
+			if last := frames[len(frames)-1]; !bytes.Equal(last.Pix, frames[test.frames-1].Pix) {
+				t.Errorf("trailer doesn't repeat the final frame")
+			}
+		})
+	}
+}
+
+func TestRenderRectangle(t *testing.T) {
+	var b dataset.Builder
+	b.SetCanvasBounds(12, 8)
+	b.SetPalette(datasettest.FourColors)
+	b.AddEvent(datasettest.TinyStart, "alice", 11, 7, 1)
+	frames := timelapse.Render(datasettest.Build(t, &b), timelapse.Options{})
+	if got, want := frames[0].Bounds(), image.Rect(0, 0, 12, 8); got != want {
+		t.Fatalf("Render frame bounds = %v, want %v", got, want)
+	}
+	if got := frames[0].ColorIndexAt(11, 7); got != 1 {
+		t.Errorf("Render frame (11,7) = color %d, want 1", got)
+	}
+}
+
+func BenchmarkRender(b *testing.B) {
+	ds := &dataset.Dataset{
+		Records: datasettest.Records(datasettest.Options{Size: 256, Users: 1000, Events: 100000}),
+		Size:    256,
+	}
+	opts := timelapse.Options{Interval: time.Minute}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		frames := timelapse.Render(ds, opts)
+		b.ReportMetric(float64(len(frames)), "frames/op")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kylelemons/rplacemap/analytics"
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+var (
+	topFlags = flag.NewFlagSet("top", flag.ExitOnError)
+	topBy    = topFlags.String("by", "placements", "What to rank users by (placements or survivors)")
+	topN     = topFlags.Int("n", 50, "Number of users to print")
+)
+
+var _ = register(commands, &command{
+	name:  "top",
+	help:  "Print a leaderboard of users from the cached dataset.",
+	flags: topFlags,
+	run:   runTop,
+})
+
+// leaderboards are the rankings supported by the top command.
+var leaderboards = map[string]func([]dataset.Record) []analytics.UserCount{
+	"placements": analytics.Placements,
+	"survivors":  analytics.Survivors,
+}
+
+func runTop(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", args)
+	}
+	rank, ok := leaderboards[*topBy]
+	if !ok {
+		return fmt.Errorf("unknown ranking %q (want placements or survivors)", *topBy)
+	}
+
+	records, err := loadCachedRecords(ctx)
+	if err != nil {
+		return err
+	}
+	board := rank(records)
+	if *topN > 0 && len(board) > *topN {
+		board = board[:*topN]
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Rank\tUser\t%s\n", *topBy)
+	for i, entry := range board {
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", i+1,
+			base64.StdEncoding.EncodeToString(entry.UserHash[:]), progress.FormatCount(entry.Count))
+	}
+	return tw.Flush()
+}
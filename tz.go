@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+	_ "time/tzdata" // so that tz= works without the system's zoneinfo
+)
+
+// requestLocation returns the time zone named by the request's tz parameter (an IANA name
+// such as "America/Los_Angeles"), in which the API formats timestamps. The default is UTC.
+func requestLocation(r *http.Request) (*time.Location, error) {
+	name := r.FormValue("tz")
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("tz: unknown time zone %q", name)
+	}
+	return loc, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+var (
+	upgradeFlags  = flag.NewFlagSet("upgrade", flag.ExitOnError)
+	upgradeOut    = upgradeFlags.String("out", "", "Output file (default: the input file with the "+dataset.ZstdFileSuffix+" suffix)")
+	upgradeRemove = upgradeFlags.Bool("remove", false, "Remove the input file once it has been upgraded")
+)
+
+var _ = register(commands, &command{
+	name:  "upgrade",
+	args:  "[file.gob.gz]",
+	help:  "Rewrite a dataset file (default: the cached dataset) in the newest format, without re-downloading it.",
+	flags: upgradeFlags,
+	run:   runUpgrade,
+})
+
+func runUpgrade(ctx context.Context, args []string) error {
+	filename := datasetFile()
+	switch len(args) {
+	case 0:
+	case 1:
+		filename = args[0]
+	default:
+		return fmt.Errorf("too many arguments %q", args)
+	}
+
+	out := *upgradeOut
+	if out == "" {
+		out = filename
+		for _, suffix := range dataset.FileSuffixes {
+			out = strings.TrimSuffix(out, suffix)
+		}
+		out += dataset.ZstdFileSuffix
+	}
+
+	start := time.Now()
+	count, err := dataset.Rewrite(ctx, filename, out)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Upgraded %s records from %s to %s in %s\n",
+		progress.FormatCount(count), filename, out, time.Since(start).Truncate(time.Millisecond))
+
+	if out == filename {
+		return nil
+	}
+	if *upgradeRemove {
+		if err := os.Remove(filename); err != nil {
+			return fmt.Errorf("removing old file: %w", err) // contains filename
+		}
+		glog.Infof("Removed %s", filename)
+	} else {
+		fmt.Printf("The old file can be removed: %s\n", filename)
+	}
+	return nil
+}
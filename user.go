@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+var (
+	userFlags = flag.NewFlagSet("user", flag.ExitOnError)
+	userHash  = userFlags.String("hash", "", "User hash, as it appears in the dataset (required)")
+	userOut   = userFlags.String("out", "", "If set, export the placements to this CSV file instead of printing them")
+)
+
+var _ = register(commands, &command{
+	name:  "user",
+	help:  "Print (or export) one user's placements from the cached dataset.",
+	flags: userFlags,
+	run:   runUser,
+})
+
+func runUser(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", args)
+	}
+	if *userHash == "" {
+		return fmt.Errorf("--hash is required")
+	}
+	hash, err := dataset.ParseUserHash(*userHash)
+	if err != nil {
+		return err
+	}
+
+	if err := ensureDataset(ctx); err != nil {
+		return err
+	}
+	var placements []dataset.Record
+	if err := dataset.Scan(ctx, datasetFile(), func(rec dataset.Record) error {
+		if rec.UserHash == hash {
+			placements = append(placements, rec)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(placements) == 0 {
+		return fmt.Errorf("no placements by user %q", *userHash)
+	}
+	sort.SliceStable(placements, func(i, j int) bool {
+		return placements[i].UnixMillis < placements[j].UnixMillis
+	})
+
+	if *userOut != "" {
+		if err := writeFile(*userOut, func(w io.Writer) error {
+			enc := newCSVEncoder(w)
+			for _, rec := range placements {
+				if err := enc.Encode(rec); err != nil {
+					return err
+				}
+			}
+			return enc.Flush()
+		}); err != nil {
+			return err
+		}
+		glog.Infof("Exported %s placements to %s", progress.FormatCount(int64(len(placements))), *userOut)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Time\tX\tY\tColor\n")
+	for _, rec := range placements {
+		r, g, b, _ := dataset.Palette[rec.Color].RGBA()
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%2d #%02X%02X%02X\n",
+			rec.Time().Format(time.RFC3339), rec.X, rec.Y, rec.Color, r>>8, g>>8, b>>8)
+	}
+	fmt.Fprintf(tw, "\n%s placements\n", progress.FormatCount(int64(len(placements))))
+	return tw.Flush()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/gsync"
+)
+
+const (
+	defaultUserSearchLimit = 20
+	maxUserSearchLimit     = 100
+	minUserSearchPrefix    = 3
+)
+
+// userMatch is a result of /api/users/search.
+type userMatch struct {
+	Index      int    `json:"index"` // 1-based, in order of each user's first placement
+	UserHash   string `json:"user_hash"`
+	Placements int64  `json:"placements"`
+}
+
+type userSearchResult struct {
+	Users     []userMatch `json:"users"`
+	Truncated bool        `json:"truncated"` // whether there were more than the limit
+}
+
+// userSearchHandler serves /api/users/search?prefix=&limit=, the users whose (base64) hash
+// starts with the prefix, using a sorted list of users which is built the first time it is needed.
+func userSearchHandler(records *gsync.Future[[]dataset.Record]) http.HandlerFunc {
+	users := gsync.Lazy(func(ctx context.Context) ([]userMatch, error) {
+		recs, err := records.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return sortedUsers(recs), nil
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Be forgiving of how the hash was saved: surrounding whitespace, or the URL-safe alphabet.
+		prefix := strings.TrimSpace(r.FormValue("prefix"))
+		prefix = strings.NewReplacer("-", "+", "_", "/").Replace(prefix)
+		if len(prefix) < minUserSearchPrefix {
+			http.Error(w, fmt.Sprintf("prefix must be at least %d characters", minUserSearchPrefix), http.StatusBadRequest)
+			return
+		}
+		limit := defaultUserSearchLimit
+		if s := r.FormValue("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				http.Error(w, fmt.Sprintf("limit: must be a positive integer, got %q", s), http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxUserSearchLimit)
+		}
+
+		sorted, err := users.Wait(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("not ready: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		result := userSearchResult{Users: []userMatch{}}
+		start := sort.Search(len(sorted), func(i int) bool { return sorted[i].UserHash >= prefix })
+		for _, u := range sorted[start:] {
+			if !strings.HasPrefix(u.UserHash, prefix) {
+				break
+			}
+			if len(result.Users) == limit {
+				result.Truncated = true
+				break
+			}
+			result.Users = append(result.Users, u)
+		}
+		writeJSON(w, result)
+	}
+}
+
+// sortedUsers returns every user in the records, sorted by hash.
+// The records must be sorted by time.
+func sortedUsers(records []dataset.Record) []userMatch {
+	index := make(map[[16]byte]int)
+	var users []userMatch
+	for _, rec := range records {
+		i, ok := index[rec.UserHash]
+		if !ok {
+			i = len(users)
+			index[rec.UserHash] = i
+			users = append(users, userMatch{
+				Index:    i + 1,
+				UserHash: base64.StdEncoding.EncodeToString(rec.UserHash[:]),
+			})
+		}
+		users[i].Placements++
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UserHash < users[j].UserHash })
+	return users
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/kylelemons/rplacemap/dataset"
+	"github.com/kylelemons/rplacemap/progress"
+)
+
+var verifyFlags = flag.NewFlagSet("verify", flag.ExitOnError)
+
+var _ = register(commands, &command{
+	name:  "verify",
+	args:  "[file.gob.zst|file.gob.gz]",
+	help:  "Check that a dataset file (default: the cached dataset) is intact.",
+	flags: verifyFlags,
+	run:   runVerify,
+})
+
+func runVerify(ctx context.Context, args []string) error {
+	filename := datasetFile()
+	switch len(args) {
+	case 0:
+	case 1:
+		filename = args[0]
+	default:
+		return fmt.Errorf("too many arguments %q", args)
+	}
+
+	info, err := dataset.ReadFileInfo(filename)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	if err := dataset.Scan(ctx, filename, func(dataset.Record) error {
+		count++
+		return nil
+	}); errors.Is(err, dataset.ErrCorrupt) {
+		return fmt.Errorf("%w\nRe-download it with: rplacemap download", err)
+	} else if err != nil {
+		return err
+	}
+
+	if c := info.Counts; c != nil && c.Records != count {
+		return fmt.Errorf("%s: decoded %d records, but the file header records %d", filename, count, c.Records)
+	}
+
+	if info.Checksum == nil {
+		fmt.Printf("%s: decoded %s records (no checksum recorded; re-download to add one)\n",
+			filename, progress.FormatCount(count))
+		return nil
+	}
+	fmt.Printf("%s: OK, %s records, sha256 %x\n", filename, progress.FormatCount(count), info.Checksum)
+	return nil
+}
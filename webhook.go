@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// webhookTimeout bounds each webhook delivery.
+const webhookTimeout = 10 * time.Second
+
+// webhookLinkTTL is how long signed artifact links in notifications remain valid.
+const webhookLinkTTL = 7 * 24 * time.Hour
+
+// A jobNotification is the JSON body POSTed to webhooks when a render job finishes.
+//
+// Text and Content hold a human-readable summary, so that the body can also be
+// sent directly to Slack and Discord incoming webhooks (respectively).
+type jobNotification struct {
+	ID         string            `json:"id"`
+	Job        string            `json:"job"`
+	Params     map[string]string `json:"params,omitempty"`
+	Artifact   string            `json:"artifact,omitempty"`
+	DurationMS int64             `json:"duration_ms"`
+	Error      string            `json:"error,omitempty"`
+
+	Text    string `json:"text"`
+	Content string `json:"content"`
+}
+
+// webhooks notifies a set of URLs when render jobs finish.
+type webhooks struct {
+	urls   []*url.URL
+	base   *url.URL   // for resolving artifact paths
+	signer *urlSigner // for signing artifact URLs, if required
+}
+
+// parseWebhooks parses a comma-separated list of webhook URLs.
+func parseWebhooks(spec string) (*webhooks, error) {
+	hooks := new(webhooks)
+	for _, raw := range strings.Split(spec, ",") {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("webhook %q is not an http(s) URL", raw)
+		}
+		hooks.urls = append(hooks.urls, u)
+	}
+	return hooks, nil
+}
+
+// jobFinished notifies the webhooks (if any) that a job finished after the given duration,
+// producing the artifact at the given path on this server (if it succeeded).
+func (h *webhooks) jobFinished(ctx context.Context, job string, params map[string]string, artifact string, dur time.Duration, jobErr error) {
+	if h == nil || len(h.urls) == 0 {
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	n := jobNotification{
+		ID:         hex.EncodeToString(id),
+		Job:        job,
+		Params:     params,
+		DurationMS: dur.Milliseconds(),
+	}
+	dur = dur.Truncate(time.Millisecond)
+	switch {
+	case jobErr != nil:
+		n.Error = jobErr.Error()
+		n.Text = fmt.Sprintf("Render %s failed after %s: %s", job, dur, jobErr)
+	case artifact != "":
+		link := &url.URL{Path: artifact}
+		if h.signer != nil && strings.HasPrefix(artifact, signedPrefix) {
+			link = h.signer.sign(link, time.Now().Add(webhookLinkTTL))
+		}
+		n.Artifact = h.base.ResolveReference(link).String()
+		n.Text = fmt.Sprintf("Render %s finished in %s: %s", job, dur, n.Artifact)
+	default:
+		n.Text = fmt.Sprintf("Render %s finished in %s", job, dur)
+	}
+	n.Content = n.Text
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		glog.Errorf("Encoding webhook notification: %s", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, u := range h.urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := postWebhook(ctx, u, body); err != nil {
+				glog.Warningf("Webhook %s: %s", u.Redacted(), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func postWebhook(ctx context.Context, u *url.URL, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %q", resp.Status)
+	}
+	return nil
+}
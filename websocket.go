@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The WebSocket protocol (RFC 6455) is spoken directly, since the server only needs
+// to accept connections and exchange whole messages on them.
+
+// Opcodes of WebSocket frames.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// Status codes of WebSocket close frames.
+const (
+	wsNormalClosure   = 1000
+	wsProtocolError   = 1002
+	wsUnsupportedData = 1003
+	wsMessageTooBig   = 1009
+)
+
+const (
+	// wsMaxMessage is the largest message a client may send; requests are small JSON objects.
+	wsMaxMessage = 64 << 10
+
+	// wsWriteTimeout bounds writing each message, so that a client which stops reading
+	// can't hold up whatever is sending to it.
+	wsWriteTimeout = 30 * time.Second
+)
+
+// wsGUID is appended to the client's key to compute the server's accept key.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// A wsConn is a server's WebSocket connection.
+// Messages are read by one goroutine, but may be written by any number of them.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu     sync.Mutex // serializes writes
+	closed bool       // once a close frame has been written
+}
+
+// A wsCloseError is the close frame of a connection which the client closed,
+// or which was closed because the client broke the protocol.
+type wsCloseError struct {
+	code   int
+	reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket closed (%d): %s", e.code, e.reason)
+}
+
+// acceptWebSocket completes the opening handshake of a WebSocket request, taking over its connection.
+// If the request isn't a valid WebSocket handshake, it responds with an error and returns one.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "this is a WebSocket endpoint", http.StatusUpgradeRequired)
+		return nil, errors.New("not a websocket handshake")
+	}
+	if v := r.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, fmt.Sprintf("unsupported WebSocket version %q", v), http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket version %q", v)
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		http.Error(w, "bad Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket key %q", key)
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websockets not supported", http.StatusInternalServerError)
+		return nil, errors.New("connection can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, "websockets not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{}) // clear the server's timeouts, which are for requests
+
+	accept := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(accept[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// headerContains reports whether one of the comma-separated values of the header is token (ignoring case).
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message from the client, answering pings along the way.
+// Once the client closes the connection (or breaks the protocol), it returns a *wsCloseError;
+// if the connection is lost, it returns the error reading from it.
+func (c *wsConn) ReadMessage() (opcode int, data []byte, err error) {
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+		switch {
+		case op == wsPing:
+			if err := c.write(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case op == wsPong:
+			continue
+		case op == wsClose:
+			closeErr := &wsCloseError{code: wsNormalClosure}
+			if len(payload) >= 2 {
+				closeErr.code = int(binary.BigEndian.Uint16(payload))
+				closeErr.reason = string(payload[2:])
+			}
+			c.Close(closeErr.code, "")
+			return 0, nil, closeErr
+		case op != wsText && op != wsBinary:
+			return 0, nil, c.fail(&wsCloseError{wsProtocolError, fmt.Sprintf("unexpected opcode %#x", op)})
+		}
+
+		// Data messages may be fragmented, with control frames between the fragments.
+		opcode, data = op, payload
+		for !fin {
+			if fin, op, payload, err = c.readFrame(); err != nil {
+				return 0, nil, c.fail(err)
+			}
+			switch op {
+			case wsContinuation:
+				if len(data)+len(payload) > wsMaxMessage {
+					return 0, nil, c.fail(&wsCloseError{wsMessageTooBig, "message too big"})
+				}
+				data = append(data, payload...)
+			case wsPing:
+				if err := c.write(wsPong, payload); err != nil {
+					return 0, nil, err
+				}
+				fin = false
+			case wsPong:
+				fin = false
+			default:
+				return 0, nil, c.fail(&wsCloseError{wsProtocolError, "expected a continuation frame"})
+			}
+		}
+		return opcode, data, nil
+	}
+}
+
+// readFrame reads a frame, unmasking its payload.
+func (c *wsConn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode = head[0]&0x80 != 0, int(head[0]&0x0F)
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, &wsCloseError{wsProtocolError, "reserved bits set"}
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, &wsCloseError{wsProtocolError, "client frames must be masked"}
+	}
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (size > 125 || !fin) {
+		return false, 0, nil, &wsCloseError{wsProtocolError, "control frames must be short and unfragmented"}
+	}
+	if size > wsMaxMessage {
+		return false, 0, nil, &wsCloseError{wsMessageTooBig, "message too big"}
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// fail closes the connection after an error reading from it, telling the client why if it broke the protocol.
+func (c *wsConn) fail(err error) error {
+	var closeErr *wsCloseError
+	if errors.As(err, &closeErr) {
+		c.Close(closeErr.code, closeErr.reason)
+		return err
+	}
+	c.conn.Close()
+	return err
+}
+
+// WriteMessage sends a text or binary message to the client, in a single frame.
+func (c *wsConn) WriteMessage(opcode int, data []byte) error {
+	return c.write(opcode, data)
+}
+
+// write sends a frame, which servers don't mask.
+func (c *wsConn) write(opcode int, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	frame := []byte{0x80 | byte(opcode)}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := (&net.Buffers{frame, payload}).WriteTo(c.conn)
+	return err
+}
+
+// Close sends a close frame with the status code and reason (unless one was already sent) and closes the connection.
+func (c *wsConn) Close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason[:min(len(reason), 123)]...)
+	c.write(wsClose, payload)
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.conn.Close()
+}